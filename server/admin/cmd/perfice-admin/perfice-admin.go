@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"perfice.adoe.dev/admin/internal"
+)
+
+func main() {
+	os.Exit(internal.Run(os.Args[1:]))
+}
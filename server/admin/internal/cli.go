@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Admin holds the connections to the databases of every service
+type Admin struct {
+	client      *mongo.Client
+	auth        *mongo.Database
+	sync        *mongo.Database
+	integration *mongo.Database
+	out         io.Writer
+}
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	// offline commands don't connect to the database
+	offline bool
+	run     func(a *Admin, flags *flag.FlagSet, args []string) error
+	// setup registers the flags of the command
+	setup func(flags *flag.FlagSet)
+}
+
+// UsageError is returned when a command is called with invalid arguments, the usage of the command is printed
+type UsageError struct {
+	Message string
+}
+
+func (e UsageError) Error() string {
+	return e.Message
+}
+
+var commands = []*command{
+	usersListCommand,
+	usersConfirmCommand,
+	usersDeleteCommand,
+	sessionsRevokeCommand,
+	syncStatsCommand,
+	integrationsValidateCommand,
+	integrationsLoadCommand,
+	secretsReencryptCommand,
+}
+
+func findCommand(args []string) (*command, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+
+	name := args[0] + " " + args[1]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, args[2:]
+		}
+	}
+
+	return nil, nil
+}
+
+func printUsage(out io.Writer) {
+	fmt.Fprintln(out, "Usage: perfice-admin <command> [flags] [arguments]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-28s %s\n", cmd.name, cmd.description)
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "The databases are reached through MONGO_URL, deleting users also requires KAFKA_URL.")
+}
+
+// Run executes the command given by the arguments and returns the exit code
+func Run(args []string) int {
+	cmd, rest := findCommand(args)
+	if cmd == nil {
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: perfice-admin %s %s\n", cmd.name, cmd.usage)
+		flags.PrintDefaults()
+	}
+
+	if cmd.setup != nil {
+		cmd.setup(flags)
+	}
+
+	if err := flags.Parse(rest); err != nil {
+		return 2
+	}
+
+	admin := &Admin{out: os.Stdout}
+	if !cmd.offline {
+		if err := admin.connect(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to connect to MongoDB:", err)
+			return 1
+		}
+		defer admin.client.Disconnect(context.Background())
+	}
+
+	if err := cmd.run(admin, flags, flags.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		if errors.As(err, &UsageError{}) {
+			flags.Usage()
+			return 2
+		}
+
+		return 1
+	}
+
+	return 0
+}
+
+func (a *Admin) connect() error {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		return errors.New("MONGO_URL is not set")
+	}
+
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(url))
+	if err != nil {
+		return err
+	}
+
+	if err := client.Ping(context.Background(), readpref.Primary()); err != nil {
+		return err
+	}
+
+	// Database names are the same as the ones used by the services
+	a.client = client
+	a.auth = client.Database("auth")
+	a.sync = client.Database("sync")
+	a.integration = client.Database("integration")
+	return nil
+}
+
+// requireArgs returns a usage error unless exactly the given amount of arguments was passed
+func requireArgs(args []string, count int) error {
+	if len(args) != count {
+		return UsageError{fmt.Sprintf("expected %d argument(s), got %d", count, len(args))}
+	}
+
+	return nil
+}
+
+// confirm asks the operator to confirm a destructive action, unless it was confirmed with a flag
+func confirm(out io.Writer, in io.Reader, message string, confirmed bool) bool {
+	if confirmed {
+		return true
+	}
+
+	fmt.Fprintf(out, "%s [y/N] ", message)
+	var answer string
+	_, _ = fmt.Fscanln(in, &answer)
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+}
+
+func flagString(flags *flag.FlagSet, name string) string {
+	return flags.Lookup(name).Value.(flag.Getter).Get().(string)
+}
+
+func flagBool(flags *flag.FlagSet, name string) bool {
+	return flags.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+func flagInt64(flags *flag.FlagSet, name string) int64 {
+	return flags.Lookup(name).Value.(flag.Getter).Get().(int64)
+}
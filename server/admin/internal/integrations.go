@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IntegrationDefinitions is the file format read by the integration commands, documents are stored as is in the
+// integration_types and integration_entities collections
+type IntegrationDefinitions struct {
+	IntegrationTypes    []json.RawMessage `json:"integrationTypes"`
+	IntegrationEntities []json.RawMessage `json:"integrationEntities"`
+}
+
+// The parts of the definitions that are read by the integration service on startup
+type integrationTypeDefinition struct {
+	IntegrationType string `json:"integrationType"`
+	Authentication  *struct {
+		Method   string         `json:"method"`
+		Settings map[string]any `json:"settings"`
+	} `json:"authentication"`
+}
+
+type integrationEntityDefinition struct {
+	EntityType      string `json:"entityType"`
+	IntegrationType string `json:"integrationType"`
+	Identifier      string `json:"identifier"`
+	Sources         []struct {
+		Type     string         `json:"type"`
+		Settings map[string]any `json:"settings"`
+	} `json:"sources"`
+	Fields map[string]struct {
+		Path any `json:"path"`
+	} `json:"fields"`
+}
+
+func readIntegrationDefinitions(path string) (IntegrationDefinitions, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return IntegrationDefinitions{}, err
+	}
+
+	var definitions IntegrationDefinitions
+	if err := json.Unmarshal(content, &definitions); err != nil {
+		return IntegrationDefinitions{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	return definitions, nil
+}
+
+func validateOAuthSettings(settings map[string]any) []string {
+	var problems []string
+	for _, key := range []string{"authorize_url", "token_url", "client_id", "client_secret"} {
+		if value, ok := settings[key].(string); !ok || value == "" {
+			problems = append(problems, fmt.Sprintf("authentication setting %s must be a non-empty string", key))
+		}
+	}
+
+	scopes, ok := settings["scopes"].([]any)
+	if !ok {
+		problems = append(problems, "authentication setting scopes must be an array")
+	}
+
+	for _, scope := range scopes {
+		if _, ok := scope.(string); !ok {
+			problems = append(problems, "authentication setting scopes must only contain strings")
+			break
+		}
+	}
+
+	if _, ok := settings["pkce"].(bool); !ok {
+		problems = append(problems, "authentication setting pkce must be a boolean")
+	}
+
+	return problems
+}
+
+func validatePullSettings(settings map[string]any) []string {
+	var problems []string
+	if url, ok := settings["url"].(string); !ok || url == "" {
+		problems = append(problems, "pull source must have a url")
+	}
+
+	interval, ok := settings["interval"].(map[string]any)
+	if !ok {
+		return append(problems, "pull source must have an interval")
+	}
+
+	if cron, ok := interval["cron"].(string); !ok || cron == "" {
+		problems = append(problems, "pull source interval must have a cron expression")
+	}
+
+	if jitter, ok := interval["jitter"]; ok {
+		if _, ok := jitter.(float64); !ok {
+			problems = append(problems, "pull source interval jitter must be a number")
+		}
+	}
+
+	return problems
+}
+
+func validateIntegrationEntity(entity integrationEntityDefinition) []string {
+	var problems []string
+	if entity.Identifier == "" {
+		problems = append(problems, "identifier is missing")
+	}
+
+	if len(entity.Sources) == 0 {
+		problems = append(problems, "at least one source is required")
+	}
+
+	for _, source := range entity.Sources {
+		switch source.Type {
+		case "pull":
+			problems = append(problems, validatePullSettings(source.Settings)...)
+		case "push":
+		default:
+			problems = append(problems, fmt.Sprintf("unknown source type %q", source.Type))
+		}
+	}
+
+	for key, field := range entity.Fields {
+		if field.Path == nil {
+			problems = append(problems, fmt.Sprintf("field %s has no path", key))
+		}
+	}
+
+	return problems
+}
+
+// validateDefinitions returns every problem that would make the integration service fail to load the definitions.
+// Entities may refer to integration types in the file or to the existing ones.
+func validateDefinitions(definitions IntegrationDefinitions, existingTypes []string) []string {
+	var problems []string
+	report := func(location string, messages ...string) {
+		for _, message := range messages {
+			problems = append(problems, location+": "+message)
+		}
+	}
+
+	knownTypes := map[string]bool{}
+	for _, integrationType := range existingTypes {
+		knownTypes[integrationType] = true
+	}
+
+	definedTypes := map[string]bool{}
+	for i, raw := range definitions.IntegrationTypes {
+		location := fmt.Sprintf("integrationTypes[%d]", i)
+
+		var definition integrationTypeDefinition
+		if err := json.Unmarshal(raw, &definition); err != nil {
+			report(location, err.Error())
+			continue
+		}
+
+		if definition.IntegrationType == "" {
+			report(location, "integrationType is missing")
+			continue
+		}
+
+		location = fmt.Sprintf("integration type %s", definition.IntegrationType)
+		if definedTypes[definition.IntegrationType] {
+			report(location, "defined more than once")
+		}
+
+		definedTypes[definition.IntegrationType] = true
+		knownTypes[definition.IntegrationType] = true
+
+		if definition.Authentication == nil {
+			continue
+		}
+
+		if definition.Authentication.Method != "oauth" {
+			report(location, fmt.Sprintf("unknown authentication method %q", definition.Authentication.Method))
+			continue
+		}
+
+		report(location, validateOAuthSettings(definition.Authentication.Settings)...)
+	}
+
+	definedEntities := map[string]bool{}
+	for i, raw := range definitions.IntegrationEntities {
+		location := fmt.Sprintf("integrationEntities[%d]", i)
+
+		var definition integrationEntityDefinition
+		if err := json.Unmarshal(raw, &definition); err != nil {
+			report(location, err.Error())
+			continue
+		}
+
+		if definition.EntityType == "" || definition.IntegrationType == "" {
+			report(location, "entityType and integrationType are required")
+			continue
+		}
+
+		location = fmt.Sprintf("integration entity %s/%s", definition.IntegrationType, definition.EntityType)
+		key := definition.IntegrationType + "/" + definition.EntityType
+		if definedEntities[key] {
+			report(location, "defined more than once")
+		}
+
+		definedEntities[key] = true
+		if !knownTypes[definition.IntegrationType] {
+			report(location, "unknown integration type")
+		}
+
+		report(location, validateIntegrationEntity(definition)...)
+	}
+
+	return problems
+}
+
+func printProblems(a *Admin, problems []string) error {
+	for _, problem := range problems {
+		fmt.Fprintln(a.out, problem)
+	}
+
+	return fmt.Errorf("found %d problem(s)", len(problems))
+}
+
+var integrationsValidateCommand = &command{
+	name:        "integrations validate",
+	usage:       "<file>",
+	description: "Check integration definitions without loading them",
+	offline:     true,
+	run: func(a *Admin, flags *flag.FlagSet, args []string) error {
+		if err := requireArgs(args, 1); err != nil {
+			return err
+		}
+
+		definitions, err := readIntegrationDefinitions(args[0])
+		if err != nil {
+			return err
+		}
+
+		if problems := validateDefinitions(definitions, nil); len(problems) > 0 {
+			return printProblems(a, problems)
+		}
+
+		fmt.Fprintf(a.out, "%d integration type(s) and %d entity definition(s) are valid\n",
+			len(definitions.IntegrationTypes), len(definitions.IntegrationEntities))
+		return nil
+	},
+}
+
+var integrationsLoadCommand = &command{
+	name:        "integrations load",
+	usage:       "[-dry-run] <file>",
+	description: "Validate and insert or replace integration definitions",
+	setup: func(flags *flag.FlagSet) {
+		flags.Bool("dry-run", false, "only validate against the existing definitions")
+	},
+	run: func(a *Admin, flags *flag.FlagSet, args []string) error {
+		if err := requireArgs(args, 1); err != nil {
+			return err
+		}
+
+		definitions, err := readIntegrationDefinitions(args[0])
+		if err != nil {
+			return err
+		}
+
+		existing, err := a.integration.Collection("integration_types").Distinct(context.Background(), "integrationType", bson.M{})
+		if err != nil {
+			return err
+		}
+
+		existingTypes := make([]string, 0, len(existing))
+		for _, integrationType := range existing {
+			if name, ok := integrationType.(string); ok {
+				existingTypes = append(existingTypes, name)
+			}
+		}
+
+		if problems := validateDefinitions(definitions, existingTypes); len(problems) > 0 {
+			return printProblems(a, problems)
+		}
+
+		if flagBool(flags, "dry-run") {
+			fmt.Fprintln(a.out, "Definitions are valid, nothing was written")
+			return nil
+		}
+
+		for _, raw := range definitions.IntegrationTypes {
+			document, err := toDocument(raw)
+			if err != nil {
+				return err
+			}
+
+			err = replaceDefinition(a, "integration_types", bson.M{"integrationType": document["integrationType"]}, document)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, raw := range definitions.IntegrationEntities {
+			document, err := toDocument(raw)
+			if err != nil {
+				return err
+			}
+
+			filter := bson.M{"integrationType": document["integrationType"], "entityType": document["entityType"]}
+			if err := replaceDefinition(a, "integration_entities", filter, document); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(a.out, "Loaded %d integration type(s) and %d entity definition(s), restart the integration service to apply them\n",
+			len(definitions.IntegrationTypes), len(definitions.IntegrationEntities))
+		return nil
+	},
+}
+
+// toDocument converts a definition from JSON, keeping whole numbers as integers so that they decode into int fields
+func toDocument(raw json.RawMessage) (bson.M, error) {
+	var document bson.M
+	if err := bson.UnmarshalExtJSON(raw, false, &document); err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func replaceDefinition(a *Admin, collection string, filter bson.M, document bson.M) error {
+	_, err := a.integration.Collection(collection).ReplaceOne(context.Background(), filter, document,
+		options.Replace().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func definitionsFromJSON(t *testing.T, content string) IntegrationDefinitions {
+	var definitions IntegrationDefinitions
+	if err := json.Unmarshal([]byte(content), &definitions); err != nil {
+		t.Fatal(err)
+	}
+
+	return definitions
+}
+
+func TestValidateDefinitions_Valid(t *testing.T) {
+	definitions := definitionsFromJSON(t, `{
+		"integrationTypes": [{
+			"integrationType": "FITBIT",
+			"name": "Fitbit",
+			"authentication": {
+				"method": "oauth",
+				"settings": {
+					"authorize_url": "https://www.fitbit.com/oauth2/authorize",
+					"token_url": "https://api.fitbit.com/oauth2/token",
+					"client_id": "id",
+					"client_secret": "secret",
+					"scopes": ["sleep"],
+					"pkce": true
+				}
+			}
+		}],
+		"integrationEntities": [{
+			"entityType": "sleep",
+			"integrationType": "FITBIT",
+			"identifier": "$.logId",
+			"sources": [{"type": "pull", "settings": {"url": "https://api.fitbit.com/sleep", "interval": {"cron": "0 */2 * * *", "jitter": 0.0}}}],
+			"fields": {"efficiency": {"name": "Efficiency", "path": "$.efficiency"}}
+		}, {
+			"entityType": "temperature",
+			"integrationType": "WEBHOOK",
+			"identifier": "[DATE]",
+			"sources": [{"type": "push", "settings": {}}]
+		}]
+	}`)
+
+	assert.Empty(t, validateDefinitions(definitions, []string{"WEBHOOK"}))
+}
+
+func TestValidateDefinitions_ReportsProblems(t *testing.T) {
+	definitions := definitionsFromJSON(t, `{
+		"integrationTypes": [
+			{"integrationType": "TODOIST", "authentication": {"method": "oauth", "settings": {"client_id": "id"}}},
+			{"integrationType": "TODOIST"},
+			{"integrationType": "OTHER", "authentication": {"method": "basic"}}
+		],
+		"integrationEntities": [
+			{"entityType": "tasks", "integrationType": "MISSING", "identifier": "$.id", "sources": [{"type": "push"}]},
+			{"entityType": "sleep", "integrationType": "TODOIST", "identifier": "$.id", "sources": [{"type": "pull", "settings": {"url": "https://example.com"}}]},
+			{"entityType": "notes", "integrationType": "TODOIST", "sources": [{"type": "poll"}]}
+		]
+	}`)
+
+	assert.ElementsMatch(t, []string{
+		"integration type TODOIST: authentication setting authorize_url must be a non-empty string",
+		"integration type TODOIST: authentication setting token_url must be a non-empty string",
+		"integration type TODOIST: authentication setting client_secret must be a non-empty string",
+		"integration type TODOIST: authentication setting scopes must be an array",
+		"integration type TODOIST: authentication setting pkce must be a boolean",
+		"integration type TODOIST: defined more than once",
+		"integration type OTHER: unknown authentication method \"basic\"",
+		"integration entity MISSING/tasks: unknown integration type",
+		"integration entity TODOIST/sleep: pull source must have an interval",
+		"integration entity TODOIST/notes: identifier is missing",
+		"integration entity TODOIST/notes: unknown source type \"poll\"",
+	}, validateDefinitions(definitions, nil))
+}
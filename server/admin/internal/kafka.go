@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Same topic and message format as the auth service, sync and integration consume it to delete user data
+var kafkaTopic = "my-topic"
+
+func (a *Admin) notifyUserDeleted(userId string) error {
+	return sendEvents(kafka.Message{
+		Key:   []byte("userDeleted"),
+		Value: []byte(userId),
+	})
+}
+
+func (a *Admin) notifySessionsRevoked(userId string, sessionIds []string) error {
+	messages := make([]kafka.Message, 0, len(sessionIds))
+	for _, sessionId := range sessionIds {
+		messages = append(messages, kafka.Message{
+			Key:   []byte("sessionRevoked"),
+			Value: []byte(userId + ":" + sessionId),
+		})
+	}
+
+	return sendEvents(messages...)
+}
+
+func sendEvents(messages ...kafka.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	url := os.Getenv("KAFKA_URL")
+	if url == "" {
+		return errors.New("KAFKA_URL is not set")
+	}
+
+	writer := &kafka.Writer{
+		Addr:     kafka.TCP(url),
+		Topic:    kafkaTopic,
+		Balancer: &kafka.LeastBytes{},
+	}
+	defer writer.Close()
+
+	return writer.WriteMessages(context.Background(), messages...)
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"perfice.adoe.dev/mongoutil"
+)
+
+// XChaCha20-Poly1305 keys, see mongoutil
+const encryptionKeySize = 32
+
+// encryptedFields lists the fields that are encrypted with ENCRYPTION_KEY by collection, the integration ones are
+// tagged with encrypt and the auth service encrypts the seeds of its signing keys, the data of queued mails and TOTP
+// secrets. Nested fields are separated by dots.
+var encryptedFields = map[string][]string{
+	"integration_auth":    {"access_token", "refresh_token"},
+	"integration_updates": {"data"},
+	"signingKeys":         {"encryptedSeed"},
+	"mailOutbox":          {"encryptedData"},
+	"users":               {"totp.encryptedSecret"},
+}
+
+// lookupBinary returns the binary value of a field, which may be nested
+func lookupBinary(document bson.M, field string) (primitive.Binary, bool) {
+	path := strings.Split(field, ".")
+	for _, key := range path[:len(path)-1] {
+		nested, ok := document[key].(bson.M)
+		if !ok {
+			return primitive.Binary{}, false
+		}
+
+		document = nested
+	}
+
+	value, ok := document[path[len(path)-1]].(primitive.Binary)
+	return value, ok
+}
+
+type reencryptResult struct {
+	reencrypted int
+	skipped     int
+	failed      int
+}
+
+// reencryptField returns the field encrypted with the new key, or nil if it was already encrypted with it
+func reencryptField(oldKey []byte, newKey []byte, value []byte, result *reencryptResult) ([]byte, error) {
+	reencrypted, err := mongoutil.ReencryptBytes(oldKey, newKey, value)
+	if err == nil {
+		result.reencrypted++
+		return reencrypted, nil
+	}
+
+	// Fields that were handled by a previous, interrupted run
+	if _, newErr := mongoutil.DecryptBytesWithKey(newKey, value); newErr == nil {
+		result.skipped++
+		return nil, nil
+	}
+
+	result.failed++
+	return nil, err
+}
+
+func (a *Admin) reencryptCollection(collection *mongo.Collection, fields []string, oldKey []byte, newKey []byte,
+	dryRun bool) (reencryptResult, error) {
+	var result reencryptResult
+	name := collection.Name()
+
+	cursor, err := collection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var document bson.M
+		if err := cursor.Decode(&document); err != nil {
+			return result, err
+		}
+
+		update := bson.M{}
+		for _, field := range fields {
+			value, ok := lookupBinary(document, field)
+			if !ok || len(value.Data) == 0 {
+				continue
+			}
+
+			reencrypted, err := reencryptField(oldKey, newKey, value.Data, &result)
+			if err != nil {
+				fmt.Fprintf(a.out, "%s %v: unable to decrypt %s: %v\n", name, document["_id"], field, err)
+				continue
+			}
+
+			if reencrypted != nil {
+				update[field] = reencrypted
+			}
+		}
+
+		if len(update) == 0 || dryRun {
+			continue
+		}
+
+		if _, err := mongoutil.SetOne(collection, bson.M{"_id": document["_id"]}, update); err != nil {
+			return result, err
+		}
+	}
+
+	return result, cursor.Err()
+}
+
+var secretsReencryptCommand = &command{
+	name:        "secrets reencrypt",
+	usage:       "[-dry-run]",
+	description: "Re-encrypt the secrets of the auth and integration services from ENCRYPTION_KEY to NEW_ENCRYPTION_KEY",
+	setup: func(flags *flag.FlagSet) {
+		flags.Bool("dry-run", false, "only check that every field can be decrypted")
+	},
+	run: func(a *Admin, flags *flag.FlagSet, args []string) error {
+		if err := requireArgs(args, 0); err != nil {
+			return err
+		}
+
+		oldKey := []byte(os.Getenv("ENCRYPTION_KEY"))
+		newKey := []byte(os.Getenv("NEW_ENCRYPTION_KEY"))
+		if len(oldKey) != encryptionKeySize || len(newKey) != encryptionKeySize {
+			return fmt.Errorf("ENCRYPTION_KEY and NEW_ENCRYPTION_KEY must both be %d characters", encryptionKeySize)
+		}
+
+		dryRun := flagBool(flags, "dry-run")
+		failed := 0
+		collections := []*mongo.Collection{
+			a.integration.Collection("integration_auth"),
+			a.integration.Collection("integration_updates"),
+			a.auth.Collection("signingKeys"),
+			a.auth.Collection("mailOutbox"),
+			a.auth.Collection("users"),
+		}
+
+		for _, collection := range collections {
+			result, err := a.reencryptCollection(collection, encryptedFields[collection.Name()], oldKey, newKey, dryRun)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(a.out, "%s: %d re-encrypted, %d already using the new key, %d failed\n",
+				collection.Name(), result.reencrypted, result.skipped, result.failed)
+			failed += result.failed
+		}
+
+		if failed > 0 {
+			return errors.New("some fields could not be decrypted with either key")
+		}
+
+		if dryRun {
+			fmt.Fprintln(a.out, "Dry run, nothing was written")
+		} else {
+			fmt.Fprintln(a.out, "Done, set ENCRYPTION_KEY to the new key and restart the auth and integration services")
+		}
+
+		return nil
+	},
+}
@@ -0,0 +1,29 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLookupBinary(t *testing.T) {
+	secret := primitive.Binary{Data: []byte{1, 2, 3}}
+	document := bson.M{"data": secret, "totp": bson.M{"encryptedSecret": secret}, "name": "user"}
+
+	value, ok := lookupBinary(document, "data")
+	assert.True(t, ok)
+	assert.Equal(t, secret, value)
+
+	value, ok = lookupBinary(document, "totp.encryptedSecret")
+	assert.True(t, ok)
+	assert.Equal(t, secret, value)
+
+	_, ok = lookupBinary(document, "name")
+	assert.False(t, ok)
+	_, ok = lookupBinary(document, "name.secret")
+	assert.False(t, ok)
+	_, ok = lookupBinary(document, "missing.encryptedSecret")
+	assert.False(t, ok)
+}
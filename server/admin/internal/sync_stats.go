@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"flag"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"perfice.adoe.dev/mongoutil"
+)
+
+type entityUsage struct {
+	EntityType string `bson:"entityType"`
+	Entities   int64  `bson:"entities"`
+	Bytes      int64  `bson:"bytes"`
+}
+
+type syncSequence struct {
+	Sequence  int64 `bson:"sequence"`
+	Compacted int64 `bson:"compacted"`
+}
+
+type keyVerification struct {
+	Generation int64     `bson:"generation"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+type keyRotation struct {
+	Session   string    `bson:"session"`
+	StartedAt time.Time `bson:"startedAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+var syncStatsCommand = &command{
+	name:        "sync stats",
+	usage:       "<id or email>",
+	description: "Show the sync storage, updates and key state of a user",
+	run: func(a *Admin, flags *flag.FlagSet, args []string) error {
+		if err := requireArgs(args, 1); err != nil {
+			return err
+		}
+
+		user, err := a.findUser(args[0])
+		if err != nil {
+			return err
+		}
+
+		usages, err := mongoutil.Find[entityUsage](a.sync.Collection("sync_usage"), bson.M{"user": user.Id},
+			options.Find().SetSort(bson.M{"entityType": 1}))
+		if err != nil {
+			return err
+		}
+
+		sequence, err := mongoutil.FindOne[syncSequence](a.sync.Collection("sync_sequences"), bson.M{"user": user.Id})
+		if err != nil {
+			return err
+		}
+
+		pending, err := mongoutil.Count(a.sync.Collection("sync_updates"), bson.M{"user": user.Id})
+		if err != nil {
+			return err
+		}
+
+		verification, err := mongoutil.FindOne[keyVerification](a.sync.Collection("key_verifications"), bson.M{"user": user.Id})
+		if err != nil {
+			return err
+		}
+
+		rotation, err := mongoutil.FindOne[keyRotation](a.sync.Collection("key_rotations"), bson.M{"user": user.Id})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(a.out, "User:          %s (%s)\n", user.Email, user.Id)
+		if sequence != nil {
+			fmt.Fprintf(a.out, "Sequence:      %d (compacted up to %d)\n", sequence.Sequence, sequence.Compacted)
+		}
+
+		fmt.Fprintf(a.out, "Sync updates:  %d\n", pending)
+		if verification != nil {
+			fmt.Fprintf(a.out, "Key:           generation %d, set %s\n", verification.Generation, verification.CreatedAt.Format(time.RFC3339))
+		} else {
+			fmt.Fprintln(a.out, "Key:           not set")
+		}
+
+		if rotation != nil && time.Now().Before(rotation.ExpiresAt) {
+			fmt.Fprintf(a.out, "Key rotation:  in progress since %s by session %s\n", rotation.StartedAt.Format(time.RFC3339), rotation.Session)
+		}
+
+		fmt.Fprintln(a.out)
+		writer := tabwriter.NewWriter(a.out, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(writer, "ENTITY TYPE\tENTITIES\tBYTES\t")
+		var totalEntities, totalBytes int64
+		for _, usage := range usages {
+			fmt.Fprintf(writer, "%s\t%d\t%d\t\n", usage.EntityType, usage.Entities, usage.Bytes)
+			totalEntities += usage.Entities
+			totalBytes += usage.Bytes
+		}
+
+		fmt.Fprintf(writer, "total\t%d\t%d\t\n", totalEntities, totalBytes)
+		return writer.Flush()
+	},
+}
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"text/tabwriter"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"perfice.adoe.dev/mongoutil"
+)
+
+// User is the part of the auth user document the admin commands need
+type User struct {
+	Id        string `bson:"_id"`
+	Email     string `bson:"email"`
+	Confirmed bool   `bson:"confirmed"`
+	Timezone  string `bson:"timezone"`
+}
+
+// Session is the part of the auth session document the admin commands need
+type Session struct {
+	Id string `bson:"_id"`
+}
+
+type UserNotFoundError struct {
+	Identifier string
+}
+
+func (e UserNotFoundError) Error() string {
+	return "user not found: " + e.Identifier
+}
+
+// findUser looks up a user by id or email
+func (a *Admin) findUser(identifier string) (User, error) {
+	user, err := mongoutil.FindOne[User](a.auth.Collection("users"),
+		bson.M{"$or": bson.A{bson.M{"_id": identifier}, bson.M{"email": identifier}}})
+	if err != nil {
+		return User{}, err
+	}
+
+	if user == nil {
+		return User{}, UserNotFoundError{identifier}
+	}
+
+	return *user, nil
+}
+
+var usersListCommand = &command{
+	name:        "users list",
+	usage:       "[-search text] [-unconfirmed] [-limit n]",
+	description: "List users, optionally searching by email",
+	setup: func(flags *flag.FlagSet) {
+		flags.String("search", "", "only list users whose email contains the text")
+		flags.Bool("unconfirmed", false, "only list users that haven't confirmed their email")
+		flags.Int64("limit", 50, "maximum amount of users to list, 0 for all")
+	},
+	run: func(a *Admin, flags *flag.FlagSet, args []string) error {
+		filter := bson.M{}
+		if search := flagString(flags, "search"); search != "" {
+			filter["email"] = bson.M{"$regex": regexp.QuoteMeta(search), "$options": "i"}
+		}
+
+		if flagBool(flags, "unconfirmed") {
+			filter["confirmed"] = false
+		}
+
+		users, err := mongoutil.Find[User](a.auth.Collection("users"), filter,
+			options.Find().SetSort(bson.M{"email": 1}).SetLimit(flagInt64(flags, "limit")))
+		if err != nil {
+			return err
+		}
+
+		writer := tabwriter.NewWriter(a.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tEMAIL\tCONFIRMED\tSESSIONS\tTIMEZONE")
+		for _, user := range users {
+			sessions, err := mongoutil.Count(a.auth.Collection("sessions"), bson.M{"user": user.Id})
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(writer, "%s\t%s\t%t\t%d\t%s\n", user.Id, user.Email, user.Confirmed, sessions, user.Timezone)
+		}
+
+		return writer.Flush()
+	},
+}
+
+var usersConfirmCommand = &command{
+	name:        "users confirm",
+	usage:       "<id or email>",
+	description: "Mark the email of a user as confirmed",
+	run: func(a *Admin, flags *flag.FlagSet, args []string) error {
+		if err := requireArgs(args, 1); err != nil {
+			return err
+		}
+
+		user, err := a.findUser(args[0])
+		if err != nil {
+			return err
+		}
+
+		if _, err := mongoutil.SetOne(a.auth.Collection("users"), bson.M{"_id": user.Id}, bson.M{"confirmed": true}); err != nil {
+			return err
+		}
+
+		// Pending confirmation links are useless once the email is confirmed
+		_, err = a.auth.Collection("accountTokens").DeleteMany(context.Background(),
+			bson.M{"userId": user.Id, "type": "confirmation"})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(a.out, "Confirmed %s\n", user.Email)
+		return nil
+	},
+}
+
+var usersDeleteCommand = &command{
+	name:        "users delete",
+	usage:       "[-yes] [-resend] <id or email>",
+	description: "Delete a user and notify the other services through Kafka",
+	setup: func(flags *flag.FlagSet) {
+		flags.Bool("yes", false, "don't ask for confirmation")
+		flags.Bool("resend", false, "only publish userDeleted again for an already deleted user id")
+	},
+	run: func(a *Admin, flags *flag.FlagSet, args []string) error {
+		if err := requireArgs(args, 1); err != nil {
+			return err
+		}
+
+		if flagBool(flags, "resend") {
+			if _, err := a.findUser(args[0]); err == nil {
+				return errors.New("user still exists, delete it without -resend")
+			}
+
+			return a.notifyUserDeleted(args[0])
+		}
+
+		user, err := a.findUser(args[0])
+		if err != nil {
+			return err
+		}
+
+		message := fmt.Sprintf("Delete %s (%s) and all of their data?", user.Email, user.Id)
+		if !confirm(a.out, os.Stdin, message, flagBool(flags, "yes")) {
+			fmt.Fprintln(a.out, "Aborted")
+			return nil
+		}
+
+		// Same order as the auth service, the other services delete their data once they receive userDeleted
+		if _, err := mongoutil.DeleteOne(a.auth.Collection("users"), bson.M{"_id": user.Id}); err != nil {
+			return err
+		}
+
+		if err := a.notifyUserDeleted(user.Id); err != nil {
+			return fmt.Errorf("user was deleted but notifying the other services failed, retry with -resend %s: %w", user.Id, err)
+		}
+
+		if _, err := mongoutil.DeleteMany(a.auth.Collection("accountTokens"), bson.M{"userId": user.Id}); err != nil {
+			return err
+		}
+
+		if _, err := mongoutil.DeleteMany(a.auth.Collection("sessions"), bson.M{"user": user.Id}); err != nil {
+			return err
+		}
+
+		if _, err := mongoutil.DeleteMany(a.auth.Collection("refreshTokens"), bson.M{"user": user.Id}); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(a.out, "Deleted %s\n", user.Email)
+		return nil
+	},
+}
+
+var sessionsRevokeCommand = &command{
+	name:        "sessions revoke",
+	usage:       "[-session id] <id or email>",
+	description: "Revoke every session of a user, or a single one",
+	setup: func(flags *flag.FlagSet) {
+		flags.String("session", "", "only revoke the session with this id")
+	},
+	run: func(a *Admin, flags *flag.FlagSet, args []string) error {
+		if err := requireArgs(args, 1); err != nil {
+			return err
+		}
+
+		user, err := a.findUser(args[0])
+		if err != nil {
+			return err
+		}
+
+		filter := bson.M{"user": user.Id}
+		if session := flagString(flags, "session"); session != "" {
+			filter["_id"] = session
+		}
+
+		sessions, err := mongoutil.Find[Session](a.auth.Collection("sessions"), filter)
+		if err != nil {
+			return err
+		}
+
+		sessionIds := make([]string, 0, len(sessions))
+		for _, session := range sessions {
+			sessionIds = append(sessionIds, session.Id)
+		}
+
+		result, err := a.auth.Collection("sessions").DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": sessionIds}})
+		if err != nil {
+			return err
+		}
+
+		if _, err := mongoutil.DeleteMany(a.auth.Collection("refreshTokens"), bson.M{"session": bson.M{"$in": sessionIds}}); err != nil {
+			return err
+		}
+
+		// Without the notification the sync service detaches the sessions on its next compaction instead
+		if err := a.notifySessionsRevoked(user.Id, sessionIds); err != nil {
+			fmt.Fprintln(a.out, "Unable to notify the sync service:", err)
+		}
+
+		fmt.Fprintf(a.out, "Revoked %d session(s) of %s\n", result.DeletedCount, user.Email)
+		return nil
+	},
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"perfice.adoe.dev/mongoutil"
 )
 
 type AuthApp struct {
@@ -34,6 +36,34 @@ func NewAuthApp() *AuthApp {
 	}
 }
 
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid %s: %w", name, err))
+	}
+
+	return duration
+}
+
+// rateLimitStore returns the store of RATE_LIMIT_STORE, replicas have to use "mongo" to share their counters
+func (a *AuthApp) rateLimitStore() RateLimitStore {
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "", "memory":
+		store := NewMemoryRateLimitStore()
+		store.Run()
+		return store
+	case "mongo":
+		return NewMongoRateLimitStore(a.db.Collection("rateLimits"))
+	default:
+		panic(fmt.Errorf("invalid RATE_LIMIT_STORE %q", os.Getenv("RATE_LIMIT_STORE")))
+	}
+}
+
 func (a *AuthApp) setupSentry() {
 	err := sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRY_DSN"),
@@ -46,27 +76,96 @@ func (a *AuthApp) setupSentry() {
 
 func (a *AuthApp) Init() {
 	log.Println("Running auth server")
+	// Only used to verify tokens issued before signing keys were introduced
 	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
-	sessionService := NewSessionService(a.db.Collection("sessions"), jwtSecret)
-	a.setupKafka()
+	encryptionKey := []byte(os.Getenv("ENCRYPTION_KEY"))
 	a.setupSentry()
+	if err := mongoutil.RunMigrations(a.db, authMigrations); err != nil {
+		panic(err)
+	}
+
+	if err := mongoutil.EnsureIndexesLogged(a.db, authIndexes); err != nil {
+		sentry.CaptureException(err)
+	}
+	a.setupKafka()
+	sessionCache := NewSessionCache(durationFromEnv("SESSION_CACHE_TTL", defaultSessionCacheTTL))
+	sessionCache.Run()
+	signingKeys := NewSigningKeyService(a.db.Collection("signingKeys"), encryptionKey,
+		durationFromEnv("JWT_KEY_ROTATION_INTERVAL", defaultKeyRotationInterval), jwtSecret)
+	if err := signingKeys.Load(); err != nil {
+		panic(err)
+	}
+	signingKeys.Run()
+
+	sessionService := NewSessionService(a.db.Collection("sessions"), a.db.Collection("refreshTokens"), signingKeys,
+		a.kafkaService, sessionCache)
+	a.readSessionEvents(sessionService)
+
+	templates, err := templatesFromEnv()
+	if err != nil {
+		panic(err)
+	}
+
+	mailer, err := mailerFromEnv()
+	if err != nil {
+		panic(err)
+	}
 
-	apiKey := os.Getenv("MAILEROO_API_KEY")
-	if apiKey != "" {
-		a.mailService = NewMailService(apiKey)
+	// Without a mailer emails aren't confirmed and passwords can't be reset
+	if mailer != nil {
+		outbox := NewMailOutbox(NewMailOutboxCollection(a.db.Collection("mailOutbox")), mailer, templates, encryptionKey)
+		outbox.Run()
+		a.mailService = NewMailService(outbox)
 	}
 
-	authService := NewAuthService(NewUserCollection(a.db.Collection("users")), NewAccountTokenCollection(a.db.Collection("accountTokens")),
-		jwtSecret, sessionService, a.kafkaService, a.mailService)
+	userCollection := NewUserCollection(a.db.Collection("users"))
+	mfaService := NewMfaService(userCollection, NewMfaChallengeCollection(a.db.Collection("mfaChallenges")),
+		encryptionKey)
+	var passkeyService *PasskeyService
+	// Passkeys are bound to a domain, so they are only enabled once it has been configured
+	if rpId := os.Getenv("WEBAUTHN_RP_ID"); rpId != "" {
+		passkeyService, err = NewPasskeyService(rpId, userCollection,
+			NewWebAuthnChallengeCollection(a.db.Collection("webauthnChallenges")))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	accountTokenCollection := NewAccountTokenCollection(a.db.Collection("accountTokens"), map[string]time.Duration{
+		confirmationAccountToken:  durationFromEnv("CONFIRMATION_TOKEN_EXPIRY", defaultConfirmationTokenExpiry),
+		passwordResetAccountToken: durationFromEnv("PASSWORD_RESET_TOKEN_EXPIRY", defaultPasswordResetTokenExpiry),
+	})
+	authService := NewAuthService(userCollection, accountTokenCollection,
+		jwtSecret, sessionService, a.kafkaService, a.mailService, mfaService, passkeyService)
 	authService.OnUserDeleted(func(userId string) {
 		err := sessionService.OnUserDeleted(userId)
 		if err != nil {
 			sentry.CaptureException(err)
 		}
 	})
+	authService.OnUserDeleted(func(userId string) {
+		if err := mfaService.OnUserDeleted(userId); err != nil {
+			sentry.CaptureException(err)
+		}
+	})
+	oidcProviders, err := oidcProvidersFromEnv()
+	if err != nil {
+		panic(err)
+	}
+
+	oidcService := NewOidcService(oidcProviders, baseUrl, NewOidcStateCollection(a.db.Collection("oidcStates")),
+		NewOidcLoginCodeCollection(a.db.Collection("oidcLoginCodes")), NewIdentityCollection(a.db.Collection("identities")),
+		userCollection, sessionService, mfaService, a.mailService)
+	authService.OnUserDeleted(func(userId string) {
+		if err := oidcService.OnUserDeleted(userId); err != nil {
+			sentry.CaptureException(err)
+		}
+	})
 	feedbackService := NewFeedbackService(a.db.Collection("feedback"))
+	rateLimiter := NewRateLimiter(a.rateLimitStore())
 	a.setupGrpcServer(sessionService, authService)
-	a.setupHttpServer(jwtSecret, authService, sessionService, feedbackService)
+	a.setupHttpServer(signingKeys, authService, sessionService, mfaService, passkeyService, oidcService, feedbackService,
+		rateLimiter, templates)
 	log.Println("Auth server initialized")
 
 	defer sentry.Flush(2 * time.Second)
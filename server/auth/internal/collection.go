@@ -1,12 +1,17 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"perfice.adoe.dev/mongoutil"
+	"perfice.adoe.dev/util"
 )
 
 type UserCollection struct {
@@ -39,6 +44,11 @@ func (a *UserCollection) UpdateTimezone(userId string, timezone string) error {
 	return nil
 }
 
+func (a *UserCollection) UpdateLocale(userId string, locale string) error {
+	_, err := mongoutil.SetOne(a.collection, bson.M{"_id": userId}, bson.M{"locale": locale})
+	return err
+}
+
 func (a *UserCollection) DeleteUserById(userId string) error {
 	_, err := mongoutil.DeleteOne(a.collection, bson.M{"_id": userId})
 	if err != nil {
@@ -71,76 +81,399 @@ func (a *UserCollection) UpdatePassword(userId string, password string) error {
 	return err
 }
 
+func (a *UserCollection) SetTOTP(userId string, totp UserTOTP) error {
+	_, err := mongoutil.SetOne(a.collection, bson.M{"_id": userId}, bson.M{"totp": totp})
+	return err
+}
+
+func (a *UserCollection) RemoveTOTP(userId string) error {
+	_, err := a.collection.UpdateOne(context.Background(), bson.M{"_id": userId}, bson.M{"$unset": bson.M{"totp": ""}})
+	return err
+}
+
+func (a *UserCollection) SetRecoveryCodes(userId string, hashes []string) error {
+	_, err := mongoutil.SetOne(a.collection, bson.M{"_id": userId}, bson.M{"totp.recoveryCodes": hashes})
+	return err
+}
+
+// UseTOTPStep records that a code of the time step was used, it returns false if the step or a later one was used before
+func (a *UserCollection) UseTOTPStep(userId string, step int64) (bool, error) {
+	return mongoutil.SetOne(a.collection, bson.M{"_id": userId, "totp.lastUsedStep": bson.M{"$lt": step}},
+		bson.M{"totp.lastUsedStep": step})
+}
+
+// UseRecoveryCode removes a recovery code, it returns false if the user doesn't have it
+func (a *UserCollection) UseRecoveryCode(userId string, hash string) (bool, error) {
+	return mongoutil.PullOne(a.collection, bson.M{"_id": userId, "totp.recoveryCodes": hash},
+		bson.M{"totp.recoveryCodes": hash})
+}
+
+func (a *UserCollection) GetUserByWebAuthnId(webAuthnId []byte) (*User, error) {
+	return mongoutil.FindOne[User](a.collection, bson.M{"webAuthnId": webAuthnId})
+}
+
+// SetWebAuthnIdIfMissing sets the user handle, unless the user already has one
+func (a *UserCollection) SetWebAuthnIdIfMissing(userId string, webAuthnId []byte) error {
+	_, err := mongoutil.SetOne(a.collection, bson.M{"_id": userId, "webAuthnId": bson.M{"$exists": false}},
+		bson.M{"webAuthnId": webAuthnId})
+	return err
+}
+
+func (a *UserCollection) AddPasskey(userId string, passkey UserPasskey) error {
+	_, err := mongoutil.PushOne(a.collection, bson.M{"_id": userId}, bson.M{"passkeys": passkey})
+	return err
+}
+
+// RemovePasskey removes a passkey unless it is the last way to log in, returns false if nothing was removed. The check
+// is part of the update, so that concurrent deletes can't remove every passkey of an account without a password.
+func (a *UserCollection) RemovePasskey(userId string, credentialId []byte) (bool, error) {
+	return mongoutil.PullOne(a.collection, bson.M{
+		"_id":         userId,
+		"passkeys.id": credentialId,
+		"$or": bson.A{
+			bson.M{"password": bson.M{"$exists": true, "$ne": ""}},
+			bson.M{"passkeys.1": bson.M{"$exists": true}},
+		},
+	}, bson.M{"passkeys": bson.M{"id": credentialId}})
+}
+
+// UpdatePasskeyCredential stores the credential after a login, which updates its signature counter
+func (a *UserCollection) UpdatePasskeyCredential(userId string, credential webauthn.Credential, usedAt time.Time) error {
+	_, err := mongoutil.SetOne(a.collection, bson.M{"_id": userId, "passkeys.id": credential.ID}, bson.M{
+		"passkeys.$.credential": credential,
+		"passkeys.$.lastUsedAt": usedAt,
+	})
+	return err
+}
+
 var confirmationAccountToken = "confirmation"
 var passwordResetAccountToken = "passwordReset"
 
+var accountTokenLength = 32
+var defaultConfirmationTokenExpiry = 72 * time.Hour
+var defaultPasswordResetTokenExpiry = time.Hour
+
 type AccountToken struct {
-	Id        primitive.ObjectID `bson:"_id"`
-	UserId    string             `bson:"userId"`
-	Type      string             `bson:"type"`
-	Timestamp int64              `bson:"timestamp"`
+	// Id is the hash of the token, the token itself is only sent to the user
+	Id        string    `bson:"_id"`
+	UserId    string    `bson:"userId"`
+	Type      string    `bson:"type"`
+	Timestamp int64     `bson:"timestamp"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+	// Attempts counts wrong second factors entered with a password reset token
+	Attempts int `bson:"attempts"`
 }
 
 type AccountTokenCollection struct {
 	collection *mongo.Collection
+	// expiries is how long tokens of each type are valid
+	expiries map[string]time.Duration
 }
 
-func NewAccountTokenCollection(collection *mongo.Collection) *AccountTokenCollection {
-	return &AccountTokenCollection{collection}
+func NewAccountTokenCollection(collection *mongo.Collection, expiries map[string]time.Duration) *AccountTokenCollection {
+	return &AccountTokenCollection{collection, expiries}
 }
 
-func (c *AccountTokenCollection) Create(userId string, tokenType string) (*AccountToken, error) {
-	accountToken := AccountToken{
-		Id:        primitive.NewObjectID(),
+// Create returns a new random token, which can't be guessed from other tokens
+func (c *AccountTokenCollection) Create(userId string, tokenType string) (string, error) {
+	expiry, ok := c.expiries[tokenType]
+	if !ok {
+		return "", fmt.Errorf("unknown account token type %s", tokenType)
+	}
+
+	token, err := util.GenerateAlphanumericString(accountTokenLength)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = mongoutil.Insert(c.collection, AccountToken{
+		Id:        hashSecret(token),
 		UserId:    userId,
 		Type:      tokenType,
-		Timestamp: time.Now().UnixMilli(),
+		Timestamp: now.UnixMilli(),
+		ExpiresAt: now.Add(expiry),
+	})
+	if err != nil {
+		return "", err
 	}
 
-	err := mongoutil.Insert(c.collection, accountToken)
+	return token, nil
+}
+
+func (c *AccountTokenCollection) filter(token string, typeName string) bson.M {
+	return bson.M{"_id": hashSecret(token), "type": typeName, "expiresAt": bson.M{"$gt": time.Now()}}
+}
+
+// GetById returns the token if it exists and hasn't expired
+func (c *AccountTokenCollection) GetById(token string, typeName string) (*AccountToken, error) {
+	return mongoutil.FindOne[AccountToken](c.collection, c.filter(token, typeName))
+}
+
+// GetAndDeleteById uses up the token, only one of several concurrent requests gets it
+func (c *AccountTokenCollection) GetAndDeleteById(token string, typeName string) (*AccountToken, error) {
+	return takeOne[AccountToken](c.collection, c.filter(token, typeName))
+}
+
+// AddAttempt counts a failed attempt and returns the amount of attempts made so far
+func (c *AccountTokenCollection) AddAttempt(token string, typeName string) (int, error) {
+	var found AccountToken
+	err := c.collection.FindOneAndUpdate(context.Background(), c.filter(token, typeName), bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&found)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return &accountToken, nil
+	return found.Attempts, nil
 }
 
-func (c *AccountTokenCollection) GetById(id primitive.ObjectID, typeName string) (*AccountToken, error) {
-	return mongoutil.FindOne[AccountToken](c.collection, bson.M{"_id": id, "type": typeName})
+func (c *AccountTokenCollection) DeleteByUserId(userId string) error {
+	_, err := mongoutil.DeleteMany(c.collection, bson.M{"userId": userId})
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func (c *AccountTokenCollection) GetAndDeleteById(id primitive.ObjectID, typeName string) (*AccountToken, error) {
-	token, err := mongoutil.FindOne[AccountToken](c.collection, bson.M{"_id": id, "type": typeName})
+type MfaChallenge struct {
+	// Hash is the hash of the challenge token given to the client
+	Hash      string    `bson:"_id"`
+	User      string    `bson:"user"`
+	Attempts  int       `bson:"attempts"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+type MfaChallengeCollection struct {
+	collection *mongo.Collection
+}
+
+func NewMfaChallengeCollection(collection *mongo.Collection) *MfaChallengeCollection {
+	return &MfaChallengeCollection{collection}
+}
+
+func (c *MfaChallengeCollection) Create(challenge MfaChallenge) error {
+	return mongoutil.Insert(c.collection, challenge)
+}
+
+func (c *MfaChallengeCollection) Get(hash string) (*MfaChallenge, error) {
+	return mongoutil.FindOne[MfaChallenge](c.collection, bson.M{"_id": hash, "expiresAt": bson.M{"$gt": time.Now()}})
+}
+
+// AddAttempt counts a failed attempt and returns the amount of attempts made so far
+func (c *MfaChallengeCollection) AddAttempt(hash string) (int, error) {
+	var challenge MfaChallenge
+	err := c.collection.FindOneAndUpdate(context.Background(), bson.M{"_id": hash}, bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&challenge)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	if token == nil {
-		return nil, nil
-	}
+	return challenge.Attempts, nil
+}
 
-	err = c.DeleteById(id)
+// Take deletes the challenge, it returns false if it was already used
+func (c *MfaChallengeCollection) Take(hash string) (bool, error) {
+	result, err := c.collection.DeleteOne(context.Background(), bson.M{"_id": hash})
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return token, nil
+	return result.DeletedCount > 0, nil
 }
 
-func (c *AccountTokenCollection) DeleteById(id primitive.ObjectID) error {
-	_, err := mongoutil.DeleteOne(c.collection, bson.M{"_id": id})
+func (c *MfaChallengeCollection) DeleteByUser(userId string) error {
+	_, err := mongoutil.DeleteMany(c.collection, bson.M{"user": userId})
+	return err
+}
+
+type WebAuthnChallenge struct {
+	Challenge string `bson:"_id"`
+	Ceremony  string `bson:"ceremony"`
+	// User is set when adding a passkey to an existing account
+	User string `bson:"user,omitempty"`
+	// Email is set when creating an account with a passkey
+	Email     string               `bson:"email,omitempty"`
+	Session   webauthn.SessionData `bson:"session"`
+	ExpiresAt time.Time            `bson:"expiresAt"`
+}
+
+type WebAuthnChallengeCollection struct {
+	collection *mongo.Collection
+}
+
+func NewWebAuthnChallengeCollection(collection *mongo.Collection) *WebAuthnChallengeCollection {
+	return &WebAuthnChallengeCollection{collection}
+}
+
+func (c *WebAuthnChallengeCollection) Create(challenge WebAuthnChallenge) error {
+	return mongoutil.Insert(c.collection, challenge)
+}
+
+// Take deletes and returns the challenge of a ceremony, or nil if it doesn't exist or has expired
+func (c *WebAuthnChallengeCollection) Take(challenge string, ceremony string) (*WebAuthnChallenge, error) {
+	return takeOne[WebAuthnChallenge](c.collection, bson.M{
+		"_id":       challenge,
+		"ceremony":  ceremony,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	})
+}
+
+// takeOne deletes and returns a document, so that single use tokens can't be used twice
+func takeOne[T any](collection *mongo.Collection, filter bson.M) (*T, error) {
+	var found T
+	err := collection.FindOneAndDelete(context.Background(), filter).Decode(&found)
 	if err != nil {
-		return err
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
 	}
 
-	return nil
+	return &found, nil
 }
 
-func (c *AccountTokenCollection) DeleteByUserId(userId string) error {
-	_, err := mongoutil.DeleteMany(c.collection, bson.M{"userId": userId})
+type OidcState struct {
+	// Hash is the hash of the state parameter sent to the provider
+	Hash     string `bson:"_id"`
+	Provider string `bson:"provider"`
+	// Verifier is the PKCE code verifier
+	Verifier  string    `bson:"verifier"`
+	Nonce     string    `bson:"nonce"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+type OidcStateCollection struct {
+	collection *mongo.Collection
+}
+
+func NewOidcStateCollection(collection *mongo.Collection) *OidcStateCollection {
+	return &OidcStateCollection{collection}
+}
+
+func (c *OidcStateCollection) Create(state OidcState) error {
+	return mongoutil.Insert(c.collection, state)
+}
+
+func (c *OidcStateCollection) Take(hash string, provider string) (*OidcState, error) {
+	return takeOne[OidcState](c.collection, bson.M{"_id": hash, "provider": provider, "expiresAt": bson.M{"$gt": time.Now()}})
+}
+
+type OidcLoginCode struct {
+	Hash      string    `bson:"_id"`
+	User      string    `bson:"user"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+type OidcLoginCodeCollection struct {
+	collection *mongo.Collection
+}
+
+func NewOidcLoginCodeCollection(collection *mongo.Collection) *OidcLoginCodeCollection {
+	return &OidcLoginCodeCollection{collection}
+}
+
+func (c *OidcLoginCodeCollection) Create(code OidcLoginCode) error {
+	return mongoutil.Insert(c.collection, code)
+}
+
+func (c *OidcLoginCodeCollection) Take(hash string) (*OidcLoginCode, error) {
+	return takeOne[OidcLoginCode](c.collection, bson.M{"_id": hash, "expiresAt": bson.M{"$gt": time.Now()}})
+}
+
+// UserIdentity links an identity at an external provider to a user
+type UserIdentity struct {
+	Id       string `bson:"_id"`
+	Provider string `bson:"provider"`
+	// Subject is the id of the user at the provider
+	Subject string `bson:"subject"`
+	User    string `bson:"user"`
+	// Email is the email at the provider, which may differ from the one of the user
+	Email       string    `bson:"email"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	LastLoginAt time.Time `bson:"lastLoginAt"`
+}
+
+type IdentityCollection struct {
+	collection *mongo.Collection
+}
+
+func NewIdentityCollection(collection *mongo.Collection) *IdentityCollection {
+	return &IdentityCollection{collection}
+}
+
+func (c *IdentityCollection) Create(identity UserIdentity) error {
+	return mongoutil.Insert(c.collection, identity)
+}
+
+func (c *IdentityCollection) Get(provider string, subject string) (*UserIdentity, error) {
+	return mongoutil.FindOne[UserIdentity](c.collection, bson.M{"provider": provider, "subject": subject})
+}
+
+func (c *IdentityCollection) UpdateLogin(id string, email string, loginAt time.Time) error {
+	_, err := mongoutil.SetOne(c.collection, bson.M{"_id": id}, bson.M{"email": email, "lastLoginAt": loginAt})
+	return err
+}
+
+func (c *IdentityCollection) DeleteByUser(userId string) error {
+	_, err := mongoutil.DeleteMany(c.collection, bson.M{"user": userId})
+	return err
+}
+
+// OutboxMail is a mail waiting to be delivered, it is rendered when it is sent. It is deleted once sent or given up
+// on, as its data may contain account tokens.
+type OutboxMail struct {
+	Id       string `bson:"_id"`
+	To       string `bson:"to"`
+	Locale   string `bson:"locale"`
+	Template string `bson:"template"`
+	// EncryptedData is the JSON encoded data of the template, encrypted with ENCRYPTION_KEY
+	EncryptedData []byte    `bson:"encryptedData"`
+	Attempts      int       `bson:"attempts"`
+	NextAttemptAt time.Time `bson:"nextAttemptAt"`
+	LastError     string    `bson:"lastError,omitempty"`
+	CreatedAt     time.Time `bson:"createdAt"`
+}
+
+type MailOutboxCollection struct {
+	collection *mongo.Collection
+}
+
+func NewMailOutboxCollection(collection *mongo.Collection) *MailOutboxCollection {
+	return &MailOutboxCollection{collection}
+}
+
+func (c *MailOutboxCollection) Create(mail OutboxMail) error {
+	return mongoutil.Insert(c.collection, mail)
+}
+
+// Claim returns a due mail and postpones its next attempt by the lease, so that other replicas don't send it too
+func (c *MailOutboxCollection) Claim(lease time.Duration) (*OutboxMail, error) {
+	now := time.Now()
+	var mail OutboxMail
+	err := c.collection.FindOneAndUpdate(context.Background(),
+		bson.M{"nextAttemptAt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextAttemptAt": now.Add(lease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.M{"nextAttemptAt": 1}).SetReturnDocument(options.After)).Decode(&mail)
 	if err != nil {
-		return err
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
 	}
 
-	return nil
+	return &mail, nil
+}
+
+func (c *MailOutboxCollection) Reschedule(id string, nextAttemptAt time.Time, lastError string) error {
+	_, err := mongoutil.SetOne(c.collection, bson.M{"_id": id},
+		bson.M{"nextAttemptAt": nextAttemptAt, "lastError": lastError})
+	return err
+}
+
+func (c *MailOutboxCollection) Delete(id string) error {
+	_, err := mongoutil.DeleteOne(c.collection, bson.M{"_id": id})
+	return err
 }
@@ -1,29 +1,53 @@
 package internal
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/gofiber/fiber/v2"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"perfice.adoe.dev/util"
 )
 
 type AuthController struct {
 	authService    *AuthService
 	sessionService *SessionService
+	rateLimiter    *RateLimiter
+	templates      *Templates
 }
 
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// DeviceName and Platform are optional and shown in the list of sessions
+	DeviceName string `json:"deviceName"`
+	Platform   string `json:"platform"`
+}
+
+type LoginMfaRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	// Code is either a code from the authenticator or a recovery code
+	Code       string `json:"code"`
+	DeviceName string `json:"deviceName"`
+	Platform   string `json:"platform"`
 }
 
 type RegisterRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Locale is optional, the language of the browser is used otherwise
+	Locale string `json:"locale"`
+}
+
+type SetLocaleRequest struct {
+	Locale string `json:"locale"`
 }
 
 type SetTimezoneRequest struct {
@@ -57,8 +81,41 @@ func getSessionId(ctx *fiber.Ctx) string {
 	return ctx.Locals(sessionIdLocal).(string)
 }
 
-func NewAuthController(authService *AuthService, sessionService *SessionService) *AuthController {
-	return &AuthController{authService, sessionService}
+var maxDeviceNameLength = 64
+var maxPlatformLength = 32
+var maxUserAgentLength = 512
+
+func truncate(value string, length int) string {
+	runes := []rune(value)
+	if len(runes) <= length {
+		return value
+	}
+
+	return string(runes[:length])
+}
+
+// clientIP returns the address of the client. Requests are forwarded by the gateway, which sets X-Real-IP to the
+// client address it resolved through its trusted proxies.
+func clientIP(ctx *fiber.Ctx) string {
+	if ip := ctx.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+
+	return ctx.IP()
+}
+
+func sessionDevice(ctx *fiber.Ctx, deviceName string, platform string) SessionDevice {
+	return SessionDevice{
+		Name:      truncate(strings.TrimSpace(deviceName), maxDeviceNameLength),
+		Platform:  truncate(strings.TrimSpace(platform), maxPlatformLength),
+		UserAgent: truncate(ctx.Get(fiber.HeaderUserAgent), maxUserAgentLength),
+		IP:        clientIP(ctx),
+	}
+}
+
+func NewAuthController(authService *AuthService, sessionService *SessionService, rateLimiter *RateLimiter,
+	templates *Templates) *AuthController {
+	return &AuthController{authService, sessionService, rateLimiter, templates}
 }
 
 func (c *AuthController) Register(ctx *fiber.Ctx) error {
@@ -67,7 +124,12 @@ func (c *AuthController) Register(ctx *fiber.Ctx) error {
 		return ctx.SendStatus(fiber.StatusBadRequest)
 	}
 
-	if err := c.authService.Register(c.sanitizeEmail(request.Email), request.Password); err != nil {
+	locale := c.templates.MatchAcceptLanguage(ctx.Get(fiber.HeaderAcceptLanguage))
+	if request.Locale != "" {
+		locale = c.templates.MatchLocale(request.Locale)
+	}
+
+	if err := c.authService.Register(sanitizeEmail(request.Email), request.Password, locale); err != nil {
 		if errors.Is(err, UserAlreadyExistsError{}) {
 			return ctx.Status(fiber.StatusBadRequest).SendString("User already exists")
 		} else {
@@ -78,7 +140,7 @@ func (c *AuthController) Register(ctx *fiber.Ctx) error {
 	return ctx.SendStatus(fiber.StatusOK)
 }
 
-func (c *AuthController) sanitizeEmail(email string) string {
+func sanitizeEmail(email string) string {
 	return strings.Trim(strings.ToLower(email), " ")
 }
 
@@ -88,15 +150,73 @@ func (c *AuthController) Login(ctx *fiber.Ctx) error {
 		return ctx.SendStatus(fiber.StatusBadRequest)
 	}
 
-	session, err := c.authService.Login(c.sanitizeEmail(request.Email), request.Password)
+	email := sanitizeEmail(request.Email)
+	emailKey := "login:email:" + email
+	ipKey := "login:ip:" + clientIP(ctx)
+	retryAfter, err := c.rateLimiter.Lockout(emailKey, ipKey)
+	if err != nil {
+		return err
+	}
+
+	if retryAfter > 0 {
+		return tooManyRequests(ctx, retryAfter)
+	}
+
+	device := sessionDevice(ctx, request.DeviceName, request.Platform)
+	session, err := c.authService.Login(email, request.Password, device)
 	if err != nil {
 		if errors.Is(err, UserNotConfirmedError{}) {
 			return ctx.Status(fiber.StatusForbidden).SendString("Email not confirmed")
 		}
 		if errors.Is(err, InvalidCredentialsError{}) {
+			if err := c.rateLimiter.RecordFailure(emailKey, emailLockoutPolicy); err != nil {
+				return err
+			}
+			if err := c.rateLimiter.RecordFailure(ipKey, ipLockoutPolicy); err != nil {
+				return err
+			}
+
 			return ctx.Status(fiber.StatusUnauthorized).SendString("Invalid username or password")
 		}
 
+		var mfaRequired MfaRequiredError
+		if errors.As(err, &mfaRequired) {
+			// The password was correct, the second factor limits its own attempts
+			if err := c.rateLimiter.RecordSuccess(emailKey); err != nil {
+				return err
+			}
+
+			return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"mfaRequired":    true,
+				"challengeToken": mfaRequired.ChallengeToken,
+			})
+		}
+
+		return err
+	}
+
+	// Only the email is reset, an address trying many accounts stays locked out
+	if err := c.rateLimiter.RecordSuccess(emailKey); err != nil {
+		return err
+	}
+
+	return sessionResponse(ctx, session)
+}
+
+// LoginMfa is the second step of logging in for users with two-factor authentication
+func (c *AuthController) LoginMfa(ctx *fiber.Ctx) error {
+	var request LoginMfaRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	device := sessionDevice(ctx, request.DeviceName, request.Platform)
+	session, err := c.authService.LoginMfa(request.ChallengeToken, request.Code, device)
+	if err != nil {
+		if errors.Is(err, InvalidMfaChallengeError{}) || errors.Is(err, InvalidMfaCodeError{}) {
+			return ctx.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+
 		return err
 	}
 
@@ -109,8 +229,14 @@ func (c *AuthController) Refresh(ctx *fiber.Ctx) error {
 		return ctx.SendStatus(fiber.StatusBadRequest)
 	}
 
-	session, err := c.sessionService.Refresh(request.AccessToken, request.RefreshToken)
+	session, err := c.sessionService.Refresh(request.AccessToken, request.RefreshToken, clientIP(ctx),
+		truncate(ctx.Get(fiber.HeaderUserAgent), maxUserAgentLength))
 	if err != nil {
+		if errors.Is(err, InvalidRefreshTokenError{}) || errors.Is(err, RefreshTokenReusedError{}) ||
+			errors.Is(err, SessionExpiredError{}) {
+			return ctx.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+
 		return err
 	}
 
@@ -119,13 +245,30 @@ func (c *AuthController) Refresh(ctx *fiber.Ctx) error {
 
 func (c *AuthController) Logout(ctx *fiber.Ctx) error {
 	sessionId := getSessionId(ctx)
-	if err := c.sessionService.Logout(sessionId); err != nil {
+	if err := c.sessionService.Logout(getUserId(ctx), sessionId); err != nil {
 		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid session")
 	}
 
 	return ctx.SendStatus(fiber.StatusOK)
 }
 
+func (c *AuthController) SetLocale(ctx *fiber.Ctx) error {
+	var request SetLocaleRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	if !slices.Contains(c.templates.Locales(), request.Locale) {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid locale")
+	}
+
+	if err := c.authService.SetLocale(getUserId(ctx), request.Locale); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
+
 func (c *AuthController) SetTimezone(ctx *fiber.Ctx) error {
 	var request SetTimezoneRequest
 	if err := ctx.BodyParser(&request); err != nil {
@@ -170,23 +313,18 @@ func (c *AuthController) DeleteAccount(ctx *fiber.Ctx) error {
 }
 
 func (c *AuthController) ConfirmEmail(ctx *fiber.Ctx) error {
-	token, err := primitive.ObjectIDFromHex(ctx.Params("token"))
-	if err != nil {
-		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid token")
-	}
-
-	err = c.authService.ConfirmEmail(token)
+	err := c.authService.ConfirmEmail(ctx.Params("token"))
 	if err != nil {
 		sentry.CaptureException(err)
 		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid token")
 	}
 
-	return ctx.Type("html").SendString(fmt.Sprintf(confirmEmailHtml, appBaseUrl))
+	return c.sendPage(ctx, "email_confirmed", map[string]any{"AppBaseUrl": appBaseUrl})
 }
 
 func (c *AuthController) InitResetPassword(ctx *fiber.Ctx) error {
 	email := ctx.Query("email")
-	err := c.authService.InitResetPassword(c.sanitizeEmail(email))
+	err := c.authService.InitResetPassword(sanitizeEmail(email))
 	if err != nil {
 		sentry.CaptureException(err)
 		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid token")
@@ -195,33 +333,38 @@ func (c *AuthController) InitResetPassword(ctx *fiber.Ctx) error {
 	return ctx.SendStatus(fiber.StatusOK)
 }
 func (c *AuthController) FillResetPassword(ctx *fiber.Ctx) error {
-	token, err := primitive.ObjectIDFromHex(ctx.Params("token"))
-	if err != nil {
+	token := ctx.Params("token")
+	valid, mfaRequired := c.authService.ValidateResetPassword(token)
+	if !valid {
 		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid token")
 	}
 
-	if !c.authService.ValidateResetPassword(token) {
-		sentry.CaptureException(err)
-		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid token")
-	}
-
-	return ctx.Type("html").SendString(fmt.Sprintf(resetPasswordInitHtml, token.Hex()))
+	return c.sendPage(ctx, "reset_password_form", map[string]any{"Token": token, "MfaRequired": mfaRequired})
 }
 
 func (c *AuthController) ResetPassword(ctx *fiber.Ctx) error {
-	token, err := primitive.ObjectIDFromHex(ctx.FormValue("token"))
+	password := ctx.FormValue("password")
+	err := c.authService.ResetPassword(ctx.FormValue("token"), password, ctx.FormValue("code"))
 	if err != nil {
+		if errors.Is(err, InvalidMfaCodeError{}) {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid code")
+		}
+
+		sentry.CaptureException(err)
 		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid token")
 	}
 
-	password := ctx.FormValue("password")
-	err = c.authService.ResetPassword(token, password)
+	return c.sendPage(ctx, "password_reset", map[string]any{"AppBaseUrl": appBaseUrl})
+}
+
+// sendPage renders a page in the language of the browser
+func (c *AuthController) sendPage(ctx *fiber.Ctx, template string, data map[string]any) error {
+	page, err := c.templates.RenderPage(c.templates.MatchAcceptLanguage(ctx.Get(fiber.HeaderAcceptLanguage)), template, data)
 	if err != nil {
-		sentry.CaptureException(err)
-		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid token")
+		return err
 	}
 
-	return ctx.Type("html").SendString(fmt.Sprintf(resetPasswordHtml, appBaseUrl))
+	return ctx.Type("html", "utf-8").SendString(page)
 }
 
 func (c *AuthController) ResendConfirmationEmail(ctx *fiber.Ctx) error {
@@ -230,7 +373,7 @@ func (c *AuthController) ResendConfirmationEmail(ctx *fiber.Ctx) error {
 		return ctx.SendStatus(fiber.StatusBadRequest)
 	}
 
-	err := c.authService.ResendConfirmationEmail(c.sanitizeEmail(request.Email))
+	err := c.authService.ResendConfirmationEmail(sanitizeEmail(request.Email))
 	if err != nil {
 		sentry.CaptureException(err)
 		return ctx.SendStatus(fiber.StatusBadRequest)
@@ -239,6 +382,499 @@ func (c *AuthController) ResendConfirmationEmail(ctx *fiber.Ctx) error {
 	return ctx.SendStatus(fiber.StatusOK)
 }
 
+type SessionController struct {
+	sessionService *SessionService
+}
+
+func NewSessionController(sessionService *SessionService) *SessionController {
+	return &SessionController{sessionService}
+}
+
+type SessionResponse struct {
+	Id         string `json:"id"`
+	DeviceName string `json:"deviceName"`
+	Platform   string `json:"platform"`
+	UserAgent  string `json:"userAgent"`
+	IP         string `json:"ip"`
+	CreatedAt  int64  `json:"createdAt"`
+	LastSeen   int64  `json:"lastSeen"`
+	// Current is set for the session that made the request
+	Current bool `json:"current"`
+}
+
+type RenameSessionRequest struct {
+	DeviceName string `json:"deviceName"`
+}
+
+func (c *SessionController) GetSessions(ctx *fiber.Ctx) error {
+	sessions, err := c.sessionService.GetDevices(getUserId(ctx))
+	if err != nil {
+		return err
+	}
+
+	currentSessionId := getSessionId(ctx)
+	return ctx.JSON(util.SliceMap(sessions, func(session Session) SessionResponse {
+		return SessionResponse{
+			Id:         session.Id,
+			DeviceName: session.DeviceName,
+			Platform:   session.Platform,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt.UnixMilli(),
+			LastSeen:   session.LastRefresh,
+			Current:    session.Id == currentSessionId,
+		}
+	}))
+}
+
+func (c *SessionController) RenameSession(ctx *fiber.Ctx) error {
+	var request RenameSessionRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	name := strings.TrimSpace(request.DeviceName)
+	if len([]rune(name)) > maxDeviceNameLength {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Device name is too long")
+	}
+
+	err := c.sessionService.Rename(getUserId(ctx), ctx.Params("id"), name)
+	if err != nil {
+		if errors.Is(err, SessionNotFoundError{}) {
+			return ctx.Status(fiber.StatusNotFound).SendString("Session not found")
+		}
+
+		return err
+	}
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
+
+func (c *SessionController) RevokeSession(ctx *fiber.Ctx) error {
+	err := c.sessionService.Revoke(getUserId(ctx), ctx.Params("id"))
+	if err != nil {
+		if errors.Is(err, SessionNotFoundError{}) {
+			return ctx.Status(fiber.StatusNotFound).SendString("Session not found")
+		}
+
+		return err
+	}
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
+
+// RevokeOtherSessions logs out every device except the one making the request
+func (c *SessionController) RevokeOtherSessions(ctx *fiber.Ctx) error {
+	revoked, err := c.sessionService.RevokeOthers(getUserId(ctx), getSessionId(ctx))
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{"revoked": revoked})
+}
+
+type MfaController struct {
+	mfaService  *MfaService
+	rateLimiter *RateLimiter
+}
+
+func NewMfaController(mfaService *MfaService, rateLimiter *RateLimiter) *MfaController {
+	return &MfaController{mfaService, rateLimiter}
+}
+
+// checkCode runs an action that checks a code of the user. Wrong codes lock the user out, the same way as failed
+// logins. Returns whether the action ran and succeeded, otherwise the response has been sent.
+func (c *MfaController) checkCode(ctx *fiber.Ctx, action func(userId string) error) (bool, error) {
+	userId := getUserId(ctx)
+	key := "mfa:user:" + userId
+	retryAfter, err := c.rateLimiter.Lockout(key)
+	if err != nil {
+		return false, err
+	}
+
+	if retryAfter > 0 {
+		return false, tooManyRequests(ctx, retryAfter)
+	}
+
+	if err := action(userId); err != nil {
+		if errors.Is(err, InvalidMfaCodeError{}) {
+			if err := c.rateLimiter.RecordFailure(key, mfaLockoutPolicy); err != nil {
+				return false, err
+			}
+		}
+
+		return false, mfaErrorResponse(ctx, err)
+	}
+
+	return true, c.rateLimiter.RecordSuccess(key)
+}
+
+type MfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func mfaErrorResponse(ctx *fiber.Ctx, err error) error {
+	if errors.Is(err, InvalidMfaCodeError{}) {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid code")
+	}
+	if errors.Is(err, MfaAlreadyEnabledError{}) {
+		return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+	}
+	if errors.Is(err, MfaNotEnabledError{}) {
+		return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	return err
+}
+
+func (c *MfaController) GetStatus(ctx *fiber.Ctx) error {
+	status, err := c.mfaService.GetStatus(getUserId(ctx))
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(status)
+}
+
+func (c *MfaController) EnrollTOTP(ctx *fiber.Ctx) error {
+	enrollment, err := c.mfaService.Enroll(getUserId(ctx))
+	if err != nil {
+		return mfaErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(enrollment)
+}
+
+func (c *MfaController) ConfirmTOTP(ctx *fiber.Ctx) error {
+	var request MfaCodeRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	codes, err := c.mfaService.Confirm(getUserId(ctx), request.Code)
+	if err != nil {
+		return mfaErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(fiber.Map{"recoveryCodes": codes})
+}
+
+func (c *MfaController) DisableTOTP(ctx *fiber.Ctx) error {
+	var request MfaCodeRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	ok, err := c.checkCode(ctx, func(userId string) error {
+		return c.mfaService.Disable(userId, request.Code)
+	})
+	if !ok || err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
+
+func (c *MfaController) RegenerateRecoveryCodes(ctx *fiber.Ctx) error {
+	var request MfaCodeRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	var codes []string
+	ok, err := c.checkCode(ctx, func(userId string) error {
+		var err error
+		codes, err = c.mfaService.RegenerateRecoveryCodes(userId, request.Code)
+		return err
+	})
+	if !ok || err != nil {
+		return err
+	}
+
+	return ctx.JSON(fiber.Map{"recoveryCodes": codes})
+}
+
+type PasskeyController struct {
+	authService    *AuthService
+	passkeyService *PasskeyService
+}
+
+func NewPasskeyController(authService *AuthService, passkeyService *PasskeyService) *PasskeyController {
+	return &PasskeyController{authService, passkeyService}
+}
+
+type PasskeySignupRequest struct {
+	Email string `json:"email"`
+}
+
+type PasskeyCredentialRequest struct {
+	// Credential is the PublicKeyCredential returned by the browser
+	Credential json.RawMessage `json:"credential"`
+	// Name is only used when adding a passkey to an account
+	Name       string `json:"name"`
+	DeviceName string `json:"deviceName"`
+	Platform   string `json:"platform"`
+}
+
+type PasskeyResponse struct {
+	// Id is the base64url encoded credential id
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"createdAt"`
+	LastUsedAt int64  `json:"lastUsedAt"`
+}
+
+func passkeyResponse(passkey UserPasskey) PasskeyResponse {
+	return PasskeyResponse{
+		Id:         base64.RawURLEncoding.EncodeToString(passkey.Id),
+		Name:       passkey.Name,
+		CreatedAt:  passkey.CreatedAt.UnixMilli(),
+		LastUsedAt: passkey.LastUsedAt.UnixMilli(),
+	}
+}
+
+func (c *PasskeyController) BeginSignup(ctx *fiber.Ctx) error {
+	var request PasskeySignupRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	email := sanitizeEmail(request.Email)
+	if email == "" {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid email")
+	}
+
+	creation, err := c.authService.BeginPasskeySignup(email)
+	if err != nil {
+		if errors.Is(err, UserAlreadyExistsError{}) {
+			return ctx.Status(fiber.StatusBadRequest).SendString("User already exists")
+		}
+
+		return err
+	}
+
+	return ctx.JSON(creation)
+}
+
+func (c *PasskeyController) FinishSignup(ctx *fiber.Ctx) error {
+	var request PasskeyCredentialRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	session, err := c.authService.FinishPasskeySignup(request.Credential,
+		sessionDevice(ctx, request.DeviceName, request.Platform))
+	if err != nil {
+		if errors.Is(err, UserAlreadyExistsError{}) {
+			return ctx.Status(fiber.StatusBadRequest).SendString("User already exists")
+		}
+		if errors.Is(err, InvalidPasskeyError{}) {
+			return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		return err
+	}
+
+	// The email has to be confirmed before logging in
+	if session == nil {
+		return ctx.SendStatus(fiber.StatusOK)
+	}
+
+	return sessionResponse(ctx, *session)
+}
+
+func (c *PasskeyController) BeginLogin(ctx *fiber.Ctx) error {
+	assertion, err := c.passkeyService.BeginLogin()
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(assertion)
+}
+
+func (c *PasskeyController) FinishLogin(ctx *fiber.Ctx) error {
+	var request PasskeyCredentialRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	session, err := c.authService.LoginPasskey(request.Credential, sessionDevice(ctx, request.DeviceName, request.Platform))
+	if err != nil {
+		if errors.Is(err, UserNotConfirmedError{}) {
+			return ctx.Status(fiber.StatusForbidden).SendString("Email not confirmed")
+		}
+		if errors.Is(err, InvalidPasskeyError{}) {
+			return ctx.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+
+		var mfaRequired MfaRequiredError
+		if errors.As(err, &mfaRequired) {
+			return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"mfaRequired":    true,
+				"challengeToken": mfaRequired.ChallengeToken,
+			})
+		}
+
+		return err
+	}
+
+	return sessionResponse(ctx, session)
+}
+
+func (c *PasskeyController) GetPasskeys(ctx *fiber.Ctx) error {
+	passkeys, err := c.passkeyService.GetPasskeys(getUserId(ctx))
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(util.SliceMap(passkeys, passkeyResponse))
+}
+
+func (c *PasskeyController) BeginRegistration(ctx *fiber.Ctx) error {
+	creation, err := c.passkeyService.BeginRegistration(getUserId(ctx))
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(creation)
+}
+
+func (c *PasskeyController) FinishRegistration(ctx *fiber.Ctx) error {
+	var request PasskeyCredentialRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	passkey, err := c.passkeyService.FinishRegistration(getUserId(ctx), request.Name, request.Credential)
+	if err != nil {
+		if errors.Is(err, InvalidPasskeyError{}) {
+			return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		return err
+	}
+
+	return ctx.JSON(passkeyResponse(passkey))
+}
+
+func (c *PasskeyController) DeletePasskey(ctx *fiber.Ctx) error {
+	err := c.passkeyService.DeletePasskey(getUserId(ctx), ctx.Params("id"))
+	if err != nil {
+		if errors.Is(err, PasskeyNotFoundError{}) {
+			return ctx.Status(fiber.StatusNotFound).SendString("Passkey not found")
+		}
+		if errors.Is(err, LastPasskeyError{}) {
+			return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		return err
+	}
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
+
+type OidcController struct {
+	oidcService *OidcService
+	// clientUrl is where the browser is sent after the callback, with either a code or an error
+	clientUrl string
+}
+
+func NewOidcController(oidcService *OidcService, clientUrl string) *OidcController {
+	return &OidcController{oidcService, clientUrl}
+}
+
+type OidcLoginRequest struct {
+	Code       string `json:"code"`
+	DeviceName string `json:"deviceName"`
+	Platform   string `json:"platform"`
+}
+
+func (c *OidcController) GetProviders(ctx *fiber.Ctx) error {
+	return ctx.JSON(c.oidcService.GetProviders())
+}
+
+// RedirectURL sends the browser to the provider to log in. The client opens it in the browser instead of fetching it,
+// so that the state cookie is stored where the callback will arrive.
+func (c *OidcController) RedirectURL(ctx *fiber.Ctx) error {
+	redirectUrl, state, err := c.oidcService.BeginLogin(ctx.Params("provider"))
+	if err != nil {
+		if errors.Is(err, UnknownOidcProviderError{}) {
+			return ctx.SendStatus(fiber.StatusNotFound)
+		}
+
+		return err
+	}
+
+	// Without a path the cookie is scoped to /auth/oidc/<provider>, which includes the callback. Lax cookies are
+	// still sent when the provider redirects back.
+	ctx.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Expires:  time.Now().Add(oidcStateExpiry),
+		Secure:   strings.HasPrefix(baseUrl, "https://"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return ctx.Redirect(redirectUrl, fiber.StatusFound)
+}
+
+func (c *OidcController) Callback(ctx *fiber.Ctx) error {
+	query := url.Values{}
+	if providerError := ctx.Query("error"); providerError != "" {
+		query.Set("error", providerError)
+	} else {
+		code, err := c.oidcService.FinishLogin(ctx.Params("provider"), ctx.Query("code"), ctx.Query("state"),
+			ctx.Cookies(oidcStateCookie))
+		switch {
+		case err == nil:
+			query.Set("code", code)
+		case errors.Is(err, InvalidOidcStateError{}):
+			query.Set("error", "invalid_state")
+		case errors.Is(err, OidcEmailNotVerifiedError{}):
+			query.Set("error", "email_not_verified")
+		case errors.Is(err, OidcSignupDisabledError{}):
+			query.Set("error", "signup_disabled")
+		case errors.Is(err, OidcAccountNotConfirmedError{}):
+			query.Set("error", "account_not_confirmed")
+		default:
+			sentry.CaptureException(err)
+			query.Set("error", "login_failed")
+		}
+	}
+
+	ctx.ClearCookie(oidcStateCookie)
+	clientUrl := c.clientUrl + "?" + query.Encode()
+	return ctx.Type("html").SendString(fmt.Sprintf(oidcCallbackHtml, html.EscapeString(clientUrl)))
+}
+
+// Login exchanges the code the client received after the callback for a session
+func (c *OidcController) Login(ctx *fiber.Ctx) error {
+	var request OidcLoginRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	session, err := c.oidcService.CompleteLogin(request.Code, sessionDevice(ctx, request.DeviceName, request.Platform))
+	if err != nil {
+		if errors.Is(err, InvalidOidcStateError{}) {
+			return ctx.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+
+		var mfaRequired MfaRequiredError
+		if errors.As(err, &mfaRequired) {
+			return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"mfaRequired":    true,
+				"challengeToken": mfaRequired.ChallengeToken,
+			})
+		}
+
+		return err
+	}
+
+	return sessionResponse(ctx, session)
+}
+
 type FeedbackController struct {
 	feedbackService *FeedbackService
 }
@@ -47,6 +47,16 @@ func (u UserServStruct) Authenticate(ctx context.Context, req *pb.Authentication
 		return &pb.AuthenticationResponse{Result: &pb.AuthenticationResponse_Error{Error: "Invalid token"}}, nil
 	}
 
+	// Access tokens stay valid until they expire, so the session is checked to reject tokens of revoked sessions
+	active, err := u.sessionService.IsActive(sub, session)
+	if err != nil {
+		return nil, err
+	}
+
+	if !active {
+		return &pb.AuthenticationResponse{Result: &pb.AuthenticationResponse_Error{Error: "Session revoked"}}, nil
+	}
+
 	return &pb.AuthenticationResponse{
 		Result: &pb.AuthenticationResponse_Auth{
 			Auth: &pb.SuccessfulAuthenticationResponse{
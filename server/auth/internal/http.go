@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/getsentry/sentry-go"
 	jwtware "github.com/gofiber/contrib/jwt"
@@ -11,10 +12,11 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/golang-jwt/jwt/v5"
-	"perfice.adoe.dev/util"
 )
 
-func (a *AuthApp) setupHttpServer(secret []byte, authService *AuthService, sessionService *SessionService, feedbackService *FeedbackService) {
+func (a *AuthApp) setupHttpServer(signingKeys *SigningKeyService, authService *AuthService, sessionService *SessionService,
+	mfaService *MfaService, passkeyService *PasskeyService, oidcService *OidcService, feedbackService *FeedbackService,
+	rateLimiter *RateLimiter, templates *Templates) {
 	app := fiber.New(fiber.Config{
 		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
 			log.Println("Error occurred:", err)
@@ -29,31 +31,73 @@ func (a *AuthApp) setupHttpServer(secret []byte, authService *AuthService, sessi
 		}))
 
 	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "https://localhost, http://localhost:8000, http://localhost:5173, https://perfice.adoe.dev",
+		AllowOrigins:     strings.Join(allowedOrigins(), ", "),
 		AllowHeaders:     "content-type, authorization",
 		AllowCredentials: true,
 	}))
 
 	jwtMiddleware := jwtware.New(jwtware.Config{
-		SigningKey: jwtware.SigningKey{Key: secret},
+		KeyFunc: signingKeys.Keyfunc,
 	})
 
-	authController := NewAuthController(authService, sessionService)
+	authMiddleware := newAuthMiddleware(sessionService)
+	authController := NewAuthController(authService, sessionService, rateLimiter, templates)
 
-	app.Post("/register", authController.Register)
-	app.Post("/login", authController.Login)
+	app.Post("/register", rateLimiter.Middleware("register", registerRateLimit, nil), authController.Register)
+	app.Post("/login", rateLimiter.Middleware("login", loginRateLimit, nil), authController.Login)
+	app.Post("/login/mfa", rateLimiter.Middleware("loginMfa", loginRateLimit, nil), authController.LoginMfa)
 	app.Post("/refresh", authController.Refresh)
 	app.Put("/timezone", jwtMiddleware, authMiddleware, authController.SetTimezone)
+	app.Put("/locale", jwtMiddleware, authMiddleware, authController.SetLocale)
 
 	app.Get("/me", jwtMiddleware, authMiddleware, authController.Me)
 	app.Post("/delete", jwtMiddleware, authMiddleware, authController.DeleteAccount)
 	app.Post("/logout", jwtMiddleware, authMiddleware, authController.Logout)
 	app.Get("/confirm/:token", authController.ConfirmEmail)
-	app.Post("/resetInit", authController.InitResetPassword)
-	app.Post("/reset", authController.ResetPassword)
-	app.Post("/resendConfirm", authController.ResendConfirmationEmail)
+	app.Post("/resetInit", rateLimiter.Middleware("resetInit", mailClientRateLimit, &mailRateLimit),
+		authController.InitResetPassword)
+	app.Post("/reset", rateLimiter.Middleware("reset", loginRateLimit, nil), authController.ResetPassword)
+	app.Post("/resendConfirm", rateLimiter.Middleware("resendConfirm", mailClientRateLimit, &mailRateLimit),
+		authController.ResendConfirmationEmail)
 	app.Get("/reset/:token", authController.FillResetPassword)
 
+	sessionController := NewSessionController(sessionService)
+	app.Get("/sessions", jwtMiddleware, authMiddleware, sessionController.GetSessions)
+	app.Delete("/sessions", jwtMiddleware, authMiddleware, sessionController.RevokeOtherSessions)
+	app.Put("/sessions/:id", jwtMiddleware, authMiddleware, sessionController.RenameSession)
+	app.Delete("/sessions/:id", jwtMiddleware, authMiddleware, sessionController.RevokeSession)
+
+	mfaController := NewMfaController(mfaService, rateLimiter)
+	app.Get("/mfa", jwtMiddleware, authMiddleware, mfaController.GetStatus)
+	app.Post("/mfa/totp/enroll", jwtMiddleware, authMiddleware, mfaController.EnrollTOTP)
+	app.Post("/mfa/totp/confirm", jwtMiddleware, authMiddleware, mfaController.ConfirmTOTP)
+	app.Delete("/mfa/totp", jwtMiddleware, authMiddleware, mfaController.DisableTOTP)
+	app.Post("/mfa/recoveryCodes", jwtMiddleware, authMiddleware, mfaController.RegenerateRecoveryCodes)
+
+	if passkeyService != nil {
+		passkeyController := NewPasskeyController(authService, passkeyService)
+		app.Post("/register/passkey/begin", passkeyController.BeginSignup)
+		app.Post("/register/passkey/finish", passkeyController.FinishSignup)
+		app.Post("/login/passkey/begin", passkeyController.BeginLogin)
+		app.Post("/login/passkey/finish", passkeyController.FinishLogin)
+		app.Get("/passkeys", jwtMiddleware, authMiddleware, passkeyController.GetPasskeys)
+		app.Post("/passkeys/register/begin", jwtMiddleware, authMiddleware, passkeyController.BeginRegistration)
+		app.Post("/passkeys/register/finish", jwtMiddleware, authMiddleware, passkeyController.FinishRegistration)
+		app.Delete("/passkeys/:id", jwtMiddleware, authMiddleware, passkeyController.DeletePasskey)
+	}
+
+	oidcController := NewOidcController(oidcService, oidcClientUrl())
+	app.Get("/oidc/providers", oidcController.GetProviders)
+	app.Get("/oidc/:provider/redirect", oidcController.RedirectURL)
+	app.Get("/oidc/:provider/callback", oidcController.Callback)
+	app.Post("/oidc/login", oidcController.Login)
+
+	// Lets other services verify access tokens without asking auth
+	app.Get("/.well-known/jwks.json", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderCacheControl, "public, max-age=300")
+		return ctx.JSON(signingKeys.JWKS())
+	})
+
 	feedbackController := NewFeedbackController(feedbackService)
 	app.Post("/feedback", feedbackController.Feedback)
 
@@ -65,23 +109,65 @@ func (a *AuthApp) setupHttpServer(secret []byte, authService *AuthService, sessi
 	}
 }
 
-func authMiddleware(c *fiber.Ctx) error {
-	user := c.Locals("user")
-	if user == nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+var defaultAllowedOrigins = "https://localhost, http://localhost:8000, http://localhost:5173, https://perfice.adoe.dev"
+
+func splitOrigins(origins string) []string {
+	var split []string
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			split = append(split, origin)
+		}
 	}
 
-	token := user.(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
+	return split
+}
 
-	userId := util.GetFromMapOrNil(claims, "sub")
-	sessionId := util.GetFromMapOrNil(claims, "session")
+// allowedOrigins returns the origins of the clients, CORS_EXTRA_ORIGINS adds to the defaults like in the gateway
+func allowedOrigins() []string {
+	return append(splitOrigins(defaultAllowedOrigins), splitOrigins(os.Getenv("CORS_EXTRA_ORIGINS"))...)
+}
 
-	if userId == nil || sessionId == nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+// oidcClientUrl is the page of the client that finishes logging in with an identity provider
+func oidcClientUrl() string {
+	if clientUrl := os.Getenv("OIDC_CLIENT_URL"); clientUrl != "" {
+		return clientUrl
 	}
 
-	c.Locals(userIdLocal, *userId)
-	c.Locals(sessionIdLocal, *sessionId)
-	return c.Next()
+	return appBaseUrl + "/sso"
+}
+
+// newAuthMiddleware reads the user and session of the verified JWT and rejects tokens of revoked sessions
+func newAuthMiddleware(sessionService *SessionService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user := c.Locals("user")
+		if user == nil {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		token := user.(*jwt.Token)
+		claims := token.Claims.(jwt.MapClaims)
+
+		userId, ok := claims["sub"].(string)
+		if !ok {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		sessionId, ok := claims["session"].(string)
+		if !ok {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		active, err := sessionService.IsActive(userId, sessionId)
+		if err != nil {
+			return err
+		}
+
+		if !active {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		c.Locals(userIdLocal, userId)
+		c.Locals(sessionIdLocal, sessionId)
+		return c.Next()
+	}
 }
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var authIndexes = []mongoutil.IndexSpec{
+	{Collection: "users", Keys: bson.D{{Key: "email", Value: 1}}, Unique: true},
+	// Only users that have added a passkey have a user handle
+	{Collection: "users", Keys: bson.D{{Key: "webAuthnId", Value: 1}}, Unique: true, Sparse: true},
+	{Collection: "sessions", Keys: bson.D{{Key: "user", Value: 1}}},
+	{Collection: "sessions", Keys: bson.D{{Key: "refreshTokenHash", Value: 1}}, Unique: true},
+	// Sessions are removed by MongoDB once they expire
+	{Collection: "sessions", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "refreshTokens", Keys: bson.D{{Key: "session", Value: 1}}},
+	{Collection: "refreshTokens", Keys: bson.D{{Key: "user", Value: 1}}},
+	{Collection: "refreshTokens", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	// Signing keys are removed once no token signed by them can be used anymore
+	{Collection: "signingKeys", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "mfaChallenges", Keys: bson.D{{Key: "user", Value: 1}}},
+	{Collection: "mfaChallenges", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "webauthnChallenges", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "identities", Keys: bson.D{{Key: "provider", Value: 1}, {Key: "subject", Value: 1}}, Unique: true},
+	{Collection: "identities", Keys: bson.D{{Key: "user", Value: 1}}},
+	{Collection: "oidcStates", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "oidcLoginCodes", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "rateLimits", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "accountTokens", Keys: bson.D{{Key: "userId", Value: 1}}},
+	{Collection: "accountTokens", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "mailOutbox", Keys: bson.D{{Key: "nextAttemptAt", Value: 1}}},
+}
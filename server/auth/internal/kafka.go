@@ -2,7 +2,12 @@ package internal
 
 import (
 	"context"
+	"log"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
 )
 import "github.com/segmentio/kafka-go"
 
@@ -10,6 +15,41 @@ type KafkaService struct {
 	conn *kafka.Writer
 }
 
+// readSessionEvents keeps the session cache of this replica in sync with revocations made by every replica
+func (a *AuthApp) readSessionEvents(sessionService *SessionService) {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{os.Getenv("KAFKA_URL")},
+		Topic:   "my-topic",
+		Dialer:  &kafka.Dialer{Timeout: 30 * time.Second},
+	})
+
+	// Older revocations are already reflected in the database
+	if err := r.SetOffset(kafka.LastOffset); err != nil {
+		log.Println("kafka offset error", err)
+	}
+
+	go func() {
+		for {
+			m, err := r.ReadMessage(context.Background())
+			if err != nil {
+				sentry.CaptureException(err)
+				log.Println("kafka read error", err)
+				break
+			}
+
+			switch string(m.Key) {
+			case "sessionRevoked":
+				userId, sessionId, ok := strings.Cut(string(m.Value), ":")
+				if ok {
+					sessionService.OnSessionRevoked(userId, sessionId)
+				}
+			case "userDeleted":
+				sessionService.OnUserRevoked(string(m.Value))
+			}
+		}
+	}()
+}
+
 func (a *AuthApp) setupKafka() {
 	w := &kafka.Writer{
 		Addr:     kafka.TCP(os.Getenv("KAFKA_URL")),
@@ -28,6 +68,10 @@ func (a *KafkaService) NotifyUserDeleted(userId string) error {
 	return a.sendBasicMessage("userDeleted", userId)
 }
 
+func (a *KafkaService) NotifySessionRevoked(userId string, sessionId string) error {
+	return a.sendBasicMessage("sessionRevoked", userId+":"+sessionId)
+}
+
 func (a *KafkaService) sendBasicMessage(topic string, value string) error {
 	return a.conn.WriteMessages(
 		context.Background(),
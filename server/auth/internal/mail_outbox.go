@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/google/uuid"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var mailOutboxPollInterval = 30 * time.Second
+
+// mailSendLease is how long a claimed mail is left alone by other replicas while it is being sent
+var mailSendLease = 2 * time.Minute
+var mailRetryBaseDelay = 30 * time.Second
+var mailRetryMaxDelay = 6 * time.Hour
+var maxMailAttempts = 10
+
+// MailOutbox stores mails before sending them, so that a mail server being down doesn't fail the request that sent
+// the mail. Failed deliveries are retried with an increasing delay. Mails are stored as a template and its encrypted
+// data rather than rendered, so that the account tokens in them aren't readable from the database.
+type MailOutbox struct {
+	collection    *MailOutboxCollection
+	mailer        Mailer
+	templates     *Templates
+	encryptionKey []byte
+	wake          chan struct{}
+}
+
+func NewMailOutbox(collection *MailOutboxCollection, mailer Mailer, templates *Templates, encryptionKey []byte) *MailOutbox {
+	return &MailOutbox{collection, mailer, templates, encryptionKey, make(chan struct{}, 1)}
+}
+
+// Enqueue stores a mail that is rendered from the template when it is sent
+func (o *MailOutbox) Enqueue(to string, locale string, template string, data map[string]any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	encryptedData, err := mongoutil.EncryptBytesWithKey(o.encryptionKey, encoded)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = o.collection.Create(OutboxMail{
+		Id:            uuid.NewString(),
+		To:            to,
+		Locale:        locale,
+		Template:      template,
+		EncryptedData: encryptedData,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sends the mail right away rather than on the next poll
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run sends due mails in the background
+func (o *MailOutbox) Run() {
+	go func() {
+		ticker := time.NewTicker(mailOutboxPollInterval)
+		defer ticker.Stop()
+
+		for {
+			o.sendDue()
+
+			select {
+			case <-ticker.C:
+			case <-o.wake:
+			}
+		}
+	}()
+}
+
+func (o *MailOutbox) sendDue() {
+	for {
+		mail, err := o.collection.Claim(mailSendLease)
+		if err != nil {
+			sentry.CaptureException(err)
+			return
+		}
+
+		if mail == nil {
+			return
+		}
+
+		if err := o.send(*mail); err != nil {
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+// render decrypts the data of the mail and renders its template
+func (o *MailOutbox) render(mail OutboxMail) (Mail, error) {
+	decrypted, err := mongoutil.DecryptBytesWithKey(o.encryptionKey, mail.EncryptedData)
+	if err != nil {
+		return Mail{}, err
+	}
+
+	var data map[string]any
+	if err := json.Unmarshal(decrypted, &data); err != nil {
+		return Mail{}, err
+	}
+
+	rendered, err := o.templates.RenderMail(mail.Locale, mail.Template, data)
+	if err != nil {
+		return Mail{}, err
+	}
+
+	rendered.To = mail.To
+	return rendered, nil
+}
+
+func (o *MailOutbox) send(mail OutboxMail) error {
+	rendered, err := o.render(mail)
+	if err != nil {
+		// Retrying won't help, the mail can't be rendered with this key and these templates
+		log.Printf("Giving up on mail %s, unable to render it: %v", mail.Id, err)
+		if deleteErr := o.collection.Delete(mail.Id); deleteErr != nil {
+			return deleteErr
+		}
+
+		return fmt.Errorf("unable to render mail %s: %w", mail.Id, err)
+	}
+
+	sendErr := o.mailer.Send(rendered)
+	if sendErr == nil {
+		return o.collection.Delete(mail.Id)
+	}
+
+	if mail.Attempts >= maxMailAttempts {
+		log.Printf("Giving up on mail %s after %d attempts: %v", mail.Id, mail.Attempts, sendErr)
+		if err := o.collection.Delete(mail.Id); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("unable to send mail %s: %w", mail.Id, sendErr)
+	}
+
+	log.Printf("Unable to send mail %s, attempt %d: %v", mail.Id, mail.Attempts, sendErr)
+	return o.collection.Reschedule(mail.Id, time.Now().Add(mailRetryDelay(mail.Attempts)), sendErr.Error())
+}
+
+// mailRetryDelay returns how long to wait after the given amount of failed attempts
+func mailRetryDelay(attempts int) time.Duration {
+	delay := mailRetryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= mailRetryMaxDelay {
+			return mailRetryMaxDelay
+		}
+	}
+
+	return delay
+}
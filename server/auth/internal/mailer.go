@@ -0,0 +1,402 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultMailFrom = "noreply@adoe.dev"
+var defaultMailFromName = "Perfice"
+var defaultMailDir = "mails"
+var smtpTimeout = 30 * time.Second
+
+type Mail struct {
+	To      string
+	Subject string
+	Html    string
+	// Text is the plain text alternative of the HTML, for clients that don't show HTML
+	Text string
+}
+
+// Mailer delivers a single mail, the outbox takes care of retrying failed deliveries
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// mailerFromEnv returns the mailer of MAIL_TRANSPORT, or nil if mails are disabled. Without MAIL_TRANSPORT Maileroo is
+// used if MAILEROO_API_KEY is set.
+func mailerFromEnv() (Mailer, error) {
+	from := mail.Address{Name: os.Getenv("MAIL_FROM_NAME"), Address: os.Getenv("MAIL_FROM")}
+	if from.Address == "" {
+		from.Address = defaultMailFrom
+	}
+	if from.Name == "" {
+		from.Name = defaultMailFromName
+	}
+
+	transport := os.Getenv("MAIL_TRANSPORT")
+	if transport == "" && os.Getenv("MAILEROO_API_KEY") != "" {
+		transport = "maileroo"
+	}
+
+	switch transport {
+	case "", "none":
+		return nil, nil
+	case "maileroo":
+		apiKey := os.Getenv("MAILEROO_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("MAILEROO_API_KEY must be set")
+		}
+
+		return NewMailerooMailer(apiKey, from), nil
+	case "smtp":
+		return smtpMailerFromEnv(from)
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = defaultMailDir
+		}
+
+		return NewFileMailer(dir, from), nil
+	case "console":
+		return NewConsoleMailer(from), nil
+	default:
+		return nil, fmt.Errorf("invalid MAIL_TRANSPORT %q", transport)
+	}
+}
+
+type MailerooMailer struct {
+	apiKey string
+	from   mail.Address
+}
+
+func NewMailerooMailer(apiKey string, from mail.Address) *MailerooMailer {
+	return &MailerooMailer{apiKey, from}
+}
+
+func (m *MailerooMailer) Send(mail Mail) error {
+	body := map[string]interface{}{
+		"from": map[string]string{
+			"address":      m.from.Address,
+			"display_name": m.from.Name,
+		},
+		"to": map[string]string{
+			"address": mail.To,
+		},
+		"subject": mail.Subject,
+		"html":    mail.Html,
+		"plain":   mail.Text,
+	}
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", "https://smtp.maileroo.com/api/v2/emails", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", m.apiKey))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		responseBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf("unable to send maileroo mail: %s", string(responseBody))
+	}
+
+	return nil
+}
+
+const (
+	smtpSecurityStartTLS = "starttls"
+	smtpSecurityTLS      = "tls"
+	smtpSecurityNone     = "none"
+)
+
+type SmtpConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Security is starttls, tls for implicit TLS or none, which is only meant for local relays
+	Security string
+}
+
+func smtpMailerFromEnv(from mail.Address) (*SmtpMailer, error) {
+	config := SmtpConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     587,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		Security: os.Getenv("SMTP_SECURITY"),
+	}
+
+	if config.Host == "" {
+		return nil, fmt.Errorf("SMTP_HOST must be set")
+	}
+
+	if config.Security == "" {
+		config.Security = smtpSecurityStartTLS
+	}
+
+	if config.Security != smtpSecurityStartTLS && config.Security != smtpSecurityTLS && config.Security != smtpSecurityNone {
+		return nil, fmt.Errorf("invalid SMTP_SECURITY %q", config.Security)
+	}
+
+	if config.Security == smtpSecurityTLS {
+		config.Port = 465
+	}
+
+	if port := os.Getenv("SMTP_PORT"); port != "" {
+		parsed, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PORT: %w", err)
+		}
+
+		config.Port = parsed
+	}
+
+	return NewSmtpMailer(config, from), nil
+}
+
+type SmtpMailer struct {
+	config SmtpConfig
+	from   mail.Address
+}
+
+func NewSmtpMailer(config SmtpConfig, from mail.Address) *SmtpMailer {
+	return &SmtpMailer{config, from}
+}
+
+func (m *SmtpMailer) dial() (*smtp.Client, error) {
+	address := net.JoinHostPort(m.config.Host, strconv.Itoa(m.config.Port))
+	tlsConfig := &tls.Config{ServerName: m.config.Host}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+	if m.config.Security == smtpSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client, err := smtp.NewClient(conn, m.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Unlike smtp.SendMail, STARTTLS is required rather than used if the server happens to offer it
+	if m.config.Security == smtpSecurityStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func (m *SmtpMailer) Send(mail Mail) error {
+	message, err := buildMailMessage(m.from, mail, time.Now())
+	if err != nil {
+		return err
+	}
+
+	client, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if m.config.Username != "" {
+		// PlainAuth refuses to send the password over an unencrypted connection, other than to localhost
+		if err := client.Auth(smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(m.from.Address); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(mail.To); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// buildMailMessage returns the mail in RFC 5322 format
+func buildMailMessage(from mail.Address, mail Mail, date time.Time) ([]byte, error) {
+	if strings.ContainsAny(mail.To, "\r\n") {
+		return nil, fmt.Errorf("invalid recipient %q", mail.To)
+	}
+
+	messageId := make([]byte, 16)
+	if _, err := rand.Read(messageId); err != nil {
+		return nil, err
+	}
+
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", mail.To},
+		// Encoding the subject also keeps line breaks in it from adding headers
+		{"Subject", mime.QEncoding.Encode("utf-8", mail.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(messageId), domain)},
+		{"MIME-Version", "1.0"},
+	}
+
+	var body bytes.Buffer
+	if mail.Text == "" {
+		headers = append(headers, [2]string{"Content-Type", `text/html; charset="utf-8"`},
+			[2]string{"Content-Transfer-Encoding", "quoted-printable"})
+		if err := writeQuotedPrintable(&body, mail.Html); err != nil {
+			return nil, err
+		}
+	} else {
+		parts := multipart.NewWriter(&body)
+		headers = append(headers, [2]string{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()})
+		// Clients show the last alternative they support, so HTML goes last
+		for _, part := range [][2]string{{"text/plain", mail.Text}, {"text/html", mail.Html}} {
+			writer, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part[0] + `; charset="utf-8"`},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			if err := writeQuotedPrintable(writer, part[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := parts.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	var message bytes.Buffer
+	for _, header := range headers {
+		message.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// writeQuotedPrintable encodes the content so that no line is too long for SMTP, line breaks become CRLF
+func writeQuotedPrintable(w io.Writer, content string) error {
+	writer := quotedprintable.NewWriter(w)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// FileMailer writes every mail to a file in a directory, for developing without a mail server
+type FileMailer struct {
+	dir  string
+	from mail.Address
+}
+
+func NewFileMailer(dir string, from mail.Address) *FileMailer {
+	return &FileMailer{dir, from}
+}
+
+func (m *FileMailer) Send(mail Mail) error {
+	now := time.Now()
+	message, err := buildMailMessage(m.from, mail, now)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000Z"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.dir, name), message, 0o600)
+}
+
+// ConsoleMailer logs mails instead of sending them
+type ConsoleMailer struct {
+	from mail.Address
+}
+
+func NewConsoleMailer(from mail.Address) *ConsoleMailer {
+	return &ConsoleMailer{from}
+}
+
+func (m *ConsoleMailer) Send(mail Mail) error {
+	message, err := buildMailMessage(m.from, mail, time.Now())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Mail to %s:\n%s", mail.To, message)
+	return nil
+}
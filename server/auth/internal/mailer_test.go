@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+var testMailFrom = mail.Address{Name: "Perfice", Address: "noreply@example.com"}
+
+func TestBuildMailMessage(t *testing.T) {
+	message, err := buildMailMessage(testMailFrom, Mail{
+		To:      "user@example.com",
+		Subject: "Reset\r\nBcc: other@example.com",
+		Html:    "<p>Hello</p>\n<p>World</p>",
+	}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	assert.NoError(t, err)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(message)))
+	assert.NoError(t, err)
+	assert.Equal(t, `"Perfice" <noreply@example.com>`, parsed.Header.Get("From"))
+	assert.Equal(t, "user@example.com", parsed.Header.Get("To"))
+	assert.Empty(t, parsed.Header.Get("Bcc"))
+	assert.Equal(t, "Tue, 02 Jan 2024 03:04:05 +0000", parsed.Header.Get("Date"))
+	assert.True(t, strings.HasSuffix(parsed.Header.Get("Message-ID"), "@example.com>"))
+	assert.Contains(t, string(message), "<p>Hello</p>\r\n<p>World</p>")
+
+	_, err = buildMailMessage(testMailFrom, Mail{To: "user@example.com\r\nBcc: other@example.com"}, time.Now())
+	assert.Error(t, err)
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mails")
+	mailer := NewFileMailer(dir, testMailFrom)
+	assert.NoError(t, mailer.Send(Mail{To: "user@example.com", Subject: "Confirm your email", Html: "<p>Hello</p>"}))
+
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	content, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "To: user@example.com\r\n")
+	assert.Contains(t, string(content), "<p>Hello</p>")
+}
+
+// fakeSmtpServer accepts a single mail and records the commands it receives
+func fakeSmtpServer(t *testing.T) (int, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	commands := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var received []string
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				commands <- received
+				return
+			}
+
+			line = strings.TrimRight(line, "\r\n")
+			received = append(received, line)
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case strings.HasPrefix(line, "AUTH"):
+				reply("235 Authenticated")
+			case line == "DATA":
+				reply("354 Go ahead")
+				for {
+					dataLine, err := reader.ReadString('\n')
+					if err != nil || dataLine == ".\r\n" {
+						break
+					}
+				}
+				reply("250 Queued")
+			case line == "QUIT":
+				reply("221 Bye")
+				commands <- received
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, commands
+}
+
+func TestSmtpMailer(t *testing.T) {
+	port, commands := fakeSmtpServer(t)
+	mailer := NewSmtpMailer(SmtpConfig{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "user",
+		Password: "password",
+		Security: smtpSecurityNone,
+	}, testMailFrom)
+
+	assert.NoError(t, mailer.Send(Mail{To: "user@example.com", Subject: "Confirm your email", Html: "<p>Hello</p>"}))
+	received := <-commands
+	assert.Contains(t, received, "MAIL FROM:<noreply@example.com>")
+	assert.Contains(t, received, "RCPT TO:<user@example.com>")
+	assert.Contains(t, received, "DATA")
+	assert.True(t, strings.HasPrefix(received[1], "AUTH PLAIN"))
+}
+
+func TestSmtpMailer_RequiresStartTLS(t *testing.T) {
+	port, _ := fakeSmtpServer(t)
+	mailer := NewSmtpMailer(SmtpConfig{Host: "127.0.0.1", Port: port, Security: smtpSecurityStartTLS}, testMailFrom)
+
+	// The server doesn't offer STARTTLS, so the mail must not be sent in plain text
+	assert.Error(t, mailer.Send(Mail{To: "user@example.com", Subject: "Confirm your email", Html: "<p>Hello</p>"}))
+}
+
+func TestMailRetryDelay(t *testing.T) {
+	assert.Equal(t, 30*time.Second, mailRetryDelay(1))
+	assert.Equal(t, time.Minute, mailRetryDelay(2))
+	assert.Equal(t, 4*time.Minute, mailRetryDelay(4))
+	assert.Equal(t, mailRetryMaxDelay, mailRetryDelay(20))
+}
+
+// recordingMailer records the mails it sends, or fails with err if it is set
+type recordingMailer struct {
+	sent []Mail
+	err  error
+}
+
+func (m *recordingMailer) Send(mail Mail) error {
+	if m.err != nil {
+		return m.err
+	}
+
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+func TestMailOutbox(t *testing.T) {
+	templates, err := NewTemplates(nil)
+	require.NoError(t, err)
+	url := "https://backend.example.com/auth/reset/secret-token"
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("stores the template data encrypted and renders it when sending", func(mt *mtest.T) {
+		mailer := &recordingMailer{}
+		outbox := NewMailOutbox(NewMailOutboxCollection(mt.Coll), mailer, templates, testEncryptionKey)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		require.NoError(mt, outbox.Enqueue("user@example.com", "sv", "reset_password", map[string]any{"Url": url}))
+
+		inserted := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		assert.NotContains(mt, inserted.String(), "secret-token")
+		_, err := inserted.LookupErr("html")
+		assert.Error(mt, err, "the rendered mail isn't stored")
+
+		var queued OutboxMail
+		require.NoError(mt, bson.Unmarshal(inserted, &queued))
+		assert.Equal(mt, "reset_password", queued.Template)
+
+		mt.ClearEvents()
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		require.NoError(mt, outbox.send(queued))
+		require.Len(mt, mailer.sent, 1)
+		assert.Equal(mt, "user@example.com", mailer.sent[0].To)
+		assert.Contains(mt, mailer.sent[0].Text, url)
+		assert.Equal(mt, []string{"delete"}, commands(mt))
+	})
+
+	mt.Run("deletes mails it gives up on", func(mt *mtest.T) {
+		mailer := &recordingMailer{err: errors.New("connection refused")}
+		outbox := NewMailOutbox(NewMailOutboxCollection(mt.Coll), mailer, templates, testEncryptionKey)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		require.NoError(mt, outbox.Enqueue("user@example.com", "en", "confirm_email", map[string]any{"Url": url}))
+
+		var queued OutboxMail
+		inserted := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		require.NoError(mt, bson.Unmarshal(inserted, &queued))
+
+		// Earlier attempts are rescheduled
+		mt.ClearEvents()
+		queued.Attempts = 1
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		require.NoError(mt, outbox.send(queued))
+		assert.Equal(mt, []string{"update"}, commands(mt))
+
+		mt.ClearEvents()
+		queued.Attempts = maxMailAttempts
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		assert.ErrorContains(mt, outbox.send(queued), "connection refused")
+		assert.Equal(mt, []string{"delete"}, commands(mt))
+	})
+
+	mt.Run("deletes mails that can't be decrypted", func(mt *mtest.T) {
+		mailer := &recordingMailer{}
+		outbox := NewMailOutbox(NewMailOutboxCollection(mt.Coll), mailer, templates, testEncryptionKey)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		err := outbox.send(OutboxMail{Id: "mail", To: "user@example.com", Locale: "en", Template: "confirm_email",
+			EncryptedData: []byte("not encrypted")})
+		assert.ErrorContains(mt, err, "unable to render mail mail")
+		assert.Empty(mt, mailer.sent)
+		assert.Equal(mt, []string{"delete"}, commands(mt))
+	})
+}
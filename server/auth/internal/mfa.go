@@ -0,0 +1,437 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"perfice.adoe.dev/mongoutil"
+	"perfice.adoe.dev/util"
+)
+
+var totpPeriod = 30 * time.Second
+
+// totpSkew is how many time steps before and after the current one are accepted, to allow for clock drift
+var totpSkew = 1
+var recoveryCodeCount = 10
+var recoveryCodeLength = 10
+var mfaChallengeExpiry = 5 * time.Minute
+var mfaChallengeMaxAttempts = 5
+var mfaChallengeTokenLength = 32
+
+type MfaRequiredError struct {
+	ChallengeToken string
+}
+
+func (e MfaRequiredError) Error() string {
+	return "second factor required"
+}
+
+type InvalidMfaCodeError struct{}
+
+func (e InvalidMfaCodeError) Error() string {
+	return "invalid code"
+}
+
+type InvalidMfaChallengeError struct{}
+
+func (e InvalidMfaChallengeError) Error() string {
+	return "invalid or expired challenge"
+}
+
+type MfaAlreadyEnabledError struct{}
+
+func (e MfaAlreadyEnabledError) Error() string {
+	return "two-factor authentication is already enabled"
+}
+
+type MfaNotEnabledError struct{}
+
+func (e MfaNotEnabledError) Error() string {
+	return "two-factor authentication is not enabled"
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// provisioning URI shown as a QR code
+	URI string `json:"uri"`
+}
+
+type MfaStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// MfaService handles TOTP enrollment and the second step of logging in
+type MfaService struct {
+	userCollection         *UserCollection
+	mfaChallengeCollection *MfaChallengeCollection
+	encryptionKey          []byte
+	issuer                 string
+}
+
+func NewMfaService(userCollection *UserCollection, mfaChallengeCollection *MfaChallengeCollection,
+	encryptionKey []byte) *MfaService {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "Perfice"
+	}
+
+	return &MfaService{userCollection, mfaChallengeCollection, encryptionKey, issuer}
+}
+
+// matchCode decrypts the secret of the user and returns the time step the code belongs to
+func (s *MfaService) matchCode(userTOTP UserTOTP, code string) (int64, bool, error) {
+	secret, err := mongoutil.DecryptBytesWithKey(s.encryptionKey, userTOTP.EncryptedSecret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	step, ok := matchTOTPStep(string(secret), code, time.Now())
+	return step, ok, nil
+}
+
+func (s *MfaService) getUser(userId string) (*User, error) {
+	user, err := s.userCollection.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+
+	return user, nil
+}
+
+func (s *MfaService) GetStatus(userId string) (MfaStatus, error) {
+	user, err := s.getUser(userId)
+	if err != nil {
+		return MfaStatus{}, err
+	}
+
+	if !user.MfaEnabled() {
+		return MfaStatus{}, nil
+	}
+
+	return MfaStatus{Enabled: true, RecoveryCodesLeft: len(user.TOTP.RecoveryCodes)}, nil
+}
+
+// Enroll creates a new secret, which is only used once it has been confirmed. Enrolling again replaces an unconfirmed
+// secret.
+func (s *MfaService) Enroll(userId string) (TOTPEnrollment, error) {
+	user, err := s.getUser(userId)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	if user.MfaEnabled() {
+		return TOTPEnrollment{}, MfaAlreadyEnabledError{}
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      s.issuer,
+		AccountName: user.Email,
+		Period:      uint(totpPeriod.Seconds()),
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	encryptedSecret, err := mongoutil.EncryptBytesWithKey(s.encryptionKey, []byte(key.Secret()))
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	if err := s.userCollection.SetTOTP(userId, UserTOTP{EncryptedSecret: encryptedSecret}); err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	return TOTPEnrollment{Secret: key.Secret(), URI: key.URL()}, nil
+}
+
+// Confirm enables two-factor authentication and returns the recovery codes, which are only shown this once
+func (s *MfaService) Confirm(userId string, code string) ([]string, error) {
+	user, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.TOTP == nil {
+		return nil, MfaNotEnabledError{}
+	}
+
+	if user.TOTP.Enabled {
+		return nil, MfaAlreadyEnabledError{}
+	}
+
+	step, ok, err := s.matchCode(*user.TOTP, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, InvalidMfaCodeError{}
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.userCollection.SetTOTP(userId, UserTOTP{
+		EncryptedSecret: user.TOTP.EncryptedSecret,
+		Enabled:         true,
+		RecoveryCodes:   hashes,
+		LastUsedStep:    step,
+		EnabledAt:       time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Disable turns off two-factor authentication, which requires a code or a recovery code
+func (s *MfaService) Disable(userId string, code string) error {
+	user, err := s.getUser(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Verify(*user, code); err != nil {
+		return err
+	}
+
+	return s.userCollection.RemoveTOTP(userId)
+}
+
+// RegenerateRecoveryCodes replaces every recovery code, which requires a code from the authenticator
+func (s *MfaService) RegenerateRecoveryCodes(userId string, code string) ([]string, error) {
+	user, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.MfaEnabled() {
+		return nil, MfaNotEnabledError{}
+	}
+
+	if err := s.verifyTOTP(*user, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.userCollection.SetRecoveryCodes(userId, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Verify checks a code from the authenticator or a recovery code, both can only be used once
+func (s *MfaService) Verify(user User, code string) error {
+	if !user.MfaEnabled() {
+		return MfaNotEnabledError{}
+	}
+
+	if isTOTPCode(code) {
+		return s.verifyTOTP(user, code)
+	}
+
+	used, err := s.userCollection.UseRecoveryCode(user.Id, hashSecret(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+
+	if !used {
+		return InvalidMfaCodeError{}
+	}
+
+	return nil
+}
+
+func (s *MfaService) verifyTOTP(user User, code string) error {
+	step, ok, err := s.matchCode(*user.TOTP, code)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return InvalidMfaCodeError{}
+	}
+
+	used, err := s.userCollection.UseTOTPStep(user.Id, step)
+	if err != nil {
+		return err
+	}
+
+	// The code was already used, e.g. by someone watching the user log in
+	if !used {
+		return InvalidMfaCodeError{}
+	}
+
+	return nil
+}
+
+// CreateChallenge returns the token that has to be sent together with the second factor to finish logging in
+func (s *MfaService) CreateChallenge(userId string) (string, error) {
+	token, err := util.GenerateAlphanumericString(mfaChallengeTokenLength)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.mfaChallengeCollection.Create(MfaChallenge{
+		Hash:      hashSecret(token),
+		User:      userId,
+		ExpiresAt: time.Now().Add(mfaChallengeExpiry),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// CompleteChallenge verifies the second factor for a login challenge and returns the user. The challenge is removed
+// once it succeeds or has been attempted too often.
+func (s *MfaService) CompleteChallenge(token string, code string) (User, error) {
+	hash := hashSecret(token)
+	challenge, err := s.mfaChallengeCollection.Get(hash)
+	if err != nil {
+		return User{}, err
+	}
+
+	if challenge == nil {
+		return User{}, InvalidMfaChallengeError{}
+	}
+
+	user, err := s.getUser(challenge.User)
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := s.Verify(*user, code); err != nil {
+		if !errors.Is(err, InvalidMfaCodeError{}) {
+			return User{}, err
+		}
+
+		attempts, attemptErr := s.mfaChallengeCollection.AddAttempt(hash)
+		if attemptErr != nil {
+			return User{}, attemptErr
+		}
+
+		if attempts >= mfaChallengeMaxAttempts {
+			if _, err := s.mfaChallengeCollection.Take(hash); err != nil {
+				return User{}, err
+			}
+		}
+
+		return User{}, err
+	}
+
+	taken, err := s.mfaChallengeCollection.Take(hash)
+	if err != nil {
+		return User{}, err
+	}
+
+	if !taken {
+		return User{}, InvalidMfaChallengeError{}
+	}
+
+	return *user, nil
+}
+
+func (s *MfaService) OnUserDeleted(userId string) error {
+	return s.mfaChallengeCollection.DeleteByUser(userId)
+}
+
+func isTOTPCode(code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) != int(otp.DigitsSix) {
+		return false
+	}
+
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchTOTPStep returns the time step the code belongs to, accepting steps within the skew of the current one
+func matchTOTPStep(secret string, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if !isTOTPCode(code) {
+		return 0, false
+	}
+
+	step := now.Unix() / int64(totpPeriod.Seconds())
+	for offset := -totpSkew; offset <= totpSkew; offset++ {
+		candidate := step + int64(offset)
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(candidate*int64(totpPeriod.Seconds()), 0), totp.ValidateOpts{
+			Period:    uint(totpPeriod.Seconds()),
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return candidate, true
+		}
+	}
+
+	return 0, false
+}
+
+// normalizeRecoveryCode ignores case and the separators users tend to type
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+
+		return r
+	}, code)
+}
+
+// generateRecoveryCodes returns the codes formatted for the user and their hashes for storage
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		code, err := util.GenerateAlphanumericString(recoveryCodeLength)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code = strings.ToLower(code)
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+		hashes = append(hashes, hashSecret(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashSecret hashes random secrets such as recovery codes and challenge tokens, which are too long to brute force
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+func TestMatchTOTPStep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / 30
+
+	code, err := totp.GenerateCode(testTOTPSecret, now)
+	assert.NoError(t, err)
+	matched, ok := matchTOTPStep(testTOTPSecret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, step, matched)
+
+	// Codes of the previous step are accepted to allow for clock drift
+	previous, err := totp.GenerateCode(testTOTPSecret, now.Add(-30*time.Second))
+	assert.NoError(t, err)
+	matched, ok = matchTOTPStep(testTOTPSecret, previous, now)
+	assert.True(t, ok)
+	assert.Equal(t, step-1, matched)
+
+	old, err := totp.GenerateCode(testTOTPSecret, now.Add(-2*time.Minute))
+	assert.NoError(t, err)
+	_, ok = matchTOTPStep(testTOTPSecret, old, now)
+	assert.False(t, ok)
+
+	_, ok = matchTOTPStep(testTOTPSecret, "12345", now)
+	assert.False(t, ok)
+	_, ok = matchTOTPStep(testTOTPSecret, "abcdef", now)
+	assert.False(t, ok)
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	assert.NoError(t, err)
+	assert.Len(t, codes, recoveryCodeCount)
+	assert.Len(t, hashes, recoveryCodeCount)
+
+	for i, code := range codes {
+		assert.Len(t, code, recoveryCodeLength+1)
+		assert.Equal(t, "-", code[recoveryCodeLength/2:recoveryCodeLength/2+1])
+		assert.False(t, isTOTPCode(code))
+		// The code is accepted however the user types it
+		assert.Equal(t, hashes[i], hashSecret(normalizeRecoveryCode(strings.ToUpper(code))))
+		assert.Equal(t, hashes[i], hashSecret(normalizeRecoveryCode(strings.ReplaceAll(code, "-", " "))))
+	}
+}
+
+func TestMfaService_EncryptsSecret(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("stores the secret encrypted", func(mt *mtest.T) {
+		service := NewMfaService(NewUserCollection(mt.Coll), nil, testEncryptionKey)
+		mt.AddMockResponses(userResponse(mt.T, User{Id: "user", Email: "user@example.com"}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		enrollment, err := service.Enroll("user")
+		require.NoError(mt, err)
+
+		update := mt.GetAllStartedEvents()[1].Command.Lookup("updates").Array().Index(0).Value().Document()
+		stored := update.Lookup("u", "$set", "totp").Document()
+		_, err = stored.LookupErr("secret")
+		assert.Error(mt, err, "the plaintext secret isn't stored")
+		_, encryptedSecret := stored.Lookup("encryptedSecret").Binary()
+		secret, err := mongoutil.DecryptBytesWithKey(testEncryptionKey, encryptedSecret)
+		require.NoError(mt, err)
+		assert.Equal(mt, enrollment.Secret, string(secret))
+	})
+
+	mt.Run("verifies codes with the decrypted secret", func(mt *mtest.T) {
+		service := NewMfaService(NewUserCollection(mt.Coll), nil, testEncryptionKey)
+		encryptedSecret, err := mongoutil.EncryptBytesWithKey(testEncryptionKey, []byte(testTOTPSecret))
+		require.NoError(mt, err)
+		user := User{Id: "user", TOTP: &UserTOTP{EncryptedSecret: encryptedSecret, Enabled: true}}
+
+		code, err := totp.GenerateCode(testTOTPSecret, time.Now())
+		require.NoError(mt, err)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		assert.NoError(mt, service.Verify(user, code))
+		assert.ErrorIs(mt, service.Verify(user, "000000"), InvalidMfaCodeError{})
+
+		// A secret encrypted with another key can't be used
+		user.TOTP.EncryptedSecret = []byte("not encrypted")
+		assert.Error(mt, service.Verify(user, code))
+	})
+}
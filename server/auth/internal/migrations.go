@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var authMigrations = []mongoutil.Migration{
+	{
+		Version:     1,
+		Description: "set the expiry of sessions created before sessions expired",
+		Up: func(db *mongo.Database) error {
+			// The expiry starts now rather than at the last refresh, so that the TTL index doesn't log out every
+			// session that has been idle for a while
+			_, err := db.Collection("sessions").UpdateMany(context.Background(),
+				bson.M{"expiresAt": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"expiresAt": time.Now().Add(sessionMaxLifetime)}})
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "hash the refresh tokens of existing sessions and give them an absolute expiry",
+		Up:          hashSessionRefreshTokens,
+	},
+	{
+		Version:     3,
+		Description: "delete account tokens that use object ids, which are partly predictable",
+		Up: func(db *mongo.Database) error {
+			// Users can request a new confirmation or password reset mail
+			_, err := db.Collection("accountTokens").DeleteMany(context.Background(),
+				bson.M{"_id": bson.M{"$type": "objectId"}})
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "encrypt the private keys of signing keys",
+		Up:          encryptSigningKeys,
+	},
+	{
+		Version:     5,
+		Description: "delete queued mails that were stored rendered, with account tokens in plaintext",
+		Up: func(db *mongo.Database) error {
+			// Users can request a new confirmation or password reset mail
+			_, err := db.Collection("mailOutbox").DeleteMany(context.Background(),
+				bson.M{"encryptedData": bson.M{"$exists": false}})
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "encrypt the TOTP secrets of users",
+		Up:          encryptTOTPSecrets,
+	},
+}
+
+func encryptTOTPSecrets(db *mongo.Database) error {
+	encryptionKey := []byte(os.Getenv("ENCRYPTION_KEY"))
+	users := db.Collection("users")
+	cursor, err := users.Find(context.Background(), bson.M{"totp.secret": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var user struct {
+			Id   string `bson:"_id"`
+			TOTP struct {
+				Secret string `bson:"secret"`
+			} `bson:"totp"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+
+		encryptedSecret, err := mongoutil.EncryptBytesWithKey(encryptionKey, []byte(user.TOTP.Secret))
+		if err != nil {
+			return err
+		}
+
+		_, err = users.UpdateOne(context.Background(), bson.M{"_id": user.Id}, bson.M{
+			"$set":   bson.M{"totp.encryptedSecret": encryptedSecret},
+			"$unset": bson.M{"totp.secret": ""},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func encryptSigningKeys(db *mongo.Database) error {
+	encryptionKey := []byte(os.Getenv("ENCRYPTION_KEY"))
+	signingKeys := db.Collection("signingKeys")
+	cursor, err := signingKeys.Find(context.Background(), bson.M{"privateKey": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var key struct {
+			Id         string `bson:"_id"`
+			PrivateKey []byte `bson:"privateKey"`
+		}
+		if err := cursor.Decode(&key); err != nil {
+			return err
+		}
+
+		encryptedSeed, err := mongoutil.EncryptBytesWithKey(encryptionKey, key.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = signingKeys.UpdateOne(context.Background(), bson.M{"_id": key.Id}, bson.M{
+			"$set":   bson.M{"encryptedSeed": encryptedSeed},
+			"$unset": bson.M{"privateKey": ""},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func hashSessionRefreshTokens(db *mongo.Database) error {
+	sessions := db.Collection("sessions")
+	cursor, err := sessions.Find(context.Background(), bson.M{"refreshToken": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	now := time.Now()
+	for cursor.Next(context.Background()) {
+		var session struct {
+			Id           string `bson:"_id"`
+			RefreshToken string `bson:"refreshToken"`
+			LastRefresh  int64  `bson:"lastRefresh"`
+		}
+		if err := cursor.Decode(&session); err != nil {
+			return err
+		}
+
+		// The creation time of existing sessions is unknown, their absolute lifetime starts now
+		_, err := sessions.UpdateOne(context.Background(), bson.M{"_id": session.Id}, bson.M{
+			"$set": bson.M{
+				"refreshTokenHash":  hashRefreshToken(session.RefreshToken),
+				"createdAt":         time.UnixMilli(session.LastRefresh),
+				"absoluteExpiresAt": now.Add(sessionMaxLifetime),
+			},
+			"$unset": bson.M{"accessToken": "", "refreshToken": ""},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	// Replaced by the index on refreshTokenHash
+	_, err = sessions.Indexes().DropOne(context.Background(), "accessToken_1_refreshToken_1")
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && (commandErr.Name == "IndexNotFound" || commandErr.Name == "NamespaceNotFound") {
+		return nil
+	}
+
+	return err
+}
@@ -1,9 +1,48 @@
 package internal
 
+import (
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
 type User struct {
-	Id        string `bson:"_id"`
-	Email     string `bson:"email"`
+	Id    string `bson:"_id"`
+	Email string `bson:"email"`
+	// Password is empty for accounts that only use passkeys
 	Password  string `bson:"password"`
 	Confirmed bool   `bson:"confirmed"`
 	Timezone  string `bson:"timezone"`
+	// Locale is the language of mails, the default locale is used if it is empty
+	Locale string `bson:"locale,omitempty"`
+	// TOTP is set once the user starts enrolling in two-factor authentication
+	TOTP *UserTOTP `bson:"totp,omitempty"`
+	// WebAuthnId is the random user handle passkeys are registered for, set when the first passkey is added
+	WebAuthnId []byte        `bson:"webAuthnId,omitempty"`
+	Passkeys   []UserPasskey `bson:"passkeys,omitempty"`
+}
+
+type UserPasskey struct {
+	// Id is the credential id chosen by the authenticator
+	Id         []byte              `bson:"id"`
+	Name       string              `bson:"name"`
+	Credential webauthn.Credential `bson:"credential"`
+	CreatedAt  time.Time           `bson:"createdAt"`
+	LastUsedAt time.Time           `bson:"lastUsedAt"`
+}
+
+type UserTOTP struct {
+	// EncryptedSecret is the base32 encoded shared secret, encrypted with ENCRYPTION_KEY
+	EncryptedSecret []byte `bson:"encryptedSecret"`
+	// Enabled is false until the user has confirmed enrollment with a valid code
+	Enabled bool `bson:"enabled"`
+	// RecoveryCodes are hashed, each one can be used once instead of a code
+	RecoveryCodes []string `bson:"recoveryCodes"`
+	// LastUsedStep is the time step of the last accepted code, so that a code can't be used twice
+	LastUsedStep int64     `bson:"lastUsedStep"`
+	EnabledAt    time.Time `bson:"enabledAt"`
+}
+
+func (u User) MfaEnabled() bool {
+	return u.TOTP != nil && u.TOTP.Enabled
 }
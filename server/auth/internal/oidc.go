@@ -0,0 +1,432 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+	"perfice.adoe.dev/util"
+)
+
+var oidcStateExpiry = 10 * time.Minute
+var oidcLoginCodeExpiry = time.Minute
+var oidcStateLength = 32
+var oidcDefaultScopes = []string{oidc.ScopeOpenID, "email", "profile"}
+
+// oidcStateCookie holds the state of the login attempt in the browser that started it, so that a callback URL can't
+// be used to log someone else's browser into an account
+var oidcStateCookie = "oidc_state"
+
+type UnknownOidcProviderError struct{}
+
+func (e UnknownOidcProviderError) Error() string {
+	return "unknown identity provider"
+}
+
+type InvalidOidcStateError struct{}
+
+func (e InvalidOidcStateError) Error() string {
+	return "invalid or expired login attempt"
+}
+
+type OidcEmailNotVerifiedError struct{}
+
+func (e OidcEmailNotVerifiedError) Error() string {
+	return "the identity provider has not verified the email address"
+}
+
+type OidcSignupDisabledError struct{}
+
+func (e OidcSignupDisabledError) Error() string {
+	return "no account is linked to this identity"
+}
+
+// OidcAccountNotConfirmedError is returned if the account with the email of the identity hasn't been confirmed.
+// Whoever registered it may not own the email, so linking it could let them log in to the account of the provider's user.
+type OidcAccountNotConfirmedError struct{}
+
+func (e OidcAccountNotConfirmedError) Error() string {
+	return "the account with this email address has not been confirmed"
+}
+
+type OidcProviderConfig struct {
+	// Id is used in the callback URL and to link identities, so it shouldn't change once users have logged in
+	Id           string
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	// AllowSignup creates accounts for identities that aren't linked to one yet, off unless ALLOW_SIGNUP is true
+	AllowSignup bool
+}
+
+// oidcProvidersFromEnv reads the providers listed in OIDC_PROVIDERS, each configured by OIDC_<ID>_* variables
+func oidcProvidersFromEnv() ([]OidcProviderConfig, error) {
+	var configs []OidcProviderConfig
+	for _, id := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(id) + "_"
+		config := OidcProviderConfig{
+			Id:           id,
+			Name:         os.Getenv(prefix + "NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientId:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+			AllowSignup:  os.Getenv(prefix+"ALLOW_SIGNUP") == "true",
+		}
+
+		if config.Issuer == "" || config.ClientId == "" {
+			return nil, fmt.Errorf("%sISSUER and %sCLIENT_ID must be set", prefix, prefix)
+		}
+
+		if config.Name == "" {
+			config.Name = id
+		}
+
+		if len(config.Scopes) == 0 {
+			config.Scopes = oidcDefaultScopes
+		}
+
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// OidcIdentity is the identity of a user at a provider, as stated by a verified ID token
+type OidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// OidcProvider runs the authorization code flow against a single provider. The provider is discovered on first use,
+// so the auth service can start while the provider is unreachable.
+type OidcProvider struct {
+	config      OidcProviderConfig
+	redirectUrl string
+
+	mutex    sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func NewOidcProvider(config OidcProviderConfig, redirectUrl string) *OidcProvider {
+	return &OidcProvider{config: config, redirectUrl: redirectUrl}
+}
+
+func (p *OidcProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to discover %s: %w", p.config.Id, err)
+	}
+
+	p.oauth = &oauth2.Config{
+		ClientID:     p.config.ClientId,
+		ClientSecret: p.config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  p.redirectUrl,
+		Scopes:       p.config.Scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientId})
+	return p.oauth, p.verifier, nil
+}
+
+// AuthCodeURL returns the URL the user logs in at, the verifier is the PKCE code verifier of the attempt
+func (p *OidcProvider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange redeems the authorization code and verifies the ID token it returns
+func (p *OidcProvider) Exchange(ctx context.Context, code string, verifier string, nonce string) (OidcIdentity, error) {
+	config, idTokenVerifier, err := p.discover(ctx)
+	if err != nil {
+		return OidcIdentity{}, err
+	}
+
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return OidcIdentity{}, err
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return OidcIdentity{}, errors.New("token response has no id_token")
+	}
+
+	idToken, err := idTokenVerifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return OidcIdentity{}, err
+	}
+
+	if idToken.Nonce != nonce {
+		return OidcIdentity{}, errors.New("id_token nonce doesn't match")
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return OidcIdentity{}, err
+	}
+
+	return OidcIdentity{
+		Subject:       idToken.Subject,
+		Email:         sanitizeEmail(claims.Email),
+		EmailVerified: claims.EmailVerified,
+	}, nil
+}
+
+type OidcProviderInfo struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// OidcService logs users in with external identity providers. After the callback the client receives a short-lived
+// login code, which it exchanges for a regular session.
+type OidcService struct {
+	providers           map[string]*OidcProvider
+	providerInfo        []OidcProviderInfo
+	stateCollection     *OidcStateCollection
+	loginCodeCollection *OidcLoginCodeCollection
+	identityCollection  *IdentityCollection
+	userCollection      *UserCollection
+	sessionService      *SessionService
+	mfaService          *MfaService
+	// mailService is nil if emails aren't confirmed
+	mailService *MailService
+}
+
+func NewOidcService(configs []OidcProviderConfig, callbackBaseUrl string, stateCollection *OidcStateCollection,
+	loginCodeCollection *OidcLoginCodeCollection, identityCollection *IdentityCollection, userCollection *UserCollection,
+	sessionService *SessionService, mfaService *MfaService, mailService *MailService) *OidcService {
+	providers := map[string]*OidcProvider{}
+	providerInfo := make([]OidcProviderInfo, 0, len(configs))
+	for _, config := range configs {
+		providers[config.Id] = NewOidcProvider(config, fmt.Sprintf("%s/auth/oidc/%s/callback", callbackBaseUrl, config.Id))
+		providerInfo = append(providerInfo, OidcProviderInfo{config.Id, config.Name})
+	}
+
+	return &OidcService{providers, providerInfo, stateCollection, loginCodeCollection, identityCollection,
+		userCollection, sessionService, mfaService, mailService}
+}
+
+func (s *OidcService) GetProviders() []OidcProviderInfo {
+	return s.providerInfo
+}
+
+// BeginLogin returns the URL of the provider to send the user to and the state, which the browser has to present on
+// the callback
+func (s *OidcService) BeginLogin(providerId string) (string, string, error) {
+	provider, ok := s.providers[providerId]
+	if !ok {
+		return "", "", UnknownOidcProviderError{}
+	}
+
+	state, err := util.GenerateAlphanumericString(oidcStateLength)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce, err := util.GenerateAlphanumericString(oidcStateLength)
+	if err != nil {
+		return "", "", err
+	}
+
+	verifier := oauth2.GenerateVerifier()
+	url, err := provider.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = s.stateCollection.Create(OidcState{
+		Hash:      hashSecret(state),
+		Provider:  providerId,
+		Verifier:  verifier,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(oidcStateExpiry),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return url, state, nil
+}
+
+// FinishLogin handles the callback of the provider and returns a login code for the client. The browserState is the
+// state stored in the browser by BeginLogin, it must match the state of the callback.
+func (s *OidcService) FinishLogin(providerId string, code string, state string, browserState string) (string, error) {
+	provider, ok := s.providers[providerId]
+	if !ok {
+		return "", UnknownOidcProviderError{}
+	}
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(browserState)) != 1 {
+		return "", InvalidOidcStateError{}
+	}
+
+	found, err := s.stateCollection.Take(hashSecret(state), providerId)
+	if err != nil {
+		return "", err
+	}
+
+	if found == nil {
+		return "", InvalidOidcStateError{}
+	}
+
+	identity, err := provider.Exchange(context.Background(), code, found.Verifier, found.Nonce)
+	if err != nil {
+		return "", err
+	}
+
+	user, err := s.resolveUser(provider.config, identity)
+	if err != nil {
+		return "", err
+	}
+
+	loginCode, err := util.GenerateAlphanumericString(oidcStateLength)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.loginCodeCollection.Create(OidcLoginCode{
+		Hash:      hashSecret(loginCode),
+		User:      user.Id,
+		ExpiresAt: time.Now().Add(oidcLoginCodeExpiry),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return loginCode, nil
+}
+
+// resolveUser returns the user linked to the identity. Unlinked identities are linked to the account with the same
+// email, or get a new account if the provider allows it.
+func (s *OidcService) resolveUser(config OidcProviderConfig, identity OidcIdentity) (*User, error) {
+	link, err := s.identityCollection.Get(config.Id, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if link != nil {
+		user, err := s.userCollection.GetUserById(link.User)
+		if err != nil {
+			return nil, err
+		}
+
+		if user != nil {
+			return user, s.identityCollection.UpdateLogin(link.Id, identity.Email, time.Now())
+		}
+	}
+
+	// Without a verified email anyone could claim the account of someone else
+	if !identity.EmailVerified || identity.Email == "" {
+		return nil, OidcEmailNotVerifiedError{}
+	}
+
+	user, err := s.userCollection.GetUserByEmail(identity.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		if !config.AllowSignup {
+			return nil, OidcSignupDisabledError{}
+		}
+
+		user = &User{
+			Id:        uuid.NewString(),
+			Email:     identity.Email,
+			Confirmed: true,
+			Timezone:  defaultTimezone,
+		}
+
+		if err := s.userCollection.Create(*user); err != nil {
+			return nil, err
+		}
+	} else if !user.Confirmed && s.mailService != nil {
+		// Only checked if emails are confirmed at all, like when logging in with a password
+		return nil, OidcAccountNotConfirmedError{}
+	}
+
+	now := time.Now()
+	err = s.identityCollection.Create(UserIdentity{
+		Id:          uuid.NewString(),
+		Provider:    config.Id,
+		Subject:     identity.Subject,
+		User:        user.Id,
+		Email:       identity.Email,
+		CreatedAt:   now,
+		LastLoginAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// CompleteLogin exchanges a login code for a session. Users with two-factor authentication enabled get a challenge
+// instead, the same way as when logging in with a password.
+func (s *OidcService) CompleteLogin(loginCode string, device SessionDevice) (Session, error) {
+	found, err := s.loginCodeCollection.Take(hashSecret(loginCode))
+	if err != nil {
+		return Session{}, err
+	}
+
+	if found == nil {
+		return Session{}, InvalidOidcStateError{}
+	}
+
+	user, err := s.userCollection.GetUserById(found.User)
+	if err != nil {
+		return Session{}, err
+	}
+
+	if user == nil {
+		return Session{}, InvalidOidcStateError{}
+	}
+
+	if user.MfaEnabled() {
+		challengeToken, err := s.mfaService.CreateChallenge(user.Id)
+		if err != nil {
+			return Session{}, err
+		}
+
+		return Session{}, MfaRequiredError{challengeToken}
+	}
+
+	return s.sessionService.Create(user.Id, device)
+}
+
+func (s *OidcService) OnUserDeleted(userId string) error {
+	return s.identityCollection.DeleteByUser(userId)
+}
@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// mockOidcProvider is a minimal OIDC provider that issues an ID token for a single authorization code
+type mockOidcProvider struct {
+	server *httptest.Server
+	// challenge is the PKCE code challenge sent to the authorization endpoint
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &mockOidcProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := provider.server.URL
+		writeJSON(w, map[string]any{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/authorize",
+			"token_endpoint":                        issuer + "/token",
+			"jwks_uri":                              issuer + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []map[string]any{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("code") != "code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		verifierHash := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifierHash[:]) != provider.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, provider.claims)
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]any{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+	})
+
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// authorize starts a login against the mock provider and returns the nonce it was given
+func (p *mockOidcProvider) authorize(t *testing.T, provider *OidcProvider, verifier string) string {
+	authUrl, err := provider.AuthCodeURL(context.Background(), "state", "nonce", verifier)
+	assert.NoError(t, err)
+
+	parsed, err := url.Parse(authUrl)
+	assert.NoError(t, err)
+	query := parsed.Query()
+	assert.Equal(t, p.server.URL+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.Equal(t, "state", query.Get("state"))
+
+	p.challenge = query.Get("code_challenge")
+	return query.Get("nonce")
+}
+
+func (p *mockOidcProvider) idTokenClaims(audience string, nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            p.server.URL,
+		"sub":            "subject",
+		"aud":            audience,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "User@Example.com",
+		"email_verified": true,
+	}
+}
+
+func newTestOidcProvider(mock *mockOidcProvider) *OidcProvider {
+	return NewOidcProvider(OidcProviderConfig{
+		Id:       "mock",
+		Issuer:   mock.server.URL,
+		ClientId: "perfice",
+		Scopes:   oidcDefaultScopes,
+	}, "http://localhost/auth/oidc/mock/callback")
+}
+
+func TestOidcProviderExchange(t *testing.T) {
+	mock := newMockOidcProvider(t)
+	provider := newTestOidcProvider(mock)
+
+	nonce := mock.authorize(t, provider, "verifier-verifier-verifier-verifier-verifier")
+	mock.claims = mock.idTokenClaims("perfice", nonce)
+
+	identity, err := provider.Exchange(context.Background(), "code", "verifier-verifier-verifier-verifier-verifier", nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, OidcIdentity{Subject: "subject", Email: "user@example.com", EmailVerified: true}, identity)
+}
+
+func TestOidcProviderExchange_Rejected(t *testing.T) {
+	mock := newMockOidcProvider(t)
+	provider := newTestOidcProvider(mock)
+	verifier := "verifier-verifier-verifier-verifier-verifier"
+
+	nonce := mock.authorize(t, provider, verifier)
+	mock.claims = mock.idTokenClaims("perfice", nonce)
+
+	// A code intercepted by someone else can't be redeemed without the verifier
+	_, err := provider.Exchange(context.Background(), "code", "other-verifier-other-verifier-other-verifier", nonce)
+	assert.Error(t, err)
+
+	// ID tokens of another login attempt
+	_, err = provider.Exchange(context.Background(), "code", verifier, "other")
+	assert.Error(t, err)
+
+	// ID tokens issued to another client
+	mock.claims = mock.idTokenClaims("other", nonce)
+	_, err = provider.Exchange(context.Background(), "code", verifier, nonce)
+	assert.Error(t, err)
+
+	mock.claims = mock.idTokenClaims("perfice", nonce)
+	mock.claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = provider.Exchange(context.Background(), "code", verifier, nonce)
+	assert.Error(t, err)
+}
+
+func TestOidcProvidersFromEnv(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "keycloak, google")
+	t.Setenv("OIDC_KEYCLOAK_ISSUER", "https://keycloak.example.com/realms/perfice")
+	t.Setenv("OIDC_KEYCLOAK_CLIENT_ID", "perfice")
+	t.Setenv("OIDC_KEYCLOAK_NAME", "Keycloak")
+	t.Setenv("OIDC_GOOGLE_ISSUER", "https://accounts.google.com")
+	t.Setenv("OIDC_GOOGLE_CLIENT_ID", "id")
+	t.Setenv("OIDC_GOOGLE_CLIENT_SECRET", "secret")
+	t.Setenv("OIDC_GOOGLE_SCOPES", "openid email")
+	t.Setenv("OIDC_GOOGLE_ALLOW_SIGNUP", "true")
+
+	configs, err := oidcProvidersFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, []OidcProviderConfig{
+		{Id: "keycloak", Name: "Keycloak", Issuer: "https://keycloak.example.com/realms/perfice", ClientId: "perfice",
+			Scopes: oidcDefaultScopes, AllowSignup: false},
+		{Id: "google", Name: "google", Issuer: "https://accounts.google.com", ClientId: "id", ClientSecret: "secret",
+			Scopes: []string{"openid", "email"}, AllowSignup: true},
+	}, configs)
+
+	t.Setenv("OIDC_GOOGLE_ISSUER", "")
+	_, err = oidcProvidersFromEnv()
+	assert.Error(t, err)
+}
+
+func TestOidcService_FinishLogin_RequiresBrowserState(t *testing.T) {
+	mock := newMockOidcProvider(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("rejects a callback from another browser", func(mt *mtest.T) {
+		service := NewOidcService([]OidcProviderConfig{newTestOidcProvider(mock).config}, "http://localhost",
+			NewOidcStateCollection(mt.Coll), nil, nil, nil, nil, nil, nil)
+
+		for _, browserState := range []string{"", "other"} {
+			_, err := service.FinishLogin("mock", "code", "state", browserState)
+			assert.ErrorIs(mt, err, InvalidOidcStateError{})
+		}
+
+		// The state is not consumed, so the browser that started the login can still finish it
+		assert.Empty(mt, commands(mt))
+	})
+}
+
+func TestOidcService_ResolveUser_Unconfirmed(t *testing.T) {
+	config := OidcProviderConfig{Id: "mock"}
+	identity := OidcIdentity{Subject: "subject", Email: "user@example.com", EmailVerified: true}
+	unconfirmed := User{Id: "user", Email: "user@example.com"}
+	noIdentity := mtest.CreateCursorResponse(0, "auth.identities", mtest.FirstBatch)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("rejects unconfirmed accounts when emails are confirmed", func(mt *mtest.T) {
+		service := NewOidcService(nil, "http://localhost", nil, nil, NewIdentityCollection(mt.Coll),
+			NewUserCollection(mt.Coll), nil, nil, &MailService{})
+		mt.AddMockResponses(noIdentity, userResponse(mt.T, unconfirmed))
+
+		_, err := service.resolveUser(config, identity)
+		assert.ErrorIs(mt, err, OidcAccountNotConfirmedError{})
+	})
+
+	mt.Run("links unconfirmed accounts without a mailer", func(mt *mtest.T) {
+		service := NewOidcService(nil, "http://localhost", nil, nil, NewIdentityCollection(mt.Coll),
+			NewUserCollection(mt.Coll), nil, nil, nil)
+		mt.AddMockResponses(noIdentity, userResponse(mt.T, unconfirmed), mtest.CreateSuccessResponse())
+
+		user, err := service.resolveUser(config, identity)
+		require.NoError(mt, err)
+		assert.Equal(mt, unconfirmed.Id, user.Id)
+		assert.Equal(mt, []string{"find", "find", "insert"}, commands(mt))
+	})
+}
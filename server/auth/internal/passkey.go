@@ -0,0 +1,415 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"perfice.adoe.dev/util"
+)
+
+var passkeyCeremonyTimeout = 5 * time.Minute
+var webAuthnIdLength = 32
+var maxPasskeyNameLength = 64
+
+const (
+	registrationCeremony = "registration"
+	signupCeremony       = "signup"
+	loginCeremony        = "login"
+)
+
+type InvalidPasskeyError struct {
+	Err error
+}
+
+func (e InvalidPasskeyError) Error() string {
+	return fmt.Sprintf("invalid passkey: %v", e.Err)
+}
+
+func (e InvalidPasskeyError) Is(target error) bool {
+	_, ok := target.(InvalidPasskeyError)
+	return ok
+}
+
+func (e InvalidPasskeyError) Unwrap() error {
+	return e.Err
+}
+
+type PasskeyNotFoundError struct{}
+
+func (e PasskeyNotFoundError) Error() string {
+	return "passkey not found"
+}
+
+type LastPasskeyError struct{}
+
+func (e LastPasskeyError) Error() string {
+	return "the last passkey of an account without a password can't be removed"
+}
+
+// webAuthnUser exposes a user to the WebAuthn library
+type webAuthnUser struct {
+	user User
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return u.user.WebAuthnId
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Email
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return util.SliceMap(u.user.Passkeys, func(passkey UserPasskey) webauthn.Credential {
+		return passkey.Credential
+	})
+}
+
+// webAuthnOrigins returns the origins passkeys may be used from, which default to the CORS origins
+func webAuthnOrigins() []string {
+	origins := os.Getenv("WEBAUTHN_ORIGINS")
+	if origins == "" {
+		return allowedOrigins()
+	}
+
+	return splitOrigins(origins)
+}
+
+// PasskeyService runs the WebAuthn registration and login ceremonies. The state of a ceremony is stored under its
+// challenge, which the client signs and sends back, so clients don't have to keep track of it.
+type PasskeyService struct {
+	webAuthn            *webauthn.WebAuthn
+	userCollection      *UserCollection
+	challengeCollection *WebAuthnChallengeCollection
+}
+
+func NewPasskeyService(rpId string, userCollection *UserCollection, challengeCollection *WebAuthnChallengeCollection) (*PasskeyService, error) {
+	displayName := os.Getenv("WEBAUTHN_RP_NAME")
+	if displayName == "" {
+		displayName = "Perfice"
+	}
+
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: passkeyCeremonyTimeout, TimeoutUVD: passkeyCeremonyTimeout}
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: displayName,
+		RPOrigins:     webAuthnOrigins(),
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationPreferred,
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasskeyService{webAuthn, userCollection, challengeCollection}, nil
+}
+
+func (s *PasskeyService) storeChallenge(ceremony string, userId string, email string, session *webauthn.SessionData) error {
+	expiresAt := session.Expires
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(passkeyCeremonyTimeout)
+	}
+
+	return s.challengeCollection.Create(WebAuthnChallenge{
+		Challenge: session.Challenge,
+		Ceremony:  ceremony,
+		User:      userId,
+		Email:     email,
+		Session:   *session,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// takeChallenge removes the ceremony so that a response can't be replayed
+func (s *PasskeyService) takeChallenge(challenge string, ceremony string) (*WebAuthnChallenge, error) {
+	found, err := s.challengeCollection.Take(challenge, ceremony)
+	if err != nil {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, InvalidPasskeyError{errors.New("unknown or expired challenge")}
+	}
+
+	return found, nil
+}
+
+func (s *PasskeyService) getUser(userId string) (*User, error) {
+	user, err := s.userCollection.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+
+	return user, nil
+}
+
+func generateWebAuthnId() ([]byte, error) {
+	id := make([]byte, webAuthnIdLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// ensureWebAuthnId gives users that registered with a password a user handle the first time they add a passkey
+func (s *PasskeyService) ensureWebAuthnId(user *User) (*User, error) {
+	if len(user.WebAuthnId) > 0 {
+		return user, nil
+	}
+
+	id, err := generateWebAuthnId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Two concurrent registrations must not give the user different handles
+	if err := s.userCollection.SetWebAuthnIdIfMissing(user.Id, id); err != nil {
+		return nil, err
+	}
+
+	return s.getUser(user.Id)
+}
+
+// BeginRegistration starts adding a passkey to an existing account
+func (s *PasskeyService) BeginRegistration(userId string) (*protocol.CredentialCreation, error) {
+	user, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err = s.ensureWebAuthnId(user)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := webauthn.Credentials(webAuthnUser{*user}.WebAuthnCredentials())
+	creation, session, err := s.webAuthn.BeginRegistration(webAuthnUser{*user},
+		webauthn.WithExclusions(existing.CredentialDescriptors()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.storeChallenge(registrationCeremony, userId, "", session); err != nil {
+		return nil, err
+	}
+
+	return creation, nil
+}
+
+// FinishRegistration verifies the new credential and adds it to the account
+func (s *PasskeyService) FinishRegistration(userId string, name string, response []byte) (UserPasskey, error) {
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return UserPasskey{}, InvalidPasskeyError{err}
+	}
+
+	challenge, err := s.takeChallenge(parsed.Response.CollectedClientData.Challenge, registrationCeremony)
+	if err != nil {
+		return UserPasskey{}, err
+	}
+
+	if challenge.User != userId {
+		return UserPasskey{}, InvalidPasskeyError{errors.New("challenge belongs to another user")}
+	}
+
+	user, err := s.getUser(userId)
+	if err != nil {
+		return UserPasskey{}, err
+	}
+
+	credential, err := s.webAuthn.CreateCredential(webAuthnUser{*user}, challenge.Session, parsed)
+	if err != nil {
+		return UserPasskey{}, InvalidPasskeyError{err}
+	}
+
+	passkey := newUserPasskey(*credential, name)
+	if err := s.userCollection.AddPasskey(userId, passkey); err != nil {
+		return UserPasskey{}, err
+	}
+
+	return passkey, nil
+}
+
+// BeginSignup starts creating an account that only has a passkey
+func (s *PasskeyService) BeginSignup(email string) (*protocol.CredentialCreation, error) {
+	id, err := generateWebAuthnId()
+	if err != nil {
+		return nil, err
+	}
+
+	creation, session, err := s.webAuthn.BeginRegistration(webAuthnUser{User{WebAuthnId: id, Email: email}})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.storeChallenge(signupCeremony, "", email, session); err != nil {
+		return nil, err
+	}
+
+	return creation, nil
+}
+
+// FinishSignup verifies the credential of a new account and returns the user, who still has to be created
+func (s *PasskeyService) FinishSignup(response []byte) (User, error) {
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return User{}, InvalidPasskeyError{err}
+	}
+
+	challenge, err := s.takeChallenge(parsed.Response.CollectedClientData.Challenge, signupCeremony)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{
+		Id:         uuid.NewString(),
+		Email:      challenge.Email,
+		Timezone:   defaultTimezone,
+		WebAuthnId: challenge.Session.UserID,
+	}
+
+	credential, err := s.webAuthn.CreateCredential(webAuthnUser{user}, challenge.Session, parsed)
+	if err != nil {
+		return User{}, InvalidPasskeyError{err}
+	}
+
+	user.Passkeys = []UserPasskey{newUserPasskey(*credential, "")}
+	return user, nil
+}
+
+// BeginLogin starts a login where the authenticator picks the account, so the user doesn't have to enter an email
+func (s *PasskeyService) BeginLogin() (*protocol.CredentialAssertion, error) {
+	assertion, session, err := s.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.storeChallenge(loginCeremony, "", "", session); err != nil {
+		return nil, err
+	}
+
+	return assertion, nil
+}
+
+// FinishLogin verifies the assertion and returns the user it belongs to, and whether the authenticator verified the
+// user with a PIN or biometrics. Without user verification the passkey is only something the user has.
+func (s *PasskeyService) FinishLogin(response []byte) (User, bool, error) {
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return User{}, false, InvalidPasskeyError{err}
+	}
+
+	challenge, err := s.takeChallenge(parsed.Response.CollectedClientData.Challenge, loginCeremony)
+	if err != nil {
+		return User{}, false, err
+	}
+
+	var user *User
+	handler := func(rawId []byte, userHandle []byte) (webauthn.User, error) {
+		user, err = s.userCollection.GetUserByWebAuthnId(userHandle)
+		if err != nil {
+			return nil, err
+		}
+
+		if user == nil {
+			return nil, errors.New("unknown user handle")
+		}
+
+		return webAuthnUser{*user}, nil
+	}
+
+	_, credential, err := s.webAuthn.ValidatePasskeyLogin(handler, challenge.Session, parsed)
+	if err != nil {
+		return User{}, false, InvalidPasskeyError{err}
+	}
+
+	// The signature counter went backwards, so the private key might have been copied
+	if credential.Authenticator.CloneWarning {
+		return User{}, false, InvalidPasskeyError{errors.New("possibly cloned authenticator")}
+	}
+
+	if err := s.userCollection.UpdatePasskeyCredential(user.Id, *credential, time.Now()); err != nil {
+		return User{}, false, err
+	}
+
+	return *user, credential.Flags.UserVerified, nil
+}
+
+func (s *PasskeyService) GetPasskeys(userId string) ([]UserPasskey, error) {
+	user, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.Passkeys, nil
+}
+
+// DeletePasskey removes a passkey by its base64url encoded credential id
+func (s *PasskeyService) DeletePasskey(userId string, passkeyId string) error {
+	credentialId, err := base64.RawURLEncoding.DecodeString(passkeyId)
+	if err != nil {
+		return PasskeyNotFoundError{}
+	}
+
+	user, err := s.getUser(userId)
+	if err != nil {
+		return err
+	}
+
+	passkey := util.SliceFind(user.Passkeys, func(passkey UserPasskey) bool {
+		return bytes.Equal(passkey.Id, credentialId)
+	})
+	if passkey == nil {
+		return PasskeyNotFoundError{}
+	}
+
+	// The account could only be recovered by resetting the password. Checked by the update, the passkeys read above
+	// may have changed since.
+	removed, err := s.userCollection.RemovePasskey(userId, credentialId)
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		return LastPasskeyError{}
+	}
+
+	return nil
+}
+
+func newUserPasskey(credential webauthn.Credential, name string) UserPasskey {
+	now := time.Now()
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	return UserPasskey{
+		Id:         credential.ID,
+		Name:       truncate(name, maxPasskeyNameLength),
+		Credential: credential,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+}
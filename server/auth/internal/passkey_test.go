@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestWebAuthnOrigins(t *testing.T) {
+	t.Setenv("CORS_EXTRA_ORIGINS", "https://perfice.example.com, ")
+	t.Setenv("WEBAUTHN_ORIGINS", "")
+	assert.Equal(t, []string{"https://localhost", "http://localhost:8000", "http://localhost:5173",
+		"https://perfice.adoe.dev", "https://perfice.example.com"}, webAuthnOrigins())
+
+	t.Setenv("WEBAUTHN_ORIGINS", "https://a.example.com,https://b.example.com")
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, webAuthnOrigins())
+}
+
+func TestNewUserPasskey(t *testing.T) {
+	passkey := newUserPasskey(webauthn.Credential{ID: []byte{1, 2, 3}}, "  ")
+	assert.Equal(t, []byte{1, 2, 3}, passkey.Id)
+	assert.Equal(t, "Passkey", passkey.Name)
+	assert.Equal(t, passkey.CreatedAt, passkey.LastUsedAt)
+}
+
+// userResponse returns the response to a find of the user
+func userResponse(t *testing.T, user User) bson.D {
+	return mtest.CreateCursorResponse(0, "auth.users", mtest.FirstBatch, toDocument(t, user))
+}
+
+func TestPasskeyService_DeletePasskey(t *testing.T) {
+	first := UserPasskey{Id: []byte{1}, Name: "Phone"}
+	second := UserPasskey{Id: []byte{2}, Name: "Laptop"}
+	firstId := base64.RawURLEncoding.EncodeToString(first.Id)
+	removed := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1})
+	notMatched := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0})
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("keeps the last passkey of an account without a password", func(mt *mtest.T) {
+		service, err := NewPasskeyService("localhost", NewUserCollection(mt.Coll), nil)
+		require.NoError(mt, err)
+		mt.AddMockResponses(userResponse(mt.T, User{Id: "user", Passkeys: []UserPasskey{first}}), notMatched)
+
+		assert.ErrorIs(mt, service.DeletePasskey("user", firstId), LastPasskeyError{})
+		assert.Equal(mt, []string{"find", "update"}, commands(mt))
+
+		// The guard is part of the update, rather than relying on the passkeys that were read
+		update := mt.GetAllStartedEvents()[1].Command.Lookup("updates").Array().Index(0).Value().Document()
+		filter := update.Lookup("q").Document()
+		assert.Equal(mt, "user", filter.Lookup("_id").StringValue())
+		conditions, err := filter.Lookup("$or").Array().Values()
+		require.NoError(mt, err)
+		require.Len(mt, conditions, 2)
+		assert.Equal(mt, "", conditions[0].Document().Lookup("password", "$ne").StringValue())
+		assert.True(mt, conditions[1].Document().Lookup("passkeys.1", "$exists").Boolean())
+	})
+
+	mt.Run("keeps the last passkey when another one was deleted concurrently", func(mt *mtest.T) {
+		service, err := NewPasskeyService("localhost", NewUserCollection(mt.Coll), nil)
+		require.NoError(mt, err)
+		// Both passkeys were there when the user was read, the other one has been removed since
+		mt.AddMockResponses(userResponse(mt.T, User{Id: "user", Passkeys: []UserPasskey{first, second}}), notMatched)
+
+		assert.ErrorIs(mt, service.DeletePasskey("user", firstId), LastPasskeyError{})
+	})
+
+	mt.Run("removes a passkey of an account without a password that has others", func(mt *mtest.T) {
+		service, err := NewPasskeyService("localhost", NewUserCollection(mt.Coll), nil)
+		require.NoError(mt, err)
+		mt.AddMockResponses(userResponse(mt.T, User{Id: "user", Passkeys: []UserPasskey{first, second}}), removed)
+
+		assert.NoError(mt, service.DeletePasskey("user", firstId))
+		assert.Equal(mt, []string{"find", "update"}, commands(mt))
+	})
+
+	mt.Run("removes the last passkey of an account with a password", func(mt *mtest.T) {
+		service, err := NewPasskeyService("localhost", NewUserCollection(mt.Coll), nil)
+		require.NoError(mt, err)
+		mt.AddMockResponses(userResponse(mt.T, User{Id: "user", Password: "hash", Passkeys: []UserPasskey{first}}), removed)
+
+		assert.NoError(mt, service.DeletePasskey("user", firstId))
+		assert.Equal(mt, []string{"find", "update"}, commands(mt))
+	})
+
+	mt.Run("rejects unknown passkeys", func(mt *mtest.T) {
+		service, err := NewPasskeyService("localhost", NewUserCollection(mt.Coll), nil)
+		require.NoError(mt, err)
+		mt.AddMockResponses(userResponse(mt.T, User{Id: "user", Password: "hash", Passkeys: []UserPasskey{first}}))
+
+		assert.ErrorIs(mt, service.DeletePasskey("user", base64.RawURLEncoding.EncodeToString(second.Id)), PasskeyNotFoundError{})
+		assert.ErrorIs(mt, service.DeletePasskey("user", "not base64!"), PasskeyNotFoundError{})
+		assert.Equal(mt, []string{"find"}, commands(mt))
+	})
+}
+
+func TestAuthService_LoginPasskeyOnlyAccount(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("rejects password logins", func(mt *mtest.T) {
+		authService := NewAuthService(NewUserCollection(mt.Coll), nil, nil, nil, nil, nil, nil, nil)
+		mt.AddMockResponses(userResponse(mt.T, User{Id: "user", Email: "user@example.com", Confirmed: true,
+			Passkeys: []UserPasskey{{Id: []byte{1}}}}))
+
+		// Not even an empty password matches the empty hash
+		_, err := authService.Login("user@example.com", "", SessionDevice{})
+		assert.ErrorIs(mt, err, InvalidCredentialsError{})
+		assert.Equal(mt, []string{"find"}, commands(mt))
+	})
+}
+
+func TestWebAuthnChallengeCollection_Take(t *testing.T) {
+	challenge := WebAuthnChallenge{
+		Challenge: "challenge",
+		Ceremony:  loginCeremony,
+		Session:   webauthn.SessionData{Challenge: "challenge"},
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("challenges can only be used once", func(mt *mtest.T) {
+		service, err := NewPasskeyService("localhost", nil, NewWebAuthnChallengeCollection(mt.Coll))
+		require.NoError(mt, err)
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: toDocument(mt.T, challenge)}),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}),
+		)
+
+		found, err := service.takeChallenge("challenge", loginCeremony)
+		require.NoError(mt, err)
+		assert.Equal(mt, "challenge", found.Session.Challenge)
+
+		// The challenge is deleted as it is read, so a replayed response finds nothing
+		started := mt.GetStartedEvent()
+		require.Equal(mt, "findAndModify", started.CommandName)
+		assert.True(mt, started.Command.Lookup("remove").Boolean())
+		query := started.Command.Lookup("query").Document()
+		assert.Equal(mt, "challenge", query.Lookup("_id").StringValue())
+		assert.Equal(mt, loginCeremony, query.Lookup("ceremony").StringValue())
+		_, err = query.LookupErr("expiresAt", "$gt")
+		assert.NoError(mt, err, "expired challenges are ignored")
+
+		_, err = service.takeChallenge("challenge", loginCeremony)
+		assert.ErrorIs(mt, err, InvalidPasskeyError{})
+	})
+}
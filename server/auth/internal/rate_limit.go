@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var rateLimitCleanupInterval = time.Minute
+
+type RateLimitRule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// LockoutPolicy locks a key out after Threshold failures, doubling the delay with every further failure
+type LockoutPolicy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Window is how long failures are remembered
+	Window time.Duration
+}
+
+var loginRateLimit = RateLimitRule{Limit: 10, Window: time.Minute}
+var registerRateLimit = RateLimitRule{Limit: 5, Window: time.Hour}
+
+// mailRateLimit limits endpoints that send mails, both per client and per recipient
+var mailRateLimit = RateLimitRule{Limit: 3, Window: time.Hour}
+var mailClientRateLimit = RateLimitRule{Limit: 10, Window: time.Hour}
+
+var emailLockoutPolicy = LockoutPolicy{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Window: 24 * time.Hour}
+
+// mfaLockoutPolicy locks out users entering wrong codes to manage two-factor authentication, which would otherwise
+// allow brute forcing a code with a stolen access token
+var mfaLockoutPolicy = LockoutPolicy{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Window: 24 * time.Hour}
+
+// Clients behind a shared address, such as a NAT, get more attempts before being locked out
+var ipLockoutPolicy = LockoutPolicy{Threshold: 20, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Window: 24 * time.Hour}
+
+type RateLimitEntry struct {
+	Count       int
+	WindowEnd   time.Time
+	LockedUntil time.Time
+}
+
+// RateLimitStore keeps the counters of the rate limiter. The Mongo store shares them between replicas.
+type RateLimitStore interface {
+	// Increment counts an attempt, starting a new window if the current one has ended
+	Increment(key string, window time.Duration) (RateLimitEntry, error)
+	// Get returns the entry of the key, which is empty if it doesn't exist
+	Get(key string) (RateLimitEntry, error)
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
+
+func (e RateLimitEntry) expiresAt() time.Time {
+	if e.LockedUntil.After(e.WindowEnd) {
+		return e.LockedUntil
+	}
+
+	return e.WindowEnd
+}
+
+type MemoryRateLimitStore struct {
+	mutex   sync.Mutex
+	entries map[string]RateLimitEntry
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{entries: map[string]RateLimitEntry{}}
+}
+
+func (s *MemoryRateLimitStore) Increment(key string, window time.Duration) (RateLimitEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	entry := s.entries[key]
+	if now.Before(entry.WindowEnd) {
+		entry.Count++
+	} else {
+		entry.Count = 1
+		entry.WindowEnd = now.Add(window)
+	}
+
+	s.entries[key] = entry
+	return entry, nil
+}
+
+func (s *MemoryRateLimitStore) Get(key string) (RateLimitEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expiresAt()) {
+		return RateLimitEntry{}, nil
+	}
+
+	return entry, nil
+}
+
+func (s *MemoryRateLimitStore) Lock(key string, until time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry := s.entries[key]
+	entry.LockedUntil = until
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *MemoryRateLimitStore) Reset(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryRateLimitStore) removeExpired() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt()) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// Run periodically removes expired entries
+func (s *MemoryRateLimitStore) Run() {
+	go func() {
+		ticker := time.NewTicker(rateLimitCleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.removeExpired()
+		}
+	}()
+}
+
+type mongoRateLimitEntry struct {
+	Key         string    `bson:"_id"`
+	Count       int       `bson:"count"`
+	WindowEnd   time.Time `bson:"windowEnd"`
+	LockedUntil time.Time `bson:"lockedUntil"`
+	// ExpiresAt is the later of the window end and the lockout, when MongoDB removes the entry
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+type MongoRateLimitStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoRateLimitStore(collection *mongo.Collection) *MongoRateLimitStore {
+	return &MongoRateLimitStore{collection}
+}
+
+// setExpiresAt is the last stage of every update, so that entries are kept until both the window and lockout end
+var setExpiresAt = bson.M{"$set": bson.M{"expiresAt": bson.M{"$max": bson.A{"$windowEnd", "$lockedUntil"}}}}
+
+func (s *MongoRateLimitStore) Increment(key string, window time.Duration) (RateLimitEntry, error) {
+	now := time.Now()
+	// A single pipeline update, so that replicas counting at the same time don't overwrite each other
+	inWindow := bson.M{"$gt": bson.A{"$windowEnd", now}}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"count":     bson.M{"$cond": bson.A{inWindow, bson.M{"$add": bson.A{"$count", 1}}, 1}},
+			"windowEnd": bson.M{"$cond": bson.A{inWindow, "$windowEnd", now.Add(window)}},
+		}},
+		setExpiresAt,
+	}
+
+	var entry mongoRateLimitEntry
+	err := s.collection.FindOneAndUpdate(context.Background(), bson.M{"_id": key}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&entry)
+	if err != nil {
+		return RateLimitEntry{}, err
+	}
+
+	return RateLimitEntry{entry.Count, entry.WindowEnd, entry.LockedUntil}, nil
+}
+
+func (s *MongoRateLimitStore) Get(key string) (RateLimitEntry, error) {
+	entry, err := mongoutil.FindOne[mongoRateLimitEntry](s.collection, bson.M{"_id": key, "expiresAt": bson.M{"$gt": time.Now()}})
+	if err != nil || entry == nil {
+		return RateLimitEntry{}, err
+	}
+
+	return RateLimitEntry{entry.Count, entry.WindowEnd, entry.LockedUntil}, nil
+}
+
+func (s *MongoRateLimitStore) Lock(key string, until time.Time) error {
+	_, err := s.collection.UpdateOne(context.Background(), bson.M{"_id": key},
+		bson.A{bson.M{"$set": bson.M{"lockedUntil": until}}, setExpiresAt}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoRateLimitStore) Reset(key string) error {
+	_, err := mongoutil.DeleteOne(s.collection, bson.M{"_id": key})
+	return err
+}
+
+// RateLimiter throttles requests per key and locks keys out after repeated failures
+type RateLimiter struct {
+	store RateLimitStore
+}
+
+func NewRateLimiter(store RateLimitStore) *RateLimiter {
+	return &RateLimiter{store}
+}
+
+// Allow counts a request and returns how long to wait if the limit has been exceeded, or zero if it is allowed
+func (l *RateLimiter) Allow(key string, rule RateLimitRule) (time.Duration, error) {
+	entry, err := l.store.Increment("limit:"+key, rule.Window)
+	if err != nil {
+		return 0, err
+	}
+
+	if entry.Count > rule.Limit {
+		return time.Until(entry.WindowEnd), nil
+	}
+
+	return 0, nil
+}
+
+// Lockout returns how long the longest lockout of the keys lasts, or zero if none is locked out
+func (l *RateLimiter) Lockout(keys ...string) (time.Duration, error) {
+	var longest time.Duration
+	for _, key := range keys {
+		entry, err := l.store.Get("failures:" + key)
+		if err != nil {
+			return 0, err
+		}
+
+		if remaining := time.Until(entry.LockedUntil); remaining > longest {
+			longest = remaining
+		}
+	}
+
+	return longest, nil
+}
+
+// RecordFailure counts a failed attempt and locks the key out once the policy says so
+func (l *RateLimiter) RecordFailure(key string, policy LockoutPolicy) error {
+	entry, err := l.store.Increment("failures:"+key, policy.Window)
+	if err != nil {
+		return err
+	}
+
+	delay := lockoutDelay(policy, entry.Count)
+	if delay <= 0 {
+		return nil
+	}
+
+	return l.store.Lock("failures:"+key, time.Now().Add(delay))
+}
+
+func (l *RateLimiter) RecordSuccess(key string) error {
+	return l.store.Reset("failures:" + key)
+}
+
+// lockoutDelay returns how long to lock out after the given amount of failures
+func lockoutDelay(policy LockoutPolicy, failures int) time.Duration {
+	if failures < policy.Threshold {
+		return 0
+	}
+
+	// Capping the exponent first keeps the multiplication from overflowing
+	exponent := math.Min(float64(failures-policy.Threshold), 32)
+	delay := time.Duration(float64(policy.BaseDelay) * math.Pow(2, exponent))
+	if delay > policy.MaxDelay || delay <= 0 {
+		return policy.MaxDelay
+	}
+
+	return delay
+}
+
+// tooManyRequests responds with 429 and the amount of seconds after which the client may try again
+func tooManyRequests(ctx *fiber.Ctx, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return ctx.Status(fiber.StatusTooManyRequests).SendString("Too many requests")
+}
+
+// Middleware limits a route per client address and, if emailRule is set, per email of the request
+func (l *RateLimiter) Middleware(name string, rule RateLimitRule, emailRule *RateLimitRule) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		retryAfter, err := l.Allow(name+":ip:"+clientIP(ctx), rule)
+		if err != nil {
+			return err
+		}
+
+		if retryAfter <= 0 && emailRule != nil {
+			if email := requestEmail(ctx); email != "" {
+				retryAfter, err = l.Allow(name+":email:"+email, *emailRule)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if retryAfter > 0 {
+			return tooManyRequests(ctx, retryAfter)
+		}
+
+		return ctx.Next()
+	}
+}
+
+// requestEmail returns the email a request is about, from the query or a JSON body
+func requestEmail(ctx *fiber.Ctx) string {
+	if email := ctx.Query("email"); email != "" {
+		return sanitizeEmail(email)
+	}
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := ctx.BodyParser(&body); err != nil {
+		return ""
+	}
+
+	return sanitizeEmail(body.Email)
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+
+	entry, err := store.Increment("key", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, entry.Count)
+	windowEnd := entry.WindowEnd
+
+	entry, err = store.Increment("key", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, entry.Count)
+	assert.Equal(t, windowEnd, entry.WindowEnd)
+
+	// A new window starts once the current one has ended
+	entry, err = store.Increment("short", -time.Second)
+	assert.NoError(t, err)
+	entry, err = store.Increment("short", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, entry.Count)
+
+	until := time.Now().Add(time.Hour)
+	assert.NoError(t, store.Lock("key", until))
+	entry, err = store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimitEntry{2, windowEnd, until}, entry)
+
+	assert.NoError(t, store.Reset("key"))
+	entry, err = store.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimitEntry{}, entry)
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryRateLimitStore())
+	rule := RateLimitRule{Limit: 2, Window: time.Minute}
+
+	for i := 0; i < rule.Limit; i++ {
+		retryAfter, err := limiter.Allow("login:ip:127.0.0.1", rule)
+		assert.NoError(t, err)
+		assert.Zero(t, retryAfter)
+	}
+
+	retryAfter, err := limiter.Allow("login:ip:127.0.0.1", rule)
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Minute, retryAfter, float64(time.Second))
+
+	// Other keys have their own counters
+	retryAfter, err = limiter.Allow("login:ip:127.0.0.2", rule)
+	assert.NoError(t, err)
+	assert.Zero(t, retryAfter)
+}
+
+func TestRateLimiterLockout(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryRateLimitStore())
+	policy := LockoutPolicy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+
+	for i := 0; i < policy.Threshold-1; i++ {
+		assert.NoError(t, limiter.RecordFailure("email", policy))
+	}
+
+	lockout, err := limiter.Lockout("email", "ip")
+	assert.NoError(t, err)
+	assert.Zero(t, lockout)
+
+	assert.NoError(t, limiter.RecordFailure("email", policy))
+	lockout, err = limiter.Lockout("ip", "email")
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Minute, lockout, float64(time.Second))
+
+	assert.NoError(t, limiter.RecordSuccess("email"))
+	lockout, err = limiter.Lockout("email")
+	assert.NoError(t, err)
+	assert.Zero(t, lockout)
+}
+
+func TestLockoutDelay(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour}
+
+	assert.Zero(t, lockoutDelay(policy, 4))
+	assert.Equal(t, 30*time.Second, lockoutDelay(policy, 5))
+	assert.Equal(t, time.Minute, lockoutDelay(policy, 6))
+	assert.Equal(t, 2*time.Minute, lockoutDelay(policy, 7))
+	assert.Equal(t, time.Hour, lockoutDelay(policy, 12))
+	assert.Equal(t, time.Hour, lockoutDelay(policy, 1000))
+}
@@ -4,9 +4,9 @@ import (
 	"errors"
 	"time"
 
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/google/uuid"
 	"github.com/matthewhartstonge/argon2"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"perfice.adoe.dev/util"
 )
@@ -14,6 +14,8 @@ import "perfice.adoe.dev/mongoutil"
 
 type UserDeletedCallback func(userId string)
 
+var defaultTimezone = "Europe/Amsterdam"
+
 type AuthService struct {
 	jwtSecret              []byte
 	userCollection         *UserCollection
@@ -25,10 +27,14 @@ type AuthService struct {
 	cachedTimezones      util.GenericSyncMap[string, string]
 	userDeletedCallbacks []UserDeletedCallback
 	mailService          *MailService
+	mfaService           *MfaService
+	// passkeyService is nil if passkeys aren't configured
+	passkeyService *PasskeyService
 }
 
 func NewAuthService(userCollection *UserCollection, accountTokenCollection *AccountTokenCollection, jwtSecret []byte,
-	sessionService *SessionService, kafkaService *KafkaService, mailService *MailService) *AuthService {
+	sessionService *SessionService, kafkaService *KafkaService, mailService *MailService, mfaService *MfaService,
+	passkeyService *PasskeyService) *AuthService {
 	return &AuthService{
 		jwtSecret:              jwtSecret,
 		userCollection:         userCollection,
@@ -39,6 +45,8 @@ func NewAuthService(userCollection *UserCollection, accountTokenCollection *Acco
 		cachedTimezones:        util.GenericSyncMap[string, string]{},
 		userDeletedCallbacks:   []UserDeletedCallback{},
 		mailService:            mailService,
+		mfaService:             mfaService,
+		passkeyService:         passkeyService,
 	}
 }
 
@@ -87,7 +95,8 @@ func (a *AuthService) GetUserTimeZone(userId string) (string, error) {
 	return user.Timezone, nil
 }
 
-func (a *AuthService) Register(email string, password string) error {
+// Register creates an account, the locale is the language of the mails sent to the user
+func (a *AuthService) Register(email string, password string, locale string) error {
 	existing, err := a.getUserByEmail(email)
 	if err != nil {
 		return err
@@ -106,7 +115,8 @@ func (a *AuthService) Register(email string, password string) error {
 		Id:       uuid.NewString(),
 		Email:    email,
 		Password: string(hashedPassword),
-		Timezone: "Europe/Amsterdam",
+		Timezone: defaultTimezone,
+		Locale:   locale,
 	}
 
 	if a.mailService != nil {
@@ -125,7 +135,7 @@ func (a *AuthService) createConfirmationEmail(user User) error {
 		return err
 	}
 
-	err = a.mailService.SendEmailConfirmationMail(user.Email, confirmationToken.Id.Hex())
+	err = a.mailService.SendEmailConfirmationMail(user.Email, user.Locale, confirmationToken)
 	if err != nil {
 		return err
 	}
@@ -133,19 +143,20 @@ func (a *AuthService) createConfirmationEmail(user User) error {
 	return nil
 }
 
-func (a *AuthService) Login(email string, password string) (Session, error) {
+func (a *AuthService) Login(email string, password string, device SessionDevice) (Session, error) {
 	user, err := a.getUserByEmail(email)
 	if err != nil {
 		return Session{}, err
 	}
 
+	// Unknown emails count as failed logins, so that they are rate limited the same way
 	if user == nil {
-		return Session{}, errors.New("invalid email")
+		return Session{}, InvalidCredentialsError{}
 	}
 
-	// Only check confirmation if mail service has been configured
-	if !user.Confirmed && a.mailService != nil {
-		return Session{}, UserNotConfirmedError{}
+	// Accounts that only use passkeys can't log in with a password
+	if user.Password == "" {
+		return Session{}, InvalidCredentialsError{}
 	}
 
 	ok, err := argon2.VerifyEncoded([]byte(password), []byte(user.Password))
@@ -157,7 +168,22 @@ func (a *AuthService) Login(email string, password string) (Session, error) {
 		return Session{}, InvalidCredentialsError{}
 	}
 
-	session, err := a.sessionService.Create(user.Id)
+	// Only check confirmation if mail service has been configured. Checked after the password, so that it doesn't tell
+	// anyone whether an email is registered.
+	if !user.Confirmed && a.mailService != nil {
+		return Session{}, UserNotConfirmedError{}
+	}
+
+	if user.MfaEnabled() {
+		challengeToken, err := a.mfaService.CreateChallenge(user.Id)
+		if err != nil {
+			return Session{}, err
+		}
+
+		return Session{}, MfaRequiredError{challengeToken}
+	}
+
+	session, err := a.sessionService.Create(user.Id, device)
 	if err != nil {
 		return Session{}, err
 	}
@@ -165,6 +191,96 @@ func (a *AuthService) Login(email string, password string) (Session, error) {
 	return session, nil
 }
 
+// LoginMfa finishes a login that required a second factor
+func (a *AuthService) LoginMfa(challengeToken string, code string, device SessionDevice) (Session, error) {
+	user, err := a.mfaService.CompleteChallenge(challengeToken, code)
+	if err != nil {
+		return Session{}, err
+	}
+
+	return a.sessionService.Create(user.Id, device)
+}
+
+// BeginPasskeySignup starts creating an account without a password
+func (a *AuthService) BeginPasskeySignup(email string) (*protocol.CredentialCreation, error) {
+	existing, err := a.getUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		return nil, UserAlreadyExistsError{}
+	}
+
+	return a.passkeyService.BeginSignup(email)
+}
+
+// FinishPasskeySignup creates the account, it returns a session unless the email has to be confirmed first
+func (a *AuthService) FinishPasskeySignup(response []byte, device SessionDevice) (*Session, error) {
+	user, err := a.passkeyService.FinishSignup(response)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := a.getUserByEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		return nil, UserAlreadyExistsError{}
+	}
+
+	if a.mailService != nil {
+		if err := a.createConfirmationEmail(user); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.userCollection.Create(user); err != nil {
+		return nil, err
+	}
+
+	if a.mailService != nil {
+		return nil, nil
+	}
+
+	session, err := a.sessionService.Create(user.Id, device)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// LoginPasskey logs in with a passkey. A passkey that verified the user with a PIN or biometrics is already two
+// factors, other authenticators are only one so users with two-factor authentication get a challenge.
+func (a *AuthService) LoginPasskey(response []byte, device SessionDevice) (Session, error) {
+	user, userVerified, err := a.passkeyService.FinishLogin(response)
+	if err != nil {
+		return Session{}, err
+	}
+
+	if !user.Confirmed && a.mailService != nil {
+		return Session{}, UserNotConfirmedError{}
+	}
+
+	if !userVerified && user.MfaEnabled() {
+		challengeToken, err := a.mfaService.CreateChallenge(user.Id)
+		if err != nil {
+			return Session{}, err
+		}
+
+		return Session{}, MfaRequiredError{challengeToken}
+	}
+
+	return a.sessionService.Create(user.Id, device)
+}
+
+func (a *AuthService) SetLocale(userId string, locale string) error {
+	return a.userCollection.UpdateLocale(userId, locale)
+}
+
 func (a *AuthService) SetTimezone(userId string, timezone string) error {
 	err := a.userCollection.UpdateTimezone(userId, timezone)
 	if err != nil {
@@ -216,7 +332,7 @@ func (a *AuthService) DeleteUser(userId string) error {
 	return nil
 }
 
-func (a *AuthService) ConfirmEmail(token primitive.ObjectID) error {
+func (a *AuthService) ConfirmEmail(token string) error {
 	found, err := a.accountTokenCollection.GetAndDeleteById(token, confirmationAccountToken)
 	if err != nil {
 		return err
@@ -228,8 +344,10 @@ func (a *AuthService) ConfirmEmail(token primitive.ObjectID) error {
 
 	return a.userCollection.ConfirmEmail(found.UserId)
 }
-func (a *AuthService) ResetPassword(token primitive.ObjectID, newPassword string) error {
-	found, err := a.accountTokenCollection.GetAndDeleteById(token, passwordResetAccountToken)
+
+// ResetPassword sets a new password, users with two-factor authentication also need a code or a recovery code
+func (a *AuthService) ResetPassword(token string, newPassword string, code string) error {
+	found, err := a.accountTokenCollection.GetById(token, passwordResetAccountToken)
 	if err != nil {
 		return err
 	}
@@ -247,6 +365,38 @@ func (a *AuthService) ResetPassword(token primitive.ObjectID, newPassword string
 		return errors.New("invalid token")
 	}
 
+	// Checked before the token is used up, so that a mistyped code doesn't require a new reset mail. The token is
+	// used up after too many wrong codes instead, like an MFA challenge.
+	if user.MfaEnabled() {
+		if err := a.mfaService.Verify(*user, code); err != nil {
+			if !errors.Is(err, InvalidMfaCodeError{}) {
+				return err
+			}
+
+			attempts, attemptErr := a.accountTokenCollection.AddAttempt(token, passwordResetAccountToken)
+			if attemptErr != nil {
+				return attemptErr
+			}
+
+			if attempts >= mfaChallengeMaxAttempts {
+				if _, err := a.accountTokenCollection.GetAndDeleteById(token, passwordResetAccountToken); err != nil {
+					return err
+				}
+			}
+
+			return err
+		}
+	}
+
+	found, err = a.accountTokenCollection.GetAndDeleteById(token, passwordResetAccountToken)
+	if err != nil {
+		return err
+	}
+
+	if found == nil {
+		return errors.New("invalid token")
+	}
+
 	hashedPassword, err := a.argon.HashEncoded([]byte(newPassword))
 	if err != nil {
 		return err
@@ -279,16 +429,22 @@ func (a *AuthService) InitResetPassword(email string) error {
 		return err
 	}
 
-	return a.mailService.SendPasswordResetMail(email, token.Id.Hex())
+	return a.mailService.SendPasswordResetMail(email, user.Locale, token)
 }
 
-func (a *AuthService) ValidateResetPassword(token primitive.ObjectID) bool {
+// ValidateResetPassword returns whether the token is valid and whether the user has to enter a second factor
+func (a *AuthService) ValidateResetPassword(token string) (valid bool, mfaRequired bool) {
 	found, err := a.accountTokenCollection.GetById(token, passwordResetAccountToken)
-	if err != nil {
-		return false
+	if err != nil || found == nil {
+		return false, false
+	}
+
+	user, err := a.userCollection.GetUserById(found.UserId)
+	if err != nil || user == nil {
+		return false, false
 	}
 
-	return found != nil
+	return true, user.MfaEnabled()
 }
 
 func (a *AuthService) ResendConfirmationEmail(email string) error {
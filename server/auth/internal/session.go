@@ -2,14 +2,20 @@ package internal
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log"
 	"math/big"
 	"time"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"perfice.adoe.dev/mongoutil"
 )
 
@@ -17,34 +23,149 @@ type Session struct {
 	Id   string `bson:"_id"`
 	User string `bson:"user"`
 
-	AccessToken  string `bson:"accessToken"`
-	RefreshToken string `bson:"refreshToken"`
+	// AccessToken and RefreshToken are only set on sessions returned by Create and Refresh, they are never stored
+	AccessToken  string `bson:"-"`
+	RefreshToken string `bson:"-"`
+	// RefreshTokenHash is the hash of the only refresh token that can currently be used for the session
+	RefreshTokenHash string `bson:"refreshTokenHash"`
+
+	// Device describes the client the session was created on, IP and UserAgent are updated on every refresh
+	DeviceName string `bson:"deviceName"`
+	Platform   string `bson:"platform"`
+	UserAgent  string `bson:"userAgent"`
+	IP         string `bson:"ip"`
+
+	// LastRefresh is also when the session was last seen, active clients refresh whenever the access token expires
+	LastRefresh int64     `bson:"lastRefresh"`
+	Expiry      int64     `bson:"expiry"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	// AbsoluteExpiresAt is when the session ends, no matter how often it is refreshed
+	AbsoluteExpiresAt time.Time `bson:"absoluteExpiresAt"`
+	// ExpiresAt is when the session is removed unless it is refreshed before
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// RotatedRefreshToken is a refresh token that has already been exchanged. Every refresh token issued for a session
+// belongs to the same family, presenting a rotated one means that it was stolen and the whole family is revoked.
+type RotatedRefreshToken struct {
+	Hash      string    `bson:"_id"`
+	Session   string    `bson:"session"`
+	User      string    `bson:"user"`
+	RotatedAt time.Time `bson:"rotatedAt"`
+	// ExpiresAt is the absolute expiry of the session, reuse can't be detected once the session is gone anyway
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// SessionDevice is what a client reports about itself when logging in
+type SessionDevice struct {
+	Name      string
+	Platform  string
+	UserAgent string
+	IP        string
+}
+
+type SessionNotFoundError struct{}
+
+func (e SessionNotFoundError) Error() string {
+	return "session not found"
+}
+
+type InvalidRefreshTokenError struct{}
+
+func (e InvalidRefreshTokenError) Error() string {
+	return "invalid refresh token"
+}
+
+type RefreshTokenReusedError struct{}
+
+func (e RefreshTokenReusedError) Error() string {
+	return "refresh token was already used, the session has been revoked"
+}
+
+type SessionExpiredError struct{}
 
-	LastRefresh int64 `bson:"lastRefresh"`
-	Expiry      int64 `bson:"expiry"`
+func (e SessionExpiredError) Error() string {
+	return "session expired"
 }
 
 var accessTokenExpiry = time.Minute * 15
-var refreshTokenLength = 16
+var sessionMaxLifetime = time.Hour * 24 * 365
+
+// sessionIdleExpiry ends sessions that haven't been refreshed for this long. It is off unless SESSION_IDLE_EXPIRY is
+// set, sessions then only end at their absolute lifetime.
+var sessionIdleExpiry = durationFromEnv("SESSION_IDLE_EXPIRY", 0)
+
+var refreshTokenLength = 32
 var characters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
 type SessionService struct {
-	jwtSecret         []byte
-	sessionCollection *mongo.Collection
+	signingKeys            *SigningKeyService
+	sessionCollection      *mongo.Collection
+	refreshTokenCollection *mongo.Collection
+	kafkaService           *KafkaService
+	cache                  *SessionCache
 }
 
-func NewSessionService(sessionCollection *mongo.Collection, jwtSecret []byte) *SessionService {
-	return &SessionService{jwtSecret, sessionCollection}
+func NewSessionService(sessionCollection *mongo.Collection, refreshTokenCollection *mongo.Collection,
+	signingKeys *SigningKeyService, kafkaService *KafkaService, cache *SessionCache) *SessionService {
+	return &SessionService{signingKeys, sessionCollection, refreshTokenCollection, kafkaService, cache}
 }
 
 func (s *SessionService) GetSessions(userId string) ([]Session, error) {
 	return mongoutil.Find[Session](s.sessionCollection, bson.M{"user": userId})
 }
 
+// GetDevices returns the sessions of a user, most recently seen first
+func (s *SessionService) GetDevices(userId string) ([]Session, error) {
+	return mongoutil.Find[Session](s.sessionCollection, bson.M{"user": userId},
+		options.Find().SetSort(bson.M{"lastRefresh": -1}))
+}
+
+func (s *SessionService) Rename(userId string, sessionId string, name string) error {
+	found, err := mongoutil.SetOne(s.sessionCollection, bson.M{"_id": sessionId, "user": userId}, bson.M{"deviceName": name})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return SessionNotFoundError{}
+	}
+
+	return nil
+}
+
+// Revoke logs out a session of the user, which can be any of their devices
+func (s *SessionService) Revoke(userId string, sessionId string) error {
+	session, err := mongoutil.FindOne[Session](s.sessionCollection, bson.M{"_id": sessionId, "user": userId})
+	if err != nil {
+		return err
+	}
+
+	if session == nil {
+		return SessionNotFoundError{}
+	}
+
+	return s.revokeFamily(userId, sessionId)
+}
+
+// RevokeOthers logs out every session of the user except the current one and returns how many were revoked
+func (s *SessionService) RevokeOthers(userId string, currentSessionId string) (int, error) {
+	sessions, err := mongoutil.Find[Session](s.sessionCollection, bson.M{"user": userId, "_id": bson.M{"$ne": currentSessionId}})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, session := range sessions {
+		if err := s.revokeFamily(userId, session.Id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(sessions), nil
+}
+
 func (s *SessionService) AuthenticateToken(tokenStr string) (string, string, error) {
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		return s.jwtSecret, nil
-	})
+	token, err := s.signingKeys.Parse(tokenStr)
 	if err != nil {
 		return "", "", err
 	}
@@ -71,7 +192,37 @@ func (s *SessionService) AuthenticateToken(tokenStr string) (string, string, err
 	return sub, session, nil
 }
 
-func (s *SessionService) Create(userId string) (Session, error) {
+// IsActive returns whether the session still exists, a valid access token is not enough once it has been revoked
+func (s *SessionService) IsActive(userId string, sessionId string) (bool, error) {
+	if active, ok := s.cache.Get(sessionId); ok {
+		return active, nil
+	}
+
+	session, err := mongoutil.FindOne[Session](s.sessionCollection, bson.M{"_id": sessionId, "user": userId})
+	if err != nil {
+		return false, err
+	}
+
+	if session == nil {
+		s.cache.StoreRevoked(userId, sessionId)
+		return false, nil
+	}
+
+	s.cache.StoreActive(userId, sessionId)
+	return true, nil
+}
+
+// OnSessionRevoked is called when any auth replica revokes a session
+func (s *SessionService) OnSessionRevoked(userId string, sessionId string) {
+	s.cache.StoreRevoked(userId, sessionId)
+}
+
+// OnUserRevoked is called when any auth replica deletes a user
+func (s *SessionService) OnUserRevoked(userId string) {
+	s.cache.RevokeUser(userId)
+}
+
+func (s *SessionService) Create(userId string, device SessionDevice) (Session, error) {
 	sessionId := uuid.NewString()
 	expiry := time.Now().Add(accessTokenExpiry).UnixMilli()
 
@@ -85,14 +236,23 @@ func (s *SessionService) Create(userId string) (Session, error) {
 		return Session{}, err
 	}
 
+	now := time.Now()
 	session := Session{
-		Id:           sessionId,
-		User:         userId,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		LastRefresh:  time.Now().UnixMilli(),
-		Expiry:       expiry,
+		Id:                sessionId,
+		User:              userId,
+		AccessToken:       accessToken,
+		RefreshToken:      refreshToken,
+		RefreshTokenHash:  hashRefreshToken(refreshToken),
+		DeviceName:        device.Name,
+		Platform:          device.Platform,
+		UserAgent:         device.UserAgent,
+		IP:                device.IP,
+		LastRefresh:       now.UnixMilli(),
+		Expiry:            expiry,
+		CreatedAt:         now,
+		AbsoluteExpiresAt: now.Add(sessionMaxLifetime),
 	}
+	session.ExpiresAt = session.idleExpiry(now)
 
 	if err := mongoutil.Insert(s.sessionCollection, session); err != nil {
 		return Session{}, err
@@ -101,17 +261,53 @@ func (s *SessionService) Create(userId string) (Session, error) {
 	return session, nil
 }
 
-func (s *SessionService) Refresh(accessToken string, refreshToken string) (Session, error) {
-	session, err := s.getSessionByAccessTokenAndRefreshToken(accessToken, refreshToken)
+// sessionRefreshWindow is the longest a session can go without being refreshed
+func sessionRefreshWindow() time.Duration {
+	if sessionIdleExpiry > 0 && sessionIdleExpiry < sessionMaxLifetime {
+		return sessionIdleExpiry
+	}
+
+	return sessionMaxLifetime
+}
+
+// idleExpiry is when the session is removed if it isn't refreshed, which is never after its absolute expiry
+func (s Session) idleExpiry(now time.Time) time.Time {
+	expiresAt := now.Add(sessionIdleExpiry)
+	if sessionIdleExpiry <= 0 || expiresAt.After(s.AbsoluteExpiresAt) {
+		return s.AbsoluteExpiresAt
+	}
+
+	return expiresAt
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token. The access token must belong to the
+// same session but may have expired. The IP and user agent of the session are updated to the ones of the refresh.
+func (s *SessionService) Refresh(accessToken string, refreshToken string, ip string, userAgent string) (Session, error) {
+	hash := hashRefreshToken(refreshToken)
+	session, err := mongoutil.FindOne[Session](s.sessionCollection, bson.M{"refreshTokenHash": hash})
 	if err != nil {
 		return Session{}, err
 	}
 
 	if session == nil {
-		return Session{}, errors.New("unable to refresh token: invalid session")
+		return Session{}, s.handleUnknownRefreshToken(hash)
+	}
+
+	if !s.accessTokenBelongsTo(accessToken, session.Id) {
+		return Session{}, InvalidRefreshTokenError{}
 	}
 
-	newExpiry := time.Now().Add(accessTokenExpiry).UnixMilli()
+	// The idle expiry is never after the absolute one. Expired sessions are removed by a TTL index, which may lag behind.
+	now := time.Now()
+	if !now.Before(session.ExpiresAt) {
+		if err := s.revokeFamily(session.User, session.Id); err != nil {
+			return Session{}, err
+		}
+
+		return Session{}, SessionExpiredError{}
+	}
+
+	newExpiry := now.Add(accessTokenExpiry).UnixMilli()
 	newAccessToken, err := s.createAccessToken(session.User, session.Id, newExpiry)
 	if err != nil {
 		return Session{}, err
@@ -122,10 +318,31 @@ func (s *SessionService) Refresh(accessToken string, refreshToken string) (Sessi
 		return Session{}, err
 	}
 
+	// Recording the token as rotated claims it, a concurrent refresh with the same token fails on the duplicate key
+	// and is treated as reuse
+	err = mongoutil.Insert(s.refreshTokenCollection, RotatedRefreshToken{
+		Hash:      hash,
+		Session:   session.Id,
+		User:      session.User,
+		RotatedAt: now,
+		ExpiresAt: session.AbsoluteExpiresAt,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return Session{}, s.handleReuse(session.Id, session.User)
+	}
+
+	if err != nil {
+		return Session{}, err
+	}
+
 	session.Expiry = newExpiry
-	session.LastRefresh = time.Now().UnixMilli()
+	session.LastRefresh = now.UnixMilli()
 	session.AccessToken = newAccessToken
 	session.RefreshToken = newRefreshToken
+	session.RefreshTokenHash = hashRefreshToken(newRefreshToken)
+	session.ExpiresAt = session.idleExpiry(now)
+	session.IP = ip
+	session.UserAgent = userAgent
 
 	_, err = mongoutil.SetOne(s.sessionCollection, bson.M{
 		"_id": session.Id,
@@ -138,6 +355,72 @@ func (s *SessionService) Refresh(accessToken string, refreshToken string) (Sessi
 	return *session, nil
 }
 
+// handleUnknownRefreshToken revokes the session family if the token has already been rotated
+func (s *SessionService) handleUnknownRefreshToken(hash string) error {
+	rotated, err := mongoutil.FindOne[RotatedRefreshToken](s.refreshTokenCollection, bson.M{"_id": hash})
+	if err != nil {
+		return err
+	}
+
+	if rotated == nil {
+		return InvalidRefreshTokenError{}
+	}
+
+	return s.handleReuse(rotated.Session, rotated.User)
+}
+
+func (s *SessionService) handleReuse(sessionId string, userId string) error {
+	log.Printf("Refresh token reuse detected, revoking session %s of user %s", sessionId, userId)
+	if err := s.revokeFamily(userId, sessionId); err != nil {
+		return err
+	}
+
+	return RefreshTokenReusedError{}
+}
+
+// revokeFamily deletes a session together with the refresh tokens that were issued for it and lets the other services
+// know that the session is gone
+func (s *SessionService) revokeFamily(userId string, sessionId string) error {
+	if _, err := mongoutil.DeleteOne(s.sessionCollection, bson.M{"_id": sessionId}); err != nil {
+		return err
+	}
+
+	s.cache.StoreRevoked(userId, sessionId)
+	if _, err := mongoutil.DeleteMany(s.refreshTokenCollection, bson.M{"session": sessionId}); err != nil {
+		return err
+	}
+
+	// The sync service also detaches dead sessions periodically, so a lost notification only delays the cleanup
+	if err := s.kafkaService.NotifySessionRevoked(userId, sessionId); err != nil {
+		log.Println("Failed to notify session revocation:", err)
+		sentry.CaptureException(fmt.Errorf("failed to notify session revocation: %w", err))
+	}
+
+	return nil
+}
+
+// accessTokenBelongsTo checks the signature of an access token, which is usually expired when refreshing
+func (s *SessionService) accessTokenBelongsTo(tokenStr string, sessionId string) bool {
+	token, err := s.signingKeys.Parse(tokenStr, jwt.WithoutClaimsValidation())
+	if err != nil {
+		return false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+
+	session, ok := claims["session"].(string)
+	return ok && session == sessionId
+}
+
+// hashRefreshToken hashes a refresh token for storage, the tokens are random so a fast hash is enough
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
 func (s *SessionService) createRefreshToken() (string, error) {
 	token := make([]rune, refreshTokenLength)
 	for j := 0; j < refreshTokenLength; j++ {
@@ -159,25 +442,20 @@ func (s *SessionService) createAccessToken(userId string, sessionId string, expi
 		"exp":     expiry / 1000,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.jwtSecret)
-}
-
-func (s *SessionService) getSessionByAccessTokenAndRefreshToken(accessToken string, refreshToken string) (*Session, error) {
-	session, err := mongoutil.FindOne[Session](s.sessionCollection, bson.M{"accessToken": accessToken, "refreshToken": refreshToken})
-	if err != nil {
-		return nil, err
-	}
-
-	return session, nil
+	return s.signingKeys.Sign(claims)
 }
 
-func (s *SessionService) Logout(sessionId string) error {
-	_, err := mongoutil.DeleteOne(s.sessionCollection, bson.M{"_id": sessionId})
-	return err
+func (s *SessionService) Logout(userId string, sessionId string) error {
+	return s.revokeFamily(userId, sessionId)
 }
 
 func (s *SessionService) OnUserDeleted(id string) error {
-	_, err := mongoutil.DeleteMany(s.sessionCollection, bson.M{"user": id})
+	if _, err := mongoutil.DeleteMany(s.sessionCollection, bson.M{"user": id}); err != nil {
+		return err
+	}
+
+	s.cache.RevokeUser(id)
+
+	_, err := mongoutil.DeleteMany(s.refreshTokenCollection, bson.M{"user": id})
 	return err
 }
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"time"
+
+	"perfice.adoe.dev/util"
+)
+
+var defaultSessionCacheTTL = 30 * time.Second
+var sessionCacheCleanupInterval = time.Minute
+
+type cachedSession struct {
+	user string
+	// active is false for sessions that are known to be revoked
+	active bool
+	until  time.Time
+}
+
+// SessionCache remembers which sessions exist, so that authenticating a request doesn't need a database lookup.
+// Active sessions are only cached for a short time in case a revocation is missed. Revoked sessions never come back,
+// they are remembered until every access token issued for them has expired.
+type SessionCache struct {
+	ttl     time.Duration
+	entries util.GenericSyncMap[string, cachedSession]
+}
+
+func NewSessionCache(ttl time.Duration) *SessionCache {
+	return &SessionCache{ttl: ttl}
+}
+
+// Get returns whether the session is active, ok is false if the session isn't cached
+func (c *SessionCache) Get(sessionId string) (active bool, ok bool) {
+	entry, ok := c.entries.Load(sessionId)
+	if !ok {
+		return false, false
+	}
+
+	if time.Now().After(entry.until) {
+		c.entries.CompareAndDelete(sessionId, entry)
+		return false, false
+	}
+
+	return entry.active, true
+}
+
+// StoreActive caches a session that was found in the database. A revoked entry is never replaced, since the lookup may
+// have happened before the revocation was stored.
+func (c *SessionCache) StoreActive(userId string, sessionId string) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := cachedSession{userId, true, now.Add(c.ttl)}
+	for {
+		existing, loaded := c.entries.LoadOrStore(sessionId, entry)
+		if !loaded || (!existing.active && now.Before(existing.until)) {
+			return
+		}
+
+		if c.entries.CompareAndSwap(sessionId, existing, entry) {
+			return
+		}
+	}
+}
+
+// StoreRevoked marks a session as revoked, which also replaces a cached active entry
+func (c *SessionCache) StoreRevoked(userId string, sessionId string) {
+	c.entries.Store(sessionId, cachedSession{userId, false, time.Now().Add(accessTokenExpiry)})
+}
+
+// RevokeUser marks the cached sessions of a deleted user as revoked, uncached ones are looked up and not found
+func (c *SessionCache) RevokeUser(userId string) {
+	for sessionId, entry := range c.entries.Range() {
+		if entry.user == userId {
+			c.StoreRevoked(userId, sessionId)
+		}
+	}
+}
+
+func (c *SessionCache) removeExpired() {
+	now := time.Now()
+	for sessionId, entry := range c.entries.Range() {
+		if now.After(entry.until) {
+			c.entries.CompareAndDelete(sessionId, entry)
+		}
+	}
+}
+
+// Run periodically removes expired entries
+func (c *SessionCache) Run() {
+	go func() {
+		ticker := time.NewTicker(sessionCacheCleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			c.removeExpired()
+		}
+	}()
+}
@@ -0,0 +1,23 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionCache_RevokedIsSticky(t *testing.T) {
+	cache := NewSessionCache(defaultSessionCacheTTL)
+
+	cache.StoreActive("user", "session")
+	active, ok := cache.Get("session")
+	assert.True(t, ok)
+	assert.True(t, active)
+
+	// A lookup that started before the revocation must not bring the session back
+	cache.StoreRevoked("user", "session")
+	cache.StoreActive("user", "session")
+	active, ok = cache.Get("session")
+	assert.True(t, ok)
+	assert.False(t, active, "revoked session should stay revoked")
+}
@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var defaultKeyRotationInterval = time.Hour * 24 * 30
+var signingKeyRefreshInterval = time.Minute * 5
+
+// Unknown key ids reload the keys at most this often, so that made up ids can't be used to flood the database
+var signingKeyMinReloadInterval = time.Second * 10
+
+// SigningKey is an Ed25519 key pair used to sign access tokens, its id is the "kid" header of the tokens it signs
+type SigningKey struct {
+	Id string `bson:"_id"`
+	// EncryptedSeed is the seed of the private key, encrypted with ENCRYPTION_KEY like fields tagged with encrypt
+	EncryptedSeed []byte    `bson:"encryptedSeed"`
+	PublicKey     []byte    `bson:"publicKey"`
+	CreatedAt     time.Time `bson:"createdAt"`
+	// RetiresAt is when a newer key takes over signing, the key is still used for verifying until it expires
+	RetiresAt time.Time `bson:"retiresAt"`
+	// ExpiresAt is when the key is removed. Refreshing checks the expired access token of the session, so keys are
+	// kept for as long as a session may go without refreshing.
+	ExpiresAt time.Time `bson:"expiresAt"`
+
+	// seed is the decrypted seed, it is only kept in memory
+	seed []byte
+}
+
+// JSONWebKey is the public part of a signing key as served by the JWKS endpoint
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyId     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+type UnknownSigningKeyError struct {
+	KeyId string
+}
+
+func (e UnknownSigningKeyError) Error() string {
+	return "unknown signing key: " + e.KeyId
+}
+
+// SigningKeyService signs access tokens with the newest key and verifies them with any key that hasn't expired.
+// Keys are shared through the database, so every replica can verify tokens signed by the others.
+type SigningKeyService struct {
+	collection       *mongo.Collection
+	encryptionKey    []byte
+	rotationInterval time.Duration
+	// legacySecret verifies HS256 tokens without a kid that were issued before signing keys, if set
+	legacySecret []byte
+
+	mutex      sync.RWMutex
+	keys       map[string]SigningKey
+	current    *SigningKey
+	lastReload time.Time
+	// firstKeyCreatedAt is when the oldest known key was created, legacy tokens were issued before it
+	firstKeyCreatedAt time.Time
+}
+
+func NewSigningKeyService(collection *mongo.Collection, encryptionKey []byte, rotationInterval time.Duration,
+	legacySecret []byte) *SigningKeyService {
+	return &SigningKeyService{collection: collection, encryptionKey: encryptionKey, rotationInterval: rotationInterval,
+		legacySecret: legacySecret, keys: map[string]SigningKey{}}
+}
+
+// Load reads the keys from the database and creates a new signing key if the current one is due for rotation
+func (s *SigningKeyService) Load() error {
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	due := s.current == nil || !time.Now().Before(s.current.RetiresAt)
+	s.mutex.RUnlock()
+	if !due {
+		return nil
+	}
+
+	// Replicas rotating at the same time each create a key, which only means that one of them is never used for signing
+	key, err := s.generate()
+	if err != nil {
+		return err
+	}
+
+	if err := mongoutil.Insert(s.collection, key); err != nil {
+		return err
+	}
+
+	log.Printf("Rotated signing key, new key %s", key.Id)
+	return s.reload()
+}
+
+func (s *SigningKeyService) reload() error {
+	now := time.Now()
+	keys, err := mongoutil.Find[SigningKey](s.collection, bson.M{"expiresAt": bson.M{"$gt": now}},
+		options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return err
+	}
+
+	byId := make(map[string]SigningKey, len(keys))
+	var current *SigningKey
+	for i := range keys {
+		key := &keys[i]
+		seed, err := mongoutil.DecryptBytesWithKey(s.encryptionKey, key.EncryptedSeed)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt signing key %s, check ENCRYPTION_KEY: %w", key.Id, err)
+		}
+
+		key.seed = seed
+		byId[key.Id] = *key
+		if current == nil && now.Before(key.RetiresAt) {
+			current = key
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys = byId
+	s.current = current
+	s.lastReload = now
+	// Keys are sorted from newest to oldest. Expired keys are no longer loaded, so the earliest one seen is kept.
+	if len(keys) > 0 {
+		oldest := keys[len(keys)-1].CreatedAt
+		if s.firstKeyCreatedAt.IsZero() || oldest.Before(s.firstKeyCreatedAt) {
+			s.firstKeyCreatedAt = oldest
+		}
+	}
+
+	return nil
+}
+
+func (s *SigningKeyService) generate() (SigningKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	encryptedSeed, err := mongoutil.EncryptBytesWithKey(s.encryptionKey, privateKey.Seed())
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	now := time.Now()
+	retiresAt := now.Add(s.rotationInterval)
+	return SigningKey{
+		Id:            uuid.NewString(),
+		EncryptedSeed: encryptedSeed,
+		PublicKey:     publicKey,
+		CreatedAt:     now,
+		RetiresAt:     retiresAt,
+		ExpiresAt:     retiresAt.Add(sessionRefreshWindow()),
+	}, nil
+}
+
+// Run periodically picks up keys created by other replicas and rotates the signing key when it is due
+func (s *SigningKeyService) Run() {
+	go func() {
+		ticker := time.NewTicker(signingKeyRefreshInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := s.Load(); err != nil {
+				log.Println("Failed to load signing keys:", err)
+				sentry.CaptureException(fmt.Errorf("failed to load signing keys: %w", err))
+			}
+		}
+	}()
+}
+
+// Sign signs the claims with the current key
+func (s *SigningKeyService) Sign(claims jwt.MapClaims) (string, error) {
+	s.mutex.RLock()
+	current := s.current
+	s.mutex.RUnlock()
+
+	if current == nil {
+		return "", errors.New("no signing key available")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = current.Id
+	return token.SignedString(ed25519.NewKeyFromSeed(current.seed))
+}
+
+func (s *SigningKeyService) getKey(keyId string) (SigningKey, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key, ok := s.keys[keyId]
+	return key, ok
+}
+
+func (s *SigningKeyService) canReload() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return time.Since(s.lastReload) >= signingKeyMinReloadInterval
+}
+
+// acceptsLegacyTokens returns true until the last legacy access token has expired, which is at most one access token
+// lifetime after the first signing key took over. Later tokens without a key id can only be forged with JWT_SECRET.
+func (s *SigningKeyService) acceptsLegacyTokens() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.firstKeyCreatedAt.IsZero() || time.Now().Before(s.firstKeyCreatedAt.Add(accessTokenExpiry))
+}
+
+// Keyfunc returns the key that verifies the token, the algorithm is pinned to the one of the key
+func (s *SigningKeyService) Keyfunc(token *jwt.Token) (interface{}, error) {
+	keyId, ok := token.Header["kid"].(string)
+	if !ok {
+		if len(s.legacySecret) > 0 && token.Method == jwt.SigningMethodHS256 {
+			if !s.acceptsLegacyTokens() {
+				return nil, errors.New("tokens without a key id are no longer accepted")
+			}
+
+			return s.legacySecret, nil
+		}
+
+		return nil, errors.New("token has no key id")
+	}
+
+	if token.Method != jwt.SigningMethodEdDSA {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	key, ok := s.getKey(keyId)
+	if !ok && s.canReload() {
+		// The key may have just been created by another replica
+		if err := s.reload(); err != nil {
+			return nil, err
+		}
+
+		key, ok = s.getKey(keyId)
+	}
+
+	if !ok {
+		return nil, UnknownSigningKeyError{keyId}
+	}
+
+	return ed25519.PublicKey(key.PublicKey), nil
+}
+
+// Parse verifies a token signed by any of the keys
+func (s *SigningKeyService) Parse(tokenStr string, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	methods := []string{jwt.SigningMethodEdDSA.Alg()}
+	if len(s.legacySecret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+
+	return jwt.Parse(tokenStr, s.Keyfunc, append(opts, jwt.WithValidMethods(methods))...)
+}
+
+// JWKS returns the public keys of every key that tokens can currently be verified with
+func (s *SigningKeyService) JWKS() JSONWebKeySet {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	set := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(s.keys))}
+	for _, key := range s.keys {
+		set.Keys = append(set.Keys, JSONWebKey{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key.PublicKey),
+			KeyId:     key.Id,
+			Algorithm: jwt.SigningMethodEdDSA.Alg(),
+			Use:       "sig",
+		})
+	}
+
+	return set
+}
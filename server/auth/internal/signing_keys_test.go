@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+// testSigningKey generates a key that retires after the given duration
+func testSigningKey(t *testing.T, retiresIn time.Duration) SigningKey {
+	service := NewSigningKeyService(nil, testEncryptionKey, retiresIn, nil)
+	key, err := service.generate()
+	require.NoError(t, err)
+
+	return key
+}
+
+// toDocument converts a model to the document that would be stored for it
+func toDocument(t *testing.T, model any) bson.D {
+	raw, err := bson.Marshal(model)
+	require.NoError(t, err)
+
+	var document bson.D
+	require.NoError(t, bson.Unmarshal(raw, &document))
+	return document
+}
+
+// signingKeysResponse returns the response to a find of the given keys
+func signingKeysResponse(t *testing.T, keys ...SigningKey) bson.D {
+	documents := make([]bson.D, 0, len(keys))
+	for _, key := range keys {
+		documents = append(documents, toDocument(t, key))
+	}
+
+	return mtest.CreateCursorResponse(0, "auth.signingKeys", mtest.FirstBatch, documents...)
+}
+
+// signWith signs the claims with the given key, regardless of whether it is the current one
+func signWith(t *testing.T, key SigningKey, claims jwt.MapClaims) string {
+	seed, err := mongoutil.DecryptBytesWithKey(testEncryptionKey, key.EncryptedSeed)
+	require.NoError(t, err)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = key.Id
+	signed, err := token.SignedString(ed25519.NewKeyFromSeed(seed))
+	require.NoError(t, err)
+
+	return signed
+}
+
+func TestSigningKeyService_Load(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("rotates a retired key", func(mt *mtest.T) {
+		retired := testSigningKey(mt.T, -time.Minute)
+		fresh := testSigningKey(mt.T, time.Hour)
+		service := NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, nil)
+
+		mt.AddMockResponses(
+			signingKeysResponse(mt.T, retired),
+			mtest.CreateSuccessResponse(),
+			signingKeysResponse(mt.T, fresh, retired),
+		)
+
+		require.NoError(mt, service.Load())
+		assert.Equal(mt, []string{"find", "insert", "find"}, commands(mt))
+
+		// The new key is stored without its plaintext seed
+		inserted := mt.GetAllStartedEvents()[1].Command.Lookup("documents").Array().Index(0).Value().Document()
+		_, err := inserted.LookupErr("privateKey")
+		assert.Error(mt, err)
+		_, encryptedSeed := inserted.Lookup("encryptedSeed").Binary()
+		seed, err := mongoutil.DecryptBytesWithKey(testEncryptionKey, encryptedSeed)
+		require.NoError(mt, err)
+		assert.Len(mt, seed, ed25519.SeedSize)
+
+		// New tokens are signed with the fresh key, tokens signed with the retired key are still valid
+		signed, err := service.Sign(jwt.MapClaims{"sub": "user"})
+		require.NoError(mt, err)
+		token, err := service.Parse(signed)
+		require.NoError(mt, err)
+		assert.Equal(mt, fresh.Id, token.Header["kid"])
+
+		_, err = service.Parse(signWith(mt.T, retired, jwt.MapClaims{"sub": "user"}))
+		assert.NoError(mt, err)
+	})
+
+	mt.Run("keeps a current key", func(mt *mtest.T) {
+		current := testSigningKey(mt.T, time.Hour)
+		service := NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, nil)
+		mt.AddMockResponses(signingKeysResponse(mt.T, current))
+
+		require.NoError(mt, service.Load())
+		assert.Equal(mt, []string{"find"}, commands(mt))
+	})
+
+	mt.Run("fails with the wrong encryption key", func(mt *mtest.T) {
+		current := testSigningKey(mt.T, time.Hour)
+		service := NewSigningKeyService(mt.Coll, []byte("fedcba9876543210fedcba9876543210"), time.Hour, nil)
+		mt.AddMockResponses(signingKeysResponse(mt.T, current))
+
+		assert.ErrorContains(mt, service.Load(), "unable to decrypt signing key "+current.Id)
+	})
+}
+
+func TestSigningKeyService_Keyfunc(t *testing.T) {
+	key := testSigningKey(t, time.Hour)
+	other := testSigningKey(t, time.Hour)
+	legacySecret := []byte("legacy")
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("verifies tokens by key id", func(mt *mtest.T) {
+		service := NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, nil)
+		mt.AddMockResponses(signingKeysResponse(mt.T, key))
+		require.NoError(mt, service.Load())
+
+		_, err := service.Parse(signWith(mt.T, key, jwt.MapClaims{"sub": "user"}))
+		assert.NoError(mt, err)
+
+		// A token with the id of one key but signed by another
+		forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "user"})
+		forged.Header["kid"] = key.Id
+		otherSeed, err := mongoutil.DecryptBytesWithKey(testEncryptionKey, other.EncryptedSeed)
+		require.NoError(mt, err)
+		signed, err := forged.SignedString(ed25519.NewKeyFromSeed(otherSeed))
+		require.NoError(mt, err)
+		_, err = service.Parse(signed)
+		assert.ErrorIs(mt, err, jwt.ErrTokenSignatureInvalid)
+	})
+
+	mt.Run("pins the algorithm of the key", func(mt *mtest.T) {
+		service := NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, legacySecret)
+		mt.AddMockResponses(signingKeysResponse(mt.T, key))
+		require.NoError(mt, service.Load())
+
+		// The public key must not be usable as an HMAC secret
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"})
+		token.Header["kid"] = key.Id
+		signed, err := token.SignedString(key.PublicKey)
+		require.NoError(mt, err)
+
+		_, err = service.Parse(signed)
+		assert.ErrorContains(mt, err, "unexpected signing method HS256")
+	})
+
+	mt.Run("reloads unknown key ids at most once per interval", func(mt *mtest.T) {
+		service := NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, nil)
+		mt.AddMockResponses(signingKeysResponse(mt.T, key))
+		require.NoError(mt, service.Load())
+
+		// A key created by another replica since the last reload
+		service.lastReload = time.Now().Add(-signingKeyMinReloadInterval)
+		mt.AddMockResponses(signingKeysResponse(mt.T, other, key))
+		_, err := service.Parse(signWith(mt.T, other, jwt.MapClaims{"sub": "user"}))
+		assert.NoError(mt, err)
+
+		unknown := testSigningKey(mt.T, time.Hour)
+		_, err = service.Parse(signWith(mt.T, unknown, jwt.MapClaims{"sub": "user"}))
+		assert.ErrorIs(mt, err, UnknownSigningKeyError{unknown.Id})
+		assert.Equal(mt, []string{"find", "find"}, commands(mt))
+	})
+
+	mt.Run("accepts legacy tokens only with a legacy secret", func(mt *mtest.T) {
+		legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString(legacySecret)
+		require.NoError(mt, err)
+
+		service := NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, legacySecret)
+		_, err = service.Parse(legacy)
+		assert.NoError(mt, err)
+
+		wrongSecret, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString([]byte("wrong"))
+		require.NoError(mt, err)
+		_, err = service.Parse(wrongSecret)
+		assert.ErrorIs(mt, err, jwt.ErrTokenSignatureInvalid)
+
+		service = NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, nil)
+		_, err = service.Parse(legacy)
+		assert.Error(mt, err)
+
+		// Tokens without a key id are only accepted with HS256
+		unsigned := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "user"})
+		seed, err := mongoutil.DecryptBytesWithKey(testEncryptionKey, key.EncryptedSeed)
+		require.NoError(mt, err)
+		noKeyId, err := unsigned.SignedString(ed25519.NewKeyFromSeed(seed))
+		require.NoError(mt, err)
+		service = NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, legacySecret)
+		_, err = service.Parse(noKeyId)
+		assert.ErrorContains(mt, err, "token has no key id")
+		assert.Empty(mt, commands(mt))
+	})
+
+	mt.Run("rejects legacy tokens once they have expired", func(mt *mtest.T) {
+		legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString(legacySecret)
+		require.NoError(mt, err)
+
+		// Legacy tokens may still be valid right after the first key was created
+		service := NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, legacySecret)
+		mt.AddMockResponses(signingKeysResponse(mt.T, key))
+		require.NoError(mt, service.Load())
+		_, err = service.Parse(legacy)
+		assert.NoError(mt, err)
+
+		first := testSigningKey(mt.T, time.Hour)
+		first.CreatedAt = time.Now().Add(-accessTokenExpiry)
+		service = NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, legacySecret)
+		mt.AddMockResponses(signingKeysResponse(mt.T, key, first))
+		require.NoError(mt, service.Load())
+		_, err = service.Parse(legacy)
+		assert.ErrorContains(mt, err, "tokens without a key id are no longer accepted")
+	})
+}
+
+func TestSigningKeyService_JWKS(t *testing.T) {
+	current := testSigningKey(t, time.Hour)
+	retired := testSigningKey(t, -time.Minute)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("lists every key that hasn't expired", func(mt *mtest.T) {
+		service := NewSigningKeyService(mt.Coll, testEncryptionKey, time.Hour, nil)
+		mt.AddMockResponses(signingKeysResponse(mt.T, current, retired))
+		require.NoError(mt, service.Load())
+
+		set := service.JWKS()
+		require.Len(mt, set.Keys, 2)
+		for _, key := range set.Keys {
+			assert.Equal(mt, "OKP", key.KeyType)
+			assert.Equal(mt, "Ed25519", key.Curve)
+			assert.Equal(mt, "EdDSA", key.Algorithm)
+			assert.Equal(mt, "sig", key.Use)
+		}
+
+		byId := map[string]JSONWebKey{}
+		for _, key := range set.Keys {
+			byId[key.KeyId] = key
+		}
+		assert.Equal(mt, base64.RawURLEncoding.EncodeToString(current.PublicKey), byId[current.Id].X)
+		assert.Equal(mt, base64.RawURLEncoding.EncodeToString(retired.PublicKey), byId[retired.Id].X)
+	})
+}
+
+// commands returns the names of the commands that were sent
+func commands(mt *mtest.T) []string {
+	var names []string
+	for _, event := range mt.GetAllStartedEvents() {
+		names = append(names, event.CommandName)
+	}
+
+	return names
+}
@@ -1,48 +1,309 @@
 package internal
 
-import "os"
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
 
 var appBaseUrl = os.Getenv("APP_BASE_URL")
 
-var resetPasswordInitHtml = `
-<h2>Reset password</h2>
-<p>Enter a new password for your account.</p>
-<form method="post" action="/auth/reset">
-	<input type="hidden" name="token" value="%s">
-	<input type="password" name="password" placeholder="Password">
-	<input type="submit" value="Reset password">
-</form>`
-
-var resetPasswordHtml = `
-<p>Your password has been reset. You can now <a href="%s/settings">login</a>.</p>
-
-<style>
-	body {
-		display: flex;
-		justify-content: center;
-		align-items: center;
-		font-family: 'Inter', sans-serif;
-		background-color: #008000;
-		color: white;
-		text-align: center;
-		height: 100vh;
-	}
-</style>		
+// oidcCallbackHtml sends the browser back to the client after logging in with an identity provider
+var oidcCallbackHtml = `
+<meta http-equiv="refresh" content="0; url=%[1]s">
+<p>Returning to <a href="%[1]s">Perfice</a>...</p>
 `
 
-var confirmEmailHtml = `
-<p>Your email address has been confirmed. You can now <a href="%s/settings">login</a>.</p>
-
-<style>
-	body {
-		display: flex;
-		justify-content: center;
-		align-items: center;
-		font-family: 'Inter', sans-serif;
-		background-color: #008000;
-		color: white;
-		text-align: center;
-		height: 100vh;
-	}
-</style>		
-`
+//go:embed templates
+var embeddedTemplates embed.FS
+
+var defaultLocale = "en"
+
+// mailTemplates have an HTML and a text version, where the text version also defines the subject
+var mailTemplates = []string{"confirm_email", "reset_password"}
+
+// pageTemplates are shown in the browser and are rendered within layout.html
+var pageTemplates = []string{"email_confirmed", "reset_password_form", "password_reset"}
+
+// Templates renders mails and pages in the locale of the user. Templates are read from a directory per locale, and
+// templates missing from a locale fall back to the default locale.
+type Templates struct {
+	locales []string
+	html    map[string]*htmltemplate.Template
+	text    map[string]*texttemplate.Template
+}
+
+// templateSource reads a template from the override directory if it has it, and otherwise from the embedded templates
+type templateSource struct {
+	override fs.FS
+	base     fs.FS
+}
+
+func (s templateSource) read(name string) (string, error) {
+	if s.override != nil {
+		content, err := fs.ReadFile(s.override, name)
+		if err == nil {
+			return string(content), nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	content, err := fs.ReadFile(s.base, name)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+// readLocale reads a template of a locale, falling back to the template of the default locale
+func (s templateSource) readLocale(locale string, name string) (string, error) {
+	content, err := s.read(locale + "/" + name)
+	if errors.Is(err, fs.ErrNotExist) && locale != defaultLocale {
+		return s.read(defaultLocale + "/" + name)
+	}
+
+	return content, err
+}
+
+// locales returns the directories of both sources, so operators can add locales by adding a directory
+func (s templateSource) locales() ([]string, error) {
+	found := map[string]bool{}
+	for _, fsys := range []fs.FS{s.base, s.override} {
+		if fsys == nil {
+			continue
+		}
+
+		entries, err := fs.ReadDir(fsys, ".")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				found[entry.Name()] = true
+			}
+		}
+	}
+
+	locales := make([]string, 0, len(found))
+	for locale := range found {
+		locales = append(locales, locale)
+	}
+
+	sort.Strings(locales)
+	return locales, nil
+}
+
+// templatesFromEnv loads the embedded templates, overridden by the templates in TEMPLATES_DIR if it is set
+func templatesFromEnv() (*Templates, error) {
+	var override fs.FS
+	if dir := os.Getenv("TEMPLATES_DIR"); dir != "" {
+		override = os.DirFS(dir)
+	}
+
+	return NewTemplates(override)
+}
+
+func NewTemplates(override fs.FS) (*Templates, error) {
+	base, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	source := templateSource{override, base}
+	locales, err := source.locales()
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := source.read("layout.html")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := &Templates{locales, map[string]*htmltemplate.Template{}, map[string]*texttemplate.Template{}}
+	for _, locale := range locales {
+		for _, name := range mailTemplates {
+			if err := templates.parseHtml(source, locale, name, ""); err != nil {
+				return nil, err
+			}
+
+			content, err := source.readLocale(locale, name+".txt")
+			if err != nil {
+				return nil, err
+			}
+
+			text, err := texttemplate.New(name).Option("missingkey=error").Parse(content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s/%s.txt: %w", locale, name, err)
+			}
+
+			templates.text[locale+"/"+name] = text
+		}
+
+		for _, name := range pageTemplates {
+			if err := templates.parseHtml(source, locale, name, layout); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return templates, nil
+}
+
+func (t *Templates) parseHtml(source templateSource, locale string, name string, layout string) error {
+	content, err := source.readLocale(locale, name+".html")
+	if err != nil {
+		return err
+	}
+
+	var html *htmltemplate.Template
+	if layout == "" {
+		html, err = htmltemplate.New(name).Option("missingkey=error").Parse(content)
+	} else {
+		// Pages execute the layout, which includes the templates the page defines
+		html, err = htmltemplate.New("layout").Option("missingkey=error").Parse(layout)
+		if err != nil {
+			return fmt.Errorf("failed to parse layout.html: %w", err)
+		}
+
+		_, err = html.New(name).Parse(content)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s/%s.html: %w", locale, name, err)
+	}
+
+	t.html[locale+"/"+name] = html
+	return nil
+}
+
+func (t *Templates) Locales() []string {
+	return t.locales
+}
+
+// MatchLocale returns the locale itself if there are templates for it, otherwise its language or the default locale
+func (t *Templates) MatchLocale(locale string) string {
+	if locale, ok := t.findLocale(locale); ok {
+		return locale
+	}
+
+	return defaultLocale
+}
+
+func (t *Templates) findLocale(locale string) (string, bool) {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	for _, candidate := range []string{locale, strings.SplitN(locale, "-", 2)[0]} {
+		for _, supported := range t.locales {
+			if strings.ToLower(supported) == candidate {
+				return supported, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// MatchAcceptLanguage returns the supported locale the browser prefers, according to an Accept-Language header
+func (t *Templates) MatchAcceptLanguage(header string) string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+
+			quality = parsed
+		}
+
+		if tag != "" && quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	for _, language := range languages {
+		if locale, ok := t.findLocale(language.tag); ok {
+			return locale
+		}
+	}
+
+	return defaultLocale
+}
+
+// RenderMail returns the subject, HTML and text of a mail, the recipient still has to be set
+func (t *Templates) RenderMail(locale string, name string, data map[string]any) (Mail, error) {
+	locale = t.MatchLocale(locale)
+	html, ok := t.html[locale+"/"+name]
+	text, textOk := t.text[locale+"/"+name]
+	if !ok || !textOk {
+		return Mail{}, fmt.Errorf("unknown mail template %s", name)
+	}
+
+	data = withLocale(data, locale)
+	var subject, htmlBody, textBody bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Mail{}, err
+	}
+
+	if err := text.Execute(&textBody, data); err != nil {
+		return Mail{}, err
+	}
+
+	if err := html.Execute(&htmlBody, data); err != nil {
+		return Mail{}, err
+	}
+
+	return Mail{
+		Subject: strings.TrimSpace(subject.String()),
+		Html:    htmlBody.String(),
+		Text:    textBody.String(),
+	}, nil
+}
+
+func (t *Templates) RenderPage(locale string, name string, data map[string]any) (string, error) {
+	locale = t.MatchLocale(locale)
+	html, ok := t.html[locale+"/"+name]
+	if !ok {
+		return "", fmt.Errorf("unknown page template %s", name)
+	}
+
+	var page bytes.Buffer
+	if err := html.ExecuteTemplate(&page, "layout", withLocale(data, locale)); err != nil {
+		return "", err
+	}
+
+	return page.String(), nil
+}
+
+// withLocale copies the data and adds the locale, which templates use for the lang attribute
+func withLocale(data map[string]any, locale string) map[string]any {
+	copied := map[string]any{"Locale": locale}
+	for key, value := range data {
+		copied[key] = value
+	}
+
+	return copied
+}
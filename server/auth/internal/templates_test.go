@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTemplateData = map[string]any{
+	"Url":         "https://backend.example.com/auth/confirm/token",
+	"AppBaseUrl":  "https://app.example.com",
+	"Token":       "token",
+	"MfaRequired": true,
+}
+
+func TestTemplates_RenderAll(t *testing.T) {
+	templates, err := NewTemplates(nil)
+	assert.NoError(t, err)
+	assert.Contains(t, templates.Locales(), defaultLocale)
+
+	for _, locale := range templates.Locales() {
+		// Every embedded locale has its own translation of every template, rather than falling back to the default
+		for _, name := range mailTemplates {
+			for _, extension := range []string{".html", ".txt"} {
+				_, err := fs.Stat(embeddedTemplates, "templates/"+locale+"/"+name+extension)
+				assert.NoError(t, err, "%s/%s%s", locale, name, extension)
+			}
+
+			mail, err := templates.RenderMail(locale, name, testTemplateData)
+			assert.NoError(t, err, "%s/%s", locale, name)
+			assert.NotEmpty(t, mail.Subject)
+			assert.NotContains(t, mail.Subject, "\n")
+			assert.Contains(t, mail.Html, "https://backend.example.com/auth/confirm/token")
+			assert.Contains(t, mail.Text, "https://backend.example.com/auth/confirm/token")
+		}
+
+		for _, name := range pageTemplates {
+			_, err := fs.Stat(embeddedTemplates, "templates/"+locale+"/"+name+".html")
+			assert.NoError(t, err, "%s/%s.html", locale, name)
+
+			page, err := templates.RenderPage(locale, name, testTemplateData)
+			assert.NoError(t, err, "%s/%s", locale, name)
+			assert.Contains(t, page, `<html lang="`+locale+`">`)
+			assert.Contains(t, page, "<title>")
+		}
+	}
+}
+
+func TestTemplates_RenderEscapes(t *testing.T) {
+	templates, err := NewTemplates(nil)
+	assert.NoError(t, err)
+
+	page, err := templates.RenderPage(defaultLocale, "reset_password_form", map[string]any{
+		"Token":       `"><script>`,
+		"MfaRequired": false,
+	})
+	assert.NoError(t, err)
+	assert.NotContains(t, page, "<script>")
+	assert.NotContains(t, page, `name="code"`)
+
+	_, err = templates.RenderMail(defaultLocale, "confirm_email", map[string]any{})
+	assert.Error(t, err)
+}
+
+func TestTemplates_Override(t *testing.T) {
+	templates, err := NewTemplates(fstest.MapFS{
+		"en/confirm_email.txt":  {Data: []byte(`{{define "subject"}}Welcome{{end}}Open {{.Url}}`)},
+		"nl/confirm_email.html": {Data: []byte(`<p>Bevestig: <a href="{{.Url}}">{{.Url}}</a></p>`)},
+		"nl/confirm_email.txt":  {Data: []byte(`{{define "subject"}}Bevestig je e-mailadres{{end}}Bevestig: {{.Url}}`)},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, templates.Locales(), "nl")
+
+	mail, err := templates.RenderMail("en", "confirm_email", testTemplateData)
+	assert.NoError(t, err)
+	assert.Equal(t, "Welcome", mail.Subject)
+	assert.Equal(t, "Open https://backend.example.com/auth/confirm/token", mail.Text)
+	// Templates that aren't overridden are still embedded ones
+	assert.Contains(t, mail.Html, "Welcome to Perfice!")
+
+	mail, err = templates.RenderMail("nl-BE", "confirm_email", testTemplateData)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bevestig je e-mailadres", mail.Subject)
+
+	// A new locale falls back to the default locale for templates it doesn't have
+	page, err := templates.RenderPage("nl", "email_confirmed", testTemplateData)
+	assert.NoError(t, err)
+	assert.Contains(t, page, `<html lang="nl">`)
+	assert.Contains(t, page, "Your email address has been confirmed")
+
+	_, err = NewTemplates(fstest.MapFS{"en/confirm_email.html": {Data: []byte("{{.Url")}})
+	assert.Error(t, err)
+}
+
+func TestTemplates_MatchLocale(t *testing.T) {
+	templates, err := NewTemplates(nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "sv", templates.MatchLocale("sv"))
+	assert.Equal(t, "sv", templates.MatchLocale("sv-SE"))
+	assert.Equal(t, defaultLocale, templates.MatchLocale("xx"))
+	assert.Equal(t, defaultLocale, templates.MatchLocale(""))
+
+	assert.Equal(t, "sv", templates.MatchAcceptLanguage("de-DE,sv-SE;q=0.9,en;q=0.8"))
+	assert.Equal(t, "en", templates.MatchAcceptLanguage("sv;q=0.5, en-GB"))
+	assert.Equal(t, "en", templates.MatchAcceptLanguage("sv;q=0, de"))
+	assert.Equal(t, defaultLocale, templates.MatchAcceptLanguage(""))
+	assert.Equal(t, defaultLocale, templates.MatchAcceptLanguage("*"))
+}
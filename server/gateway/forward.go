@@ -3,8 +3,8 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"net/http"
+	"net/netip"
 	"slices"
 	"strings"
 
@@ -55,6 +55,11 @@ func (r *RequestForwarder) forwardRequest(httpClient http.Client, c *fiber.Ctx,
 		req.Header.Set(keyString, string(value))
 	})
 
+	// X-Real-IP is the address of the client as seen through trusted proxies, services use it instead of parsing
+	// X-Forwarded-For themselves
+	req.Header.Set("x-forwarded-for", proxyConfig.forwardedFor(c))
+	req.Header.Set("x-real-ip", proxyConfig.clientIP(c))
+
 	if val := c.Locals(userIdLocal); val != nil {
 		req.Header.Set("x-userid", val.(string))
 	}
@@ -77,7 +82,6 @@ func (r *RequestForwarder) forwardRequest(httpClient http.Client, c *fiber.Ctx,
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
-	defer resp.Body.Close()
 
 	for k, v := range resp.Header {
 		for _, val := range v {
@@ -87,12 +91,97 @@ func (r *RequestForwarder) forwardRequest(httpClient http.Client, c *fiber.Ctx,
 
 	c.Status(resp.StatusCode)
 
-	body, err := io.ReadAll(resp.Body)
+	// Responses are streamed instead of buffered, so large responses and server-sent events pass through as they arrive.
+	// The body is closed by fasthttp once it has been fully written or the client disconnects.
+	c.Response().SetBodyStream(resp.Body, int(resp.ContentLength))
+	return nil
+}
+
+// ProxyConfig resolves the address of the client through the reverse proxies in front of the gateway
+type ProxyConfig struct {
+	trusted []netip.Prefix
+	// header lists the addresses a request passed through, proxies append the address they received it from
+	header string
+}
+
+var proxyConfig ProxyConfig
+
+// parseProxy parses an address or a CIDR range
+func parseProxy(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(value)
 	if err != nil {
-		return err
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func (p ProxyConfig) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func peerAddr(c *fiber.Ctx) netip.Addr {
+	addr, _ := netip.AddrFromSlice(c.Context().RemoteIP())
+	return addr.Unmap()
+}
+
+// resolveClientIP walks the chain of addresses from the right, from the proxy closest to the gateway, and returns the
+// first address that isn't a trusted proxy. Entries left of it were added by the client and can't be trusted.
+func (p ProxyConfig) resolveClientIP(peer netip.Addr, chain string) netip.Addr {
+	client := peer
+	if !p.isTrusted(peer) {
+		return client
+	}
+
+	entries := strings.Split(chain, ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			// Garbage can only have been added by the client, fall back to the last address a proxy vouched for
+			return client
+		}
+
+		client = addr.Unmap()
+		if !p.isTrusted(client) {
+			return client
+		}
+	}
+
+	return client
+}
+
+// clientIP returns the address of the client as seen through the trusted proxies
+func (p ProxyConfig) clientIP(c *fiber.Ctx) string {
+	return p.resolveClientIP(peerAddr(c), c.Get(p.header)).String()
+}
+
+// forwardedFor appends the address the request came from to X-Forwarded-For. The existing chain is only kept if it
+// was sent by a trusted proxy, anyone else could have made it up.
+func (p ProxyConfig) forwardedFor(c *fiber.Ctx) string {
+	peer := peerAddr(c)
+	chain := c.Get(fiber.HeaderXForwardedFor)
+	if chain == "" || !p.isTrusted(peer) {
+		return peer.String()
 	}
 
-	return c.Send(body)
+	return chain + ", " + peer.String()
 }
 
 func (r *RequestForwarder) handlerNew(route *ForwardedRoute) []fiber.Handler {
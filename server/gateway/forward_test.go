@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyConfig_ResolveClientIP(t *testing.T) {
+	proxy, err := parseProxy("10.0.0.0/8")
+	assert.NoError(t, err)
+	config := ProxyConfig{trusted: []netip.Prefix{proxy}, header: "X-Forwarded-For"}
+
+	tests := []struct {
+		name  string
+		peer  string
+		chain string
+		want  string
+	}{
+		{"untrusted peer ignores the header", "203.0.113.9", "198.51.100.1", "203.0.113.9"},
+		{"single proxy", "10.0.0.2", "198.51.100.1", "198.51.100.1"},
+		// A proxy that appends keeps what the client sent on the left
+		{"spoofed entries are skipped", "10.0.0.2", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"chain of proxies", "10.0.0.2", "1.2.3.4, 198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"garbage falls back to the proxy", "10.0.0.2", "198.51.100.1, garbage, 10.0.0.3", "10.0.0.3"},
+		{"missing header", "10.0.0.2", "", "10.0.0.2"},
+		{"only proxies", "10.0.0.2", "10.0.0.4, 10.0.0.3", "10.0.0.4"},
+		{"mapped addresses", "::ffff:10.0.0.2", "::ffff:198.51.100.1", "198.51.100.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := config.resolveClientIP(netip.MustParseAddr(test.peer).Unmap(), test.chain)
+			assert.Equal(t, test.want, got.String())
+		})
+	}
+
+	// Without trusted proxies the header is never used
+	assert.Equal(t, "10.0.0.2", ProxyConfig{}.resolveClientIP(netip.MustParseAddr("10.0.0.2"), "198.51.100.1").String())
+}
+
+func TestParseProxy(t *testing.T) {
+	prefix, err := parseProxy("192.168.1.7")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.7/32", prefix.String())
+
+	prefix, err = parseProxy("192.168.1.7/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.0/24", prefix.String())
+
+	_, err = parseProxy("proxy.example.com")
+	assert.Error(t, err)
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -40,10 +42,11 @@ func (a *Gateway) routeAuthService(app *fiber.App, httpClient *http.Client) {
 	remoteBase := os.Getenv("AUTH_HTTP_URL")
 	authGroup := app.Group("/auth")
 	forwarder := newRequestForwarderWithHeaders(remoteBase, a.authMiddleware, httpClient, &authGroup, false,
-		[]string{"content-type", "authorization"})
+		[]string{"content-type", "authorization", "user-agent", "accept-language"})
 
 	forwarder.Get("/me", "/me").Forward()
 	forwarder.Post("/login", "/login").Forward()
+	forwarder.Post("/login/mfa", "/login/mfa").Forward()
 	forwarder.Post("/register", "/register").Forward()
 	forwarder.Post("/logout", "/logout"). /*.Authenticated()*/ Forward()
 	forwarder.Post("/refresh", "/refresh").
@@ -51,17 +54,40 @@ func (a *Gateway) routeAuthService(app *fiber.App, httpClient *http.Client) {
 	forwarder.Put("/timezone", "/timezone").
 		//Authenticated().
 		Forward()
+	forwarder.Put("/locale", "/locale").Forward()
 	forwarder.Post("/delete", "/delete"). /*.Authenticated()*/ Forward()
 	forwarder.Get("/confirm/:token", "/confirm/%s", "token").Forward()
 	forwarder.Post("/reset", "/reset").Forward()
 	forwarder.Post("/resendConfirm", "/resendConfirm").Forward()
 	forwarder.Post("/resetInit", "/resetInit").Forward()
 	forwarder.Get("/reset/:token", "/reset/%s", "token").Forward()
+	forwarder.Get("/sessions", "/sessions").Forward()
+	forwarder.Delete("/sessions", "/sessions").Forward()
+	forwarder.Put("/sessions/:id", "/sessions/%s", "id").Forward()
+	forwarder.Delete("/sessions/:id", "/sessions/%s", "id").Forward()
+	forwarder.Get("/mfa", "/mfa").Forward()
+	forwarder.Post("/mfa/totp/enroll", "/mfa/totp/enroll").Forward()
+	forwarder.Post("/mfa/totp/confirm", "/mfa/totp/confirm").Forward()
+	forwarder.Delete("/mfa/totp", "/mfa/totp").Forward()
+	forwarder.Post("/mfa/recoveryCodes", "/mfa/recoveryCodes").Forward()
+	forwarder.Post("/register/passkey/begin", "/register/passkey/begin").Forward()
+	forwarder.Post("/register/passkey/finish", "/register/passkey/finish").Forward()
+	forwarder.Post("/login/passkey/begin", "/login/passkey/begin").Forward()
+	forwarder.Post("/login/passkey/finish", "/login/passkey/finish").Forward()
+	forwarder.Get("/passkeys", "/passkeys").Forward()
+	forwarder.Post("/passkeys/register/begin", "/passkeys/register/begin").Forward()
+	forwarder.Post("/passkeys/register/finish", "/passkeys/register/finish").Forward()
+	forwarder.Delete("/passkeys/:id", "/passkeys/%s", "id").Forward()
+	forwarder.Get("/oidc/providers", "/oidc/providers").Forward()
+	forwarder.Get("/oidc/:provider/redirect", "/oidc/%s/redirect", "provider").Forward()
+	forwarder.Get("/oidc/:provider/callback", "/oidc/%s/callback", "provider").Cookies("oidc_state").Forward()
+	forwarder.Post("/oidc/login", "/oidc/login").Forward()
 
 	baseRouter := app.Group("/")
 	baseForwarder := newRequestForwarder(remoteBase, a.authMiddleware, httpClient, &baseRouter, false)
 	baseForwarder.Post("/feedback", "/feedback").
 		Forward()
+	baseForwarder.Get("/.well-known/jwks.json", "/.well-known/jwks.json").Forward()
 }
 
 func (a *Gateway) routeSyncService(app *fiber.App, httpClient *http.Client) {
@@ -71,11 +97,24 @@ func (a *Gateway) routeSyncService(app *fiber.App, httpClient *http.Client) {
 	forwarder := newRequestForwarder(remoteBase, a.authMiddleware, httpClient, &integrationGroup, true)
 	forwarder.Post("/push", "/push").Forward()
 	forwarder.Post("/pull", "/pull").Forward()
+	forwarder.Get("/stream", "/stream").Forward()
 	forwarder.Post("/ack", "/ack").Forward()
+	forwarder.Post("/fullPush", "/fullPush").Forward()
 	forwarder.Post("/fullPull", "/fullPull").Forward()
+	forwarder.Post("/fullPull/stream", "/fullPull/stream").Forward()
 	forwarder.Get("/key", "/key").Forward()
 	forwarder.Put("/key", "/key").Forward()
+	forwarder.Post("/key/challenge", "/key/challenge").Forward()
+	forwarder.Get("/key/generations", "/key/generations").Forward()
+	forwarder.Get("/key/rotation", "/key/rotation").Forward()
+	forwarder.Post("/key/rotation", "/key/rotation").Forward()
+	forwarder.Delete("/key/rotation", "/key/rotation").Forward()
+	forwarder.Post("/key/rotation/entities", "/key/rotation/entities").Forward()
+	forwarder.Post("/key/rotation/commit", "/key/rotation/commit").Forward()
 	forwarder.Get("/salt", "/salt").Forward()
+	forwarder.Get("/usage", "/usage").Forward()
+	forwarder.Get("/backup", "/backup").Forward()
+	forwarder.Post("/backup/import", "/backup/import").Forward()
 }
 
 func (a *Gateway) routeIntegrationService(app *fiber.App, httpClient *http.Client) {
@@ -115,17 +154,68 @@ func (a *Gateway) setupSentry() {
 	}
 }
 
+var defaultBodyLimit = 64 << 20
+
+// bodyLimitFromEnv reads BODY_LIMIT, the largest request in bytes that is forwarded. It has to fit sync backups.
+func bodyLimitFromEnv() int {
+	value := os.Getenv("BODY_LIMIT")
+	if value == "" {
+		return defaultBodyLimit
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		log.Fatalf("invalid BODY_LIMIT: %s", value)
+	}
+
+	return limit
+}
+
+// proxyConfigFromEnv reads TRUSTED_PROXIES, a comma separated list of addresses and CIDR ranges of the proxies that
+// report the address of the client in PROXY_HEADER, X-Forwarded-For by default. Without trusted proxies the address
+// of the connection is used, since anyone could set the header.
+func proxyConfigFromEnv() ProxyConfig {
+	config := ProxyConfig{header: os.Getenv("PROXY_HEADER")}
+	if config.header == "" {
+		config.header = fiber.HeaderXForwardedFor
+	}
+
+	for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		prefix, err := parseProxy(value)
+		if err != nil {
+			log.Fatalf("invalid TRUSTED_PROXIES entry %s: %v", value, err)
+		}
+
+		config.trusted = append(config.trusted, prefix)
+	}
+
+	return config
+}
+
 func (a *Gateway) run() {
-	httpClient := http.Client{}
-
-	app := fiber.New(
-		fiber.Config{
-			ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-				log.Println("Error occurred:", err)
-				sentry.CaptureException(err)
-				return ctx.SendStatus(fiber.StatusInternalServerError)
-			},
-		})
+	httpClient := http.Client{
+		// Redirects are passed on to the client, like the one to the identity provider when logging in
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	config := fiber.Config{
+		BodyLimit: bodyLimitFromEnv(),
+		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
+			log.Println("Error occurred:", err)
+			sentry.CaptureException(err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		},
+	}
+	proxyConfig = proxyConfigFromEnv()
+
+	app := fiber.New(config)
 
 	app.Use(recover.New(
 		recover.Config{
@@ -21,6 +21,7 @@ import (
 	"perfice.adoe.dev/integration/internal/controller"
 	"perfice.adoe.dev/integration/internal/model"
 	"perfice.adoe.dev/integration/internal/service"
+	"perfice.adoe.dev/mongoutil"
 	pb "perfice.adoe.dev/proto"
 )
 
@@ -54,6 +55,13 @@ func NewIntegrationApp() *IntegrationApp {
 }
 
 func (a *IntegrationApp) setupServices() {
+	if err := mongoutil.RunMigrations(a.db, integrationMigrations); err != nil {
+		panic(err)
+	}
+
+	if err := mongoutil.EnsureIndexesLogged(a.db, integrationIndexes); err != nil {
+		sentry.CaptureException(err)
+	}
 	integrationTypeCollection := collection.NewIntegrationTypeCollection(a.db.Collection("integration_types"))
 	integrationEntityCollection := collection.NewIntegrationEntityCollection(a.db.Collection("integration_entities"))
 	a.integrationTypeService = service.NewIntegrationTypeService(integrationTypeCollection, integrationEntityCollection)
@@ -0,0 +1,17 @@
+package internal
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var integrationIndexes = []mongoutil.IndexSpec{
+	{Collection: "user_integrations", Keys: bson.D{{Key: "id", Value: 1}}, Unique: true},
+	{Collection: "user_integrations", Keys: bson.D{{Key: "userId", Value: 1}}},
+	// Integrations without a webhook don't have a token
+	{Collection: "user_integrations", Keys: bson.D{{Key: "webhook.token", Value: 1}}, Unique: true, Sparse: true},
+	{Collection: "integration_auth", Keys: bson.D{{Key: "user", Value: 1}, {Key: "integrationType", Value: 1}}},
+	{Collection: "integration_updates", Keys: bson.D{{Key: "userId", Value: 1}}},
+	{Collection: "integration_updates", Keys: bson.D{{Key: "integrationId", Value: 1}, {Key: "identifier", Value: 1}}},
+	{Collection: "entity_log", Keys: bson.D{{Key: "integrationId", Value: 1}, {Key: "identifier", Value: 1}}},
+}
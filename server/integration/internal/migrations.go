@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var integrationMigrations = []mongoutil.Migration{
+	{
+		Version:     1,
+		Description: "move legacy url and interval of integration entities into a pull source",
+		Up: func(db *mongo.Database) error {
+			_, err := db.Collection("integration_entities").UpdateMany(context.Background(),
+				bson.M{"url": bson.M{"$exists": true}},
+				mongo.Pipeline{
+					{{Key: "$set", Value: bson.M{"sources": bson.M{"$cond": bson.A{
+						// Entities that already have sources only need the legacy fields removed
+						bson.M{"$gt": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{"$sources", bson.A{}}}}, 0}},
+						"$sources",
+						bson.A{bson.M{"type": "pull", "settings": bson.M{"url": "$url", "interval": "$interval"}}},
+					}}}}},
+					{{Key: "$unset", Value: bson.A{"url", "interval"}}},
+				})
+			return err
+		},
+	},
+}
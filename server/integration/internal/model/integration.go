@@ -21,20 +21,18 @@ type IntegrationOption struct {
 }
 
 type IntegrationEntityDefinition struct {
-	EntityType      string                    `json:"entityType" bson:"entityType"`
-	Name            string                    `json:"name" bson:"name"`
-	IntegrationType string                    `json:"integrationType" bson:"integrationType"`
-	Sources         []IntegrationEntitySource `json:"sources" bson:"sources"`
-	//URL             string                            `json:"url" bson:"url"`
-	//Interval        IntegrationFetchInterval          `json:"interval" bson:"interval"`
-	Identifier  string                            `json:"identifier" bson:"identifier"`
-	Timestamp   any                               `json:"timestamp" bson:"timestamp"`
-	Multiple    string                            `json:"multiple,omitempty" bson:"multiple"`
-	History     *HistoryOptions                   `json:"history" bson:"history"`
-	Fields      map[string]IntegrationEntityField `json:"fields" bson:"fields"`
-	Schema      map[string]interface{}            `json:"schema" bson:"schema"`
-	LogSettings *IntegrationEntityLogSettings     `json:"logSettings" bson:"logSettings"`
-	Options     map[string]IntegrationOption      `json:"options" bson:"options"`
+	EntityType      string                            `json:"entityType" bson:"entityType"`
+	Name            string                            `json:"name" bson:"name"`
+	IntegrationType string                            `json:"integrationType" bson:"integrationType"`
+	Sources         []IntegrationEntitySource         `json:"sources" bson:"sources"`
+	Identifier      string                            `json:"identifier" bson:"identifier"`
+	Timestamp       any                               `json:"timestamp" bson:"timestamp"`
+	Multiple        string                            `json:"multiple,omitempty" bson:"multiple"`
+	History         *HistoryOptions                   `json:"history" bson:"history"`
+	Fields          map[string]IntegrationEntityField `json:"fields" bson:"fields"`
+	Schema          map[string]interface{}            `json:"schema" bson:"schema"`
+	LogSettings     *IntegrationEntityLogSettings     `json:"logSettings" bson:"logSettings"`
+	Options         map[string]IntegrationOption      `json:"options" bson:"options"`
 }
 
 var PullIntegrationEntitySourceType = "pull"
@@ -354,7 +354,17 @@ func Float64frombytes(bytes []byte) float64 {
 }
 
 func encryptBytes(bytes []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(encryptionKey)
+	return EncryptBytesWithKey(encryptionKey, bytes)
+}
+
+func decryptBytes(bytes []byte) ([]byte, error) {
+	return DecryptBytesWithKey(encryptionKey, bytes)
+}
+
+// EncryptBytesWithKey encrypts bytes the same way as fields tagged with encrypt, but with the given key instead of
+// ENCRYPTION_KEY
+func EncryptBytesWithKey(key []byte, bytes []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
 	if err != nil {
 		return nil, err
 	}
@@ -370,8 +380,8 @@ func encryptBytes(bytes []byte) ([]byte, error) {
 	return encryptedBytes, nil
 }
 
-func decryptBytes(bytes []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(encryptionKey)
+func DecryptBytesWithKey(key []byte, bytes []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
 	if err != nil {
 		return nil, err
 	}
@@ -389,3 +399,13 @@ func decryptBytes(bytes []byte) ([]byte, error) {
 
 	return plaintext, nil
 }
+
+// ReencryptBytes decrypts an encrypted field with the old key and encrypts it again with the new key
+func ReencryptBytes(oldKey []byte, newKey []byte, bytes []byte) ([]byte, error) {
+	plaintext, err := DecryptBytesWithKey(oldKey, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return EncryptBytesWithKey(newKey, plaintext)
+}
@@ -0,0 +1,201 @@
+package mongoutil
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexSpec declares an index that should exist on a collection
+type IndexSpec struct {
+	Collection string
+	Keys       bson.D
+	// Name defaults to the name MongoDB would generate from the keys, e.g. "user_1_id_1"
+	Name   string
+	Unique bool
+	Sparse bool
+	// TTL removes documents once the indexed date field is more than ExpireAfter in the past
+	TTL         bool
+	ExpireAfter time.Duration
+}
+
+func (s IndexSpec) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	parts := make([]string, 0, len(s.Keys))
+	for _, key := range s.Keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", key.Key, key.Value))
+	}
+
+	return strings.Join(parts, "_")
+}
+
+func (s IndexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(s.name())
+	if s.Unique {
+		opts.SetUnique(true)
+	}
+
+	if s.Sparse {
+		opts.SetSparse(true)
+	}
+
+	if s.TTL {
+		opts.SetExpireAfterSeconds(int32(s.ExpireAfter.Seconds()))
+	}
+
+	return mongo.IndexModel{Keys: s.Keys, Options: opts}
+}
+
+// IndexDrift describes a difference between the declared and the existing indexes of a collection
+type IndexDrift struct {
+	Collection string
+	Name       string
+	Reason     string
+}
+
+func (d IndexDrift) String() string {
+	return fmt.Sprintf("%s.%s: %s", d.Collection, d.Name, d.Reason)
+}
+
+// EnsureIndexes creates every declared index that is missing. Existing indexes are never dropped or changed;
+// indexes whose definition differs from the declaration and indexes that were not declared are reported as drift.
+// Failing to create one index does not prevent the others from being created.
+func EnsureIndexes(db *mongo.Database, specs []IndexSpec) ([]IndexDrift, error) {
+	byCollection := map[string][]IndexSpec{}
+	var order []string
+	for _, spec := range specs {
+		if _, ok := byCollection[spec.Collection]; !ok {
+			order = append(order, spec.Collection)
+		}
+
+		byCollection[spec.Collection] = append(byCollection[spec.Collection], spec)
+	}
+
+	var drift []IndexDrift
+	var errs []error
+	for _, collectionName := range order {
+		collectionDrift, err := ensureCollectionIndexes(db.Collection(collectionName), byCollection[collectionName])
+		drift = append(drift, collectionDrift...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return drift, errors.Join(errs...)
+}
+
+// EnsureIndexesLogged ensures the indexes like EnsureIndexes and logs the drift. Services keep running if indexes
+// can't be created, so the returned error is only meant to be reported.
+func EnsureIndexesLogged(db *mongo.Database, specs []IndexSpec) error {
+	drift, err := EnsureIndexes(db, specs)
+	for _, d := range drift {
+		log.Println("Index drift:", d)
+	}
+
+	if err != nil {
+		log.Println("Failed to ensure indexes:", err)
+		return fmt.Errorf("failed to ensure indexes: %w", err)
+	}
+
+	return nil
+}
+
+func ensureCollectionIndexes(collection *mongo.Collection, specs []IndexSpec) ([]IndexDrift, error) {
+	existing, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexes of %s: %w", collection.Name(), err)
+	}
+
+	existingByName := map[string]*mongo.IndexSpecification{}
+	for _, index := range existing {
+		existingByName[index.Name] = index
+	}
+
+	var drift []IndexDrift
+	var errs []error
+	declared := map[string]bool{}
+	for _, spec := range specs {
+		name := spec.name()
+		declared[name] = true
+
+		if index, ok := existingByName[name]; ok {
+			if reason := compareIndex(spec, index); reason != "" {
+				drift = append(drift, IndexDrift{collection.Name(), name, reason})
+			}
+
+			continue
+		}
+
+		if _, err := collection.Indexes().CreateOne(ctx, spec.model()); err != nil {
+			drift = append(drift, IndexDrift{collection.Name(), name, "missing, creation failed"})
+			errs = append(errs, fmt.Errorf("failed to create index %s on %s: %w", name, collection.Name(), err))
+		}
+	}
+
+	for _, index := range existing {
+		if index.Name != "_id_" && !declared[index.Name] {
+			drift = append(drift, IndexDrift{collection.Name(), index.Name, "not declared"})
+		}
+	}
+
+	return drift, errors.Join(errs...)
+}
+
+// compareIndex returns why an existing index doesn't match its declaration, or an empty string if it does
+func compareIndex(spec IndexSpec, index *mongo.IndexSpecification) string {
+	if !keysEqual(spec.Keys, index.KeysDocument) {
+		return "keys differ"
+	}
+
+	if spec.Unique != (index.Unique != nil && *index.Unique) {
+		return "unique option differs"
+	}
+
+	if spec.Sparse != (index.Sparse != nil && *index.Sparse) {
+		return "sparse option differs"
+	}
+
+	if spec.TTL != (index.ExpireAfterSeconds != nil) {
+		return "ttl option differs"
+	}
+
+	if spec.TTL && int32(spec.ExpireAfter.Seconds()) != *index.ExpireAfterSeconds {
+		return "ttl expiry differs"
+	}
+
+	return ""
+}
+
+func keysEqual(keys bson.D, document bson.Raw) bool {
+	elements, err := document.Elements()
+	if err != nil || len(elements) != len(keys) {
+		return false
+	}
+
+	for i, element := range elements {
+		if element.Key() != keys[i].Key {
+			return false
+		}
+
+		// Index directions may be stored as any numeric type, special indexes such as "text" as strings
+		value := element.Value()
+		if number, ok := value.AsInt64OK(); ok {
+			if fmt.Sprint(number) != fmt.Sprint(keys[i].Value) {
+				return false
+			}
+		} else if str, ok := value.StringValueOK(); !ok || str != fmt.Sprint(keys[i].Value) {
+			return false
+		}
+	}
+
+	return true
+}
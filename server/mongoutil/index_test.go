@@ -0,0 +1,108 @@
+package mongoutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func rawKeys(t *testing.T, keys bson.D) bson.Raw {
+	raw, err := bson.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func TestIndexSpec_Name(t *testing.T) {
+	tests := []struct {
+		name string
+		spec IndexSpec
+		want string
+	}{
+		{"single key", IndexSpec{Keys: bson.D{{Key: "user", Value: 1}}}, "user_1"},
+		{"compound key", IndexSpec{Keys: bson.D{{Key: "user", Value: 1}, {Key: "sequence", Value: -1}}}, "user_1_sequence_-1"},
+		{"text index", IndexSpec{Keys: bson.D{{Key: "name", Value: "text"}}}, "name_text"},
+		{"explicit name", IndexSpec{Keys: bson.D{{Key: "user", Value: 1}}, Name: "by_user"}, "by_user"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, test.spec.name())
+		})
+	}
+}
+
+func TestKeysEqual(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     bson.D
+		existing bson.D
+		want     bool
+	}{
+		{"same keys", bson.D{{Key: "user", Value: 1}}, bson.D{{Key: "user", Value: int32(1)}}, true},
+		{"stored as double", bson.D{{Key: "user", Value: 1}}, bson.D{{Key: "user", Value: 1.0}}, true},
+		{"stored as int64", bson.D{{Key: "user", Value: -1}}, bson.D{{Key: "user", Value: int64(-1)}}, true},
+		{"string index", bson.D{{Key: "name", Value: "text"}}, bson.D{{Key: "name", Value: "text"}}, true},
+		{"different direction", bson.D{{Key: "user", Value: 1}}, bson.D{{Key: "user", Value: int32(-1)}}, false},
+		{"different field", bson.D{{Key: "user", Value: 1}}, bson.D{{Key: "id", Value: int32(1)}}, false},
+		{"different order", bson.D{{Key: "user", Value: 1}, {Key: "id", Value: 1}},
+			bson.D{{Key: "id", Value: int32(1)}, {Key: "user", Value: int32(1)}}, false},
+		{"missing key", bson.D{{Key: "user", Value: 1}, {Key: "id", Value: 1}}, bson.D{{Key: "user", Value: int32(1)}}, false},
+		{"extra key", bson.D{{Key: "user", Value: 1}}, bson.D{{Key: "user", Value: int32(1)}, {Key: "id", Value: int32(1)}}, false},
+		{"string instead of number", bson.D{{Key: "user", Value: 1}}, bson.D{{Key: "user", Value: "hashed"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, keysEqual(test.keys, rawKeys(t, test.existing)))
+		})
+	}
+
+	assert.False(t, keysEqual(bson.D{{Key: "user", Value: 1}}, bson.Raw{0x01}), "malformed documents never match")
+}
+
+func TestCompareIndex(t *testing.T) {
+	yes := true
+	no := false
+	day := int32((24 * time.Hour).Seconds())
+	hour := int32(time.Hour.Seconds())
+
+	userKeys := bson.D{{Key: "user", Value: 1}}
+	tests := []struct {
+		name  string
+		spec  IndexSpec
+		index mongo.IndexSpecification
+		want  string
+	}{
+		{"matches", IndexSpec{Keys: userKeys}, mongo.IndexSpecification{}, ""},
+		{"false options match unset ones", IndexSpec{Keys: userKeys}, mongo.IndexSpecification{Unique: &no, Sparse: &no}, ""},
+		{"keys", IndexSpec{Keys: bson.D{{Key: "user", Value: -1}}}, mongo.IndexSpecification{}, "keys differ"},
+		{"missing unique", IndexSpec{Keys: userKeys, Unique: true}, mongo.IndexSpecification{}, "unique option differs"},
+		{"unexpected unique", IndexSpec{Keys: userKeys}, mongo.IndexSpecification{Unique: &yes}, "unique option differs"},
+		{"sparse", IndexSpec{Keys: userKeys, Sparse: true}, mongo.IndexSpecification{Sparse: &no}, "sparse option differs"},
+		{"missing ttl", IndexSpec{Keys: userKeys, TTL: true}, mongo.IndexSpecification{}, "ttl option differs"},
+		{"unexpected ttl", IndexSpec{Keys: userKeys}, mongo.IndexSpecification{ExpireAfterSeconds: &day}, "ttl option differs"},
+		{"ttl expiry", IndexSpec{Keys: userKeys, TTL: true, ExpireAfter: 24 * time.Hour},
+			mongo.IndexSpecification{ExpireAfterSeconds: &hour}, "ttl expiry differs"},
+		{"ttl matches", IndexSpec{Keys: userKeys, TTL: true, ExpireAfter: 24 * time.Hour},
+			mongo.IndexSpecification{ExpireAfterSeconds: &day}, ""},
+		{"unique and sparse match", IndexSpec{Keys: userKeys, Unique: true, Sparse: true},
+			mongo.IndexSpecification{Unique: &yes, Sparse: &yes}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := test.index
+			if index.KeysDocument == nil {
+				index.KeysDocument = rawKeys(t, bson.D{{Key: "user", Value: int32(1)}})
+			}
+
+			assert.Equal(t, test.want, compareIndex(test.spec, &index))
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package mongoutil
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var migrationCollection = "_migrations"
+var migrationLockId = "lock"
+var migrationLockLease = 10 * time.Minute
+var migrationLockRetryDelay = 2 * time.Second
+
+// Migration changes the stored data of a database. Up must be idempotent, since a migration that failed halfway
+// is run again on the next startup.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(db *mongo.Database) error
+}
+
+type MigrationRecord struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Migrator applies numbered migrations in order and records them in the _migrations collection.
+// A lock document ensures that only one replica migrates a database at a time.
+type Migrator struct {
+	db         *mongo.Database
+	collection *mongo.Collection
+	migrations []Migration
+	owner      string
+	dryRun     bool
+}
+
+func NewMigrator(db *mongo.Database, migrations []Migration) *Migrator {
+	sorted := slices.Clone(migrations)
+	slices.SortFunc(sorted, func(a, b Migration) int { return a.Version - b.Version })
+
+	return &Migrator{
+		db:         db,
+		collection: db.Collection(migrationCollection),
+		migrations: sorted,
+		owner:      primitive.NewObjectID().Hex(),
+	}
+}
+
+// SetDryRun makes Run only report the pending migrations without applying them
+func (m *Migrator) SetDryRun(dryRun bool) {
+	m.dryRun = dryRun
+}
+
+func (m *Migrator) validate() error {
+	for i, migration := range m.migrations {
+		if migration.Version < 1 {
+			return fmt.Errorf("migration %q has invalid version %d", migration.Description, migration.Version)
+		}
+
+		if i > 0 && m.migrations[i-1].Version == migration.Version {
+			return fmt.Errorf("duplicate migration version %d", migration.Version)
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the migrations that have not been applied yet
+func (m *Migrator) Pending() ([]Migration, error) {
+	records, err := Find[MigrationRecord](m.collection, bson.M{"_id": bson.M{"$ne": migrationLockId}})
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int]bool{}
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Run applies every pending migration and returns the ones that were applied, or would be applied in dry-run mode.
+// Migrations are applied in order and the run stops at the first failing migration.
+func (m *Migrator) Run() ([]Migration, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	if m.dryRun {
+		return m.Pending()
+	}
+
+	if err := m.lock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock()
+
+	// Pending migrations are read after locking, another replica might have applied them in the meantime
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range pending {
+		if err := migration.Up(m.db); err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+
+		err := Insert(m.collection, MigrationRecord{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   time.Now(),
+		})
+
+		if err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// RunMigrations applies the pending migrations and logs them. If MIGRATIONS_DRY_RUN is set, the pending migrations
+// are only logged.
+func RunMigrations(db *mongo.Database, migrations []Migration) error {
+	migrator := NewMigrator(db, migrations)
+	dryRun := os.Getenv("MIGRATIONS_DRY_RUN") == "true"
+	migrator.SetDryRun(dryRun)
+
+	applied, err := migrator.Run()
+	for _, migration := range applied {
+		if dryRun {
+			log.Printf("Pending migration %d: %s", migration.Version, migration.Description)
+		} else {
+			log.Printf("Applied migration %d: %s", migration.Version, migration.Description)
+		}
+	}
+
+	return err
+}
+
+// lock waits until the lock is free or expired. Expired locks are taken over, so a crashed replica doesn't block
+// migrations forever.
+func (m *Migrator) lock() error {
+	deadline := time.Now().Add(migrationLockLease)
+	for {
+		_, err := m.collection.UpdateOne(ctx,
+			bson.M{"_id": migrationLockId, "expiresAt": bson.M{"$lt": time.Now()}},
+			bson.M{"$set": bson.M{"owner": m.owner, "expiresAt": time.Now().Add(migrationLockLease)}},
+			options.Update().SetUpsert(true))
+
+		if err == nil {
+			return nil
+		}
+
+		// The upsert fails with a duplicate key error if another replica holds the lock
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for migration lock")
+		}
+
+		time.Sleep(migrationLockRetryDelay)
+	}
+}
+
+func (m *Migrator) unlock() {
+	_, _ = DeleteOne(m.collection, bson.M{"_id": migrationLockId, "owner": m.owner})
+}
@@ -0,0 +1,213 @@
+package mongoutil
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+var duplicateKeyResponse = mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"})
+
+// recordingMigration returns a migration that appends its version to applied when it runs
+func recordingMigration(version int, applied *[]int) Migration {
+	return Migration{
+		Version:     version,
+		Description: "test migration",
+		Up: func(_ *mongo.Database) error {
+			*applied = append(*applied, version)
+			return nil
+		},
+	}
+}
+
+// appliedRecords returns the response to Pending listing the given versions as applied
+func appliedRecords(versions ...int) bson.D {
+	documents := make([]bson.D, 0, len(versions))
+	for _, version := range versions {
+		documents = append(documents, bson.D{{Key: "_id", Value: version}, {Key: "description", Value: "test migration"}})
+	}
+
+	return mtest.CreateCursorResponse(0, "test."+migrationCollection, mtest.FirstBatch, documents...)
+}
+
+// commands returns the names of the commands that were sent
+func commands(mt *mtest.T) []string {
+	var names []string
+	for _, event := range mt.GetAllStartedEvents() {
+		names = append(names, event.CommandName)
+	}
+
+	return names
+}
+
+// withLockTiming shortens the lock lease and retry delay for the duration of a test
+func withLockTiming(t *testing.T, lease time.Duration, retryDelay time.Duration) {
+	previousLease, previousDelay := migrationLockLease, migrationLockRetryDelay
+	migrationLockLease, migrationLockRetryDelay = lease, retryDelay
+	t.Cleanup(func() {
+		migrationLockLease, migrationLockRetryDelay = previousLease, previousDelay
+	})
+}
+
+func TestMigrator_Run(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("applies pending migrations in order", func(mt *mtest.T) {
+		var applied []int
+		migrator := NewMigrator(mt.DB, []Migration{
+			recordingMigration(3, &applied), recordingMigration(1, &applied), recordingMigration(2, &applied),
+		})
+
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(), // lock
+			appliedRecords(1),
+			mtest.CreateSuccessResponse(), // record 2
+			mtest.CreateSuccessResponse(), // record 3
+			mtest.CreateSuccessResponse(), // unlock
+		)
+
+		migrations, err := migrator.Run()
+		require.NoError(mt, err)
+		assert.Equal(mt, []int{2, 3}, applied)
+		assert.Len(mt, migrations, 2)
+		assert.Equal(mt, []string{"update", "find", "insert", "insert", "delete"}, commands(mt))
+	})
+
+	mt.Run("stops at the first failing migration", func(mt *mtest.T) {
+		var applied []int
+		failing := Migration{Version: 2, Description: "failing", Up: func(_ *mongo.Database) error {
+			return errors.New("failed")
+		}}
+		migrator := NewMigrator(mt.DB, []Migration{recordingMigration(1, &applied), failing, recordingMigration(3, &applied)})
+
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(), // lock
+			appliedRecords(),
+			mtest.CreateSuccessResponse(), // record 1
+			mtest.CreateSuccessResponse(), // unlock
+		)
+
+		migrations, err := migrator.Run()
+		assert.ErrorContains(mt, err, "migration 2 (failing) failed")
+		assert.Equal(mt, []int{1}, applied)
+		assert.Len(mt, migrations, 1)
+		// The lock is released even though the run failed
+		assert.Equal(mt, []string{"update", "find", "insert", "delete"}, commands(mt))
+	})
+}
+
+func TestMigrator_DryRun(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("only reports pending migrations", func(mt *mtest.T) {
+		var applied []int
+		migrator := NewMigrator(mt.DB, []Migration{recordingMigration(1, &applied), recordingMigration(2, &applied)})
+		migrator.SetDryRun(true)
+
+		mt.AddMockResponses(appliedRecords(1))
+
+		migrations, err := migrator.Run()
+		require.NoError(mt, err)
+		assert.Empty(mt, applied)
+		require.Len(mt, migrations, 1)
+		assert.Equal(mt, 2, migrations[0].Version)
+		// Nothing is locked or recorded
+		assert.Equal(mt, []string{"find"}, commands(mt))
+	})
+
+	mt.Run("is enabled by MIGRATIONS_DRY_RUN", func(mt *mtest.T) {
+		mt.Setenv("MIGRATIONS_DRY_RUN", "true")
+		var applied []int
+
+		mt.AddMockResponses(appliedRecords())
+
+		require.NoError(mt, RunMigrations(mt.DB, []Migration{recordingMigration(1, &applied)}))
+		assert.Empty(mt, applied)
+		assert.Equal(mt, []string{"find"}, commands(mt))
+	})
+}
+
+func TestMigrator_Validate(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("rejects invalid versions", func(mt *mtest.T) {
+		var applied []int
+
+		_, err := NewMigrator(mt.DB, []Migration{recordingMigration(0, &applied)}).Run()
+		assert.ErrorContains(mt, err, "invalid version 0")
+
+		_, err = NewMigrator(mt.DB, []Migration{recordingMigration(1, &applied), recordingMigration(1, &applied)}).Run()
+		assert.ErrorContains(mt, err, "duplicate migration version 1")
+
+		assert.Empty(mt, commands(mt), "nothing is read before the migrations are valid")
+	})
+}
+
+func TestMigrator_Lock(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("takes the lock with a lease", func(mt *mtest.T) {
+		migrator := NewMigrator(mt.DB, nil)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+
+		before := time.Now()
+		require.NoError(mt, migrator.lock())
+		migrator.unlock()
+
+		started := mt.GetStartedEvent()
+		require.Equal(mt, "update", started.CommandName)
+		update := started.Command.Lookup("updates").Array().Index(0).Value().Document()
+
+		// Only a missing or expired lock matches, an existing lock makes the upsert fail with a duplicate key
+		filter := update.Lookup("q").Document()
+		assert.Equal(mt, migrationLockId, filter.Lookup("_id").StringValue())
+		expiredBefore := filter.Lookup("expiresAt", "$lt").Time()
+		assert.False(mt, expiredBefore.Before(before.Truncate(time.Millisecond)))
+		assert.True(mt, update.Lookup("upsert").Boolean())
+
+		set := update.Lookup("u", "$set").Document()
+		assert.Equal(mt, migrator.owner, set.Lookup("owner").StringValue())
+		leaseEnd := set.Lookup("expiresAt").Time()
+		assert.WithinDuration(mt, before.Add(migrationLockLease), leaseEnd, time.Second)
+
+		// Unlocking only removes the lock of this migrator, not one taken over by another replica
+		started = mt.GetStartedEvent()
+		require.Equal(mt, "delete", started.CommandName)
+		deleteFilter := started.Command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q").Document()
+		assert.Equal(mt, migrationLockId, deleteFilter.Lookup("_id").StringValue())
+		assert.Equal(mt, migrator.owner, deleteFilter.Lookup("owner").StringValue())
+	})
+
+	mt.Run("waits for a lock held by another replica", func(mt *mtest.T) {
+		withLockTiming(mt.T, time.Minute, time.Millisecond)
+		migrator := NewMigrator(mt.DB, nil)
+		mt.AddMockResponses(duplicateKeyResponse, duplicateKeyResponse, mtest.CreateSuccessResponse())
+
+		require.NoError(mt, migrator.lock())
+		assert.Equal(mt, []string{"update", "update", "update"}, commands(mt))
+	})
+
+	mt.Run("times out after the lease", func(mt *mtest.T) {
+		withLockTiming(mt.T, 20*time.Millisecond, 5*time.Millisecond)
+		migrator := NewMigrator(mt.DB, nil)
+
+		responses := make([]bson.D, 100)
+		for i := range responses {
+			responses[i] = duplicateKeyResponse
+		}
+		mt.AddMockResponses(responses...)
+
+		assert.ErrorContains(mt, migrator.lock(), "timed out waiting for migration lock")
+	})
+
+	mt.Run("fails on other errors", func(mt *mtest.T) {
+		migrator := NewMigrator(mt.DB, nil)
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 13, Message: "unauthorized"}))
+
+		_, err := migrator.Run()
+		assert.ErrorContains(mt, err, "unauthorized")
+		assert.Equal(mt, []string{"update"}, commands(mt))
+	})
+}
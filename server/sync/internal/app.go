@@ -17,6 +17,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"perfice.adoe.dev/mongoutil"
 	pb "perfice.adoe.dev/proto"
 )
 
@@ -24,10 +25,15 @@ type SyncApp struct {
 	client *mongo.Client
 	db     *mongo.Database
 
-	entityTypes            []string
+	entityTypeRegistry     *EntityTypeRegistry
 	syncService            *SyncService
+	syncNotifier           *SyncNotifier
+	compactionService      *CompactionService
 	authClient             pb.UserServiceClient
 	keyVerificationService *KeyVerificationService
+	usageService           *UsageService
+	keyRotationService     *KeyRotationService
+	backupService          *BackupService
 	saltService            *SaltService
 }
 
@@ -43,25 +49,6 @@ func NewSyncApp() *SyncApp {
 	return &SyncApp{
 		client: client,
 		db:     client.Database("sync"),
-		entityTypes: []string{
-			"trackables",
-			"variables",
-			"entries",
-			"trackableCategories",
-			"forms",
-			"formSnapshots",
-			"analyticSettings",
-			"goals",
-			"tags",
-			"tagEntries",
-			"formTemplates",
-			"tagCategories",
-			"dashboards",
-			"dashboardWidgets",
-			"reflections",
-			"savedSearches",
-			"notifications",
-		},
 	}
 }
 
@@ -77,22 +64,48 @@ func (a *SyncApp) setupSentry() {
 
 func (a *SyncApp) Init() {
 	a.setupAuthService()
-	a.setupServices()
 	a.setupSentry()
+	a.setupServices()
+	a.setupInternalServer()
 	a.setupHttpServer()
 }
 
 func (a *SyncApp) setupServices() {
+	if err := mongoutil.RunMigrations(a.db, syncMigrations); err != nil {
+		panic(err)
+	}
+
+	if err := mongoutil.EnsureIndexesLogged(a.db, syncIndexes); err != nil {
+		sentry.CaptureException(err)
+	}
 	syncUpdateCollection := NewSyncUpdateCollection(a.db.Collection("sync_updates"))
 
-	entityCollections := map[string]*mongo.Collection{}
-	for _, entityType := range a.entityTypes {
-		entityCollections[entityType] = a.db.Collection(entityType)
+	a.entityTypeRegistry = NewEntityTypeRegistry(a.db, NewEntityTypeCollection(a.db.Collection("entity_types")))
+	if err := a.entityTypeRegistry.Load(); err != nil {
+		panic(err)
 	}
 
-	a.keyVerificationService = NewKeyVerificationService(NewKeyVerificationCollection(a.db.Collection("key_verifications")))
-	a.syncService = NewSyncService(a.client, entityCollections, syncUpdateCollection, a.keyVerificationService, a.authClient)
-	a.saltService = NewSaltService(NewSaltCollection(a.db.Collection("salts")))
+	a.entityTypeRegistry.Watch()
+
+	a.keyVerificationService = NewKeyVerificationService(NewKeyVerificationCollection(a.db.Collection("key_verifications")),
+		NewKeyGenerationCollection(a.db.Collection("key_generations")), NewKeyChallengeCollection(a.db.Collection("key_challenges")))
+	saltCollection := NewSaltCollection(a.db.Collection("salts"))
+	a.saltService = NewSaltService(saltCollection)
+	syncSequenceCollection := NewSyncSequenceCollection(a.db.Collection("sync_sequences"))
+	a.usageService = NewUsageService(NewUsageCollection(a.db.Collection("sync_usage")), a.entityTypeRegistry, quotaFromEnv())
+	a.keyRotationService = NewKeyRotationService(a.client, a.entityTypeRegistry,
+		NewKeyRotationCollection(a.db.Collection("key_rotations")), NewStagedEntityCollection(a.db.Collection("rotation_entities")),
+		a.keyVerificationService, saltCollection, syncUpdateCollection, syncSequenceCollection, a.usageService, a.authClient,
+		durationFromEnv("KEY_ROTATION_TIMEOUT", defaultKeyRotationTimeout))
+	a.syncService = NewSyncService(a.client, a.entityTypeRegistry, syncUpdateCollection, syncSequenceCollection,
+		a.keyVerificationService, a.authClient, conflictPolicyFromEnv(), a.usageService, a.keyRotationService)
+	a.backupService = NewBackupService(a.syncService, a.keyVerificationService, a.keyRotationService, saltCollection, a.entityTypeRegistry)
+
+	a.syncNotifier = NewSyncNotifier(syncUpdateCollection)
+	a.syncNotifier.Run()
+
+	a.compactionService = compactionServiceFromEnv(syncUpdateCollection, syncSequenceCollection, a.authClient)
+	a.compactionService.Run()
 
 	kafka := NewKafkaService()
 	kafka.OnUserDeleted(func(userId string) {
@@ -111,6 +124,23 @@ func (a *SyncApp) setupServices() {
 		if err != nil {
 			sentry.CaptureException(fmt.Errorf("failed to delete salts: %v", err))
 		}
+
+		err = a.usageService.OnUserDeleted(userId)
+		if err != nil {
+			sentry.CaptureException(fmt.Errorf("failed to delete usage: %v", err))
+		}
+
+		err = a.keyRotationService.OnUserDeleted(userId)
+		if err != nil {
+			sentry.CaptureException(fmt.Errorf("failed to delete key rotations: %v", err))
+		}
+	})
+
+	kafka.OnSessionRevoked(func(userId string, sessionId string) {
+		a.syncNotifier.Disconnect(sessionId)
+		if err := a.syncService.OnSessionRevoked(userId, sessionId); err != nil {
+			sentry.CaptureException(fmt.Errorf("failed to detach revoked session: %v", err))
+		}
 	})
 
 	kafka.Read()
@@ -119,6 +149,8 @@ func (a *SyncApp) setupServices() {
 func (a *SyncApp) setupHttpServer() {
 	app := fiber.New(
 		fiber.Config{
+			// Backup imports are the largest requests
+			BodyLimit: int(backupMaxSizeFromEnv()),
 			ErrorHandler: func(ctx *fiber.Ctx, err error) error {
 				log.Println("Error occurred: ", err)
 				sentry.CaptureException(err)
@@ -137,24 +169,62 @@ func (a *SyncApp) setupHttpServer() {
 		AllowHeaders: "*",
 	}))
 
-	syncController := NewSyncController(a.syncService, a.entityTypes)
+	syncController := NewSyncController(a.syncService, a.syncNotifier, a.entityTypeRegistry)
 	app.Post("/push", authMiddleware, syncController.Push)
 	app.Post("/pull", authMiddleware, syncController.Pull)
+	app.Get("/stream", authMiddleware, syncController.Stream)
 	app.Post("/ack", authMiddleware, syncController.Ack)
+	app.Post("/fullPush", authMiddleware, syncController.FullPush)
 	app.Post("/fullPull", authMiddleware, syncController.FullPull)
+	app.Post("/fullPull/stream", authMiddleware, syncController.StreamFullPull)
 
 	keyGroup := app.Group("/key")
 	keyController := NewKeyController(a.keyVerificationService)
 	keyGroup.Get("/", authMiddleware, keyController.GetKey)
 	keyGroup.Put("/", authMiddleware, keyController.SetKey)
+	keyGroup.Post("/challenge", authMiddleware, keyController.CreateChallenge)
+	keyGroup.Get("/generations", authMiddleware, keyController.GetGenerations)
+
+	keyRotationController := NewKeyRotationController(a.keyRotationService, a.entityTypeRegistry)
+	keyGroup.Get("/rotation", authMiddleware, keyRotationController.GetStatus)
+	keyGroup.Post("/rotation", authMiddleware, keyRotationController.Start)
+	keyGroup.Delete("/rotation", authMiddleware, keyRotationController.Abort)
+	keyGroup.Post("/rotation/entities", authMiddleware, keyRotationController.Stage)
+	keyGroup.Post("/rotation/commit", authMiddleware, keyRotationController.Commit)
 
 	saltController := NewSaltController(a.saltService)
 	app.Get("/salt", authMiddleware, saltController.GetSalt)
 
+	backupController := NewBackupController(a.backupService, a.entityTypeRegistry)
+	app.Get("/backup", authMiddleware, backupController.Export)
+	app.Post("/backup/import", authMiddleware, backupController.Import)
+
+	usageController := NewUsageController(a.usageService, a.entityTypeRegistry)
+	app.Get("/usage", authMiddleware, usageController.GetUsage)
+
 	defer sentry.Flush(2 * time.Second)
 	log.Fatal(app.Listen(":" + os.Getenv("PORT")))
 }
 
+// setupInternalServer serves the operational endpoints on INTERNAL_PORT, which must not be published. Without a port
+// they aren't served at all, since the public port is reachable by anyone who can reach the service.
+func (a *SyncApp) setupInternalServer() {
+	port := os.Getenv("INTERNAL_PORT")
+	if port == "" {
+		return
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(recover.New())
+
+	compactionController := NewCompactionController(a.compactionService)
+	app.Get("/internal/compaction", compactionController.GetStats)
+
+	go func() {
+		log.Fatal(app.Listen(":" + port))
+	}()
+}
+
 func (a *SyncApp) setupAuthService() *grpc.ClientConn {
 	conn, err := grpc.NewClient(os.Getenv("AUTH_GRPC_URL"), grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -0,0 +1,388 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Backups are zip archives containing a manifest, the key verification, the salt and one NDJSON file per entity type.
+// The manifest lists every other file with its size and SHA-256 checksum. Entity data is encrypted by the client, so
+// backups never contain plaintext. The proof key isn't included, since anyone holding it could replace the key, the
+// client derives it again when importing.
+var backupFormatVersion = 1
+var backupManifestFile = "manifest.json"
+var backupKeyFile = "key.json"
+var backupSaltFile = "salt.json"
+var backupEntitiesDir = "entities/"
+var maxBackupManifestSize int64 = 1 << 20
+
+type InvalidBackupError struct {
+	Reason string
+}
+
+func (e InvalidBackupError) Error() string {
+	return "invalid backup: " + e.Reason
+}
+
+func invalidBackup(format string, args ...any) InvalidBackupError {
+	return InvalidBackupError{Reason: fmt.Sprintf(format, args...)}
+}
+
+type BackupFile struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	EntityType string `json:"entityType,omitempty"`
+	Entities   int64  `json:"entities,omitempty"`
+}
+
+type BackupManifest struct {
+	FormatVersion int          `json:"formatVersion"`
+	CreatedAt     time.Time    `json:"createdAt"`
+	KeyGeneration int64        `json:"keyGeneration"`
+	Files         []BackupFile `json:"files"`
+}
+
+type BackupKey struct {
+	Key        []byte `json:"key"`
+	Generation int64  `json:"generation"`
+}
+
+type BackupSalt struct {
+	Salt []byte `json:"salt"`
+}
+
+type BackupEntity struct {
+	ID            string `json:"id"`
+	Version       int    `json:"version"`
+	KeyGeneration int64  `json:"keyGeneration"`
+	Data          []byte `json:"data"`
+}
+
+// Backup is the validated content of a backup archive
+type Backup struct {
+	Manifest BackupManifest
+	Key      *BackupKey
+	Salt     *BackupSalt
+	Entities map[string][]Entity
+}
+
+func entityBackupFile(entityType string) string {
+	return backupEntitiesDir + entityType + ".ndjson"
+}
+
+// hashingWriter keeps track of the size and checksum of everything written to a file of the archive
+type hashingWriter struct {
+	writer io.Writer
+	hash   hash.Hash
+	size   int64
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+type BackupWriter struct {
+	zip   *zip.Writer
+	files []BackupFile
+}
+
+func NewBackupWriter(writer io.Writer) *BackupWriter {
+	return &BackupWriter{zip: zip.NewWriter(writer)}
+}
+
+func (w *BackupWriter) create(name string) (*hashingWriter, error) {
+	entry, err := w.zip.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hashingWriter{writer: entry, hash: sha256.New()}, nil
+}
+
+func (w *BackupWriter) record(name string, writer *hashingWriter, entityType string, entities int64) {
+	w.files = append(w.files, BackupFile{
+		Name:       name,
+		Size:       writer.size,
+		SHA256:     hex.EncodeToString(writer.hash.Sum(nil)),
+		EntityType: entityType,
+		Entities:   entities,
+	})
+}
+
+func (w *BackupWriter) WriteKey(key BackupKey) error {
+	return w.writeJSON(backupKeyFile, key)
+}
+
+func (w *BackupWriter) WriteSalt(salt BackupSalt) error {
+	return w.writeJSON(backupSaltFile, salt)
+}
+
+func (w *BackupWriter) writeJSON(name string, value any) error {
+	writer, err := w.create(name)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		return err
+	}
+
+	w.record(name, writer, "", 0)
+	return nil
+}
+
+// WriteEntities writes the entities of a type, the stream function is called with a callback that writes a chunk of
+// entities. Types without entities still get an empty file, so that importing the backup clears them.
+func (w *BackupWriter) WriteEntities(entityType string, stream func(write func(entities []Entity) error) error) error {
+	name := entityBackupFile(entityType)
+	writer, err := w.create(name)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	encoder := json.NewEncoder(writer)
+	err = stream(func(entities []Entity) error {
+		for _, entity := range entities {
+			err := encoder.Encode(BackupEntity{
+				ID:            entity.ID,
+				Version:       entity.Version,
+				KeyGeneration: entity.KeyGeneration,
+				Data:          entity.Data,
+			})
+
+			if err != nil {
+				return err
+			}
+
+			count++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	w.record(name, writer, entityType, count)
+	return nil
+}
+
+// Close writes the manifest, which has to come last since it contains the checksums of every other file
+func (w *BackupWriter) Close(keyGeneration int64) error {
+	manifest := BackupManifest{
+		FormatVersion: backupFormatVersion,
+		CreatedAt:     time.Now(),
+		KeyGeneration: keyGeneration,
+		Files:         w.files,
+	}
+
+	entry, err := w.zip.Create(backupManifestFile)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+
+	return w.zip.Close()
+}
+
+// ReadBackup validates an archive against its manifest and reads its content. Every file must be listed in the
+// manifest with a matching size and checksum, so truncated or modified backups are rejected before anything is
+// imported. Entries are never read past their declared size, which protects against zip bombs.
+func ReadBackup(reader *zip.Reader) (Backup, error) {
+	entries := map[string]*zip.File{}
+	for _, file := range reader.File {
+		if _, exists := entries[file.Name]; exists {
+			return Backup{}, invalidBackup("duplicate file %s", file.Name)
+		}
+
+		entries[file.Name] = file
+	}
+
+	manifestEntry, ok := entries[backupManifestFile]
+	if !ok {
+		return Backup{}, invalidBackup("missing %s", backupManifestFile)
+	}
+
+	var manifest BackupManifest
+	if err := readBackupJSON(manifestEntry, &manifest); err != nil {
+		return Backup{}, err
+	}
+
+	if manifest.FormatVersion != backupFormatVersion {
+		return Backup{}, invalidBackup("unsupported format version %d", manifest.FormatVersion)
+	}
+
+	backup := Backup{Manifest: manifest, Entities: map[string][]Entity{}}
+	listed := map[string]bool{backupManifestFile: true}
+	for _, file := range manifest.Files {
+		entry, ok := entries[file.Name]
+		if !ok {
+			return Backup{}, invalidBackup("missing %s", file.Name)
+		}
+
+		if listed[file.Name] {
+			return Backup{}, invalidBackup("%s is listed twice", file.Name)
+		}
+
+		listed[file.Name] = true
+		content, err := readBackupFile(entry, file)
+		if err != nil {
+			return Backup{}, err
+		}
+
+		switch {
+		case file.Name == backupKeyFile:
+			backup.Key = &BackupKey{}
+			err = unmarshalBackupJSON(file.Name, content, backup.Key)
+		case file.Name == backupSaltFile:
+			backup.Salt = &BackupSalt{}
+			err = unmarshalBackupJSON(file.Name, content, backup.Salt)
+		case strings.HasPrefix(file.Name, backupEntitiesDir):
+			err = readBackupEntities(&backup, file, content)
+		default:
+			err = invalidBackup("unexpected file %s", file.Name)
+		}
+
+		if err != nil {
+			return Backup{}, err
+		}
+	}
+
+	for name := range entries {
+		if !listed[name] {
+			return Backup{}, invalidBackup("%s is not listed in the manifest", name)
+		}
+	}
+
+	return backup, nil
+}
+
+func readBackupFile(entry *zip.File, file BackupFile) ([]byte, error) {
+	if entry.UncompressedSize64 != uint64(file.Size) {
+		return nil, invalidBackup("size of %s doesn't match the manifest", file.Name)
+	}
+
+	opened, err := entry.Open()
+	if err != nil {
+		return nil, invalidBackup("failed to open %s: %v", file.Name, err)
+	}
+	defer opened.Close()
+
+	content, err := io.ReadAll(io.LimitReader(opened, file.Size+1))
+	if err != nil {
+		return nil, invalidBackup("failed to read %s: %v", file.Name, err)
+	}
+
+	if int64(len(content)) != file.Size {
+		return nil, invalidBackup("size of %s doesn't match the manifest", file.Name)
+	}
+
+	checksum := sha256.Sum256(content)
+	if hex.EncodeToString(checksum[:]) != file.SHA256 {
+		return nil, invalidBackup("checksum of %s doesn't match the manifest", file.Name)
+	}
+
+	return content, nil
+}
+
+func readBackupEntities(backup *Backup, file BackupFile, content []byte) error {
+	if file.EntityType == "" || strings.Contains(file.EntityType, "/") || file.Name != entityBackupFile(file.EntityType) {
+		return invalidBackup("%s doesn't match its entity type", file.Name)
+	}
+
+	if _, exists := backup.Entities[file.EntityType]; exists {
+		return invalidBackup("entity type %s is listed twice", file.EntityType)
+	}
+
+	entities := make([]Entity, 0, file.Entities)
+	ids := map[string]bool{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for decoder.More() {
+		var entity BackupEntity
+		if err := decoder.Decode(&entity); err != nil {
+			return invalidBackup("malformed entity in %s: %v", file.Name, err)
+		}
+
+		if entity.ID == "" || entity.Data == nil {
+			return invalidBackup("entity in %s is missing its id or data", file.Name)
+		}
+
+		if ids[entity.ID] {
+			return invalidBackup("duplicate entity %s in %s", entity.ID, file.Name)
+		}
+
+		ids[entity.ID] = true
+		entities = append(entities, Entity{
+			ID:            entity.ID,
+			Version:       entity.Version,
+			KeyGeneration: entity.KeyGeneration,
+			Data:          entity.Data,
+		})
+	}
+
+	if int64(len(entities)) != file.Entities {
+		return invalidBackup("%s contains %d entities, the manifest lists %d", file.Name, len(entities), file.Entities)
+	}
+
+	backup.Entities[file.EntityType] = entities
+	return nil
+}
+
+func readBackupJSON(entry *zip.File, value any) error {
+	opened, err := entry.Open()
+	if err != nil {
+		return invalidBackup("failed to open %s: %v", entry.Name, err)
+	}
+	defer opened.Close()
+
+	// The manifest isn't covered by a checksum, so its size is limited instead
+	content, err := io.ReadAll(io.LimitReader(opened, maxBackupManifestSize+1))
+	if err != nil {
+		return invalidBackup("failed to read %s: %v", entry.Name, err)
+	}
+
+	if int64(len(content)) > maxBackupManifestSize {
+		return invalidBackup("%s is too large", entry.Name)
+	}
+
+	return unmarshalBackupJSON(entry.Name, content, value)
+}
+
+func unmarshalBackupJSON(name string, content []byte, value any) error {
+	if err := json.Unmarshal(content, value); err != nil {
+		return invalidBackup("malformed %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// EntityTypes returns the entity types contained in the backup, sorted by name
+func (b Backup) EntityTypes() []string {
+	types := make([]string, 0, len(b.Entities))
+	for entityType := range b.Entities {
+		types = append(types, entityType)
+	}
+
+	slices.Sort(types)
+	return types
+}
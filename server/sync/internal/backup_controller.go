@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"perfice.adoe.dev/util"
+)
+
+type BackupController struct {
+	backupService *BackupService
+	entityTypes   *EntityTypeRegistry
+}
+
+func NewBackupController(backupService *BackupService, entityTypes *EntityTypeRegistry) *BackupController {
+	return &BackupController{backupService, entityTypes}
+}
+
+type ImportBackupResponse struct {
+	EntityTypes []string `json:"entityTypes"`
+}
+
+func (c *BackupController) Export(ctx *fiber.Ctx) error {
+	userId := getUserId(ctx)
+
+	ctx.Set(fiber.HeaderContentType, "application/zip")
+	ctx.Set(fiber.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=\"perfice-backup-%s.zip\"", time.Now().Format("2006-01-02")))
+
+	// The status has already been sent once streaming starts, a failed export leaves a truncated archive that is
+	// rejected on import since the manifest is written last
+	ctx.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		if err := c.backupService.Export(userId, w); err != nil {
+			log.Println("Backup export failed:", err)
+			sentry.CaptureException(fmt.Errorf("backup export failed: %w", err))
+		}
+	}))
+
+	return nil
+}
+
+func decodeFormBytes(ctx *fiber.Ctx, key string) ([]byte, error) {
+	value := ctx.FormValue(key)
+	if value == "" {
+		return nil, nil
+	}
+
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// Import expects a multipart form with the archive as "backup". If the backup contains a key, "proofKey" must be set
+// to the proof key derived from it, together with "challenge" and "proof" or "expectedGeneration" for the current key,
+// the same way as for PUT /key. Binary values are base64 encoded.
+func (c *BackupController) Import(ctx *fiber.Ctx) error {
+	file, err := ctx.FormFile("backup")
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Missing backup")
+	}
+
+	challenge, err := decodeFormBytes(ctx, "challenge")
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid challenge")
+	}
+
+	proof, err := decodeFormBytes(ctx, "proof")
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid proof")
+	}
+
+	proofKey, err := decodeFormBytes(ctx, "proofKey")
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid proof key")
+	}
+
+	var expectedGeneration *int64
+	if value := ctx.FormValue("expectedGeneration"); value != "" {
+		generation, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid expected generation")
+		}
+
+		expectedGeneration = &generation
+	}
+
+	opened, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer opened.Close()
+
+	reader, err := zip.NewReader(opened, file.Size)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Backup is not a zip archive")
+	}
+
+	backup, err := ReadBackup(reader)
+	if err != nil {
+		return c.handleImportError(ctx, err)
+	}
+
+	for entityType, entities := range backup.Entities {
+		data := util.SliceMap(entities, func(entity Entity) []byte { return entity.Data })
+		if status, message := checkEntityType(c.entityTypes, entityType, true, data); status != fiber.StatusOK {
+			return ctx.Status(status).SendString(message)
+		}
+	}
+
+	entityTypes, err := c.backupService.Import(getUserId(ctx), getSessionId(ctx), backup, KeyChange{
+		ProofKey:           proofKey,
+		Challenge:          challenge,
+		Proof:              proof,
+		ExpectedGeneration: expectedGeneration,
+	})
+	if err != nil {
+		return c.handleImportError(ctx, err)
+	}
+
+	return ctx.JSON(ImportBackupResponse{entityTypes})
+}
+
+func (c *BackupController) handleImportError(ctx *fiber.Ctx, err error) error {
+	var invalidErr InvalidBackupError
+	if errors.As(err, &invalidErr) {
+		return ctx.Status(fiber.StatusBadRequest).SendString(invalidErr.Error())
+	}
+
+	if errors.As(err, &KeyProofRequiredError{}) || errors.As(err, &InvalidKeyProofError{}) {
+		return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+	}
+
+	if errors.As(err, &ProofKeyRequiredError{}) {
+		return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	if errors.As(err, &KeyChangedError{}) {
+		return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+	}
+
+	if errors.As(err, &KeyRotationInProgressError{}) {
+		return ctx.Status(fiber.StatusLocked).SendString("Key rotation in progress")
+	}
+
+	if isQuotaError(err) {
+		return ctx.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+	}
+
+	return err
+}
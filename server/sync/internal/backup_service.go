@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var defaultMaxBackupSize int64 = 64 << 20
+
+// backupMaxSizeFromEnv reads SYNC_BACKUP_MAX_SIZE, the largest backup in bytes that can be imported
+func backupMaxSizeFromEnv() int64 {
+	if size := intFromEnv("SYNC_BACKUP_MAX_SIZE"); size > 0 {
+		return size
+	}
+
+	return defaultMaxBackupSize
+}
+
+type BackupService struct {
+	syncService            *SyncService
+	keyVerificationService *KeyVerificationService
+	keyRotationService     *KeyRotationService
+	saltCollection         *SaltCollection
+	entityTypeRegistry     *EntityTypeRegistry
+}
+
+func NewBackupService(syncService *SyncService, keyVerificationService *KeyVerificationService, keyRotationService *KeyRotationService,
+	saltCollection *SaltCollection, entityTypeRegistry *EntityTypeRegistry) *BackupService {
+	return &BackupService{syncService, keyVerificationService, keyRotationService, saltCollection, entityTypeRegistry}
+}
+
+// Export writes a backup of every entity type, the key verification and the salt of a user. Types are read one
+// after another, so changes pushed while exporting may only be partially included. The salt is only of use together
+// with the key, so it is left out if no key is set.
+func (s *BackupService) Export(userId string, writer io.Writer) error {
+	backup := NewBackupWriter(writer)
+
+	verification, err := s.keyVerificationService.GetVerification(userId)
+	if err != nil {
+		return err
+	}
+
+	var keyGeneration int64
+	if verification != nil {
+		keyGeneration = verification.Generation
+		if err := backup.WriteKey(BackupKey{Key: verification.Key, Generation: verification.Generation}); err != nil {
+			return err
+		}
+
+		salt, err := s.saltCollection.FindByUser(userId)
+		if err != nil {
+			return err
+		}
+
+		if salt != nil {
+			if err := backup.WriteSalt(BackupSalt{Salt: salt.Salt}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entityType := range s.entityTypeRegistry.Names() {
+		collection := s.entityTypeRegistry.Collection(entityType)
+		if collection == nil {
+			continue
+		}
+
+		err := backup.WriteEntities(entityType, func(write func(entities []Entity) error) error {
+			return s.syncService.streamEntities(collection, userId, entityType, func(_ string, entities []Entity) error {
+				return write(entities)
+			})
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", entityType, err)
+		}
+	}
+
+	return backup.Close(keyGeneration)
+}
+
+// Import replays a backup as a full sync of every contained entity type. The key verification and salt are replaced
+// in the same transaction, so a failed import leaves the existing data untouched. Replacing the key requires the same
+// proof as setting it directly, and the proof key of the imported key, which the client derives from the key again.
+// The salt is only restored together with the key, and entities keep the key generation they were backed up with.
+func (s *BackupService) Import(userId string, sessionId string, backup Backup, change KeyChange) ([]string, error) {
+	if err := s.keyRotationService.CheckUnlocked(userId); err != nil {
+		return nil, err
+	}
+
+	for _, entityType := range backup.EntityTypes() {
+		if !s.entityTypeRegistry.Has(entityType) {
+			return nil, invalidBackup("unknown entity type %s", entityType)
+		}
+	}
+
+	var generation int64
+	var err error
+	if backup.Key != nil {
+		if len(change.ProofKey) == 0 {
+			return nil, ProofKeyRequiredError{}
+		}
+
+		generation, err = s.keyVerificationService.VerifyProof(userId, sessionId, change)
+	} else {
+		generation, err = s.keyVerificationService.GetGeneration(userId)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.syncService.replaceAll(backup.Entities, userId, sessionId, func(sessionContext mongo.SessionContext) (int64, error) {
+		if backup.Key == nil {
+			return generation, nil
+		}
+
+		imported, err := s.keyVerificationService.replaceInTransaction(sessionContext, userId, sessionId,
+			backup.Key.Key, change.ProofKey, generation, keyImportReason)
+		if err != nil {
+			return 0, err
+		}
+
+		if backup.Salt != nil {
+			if err := s.saltCollection.Replace(sessionContext, Salt{User: userId, Salt: backup.Salt.Salt}); err != nil {
+				return 0, err
+			}
+		}
+
+		return imported, nil
+	})
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestBackup(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	writer := NewBackupWriter(&buffer)
+
+	require.NoError(t, writer.WriteKey(BackupKey{Key: []byte("key"), Generation: 2}))
+	require.NoError(t, writer.WriteSalt(BackupSalt{Salt: []byte("salt")}))
+	require.NoError(t, writer.WriteEntities("entries", func(write func(entities []Entity) error) error {
+		if err := write([]Entity{{ID: "a", Version: 1, KeyGeneration: 2, Data: []byte("first")}}); err != nil {
+			return err
+		}
+
+		return write([]Entity{{ID: "b", Version: 3, KeyGeneration: 2, Data: []byte("second")}})
+	}))
+	require.NoError(t, writer.WriteEntities("tags", func(write func(entities []Entity) error) error { return nil }))
+	require.NoError(t, writer.Close(2))
+
+	return buffer.Bytes()
+}
+
+func readTestBackup(archive []byte) (Backup, error) {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return Backup{}, err
+	}
+
+	return ReadBackup(reader)
+}
+
+// rewriteBackup copies an archive, replacing the content of the given files
+func rewriteBackup(t *testing.T, archive []byte, replacements map[string][]byte) []byte {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for _, file := range reader.File {
+		entry, err := writer.Create(file.Name)
+		require.NoError(t, err)
+
+		if content, ok := replacements[file.Name]; ok {
+			_, err = entry.Write(content)
+			require.NoError(t, err)
+			continue
+		}
+
+		opened, err := file.Open()
+		require.NoError(t, err)
+		_, err = io.Copy(entry, opened)
+		require.NoError(t, err)
+		opened.Close()
+	}
+
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func TestBackup_RoundTrip(t *testing.T) {
+	backup, err := readTestBackup(writeTestBackup(t))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(2), backup.Manifest.KeyGeneration)
+	assert.Equal(t, &BackupKey{Key: []byte("key"), Generation: 2}, backup.Key)
+	assert.Equal(t, &BackupSalt{Salt: []byte("salt")}, backup.Salt)
+	assert.Equal(t, []string{"entries", "tags"}, backup.EntityTypes())
+	assert.Equal(t, []Entity{
+		{ID: "a", Version: 1, KeyGeneration: 2, Data: []byte("first")},
+		{ID: "b", Version: 3, KeyGeneration: 2, Data: []byte("second")},
+	}, backup.Entities["entries"])
+	assert.Empty(t, backup.Entities["tags"], "empty types should be included so that importing clears them")
+}
+
+func TestBackup_RejectsModifiedFile(t *testing.T) {
+	archive := rewriteBackup(t, writeTestBackup(t), map[string][]byte{
+		// Same size as the original so that only the checksum differs
+		backupSaltFile: []byte(`{"salt":"c2FsdA=="} `),
+	})
+
+	_, err := readTestBackup(archive)
+
+	var invalidErr InvalidBackupError
+	require.ErrorAs(t, err, &invalidErr)
+	assert.Contains(t, invalidErr.Reason, "checksum")
+}
+
+func TestBackup_RejectsUnlistedFile(t *testing.T) {
+	original := writeTestBackup(t)
+	reader, err := zip.NewReader(bytes.NewReader(original), int64(len(original)))
+	require.NoError(t, err)
+
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for _, file := range reader.File {
+		require.NoError(t, writer.Copy(file))
+	}
+
+	entry, err := writer.Create(entityBackupFile("goals"))
+	require.NoError(t, err)
+	_, err = entry.Write([]byte(`{"id":"x","version":1,"data":"eA=="}` + "\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	_, err = readTestBackup(buffer.Bytes())
+
+	assert.ErrorAs(t, err, &InvalidBackupError{})
+}
+
+func TestBackup_RejectsMissingManifest(t *testing.T) {
+	var buffer bytes.Buffer
+	require.NoError(t, zip.NewWriter(&buffer).Close())
+
+	_, err := readTestBackup(buffer.Bytes())
+
+	assert.ErrorAs(t, err, &InvalidBackupError{})
+}
@@ -2,10 +2,13 @@ package internal
 
 import (
 	"context"
+	"errors"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"perfice.adoe.dev/mongoutil"
+	"perfice.adoe.dev/util"
 )
 
 type SyncUpdateCollection struct {
@@ -21,6 +24,16 @@ func (c *SyncUpdateCollection) Insert(context context.Context, update SyncUpdate
 	return err
 }
 
+func (c *SyncUpdateCollection) WatchInserts(context context.Context, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream()
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+
+	pipeline := mongo.Pipeline{bson.D{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	return c.collection.Watch(context, pipeline, opts)
+}
+
 func (c *SyncUpdateCollection) GetUpdatesByIds(ids []string) ([]SyncUpdate, error) {
 	if len(ids) < 1 {
 		return []SyncUpdate{}, nil
@@ -29,6 +42,14 @@ func (c *SyncUpdateCollection) GetUpdatesByIds(ids []string) ([]SyncUpdate, erro
 	return mongoutil.Find[SyncUpdate](c.collection, bson.M{"id": bson.M{"$in": ids}})
 }
 
+func (c *SyncUpdateCollection) FindByUserAfterSequence(userId string, sessionId string, after int64, until int64, limit int64) ([]SyncUpdate, error) {
+	return mongoutil.Find[SyncUpdate](c.collection, bson.M{
+		"user":     userId,
+		"origin":   bson.M{"$ne": sessionId},
+		"sequence": bson.M{"$gt": after, "$lte": until},
+	}, options.Find().SetSort(bson.M{"sequence": 1}).SetLimit(limit))
+}
+
 func (c *SyncUpdateCollection) FindBySessionId(sessionId string) ([]SyncUpdate, error) {
 	return mongoutil.Find[SyncUpdate](c.collection, bson.M{"clients": sessionId})
 }
@@ -70,8 +91,116 @@ func (c *SyncUpdateCollection) DeleteUpdatesByEntityType(sessionContext mongo.Se
 	return err
 }
 
-func (c *SyncUpdateCollection) DeleteUpdatesByUser(id string) error {
-	_, err := mongoutil.DeleteMany(c.collection, bson.M{"user": id})
+func (c *SyncUpdateCollection) DeleteUpdatesByUser(context context.Context, id string) error {
+	_, err := c.collection.DeleteMany(context, bson.M{"user": id})
+	return err
+}
+
+func (c *SyncUpdateCollection) DistinctUsers() ([]string, error) {
+	users, err := c.collection.Distinct(context.Background(), "user", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(users))
+	for _, user := range users {
+		if id, ok := user.(string); ok {
+			result = append(result, id)
+		}
+	}
+
+	return result, nil
+}
+
+// PullSession removes a session from every update of a user, e.g. because it was revoked
+func (c *SyncUpdateCollection) PullSession(userId string, sessionId string) (int64, error) {
+	rs, err := c.collection.UpdateMany(context.Background(),
+		bson.M{"user": userId, "clients": sessionId},
+		bson.M{"$pull": bson.M{"clients": sessionId}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return rs.ModifiedCount, nil
+}
+
+// PullDeadSessions removes every session that is not in aliveSessions from the updates of a user
+func (c *SyncUpdateCollection) PullDeadSessions(userId string, aliveSessions []string) (int64, error) {
+	rs, err := c.collection.UpdateMany(context.Background(),
+		bson.M{"user": userId, "clients": bson.M{"$elemMatch": bson.M{"$nin": aliveSessions}}},
+		bson.M{"$pull": bson.M{"clients": bson.M{"$nin": aliveSessions}}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return rs.ModifiedCount, nil
+}
+
+// FindMaxSequence returns the highest sequence number of the updates matching the filter, or false if none match
+func (c *SyncUpdateCollection) FindMaxSequence(filter bson.M) (int64, bool, error) {
+	updates, err := mongoutil.Find[SyncUpdate](c.collection, filter,
+		options.Find().SetSort(bson.M{"sequence": -1}).SetLimit(1))
+
+	if err != nil || len(updates) == 0 {
+		return 0, false, err
+	}
+
+	return updates[0].Sequence, true, nil
+}
+
+// DeleteUpToSequence deletes the updates matching the filter that have a sequence number of at most maxSequence
+func (c *SyncUpdateCollection) DeleteUpToSequence(filter bson.M, maxSequence int64) (int64, error) {
+	bounded := bson.M{"sequence": bson.M{"$lte": maxSequence}}
+	for key, value := range filter {
+		bounded[key] = value
+	}
+
+	rs, err := c.collection.DeleteMany(context.Background(), bounded)
+	if err != nil {
+		return 0, err
+	}
+
+	return rs.DeletedCount, nil
+}
+
+type SyncSequenceCollection struct {
+	collection *mongo.Collection
+}
+
+func NewSyncSequenceCollection(collection *mongo.Collection) *SyncSequenceCollection {
+	return &SyncSequenceCollection{collection}
+}
+
+// Next increments and returns the sequence number of a user
+func (c *SyncSequenceCollection) Next(sessionContext mongo.SessionContext, userId string) (int64, error) {
+	var sequence SyncSequence
+	err := c.collection.FindOneAndUpdate(sessionContext,
+		bson.M{"user": userId},
+		bson.M{"$inc": bson.M{"sequence": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&sequence)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return sequence.Sequence, nil
+}
+
+func (c *SyncSequenceCollection) FindByUser(userId string) (*SyncSequence, error) {
+	return mongoutil.FindOne[SyncSequence](c.collection, bson.M{"user": userId})
+}
+
+// SetCompacted marks every update up to and including the given sequence number as possibly removed
+func (c *SyncSequenceCollection) SetCompacted(context context.Context, userId string, sequence int64) error {
+	_, err := c.collection.UpdateOne(context, bson.M{"user": userId},
+		bson.M{"$max": bson.M{"compacted": sequence}})
+	return err
+}
+
+func (c *SyncSequenceCollection) DeleteByUser(id string) error {
+	_, err := c.collection.DeleteOne(context.Background(), bson.M{"user": id})
 	return err
 }
 
@@ -83,8 +212,43 @@ func NewKeyVerificationCollection(collection *mongo.Collection) *KeyVerification
 	return &KeyVerificationCollection{collection}
 }
 
-func (c *KeyVerificationCollection) Upsert(verification KeyVerification) error {
-	return mongoutil.Upsert(c.collection, bson.M{"user": verification.User}, verification)
+// ReplaceIfGeneration replaces the key of a user only if the stored key still has the given generation, so that
+// concurrent key changes can't overwrite each other. A generation of 0 means that no key is stored yet.
+// Returns false if the stored key has changed in the meantime.
+func (c *KeyVerificationCollection) ReplaceIfGeneration(verification KeyVerification, generation int64) (bool, error) {
+	result, err := c.collection.ReplaceOne(context.Background(),
+		bson.M{"user": verification.User, "generation": generation},
+		verification,
+		options.Replace().SetUpsert(generation == 0))
+
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.MatchedCount > 0 || result.UpsertedCount > 0, nil
+}
+
+func (c *KeyVerificationCollection) Replace(context context.Context, verification KeyVerification) error {
+	_, err := c.collection.ReplaceOne(context, bson.M{"user": verification.User}, verification, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (c *KeyVerificationCollection) FindByUserInSession(context context.Context, user string) (*KeyVerification, error) {
+	var verification KeyVerification
+	err := c.collection.FindOne(context, bson.M{"user": user}).Decode(&verification)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &verification, nil
 }
 
 func (c *KeyVerificationCollection) FindByUser(user string) (*KeyVerification, error) {
@@ -96,6 +260,62 @@ func (c *KeyVerificationCollection) DeleteByUser(id string) error {
 	return err
 }
 
+type KeyGenerationCollection struct {
+	collection *mongo.Collection
+}
+
+func NewKeyGenerationCollection(collection *mongo.Collection) *KeyGenerationCollection {
+	return &KeyGenerationCollection{collection}
+}
+
+func (c *KeyGenerationCollection) Insert(context context.Context, generation KeyGeneration) error {
+	_, err := c.collection.InsertOne(context, generation)
+	return err
+}
+
+func (c *KeyGenerationCollection) FindByUser(user string) ([]KeyGeneration, error) {
+	return mongoutil.Find[KeyGeneration](c.collection, bson.M{"user": user},
+		options.Find().SetSort(bson.M{"generation": -1}))
+}
+
+func (c *KeyGenerationCollection) DeleteByUser(id string) error {
+	_, err := mongoutil.DeleteMany(c.collection, bson.M{"user": id})
+	return err
+}
+
+type KeyChallengeCollection struct {
+	collection *mongo.Collection
+}
+
+func NewKeyChallengeCollection(collection *mongo.Collection) *KeyChallengeCollection {
+	return &KeyChallengeCollection{collection}
+}
+
+func (c *KeyChallengeCollection) Insert(challenge KeyChallenge) error {
+	_, err := c.collection.InsertOne(context.Background(), challenge)
+	return err
+}
+
+// Take removes and returns a challenge, so that it can only be answered once
+func (c *KeyChallengeCollection) Take(user string, challenge []byte) (*KeyChallenge, error) {
+	var taken KeyChallenge
+	err := c.collection.FindOneAndDelete(context.Background(), bson.M{"user": user, "challenge": challenge}).Decode(&taken)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &taken, nil
+}
+
+func (c *KeyChallengeCollection) DeleteByUser(id string) error {
+	_, err := mongoutil.DeleteMany(c.collection, bson.M{"user": id})
+	return err
+}
+
 type SaltCollection struct {
 	collection *mongo.Collection
 }
@@ -109,6 +329,11 @@ func (c *SaltCollection) Insert(salt Salt) error {
 	return err
 }
 
+func (c *SaltCollection) Replace(context context.Context, salt Salt) error {
+	_, err := c.collection.ReplaceOne(context, bson.M{"user": salt.User}, salt, options.Replace().SetUpsert(true))
+	return err
+}
+
 func (c *SaltCollection) FindByUser(user string) (*Salt, error) {
 	return mongoutil.FindOne[Salt](c.collection, bson.M{"user": user})
 }
@@ -117,3 +342,151 @@ func (c *SaltCollection) DeleteByUser(id string) error {
 	_, err := c.collection.DeleteOne(context.Background(), bson.M{"user": id})
 	return err
 }
+
+type EntityTypeCollection struct {
+	collection *mongo.Collection
+}
+
+func NewEntityTypeCollection(collection *mongo.Collection) *EntityTypeCollection {
+	return &EntityTypeCollection{collection}
+}
+
+func (c *EntityTypeCollection) FindAll() ([]EntityTypeDefinition, error) {
+	return mongoutil.Find[EntityTypeDefinition](c.collection, bson.M{})
+}
+
+func (c *EntityTypeCollection) Upsert(definition EntityTypeDefinition) error {
+	return mongoutil.Upsert(c.collection, bson.M{"name": definition.Name}, definition)
+}
+
+// InsertIfMissing inserts the definition unless the entity type already exists, so changes made at runtime are kept
+func (c *EntityTypeCollection) InsertIfMissing(definition EntityTypeDefinition) error {
+	_, err := c.collection.UpdateOne(context.Background(), bson.M{"name": definition.Name},
+		bson.M{"$setOnInsert": definition}, options.Update().SetUpsert(true))
+	return err
+}
+
+type KeyRotationCollection struct {
+	collection *mongo.Collection
+}
+
+func NewKeyRotationCollection(collection *mongo.Collection) *KeyRotationCollection {
+	return &KeyRotationCollection{collection}
+}
+
+func (c *KeyRotationCollection) Insert(rotation KeyRotation) error {
+	_, err := c.collection.InsertOne(context.Background(), rotation)
+	return err
+}
+
+// FindByUser returns the rotation of a user, including expired rotations that haven't been removed yet
+func (c *KeyRotationCollection) FindByUser(context context.Context, userId string) (*KeyRotation, error) {
+	var rotation KeyRotation
+	err := c.collection.FindOne(context, bson.M{"user": userId}).Decode(&rotation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &rotation, nil
+}
+
+func (c *KeyRotationCollection) DeleteByUser(context context.Context, userId string) error {
+	_, err := c.collection.DeleteMany(context, bson.M{"user": userId})
+	return err
+}
+
+type StagedEntityCollection struct {
+	collection *mongo.Collection
+}
+
+func NewStagedEntityCollection(collection *mongo.Collection) *StagedEntityCollection {
+	return &StagedEntityCollection{collection}
+}
+
+func (c *StagedEntityCollection) Upsert(entities []StagedEntity) error {
+	if len(entities) == 0 {
+		return nil
+	}
+
+	models := util.SliceMap(entities, func(entity StagedEntity) mongo.WriteModel {
+		return mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"rotation": entity.Rotation, "entityType": entity.EntityType, "id": entity.ID}).
+			SetReplacement(entity).
+			SetUpsert(true)
+	})
+
+	_, err := c.collection.BulkWrite(context.Background(), models)
+	return err
+}
+
+func (c *StagedEntityCollection) FindByRotationAndEntityType(context context.Context, rotationId string, entityType string) ([]StagedEntity, error) {
+	cursor, err := c.collection.Find(context, bson.M{"rotation": rotationId, "entityType": entityType})
+	if err != nil {
+		return nil, err
+	}
+
+	var entities []StagedEntity
+	if err := cursor.All(context, &entities); err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (c *StagedEntityCollection) CountByRotation(rotationId string) (int64, error) {
+	return c.collection.CountDocuments(context.Background(), bson.M{"rotation": rotationId})
+}
+
+func (c *StagedEntityCollection) DeleteByUser(context context.Context, userId string) error {
+	_, err := c.collection.DeleteMany(context, bson.M{"user": userId})
+	return err
+}
+
+type UsageCollection struct {
+	collection *mongo.Collection
+}
+
+func NewUsageCollection(collection *mongo.Collection) *UsageCollection {
+	return &UsageCollection{collection}
+}
+
+// Apply changes the usage of an entity type and returns the new usage
+func (c *UsageCollection) Apply(context context.Context, userId string, entityType string, delta usageDelta) (EntityUsage, error) {
+	var update bson.M
+	if delta.absolute {
+		update = bson.M{"$set": bson.M{"entities": delta.entities, "bytes": delta.bytes}}
+	} else {
+		update = bson.M{"$inc": bson.M{"entities": delta.entities, "bytes": delta.bytes}}
+	}
+
+	var usage EntityUsage
+	err := c.collection.FindOneAndUpdate(context,
+		bson.M{"user": userId, "entityType": entityType},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&usage)
+
+	return usage, err
+}
+
+func (c *UsageCollection) FindByUser(context context.Context, userId string) ([]EntityUsage, error) {
+	cursor, err := c.collection.Find(context, bson.M{"user": userId})
+	if err != nil {
+		return nil, err
+	}
+
+	var usages []EntityUsage
+	if err := cursor.All(context, &usages); err != nil {
+		return nil, err
+	}
+
+	return usages, nil
+}
+
+func (c *UsageCollection) DeleteByUser(id string) error {
+	_, err := mongoutil.DeleteMany(c.collection, bson.M{"user": id})
+	return err
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"go.mongodb.org/mongo-driver/bson"
+	pb "perfice.adoe.dev/proto"
+	"perfice.adoe.dev/util"
+)
+
+var defaultCompactionInterval = time.Hour
+var defaultUpdateMaxAge = 30 * 24 * time.Hour
+
+// CompactionStats counts what has been reclaimed by the compaction job since the service started
+type CompactionStats struct {
+	Runs               int64     `json:"runs"`
+	LastRun            time.Time `json:"lastRun"`
+	LastDuration       string    `json:"lastDuration"`
+	LastError          string    `json:"lastError,omitempty"`
+	UpdatesDetached    int64     `json:"updatesDetached"`
+	UnreferencedPruned int64     `json:"unreferencedPruned"`
+	ExpiredPruned      int64     `json:"expiredPruned"`
+	UsersCompacted     int64     `json:"usersCompacted"`
+}
+
+// CompactionService removes dead sessions from sync updates and deletes updates that are no longer needed.
+// Expired sequence numbers are recorded as compacted, so sessions whose cursor is behind have to do a full pull.
+type CompactionService struct {
+	syncUpdateCollection   *SyncUpdateCollection
+	syncSequenceCollection *SyncSequenceCollection
+	authClient             pb.UserServiceClient
+	interval               time.Duration
+	maxAge                 time.Duration
+
+	mutex sync.Mutex
+	stats CompactionStats
+}
+
+func NewCompactionService(syncUpdateCollection *SyncUpdateCollection, syncSequenceCollection *SyncSequenceCollection,
+	authClient pb.UserServiceClient, interval time.Duration, maxAge time.Duration) *CompactionService {
+	return &CompactionService{
+		syncUpdateCollection:   syncUpdateCollection,
+		syncSequenceCollection: syncSequenceCollection,
+		authClient:             authClient,
+		interval:               interval,
+		maxAge:                 maxAge,
+	}
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid %s: %w", name, err))
+	}
+
+	return duration
+}
+
+// compactionServiceFromEnv reads SYNC_COMPACTION_INTERVAL and SYNC_UPDATE_MAX_AGE, a max age of 0 keeps updates forever
+func compactionServiceFromEnv(syncUpdateCollection *SyncUpdateCollection, syncSequenceCollection *SyncSequenceCollection,
+	authClient pb.UserServiceClient) *CompactionService {
+	return NewCompactionService(syncUpdateCollection, syncSequenceCollection, authClient,
+		durationFromEnv("SYNC_COMPACTION_INTERVAL", defaultCompactionInterval),
+		durationFromEnv("SYNC_UPDATE_MAX_AGE", defaultUpdateMaxAge))
+}
+
+func (s *CompactionService) Run() {
+	go func() {
+		for {
+			s.Compact()
+			time.Sleep(s.interval)
+		}
+	}()
+}
+
+func (s *CompactionService) Stats() CompactionStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stats
+}
+
+// Compact runs a single compaction over every user that has sync updates
+func (s *CompactionService) Compact() {
+	start := time.Now()
+	var run CompactionStats
+
+	users, err := s.syncUpdateCollection.DistinctUsers()
+	for _, userId := range users {
+		if userErr := s.compactUser(userId, &run); userErr != nil {
+			// Keep going, one failing user shouldn't prevent compacting the others
+			err = userErr
+			sentry.CaptureException(fmt.Errorf("failed to compact sync updates of user %s: %w", userId, userErr))
+		}
+	}
+
+	if err != nil {
+		log.Println("Sync update compaction failed:", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stats.Runs++
+	s.stats.LastRun = start
+	s.stats.LastDuration = time.Since(start).String()
+	s.stats.LastError = ""
+	if err != nil {
+		s.stats.LastError = err.Error()
+	}
+
+	s.stats.UpdatesDetached += run.UpdatesDetached
+	s.stats.UnreferencedPruned += run.UnreferencedPruned
+	s.stats.ExpiredPruned += run.ExpiredPruned
+	s.stats.UsersCompacted += run.UsersCompacted
+}
+
+func (s *CompactionService) compactUser(userId string, run *CompactionStats) error {
+	sessions, err := s.authClient.GetSessions(context.Background(), &pb.GetSessionsRequest{UserId: userId})
+	if err != nil {
+		return err
+	}
+
+	alive := util.SliceMap(sessions.Sessions, func(session *pb.Session) string { return session.Id })
+	detached, err := s.syncUpdateCollection.PullDeadSessions(userId, alive)
+	if err != nil {
+		return err
+	}
+
+	// Every live session has acknowledged unreferenced updates, but pulls by cursor still read them, so deleting
+	// them expires older cursors like any other pruned update
+	unreferenced, err := s.prune(userId, bson.M{"user": userId, "clients": bson.M{"$size": 0}}, true)
+	if err != nil {
+		return err
+	}
+
+	var expired int64
+	if s.maxAge > 0 {
+		cutoff := time.Now().Add(-s.maxAge).UnixMilli()
+		expired, err = s.prune(userId, bson.M{"user": userId, "timestamp": bson.M{"$lt": cutoff}}, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	run.UpdatesDetached += detached
+	run.UnreferencedPruned += unreferenced
+	run.ExpiredPruned += expired
+	if detached > 0 || unreferenced > 0 || expired > 0 {
+		run.UsersCompacted++
+	}
+
+	return nil
+}
+
+// prune deletes the updates matching the filter. If expireCursors is set, the compaction watermark is raised before
+// deleting, so that a pull never silently skips a deleted update. Updates inserted while pruning have higher sequence
+// numbers and are kept.
+func (s *CompactionService) prune(userId string, filter bson.M, expireCursors bool) (int64, error) {
+	maxSequence, found, err := s.syncUpdateCollection.FindMaxSequence(filter)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	if expireCursors {
+		if err := s.syncSequenceCollection.SetCompacted(context.Background(), userId, maxSequence); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.syncUpdateCollection.DeleteUpToSequence(filter, maxSequence)
+}
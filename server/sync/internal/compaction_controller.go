@@ -0,0 +1,15 @@
+package internal
+
+import "github.com/gofiber/fiber/v2"
+
+type CompactionController struct {
+	compactionService *CompactionService
+}
+
+func NewCompactionController(compactionService *CompactionService) *CompactionController {
+	return &CompactionController{compactionService}
+}
+
+func (c *CompactionController) GetStats(ctx *fiber.Ctx) error {
+	return ctx.JSON(c.compactionService.Stats())
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+type ConflictResolution string
+
+// Incoming entity replaces the stored one, the conflict is only reported
+var overwriteConflictResolution ConflictResolution = "overwrite"
+
+// Stored entity is kept and the incoming entity is dropped from the update
+var keepConflictResolution ConflictResolution = "keep"
+
+// The whole update is rejected and not acknowledged
+var rejectConflictResolution ConflictResolution = "reject"
+
+// ConflictPolicy decides what happens when an incoming entity is stale, see isStale
+type ConflictPolicy interface {
+	Resolve(stored Entity, incoming UpdateEntity) ConflictResolution
+}
+
+type LastWriterWinsPolicy struct{}
+
+func (p LastWriterWinsPolicy) Resolve(stored Entity, incoming UpdateEntity) ConflictResolution {
+	return overwriteConflictResolution
+}
+
+// HighestVersionWinsPolicy keeps the stored entity. A stale entity never has a higher version than the stored one, and
+// on equal versions the writer that came first wins.
+type HighestVersionWinsPolicy struct{}
+
+func (p HighestVersionWinsPolicy) Resolve(stored Entity, incoming UpdateEntity) ConflictResolution {
+	return keepConflictResolution
+}
+
+type RejectPolicy struct{}
+
+func (p RejectPolicy) Resolve(stored Entity, incoming UpdateEntity) ConflictResolution {
+	return rejectConflictResolution
+}
+
+var conflictPolicies = map[string]ConflictPolicy{
+	"lastWriterWins":     LastWriterWinsPolicy{},
+	"highestVersionWins": HighestVersionWinsPolicy{},
+	"reject":             RejectPolicy{},
+}
+
+func NewConflictPolicy(name string) (ConflictPolicy, error) {
+	if name == "" {
+		return HighestVersionWinsPolicy{}, nil
+	}
+
+	policy, ok := conflictPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown conflict policy %s", name)
+	}
+
+	return policy, nil
+}
+
+func conflictPolicyFromEnv() ConflictPolicy {
+	policy, err := NewConflictPolicy(os.Getenv("SYNC_CONFLICT_POLICY"))
+	if err != nil {
+		panic(err)
+	}
+
+	return policy
+}
+
+// isStale returns true if the incoming entity was based on an older version than the stored one. Two clients editing
+// the same version both send the next version, so an equal version is stale too unless it is a retry of the same write.
+func isStale(stored Entity, incoming UpdateEntity) bool {
+	if incoming.Version == stored.Version {
+		return !bytes.Equal(incoming.Data, stored.Data)
+	}
+
+	return incoming.Version < stored.Version
+}
+
+// resolveConflicts compares the incoming entities against the stored ones and returns the entities that should be
+// written together with a conflict describing every stale entity. A nil conflict means nothing was stale.
+func resolveConflicts(policy ConflictPolicy, update IncomingSyncUpdate, stored map[string]Entity) ([]UpdateEntity, *SyncConflict) {
+	var accepted = make([]UpdateEntity, 0, len(update.Entities))
+	var conflicting []ConflictEntity
+	rejected := false
+
+	for _, entity := range update.Entities {
+		existing, ok := stored[entity.ID]
+		if !ok || !isStale(existing, entity) {
+			accepted = append(accepted, entity)
+			continue
+		}
+
+		resolution := policy.Resolve(existing, entity)
+		conflicting = append(conflicting, ConflictEntity{
+			ID:              entity.ID,
+			IncomingVersion: entity.Version,
+			Resolution:      resolution,
+			Stored:          existing,
+		})
+
+		switch resolution {
+		case overwriteConflictResolution:
+			accepted = append(accepted, entity)
+		case rejectConflictResolution:
+			rejected = true
+		}
+	}
+
+	if len(conflicting) == 0 {
+		return accepted, nil
+	}
+
+	conflict := &SyncConflict{
+		UpdateID:   update.ID,
+		EntityType: update.EntityType,
+		Rejected:   rejected,
+		Entities:   conflicting,
+	}
+
+	if rejected {
+		return nil, conflict
+	}
+
+	return accepted, conflict
+}
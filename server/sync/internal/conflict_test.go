@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func conflictTestUpdate() (IncomingSyncUpdate, map[string]Entity) {
+	update := IncomingSyncUpdate{
+		ID:         "update",
+		Operation:  putOperation,
+		EntityType: "entries",
+		Entities: []UpdateEntity{
+			{ID: "fresh", Version: 3, Data: []byte("fresh")},
+			{ID: "stale", Version: 1, Data: []byte("stale")},
+			{ID: "new", Version: 1, Data: []byte("new")},
+		},
+	}
+
+	stored := map[string]Entity{
+		"fresh": {ID: "fresh", Version: 2, Data: []byte("stored")},
+		"stale": {ID: "stale", Version: 2, Data: []byte("stored")},
+	}
+
+	return update, stored
+}
+
+func TestResolveConflicts_NoConflicts(t *testing.T) {
+	update, _ := conflictTestUpdate()
+
+	entities, conflict := resolveConflicts(HighestVersionWinsPolicy{}, update, map[string]Entity{})
+
+	assert.Nil(t, conflict, "there should be no conflict without stored entities")
+	assert.Len(t, entities, 3, "all entities should be written")
+}
+
+func TestResolveConflicts_LastWriterWins(t *testing.T) {
+	update, stored := conflictTestUpdate()
+
+	entities, conflict := resolveConflicts(LastWriterWinsPolicy{}, update, stored)
+
+	assert.Len(t, entities, 3, "stale entities should still be written")
+	assert.NotNil(t, conflict, "stale entity should be reported")
+	assert.False(t, conflict.Rejected)
+	assert.Equal(t, "stale", conflict.Entities[0].ID)
+	assert.Equal(t, overwriteConflictResolution, conflict.Entities[0].Resolution)
+}
+
+func TestResolveConflicts_HighestVersionWins(t *testing.T) {
+	update, stored := conflictTestUpdate()
+
+	entities, conflict := resolveConflicts(HighestVersionWinsPolicy{}, update, stored)
+
+	assert.Len(t, entities, 2, "stale entity should be dropped")
+	assert.NotNil(t, conflict)
+	assert.False(t, conflict.Rejected)
+	assert.Equal(t, keepConflictResolution, conflict.Entities[0].Resolution)
+	assert.Equal(t, 2, conflict.Entities[0].Stored.Version, "stored entity should be returned to the client")
+}
+
+func TestResolveConflicts_EqualVersions(t *testing.T) {
+	update := IncomingSyncUpdate{
+		ID:         "update",
+		Operation:  putOperation,
+		EntityType: "entries",
+		Entities: []UpdateEntity{
+			{ID: "concurrent", Version: 3, Data: []byte("concurrent")},
+			{ID: "retried", Version: 3, Data: []byte("retried")},
+		},
+	}
+	stored := map[string]Entity{
+		"concurrent": {ID: "concurrent", Version: 3, Data: []byte("stored")},
+		"retried":    {ID: "retried", Version: 3, Data: []byte("retried")},
+	}
+
+	entities, conflict := resolveConflicts(HighestVersionWinsPolicy{}, update, stored)
+
+	assert.Equal(t, []UpdateEntity{update.Entities[1]}, entities, "only the retried write should be written")
+	assert.NotNil(t, conflict, "concurrent write from the same version should be reported")
+	assert.Len(t, conflict.Entities, 1)
+	assert.Equal(t, "concurrent", conflict.Entities[0].ID)
+	assert.Equal(t, keepConflictResolution, conflict.Entities[0].Resolution, "first writer should win on equal versions")
+}
+
+func TestResolveConflicts_Reject(t *testing.T) {
+	update, stored := conflictTestUpdate()
+
+	entities, conflict := resolveConflicts(RejectPolicy{}, update, stored)
+
+	assert.Nil(t, entities, "nothing should be written when rejected")
+	assert.NotNil(t, conflict)
+	assert.True(t, conflict.Rejected)
+	assert.Equal(t, "update", conflict.UpdateID)
+}
+
+func TestNewConflictPolicy(t *testing.T) {
+	policy, err := NewConflictPolicy("")
+	assert.NoError(t, err)
+	assert.IsType(t, HighestVersionWinsPolicy{}, policy, "highest version should win by default")
+
+	_, err = NewConflictPolicy("unknown")
+	assert.Error(t, err)
+}
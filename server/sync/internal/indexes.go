@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var syncIndexes = []mongoutil.IndexSpec{
+	{Collection: "sync_updates", Keys: bson.D{{Key: "id", Value: 1}}, Unique: true},
+	{Collection: "sync_updates", Keys: bson.D{{Key: "clients", Value: 1}}},
+	{Collection: "sync_updates", Keys: bson.D{{Key: "user", Value: 1}, {Key: "sequence", Value: 1}}},
+	{Collection: "sync_updates", Keys: bson.D{{Key: "user", Value: 1}, {Key: "entityType", Value: 1}}},
+	{Collection: "sync_sequences", Keys: bson.D{{Key: "user", Value: 1}}, Unique: true},
+	{Collection: "key_verifications", Keys: bson.D{{Key: "user", Value: 1}}, Unique: true},
+	{Collection: "key_generations", Keys: bson.D{{Key: "user", Value: 1}, {Key: "generation", Value: 1}}, Unique: true},
+	{Collection: "key_challenges", Keys: bson.D{{Key: "user", Value: 1}, {Key: "challenge", Value: 1}}},
+	{Collection: "key_challenges", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "salts", Keys: bson.D{{Key: "user", Value: 1}}, Unique: true},
+	{Collection: "sync_usage", Keys: bson.D{{Key: "user", Value: 1}, {Key: "entityType", Value: 1}}, Unique: true},
+	{Collection: "entity_types", Keys: bson.D{{Key: "name", Value: 1}}, Unique: true},
+	{Collection: "key_rotations", Keys: bson.D{{Key: "user", Value: 1}}, Unique: true},
+	{Collection: "key_rotations", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+	{Collection: "rotation_entities", Keys: bson.D{{Key: "rotation", Value: 1}, {Key: "entityType", Value: 1}, {Key: "id", Value: 1}}, Unique: true},
+	{Collection: "rotation_entities", Keys: bson.D{{Key: "user", Value: 1}}},
+	{Collection: "rotation_entities", Keys: bson.D{{Key: "expiresAt", Value: 1}}, TTL: true},
+}
+
+func entityIndexes(entityType string) []mongoutil.IndexSpec {
+	return []mongoutil.IndexSpec{
+		{Collection: entityType, Keys: bson.D{{Key: "user", Value: 1}, {Key: "id", Value: 1}}, Unique: true},
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -11,11 +12,13 @@ import (
 )
 
 type UserDeletedCallback func(userId string)
+type SessionRevokedCallback func(userId string, sessionId string)
 
 type KafkaService struct {
 	conn *kafka.Reader
 
-	userDeletedCallbacks []UserDeletedCallback
+	userDeletedCallbacks    []UserDeletedCallback
+	sessionRevokedCallbacks []SessionRevokedCallback
 }
 
 func NewKafkaService() *KafkaService {
@@ -29,7 +32,7 @@ func NewKafkaService() *KafkaService {
 		Dialer:  dialer,
 	})
 
-	return &KafkaService{r, []UserDeletedCallback{}}
+	return &KafkaService{r, []UserDeletedCallback{}, []SessionRevokedCallback{}}
 }
 
 func (a *KafkaService) Read() {
@@ -52,6 +55,17 @@ func (a *KafkaService) Read() {
 					callback(userId)
 				}
 				break
+			case "sessionRevoked":
+				userId, sessionId, ok := strings.Cut(eventData, ":")
+				if !ok {
+					log.Println("invalid sessionRevoked event", eventData)
+					break
+				}
+
+				for _, callback := range a.sessionRevokedCallbacks {
+					callback(userId, sessionId)
+				}
+				break
 			}
 		}
 	}()
@@ -60,3 +74,7 @@ func (a *KafkaService) Read() {
 func (a *KafkaService) OnUserDeleted(callback UserDeletedCallback) {
 	a.userDeletedCallbacks = append(a.userDeletedCallbacks, callback)
 }
+
+func (a *KafkaService) OnSessionRevoked(callback SessionRevokedCallback) {
+	a.sessionRevokedCallbacks = append(a.sessionRevokedCallbacks, callback)
+}
@@ -1,16 +1,45 @@
 package internal
 
 import (
+	"errors"
+	"time"
+
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
+	"perfice.adoe.dev/util"
 )
 
+// KeyRequest replaces the key. ProofKey is derived from the decrypted key blob by the client, Challenge and Proof are
+// required if the current key has a proof key. Keys set without a proof key are replaced by passing their generation
+// as ExpectedGeneration.
 type KeyRequest struct {
-	Key []byte `json:"key" validate:"required"`
+	Key                []byte `json:"key" validate:"required"`
+	ProofKey           []byte `json:"proofKey" validate:"required"`
+	Challenge          []byte `json:"challenge"`
+	Proof              []byte `json:"proof"`
+	ExpectedGeneration *int64 `json:"expectedGeneration"`
 }
 
 type KeyResponse struct {
-	Key []byte `json:"key"`
+	Key        []byte `json:"key"`
+	Generation int64  `json:"generation"`
+}
+
+type SetKeyResponse struct {
+	Generation int64 `json:"generation"`
+}
+
+type KeyChallengeResponse struct {
+	Challenge []byte    `json:"challenge"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type KeyGenerationResponse struct {
+	Generation int64     `json:"generation"`
+	Key        []byte    `json:"key"`
+	Session    string    `json:"session"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"createdAt"`
 }
 
 type KeyController struct {
@@ -24,12 +53,16 @@ func NewKeyController(keyVerificationService *KeyVerificationService) *KeyContro
 
 func (c *KeyController) GetKey(ctx *fiber.Ctx) error {
 	userId := getUserId(ctx)
-	key, err := c.keyVerificationService.GetKeyByUser(userId)
+	verification, err := c.keyVerificationService.GetVerification(userId)
 	if err != nil {
 		return err
 	}
 
-	return ctx.JSON(KeyResponse{key})
+	if verification == nil {
+		return ctx.JSON(KeyResponse{})
+	}
+
+	return ctx.JSON(KeyResponse{verification.Key, verification.Generation})
 }
 
 func (c *KeyController) SetKey(ctx *fiber.Ctx) error {
@@ -39,10 +72,55 @@ func (c *KeyController) SetKey(ctx *fiber.Ctx) error {
 	}
 
 	userId := getUserId(ctx)
-	err := c.keyVerificationService.SetKey(userId, req.Key)
+	generation, err := c.keyVerificationService.SetKey(userId, getSessionId(ctx), KeyChange{
+		Key:                req.Key,
+		ProofKey:           req.ProofKey,
+		Challenge:          req.Challenge,
+		Proof:              req.Proof,
+		ExpectedGeneration: req.ExpectedGeneration,
+	})
+
+	if err != nil {
+		if errors.As(err, &KeyProofRequiredError{}) || errors.As(err, &InvalidKeyProofError{}) {
+			return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+
+		if errors.As(err, &KeyChangedError{}) {
+			return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+
+		if errors.As(err, &ProofKeyRequiredError{}) {
+			return ctx.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		return err
+	}
+
+	return ctx.JSON(SetKeyResponse{generation})
+}
+
+func (c *KeyController) CreateChallenge(ctx *fiber.Ctx) error {
+	challenge, err := c.keyVerificationService.CreateChallenge(getUserId(ctx), getSessionId(ctx))
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(KeyChallengeResponse{challenge.Challenge, challenge.ExpiresAt})
+}
+
+func (c *KeyController) GetGenerations(ctx *fiber.Ctx) error {
+	generations, err := c.keyVerificationService.GetGenerations(getUserId(ctx))
 	if err != nil {
 		return err
 	}
 
-	return ctx.SendStatus(fiber.StatusOK)
+	return ctx.JSON(util.SliceMap(generations, func(generation KeyGeneration) KeyGenerationResponse {
+		return KeyGenerationResponse{
+			Generation: generation.Generation,
+			Key:        generation.Key,
+			Session:    generation.Session,
+			Reason:     generation.Reason,
+			CreatedAt:  generation.CreatedAt,
+		}
+	}))
 }
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	pb "perfice.adoe.dev/proto"
+	"perfice.adoe.dev/util"
+)
+
+// Sent to other sessions once a rotation has been committed, they have to re-derive the key and do a full pull
+var keyRotationOperation = "keyRotation"
+
+var defaultKeyRotationTimeout = time.Hour
+
+type KeyRotationInProgressError struct{}
+
+func (e KeyRotationInProgressError) Error() string {
+	return "a key rotation is in progress"
+}
+
+type KeyRotationNotFoundError struct{}
+
+func (e KeyRotationNotFoundError) Error() string {
+	return "no active key rotation for this session"
+}
+
+// KeyRotationIncompleteError is returned on commit if the staged entities don't match the stored ones, either
+// because not everything was uploaded or because entities changed since the rotation started
+type KeyRotationIncompleteError struct {
+	EntityType string
+}
+
+func (e KeyRotationIncompleteError) Error() string {
+	return "staged entities of " + e.EntityType + " don't match the stored entities"
+}
+
+type KeyRotationService struct {
+	client                 *mongo.Client
+	entityTypeRegistry     *EntityTypeRegistry
+	keyRotationCollection  *KeyRotationCollection
+	stagedEntityCollection *StagedEntityCollection
+	keyVerificationService *KeyVerificationService
+	saltCollection         *SaltCollection
+	syncUpdateCollection   *SyncUpdateCollection
+	syncSequenceCollection *SyncSequenceCollection
+	usageService           *UsageService
+	authClient             pb.UserServiceClient
+	timeout                time.Duration
+}
+
+func NewKeyRotationService(client *mongo.Client, entityTypeRegistry *EntityTypeRegistry, keyRotationCollection *KeyRotationCollection,
+	stagedEntityCollection *StagedEntityCollection, keyVerificationService *KeyVerificationService, saltCollection *SaltCollection,
+	syncUpdateCollection *SyncUpdateCollection, syncSequenceCollection *SyncSequenceCollection, usageService *UsageService,
+	authClient pb.UserServiceClient, timeout time.Duration) *KeyRotationService {
+	return &KeyRotationService{client, entityTypeRegistry, keyRotationCollection, stagedEntityCollection,
+		keyVerificationService, saltCollection, syncUpdateCollection, syncSequenceCollection, usageService, authClient, timeout}
+}
+
+// GetActive returns the active rotation of a user, or nil if there is none
+func (s *KeyRotationService) GetActive(userId string) (*KeyRotation, error) {
+	return s.getActive(context.Background(), userId)
+}
+
+func (s *KeyRotationService) getActive(context context.Context, userId string) (*KeyRotation, error) {
+	rotation, err := s.keyRotationCollection.FindByUser(context, userId)
+	if err != nil || rotation == nil {
+		return nil, err
+	}
+
+	if time.Now().After(rotation.ExpiresAt) {
+		// Expired rotations are removed by a TTL index eventually, until then they are ignored
+		return nil, nil
+	}
+
+	return rotation, nil
+}
+
+// CheckUnlocked returns KeyRotationInProgressError if pushes are locked by a rotation
+func (s *KeyRotationService) CheckUnlocked(userId string) error {
+	rotation, err := s.GetActive(userId)
+	if err != nil {
+		return err
+	}
+
+	if rotation != nil {
+		return KeyRotationInProgressError{}
+	}
+
+	return nil
+}
+
+// Start locks pushes and generates the salt for the new key. The caller has to prove that it knows the current key,
+// the same way as when setting the key directly.
+func (s *KeyRotationService) Start(userId string, sessionId string, proof KeyChange) (KeyRotation, error) {
+	generation, err := s.keyVerificationService.VerifyProof(userId, sessionId, proof)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+
+	existing, err := s.keyRotationCollection.FindByUser(context.Background(), userId)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+
+	if existing != nil {
+		if time.Now().Before(existing.ExpiresAt) {
+			return KeyRotation{}, KeyRotationInProgressError{}
+		}
+
+		// Roll back the abandoned rotation before starting a new one
+		if err := s.Abort(userId); err != nil {
+			return KeyRotation{}, err
+		}
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return KeyRotation{}, err
+	}
+
+	rotation := KeyRotation{
+		ID:         uuid.NewString(),
+		User:       userId,
+		Session:    sessionId,
+		Salt:       salt,
+		Generation: generation,
+		StartedAt:  time.Now(),
+		ExpiresAt:  time.Now().Add(s.timeout),
+	}
+
+	if err := s.keyRotationCollection.Insert(rotation); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			// Another session started a rotation at the same time
+			return KeyRotation{}, KeyRotationInProgressError{}
+		}
+
+		return KeyRotation{}, err
+	}
+
+	return rotation, nil
+}
+
+func (s *KeyRotationService) getOwnRotation(context context.Context, userId string, sessionId string) (*KeyRotation, error) {
+	rotation, err := s.getActive(context, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if rotation == nil || rotation.Session != sessionId {
+		return nil, KeyRotationNotFoundError{}
+	}
+
+	return rotation, nil
+}
+
+// Stage stores re-encrypted entities of the rotation, uploading an entity again replaces the staged version.
+// Returns the amount of entities staged so far.
+func (s *KeyRotationService) Stage(userId string, sessionId string, entityType string, entities []Entity) (int64, error) {
+	rotation, err := s.getOwnRotation(context.Background(), userId, sessionId)
+	if err != nil {
+		return 0, err
+	}
+
+	staged := util.SliceMap(entities, func(entity Entity) StagedEntity {
+		return StagedEntity{
+			Rotation:   rotation.ID,
+			User:       userId,
+			EntityType: entityType,
+			ID:         entity.ID,
+			Version:    entity.Version,
+			Data:       entity.Data,
+			ExpiresAt:  rotation.ExpiresAt,
+		}
+	})
+
+	if err := s.stagedEntityCollection.Upsert(staged); err != nil {
+		return 0, err
+	}
+
+	return s.stagedEntityCollection.CountByRotation(rotation.ID)
+}
+
+// Commit atomically replaces every entity with its staged version and swaps the key verification and salt.
+// Pending sync updates are encrypted under the old key, so they are dropped and other sessions are told to re-derive
+// the key and do a full pull. Returns the new key generation.
+func (s *KeyRotationService) Commit(userId string, sessionId string, key []byte, proofKey []byte) (int64, error) {
+	sessions, err := s.authClient.GetSessions(context.Background(), &pb.GetSessionsRequest{UserId: userId})
+	if err != nil {
+		return 0, err
+	}
+
+	otherSessions := util.SliceMap(
+		util.SliceFilter(sessions.Sessions, func(session *pb.Session) bool { return session.Id != sessionId }),
+		func(session *pb.Session) string { return session.Id })
+
+	session, err := s.client.StartSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.EndSession(context.Background())
+
+	generation, err := session.WithTransaction(context.Background(), func(sessionContext mongo.SessionContext) (any, error) {
+		rotation, err := s.getOwnRotation(sessionContext, userId, sessionId)
+		if err != nil {
+			return nil, err
+		}
+
+		generation, err := s.keyVerificationService.replaceInTransaction(sessionContext, userId, sessionId, key, proofKey,
+			rotation.Generation, keyRotationReason)
+		if err != nil {
+			return nil, err
+		}
+
+		for entityType, collection := range s.entityTypeRegistry.Collections() {
+			if err := s.commitEntityType(sessionContext, collection, *rotation, entityType, generation); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := s.saltCollection.Replace(sessionContext, Salt{User: userId, Salt: rotation.Salt}); err != nil {
+			return nil, err
+		}
+
+		if err := s.syncUpdateCollection.DeleteUpdatesByUser(sessionContext, userId); err != nil {
+			return nil, err
+		}
+
+		sequence, err := s.syncSequenceCollection.Next(sessionContext, userId)
+		if err != nil {
+			return nil, err
+		}
+
+		// Cursors from before the rotation point at data encrypted under the old key
+		if err := s.syncSequenceCollection.SetCompacted(sessionContext, userId, sequence-1); err != nil {
+			return nil, err
+		}
+
+		err = s.syncUpdateCollection.Insert(sessionContext, SyncUpdate{
+			ID:            uuid.NewString(),
+			User:          userId,
+			Sequence:      sequence,
+			Origin:        sessionId,
+			Operation:     keyRotationOperation,
+			Timestamp:     time.Now().UnixMilli(),
+			KeyGeneration: generation,
+			Clients:       otherSessions,
+			Entities:      []UpdateEntity{},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.stagedEntityCollection.DeleteByUser(sessionContext, userId); err != nil {
+			return nil, err
+		}
+
+		return generation, s.keyRotationCollection.DeleteByUser(sessionContext, userId)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return generation.(int64), nil
+}
+
+// commitEntityType replaces the stored entities of a type with the staged ones. Every stored entity must have been
+// staged with the same version, otherwise entities would be lost or changes made since the rotation started would be
+// overwritten.
+func (s *KeyRotationService) commitEntityType(sessionContext mongo.SessionContext, collection *mongo.Collection, rotation KeyRotation, entityType string, generation int64) error {
+	cursor, err := collection.Find(sessionContext, bson.M{"user": rotation.User},
+		options.Find().SetProjection(bson.M{"id": 1, "version": 1}))
+	if err != nil {
+		return err
+	}
+
+	var stored []Entity
+	if err := cursor.All(sessionContext, &stored); err != nil {
+		return err
+	}
+
+	staged, err := s.stagedEntityCollection.FindByRotationAndEntityType(sessionContext, rotation.ID, entityType)
+	if err != nil {
+		return err
+	}
+
+	if len(stored) != len(staged) {
+		return KeyRotationIncompleteError{EntityType: entityType}
+	}
+
+	versions := map[string]int{}
+	for _, entity := range staged {
+		versions[entity.ID] = entity.Version
+	}
+
+	for _, entity := range stored {
+		version, ok := versions[entity.ID]
+		if !ok || version != entity.Version {
+			return KeyRotationIncompleteError{EntityType: entityType}
+		}
+	}
+
+	if len(stored) == 0 {
+		return nil
+	}
+
+	entities := util.SliceMap(staged, func(entity StagedEntity) Entity {
+		return Entity{ID: entity.ID, Version: entity.Version, KeyGeneration: generation, Data: entity.Data}
+	})
+
+	if err := replaceEntities(sessionContext, collection, rotation.User, entities); err != nil {
+		return err
+	}
+
+	delta := usageDelta{entities: int64(len(entities)), absolute: true}
+	for _, entity := range entities {
+		delta.bytes += int64(len(entity.Data))
+	}
+
+	return s.usageService.Apply(sessionContext, rotation.User, entityType, delta)
+}
+
+// Abort rolls back the rotation of a user. Nothing has been changed before committing, so the staged entities and
+// the rotation only need to be deleted.
+func (s *KeyRotationService) Abort(userId string) error {
+	if err := s.stagedEntityCollection.DeleteByUser(context.Background(), userId); err != nil {
+		return err
+	}
+
+	return s.keyRotationCollection.DeleteByUser(context.Background(), userId)
+}
+
+func (s *KeyRotationService) OnUserDeleted(userId string) error {
+	return s.Abort(userId)
+}
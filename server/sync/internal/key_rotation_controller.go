@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"perfice.adoe.dev/util"
+)
+
+type KeyRotationController struct {
+	keyRotationService *KeyRotationService
+	entityTypes        *EntityTypeRegistry
+	validator          *validator.Validate
+}
+
+func NewKeyRotationController(keyRotationService *KeyRotationService, entityTypes *EntityTypeRegistry) *KeyRotationController {
+	return &KeyRotationController{keyRotationService, entityTypes, validator.New(validator.WithRequiredStructEnabled())}
+}
+
+type KeyRotationResponse struct {
+	ID        string    `json:"id"`
+	Session   string    `json:"session"`
+	Salt      []byte    `json:"salt"`
+	StartedAt time.Time `json:"startedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type KeyRotationStatusResponse struct {
+	Active   bool                 `json:"active"`
+	Rotation *KeyRotationResponse `json:"rotation"`
+}
+
+type StageEntitiesRequest struct {
+	EntityType string                `json:"entityType" validate:"required"`
+	Entities   []IncomingSavedEntity `json:"entities" validate:"required,dive"`
+}
+
+type StageEntitiesResponse struct {
+	Staged int64 `json:"staged"`
+}
+
+// StartKeyRotationRequest proves knowledge of the current key, the same way as KeyRequest
+type StartKeyRotationRequest struct {
+	Challenge          []byte `json:"challenge"`
+	Proof              []byte `json:"proof"`
+	ExpectedGeneration *int64 `json:"expectedGeneration"`
+}
+
+type CommitKeyRotationRequest struct {
+	Key      []byte `json:"key" validate:"required"`
+	ProofKey []byte `json:"proofKey" validate:"required"`
+}
+
+type CommitKeyRotationResponse struct {
+	Generation int64 `json:"generation"`
+}
+
+func serializeKeyRotation(rotation KeyRotation) KeyRotationResponse {
+	return KeyRotationResponse{
+		ID:        rotation.ID,
+		Session:   rotation.Session,
+		Salt:      rotation.Salt,
+		StartedAt: rotation.StartedAt,
+		ExpiresAt: rotation.ExpiresAt,
+	}
+}
+
+func (c *KeyRotationController) GetStatus(ctx *fiber.Ctx) error {
+	rotation, err := c.keyRotationService.GetActive(getUserId(ctx))
+	if err != nil {
+		return err
+	}
+
+	if rotation == nil {
+		return ctx.JSON(KeyRotationStatusResponse{Active: false})
+	}
+
+	// Only the initiating session needs the new salt
+	response := serializeKeyRotation(*rotation)
+	if rotation.Session != getSessionId(ctx) {
+		response.Salt = nil
+	}
+
+	return ctx.JSON(KeyRotationStatusResponse{Active: true, Rotation: &response})
+}
+
+func (c *KeyRotationController) Start(ctx *fiber.Ctx) error {
+	var req StartKeyRotationRequest
+	if err := ParseAndValidate(ctx, c.validator, &req); err != nil {
+		return err
+	}
+
+	rotation, err := c.keyRotationService.Start(getUserId(ctx), getSessionId(ctx), KeyChange{
+		Challenge:          req.Challenge,
+		Proof:              req.Proof,
+		ExpectedGeneration: req.ExpectedGeneration,
+	})
+	if err != nil {
+		if errors.As(err, &KeyRotationInProgressError{}) {
+			return ctx.Status(fiber.StatusConflict).SendString("Key rotation already in progress")
+		}
+
+		if errors.As(err, &KeyProofRequiredError{}) || errors.As(err, &InvalidKeyProofError{}) {
+			return ctx.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+
+		if errors.As(err, &KeyChangedError{}) {
+			return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+
+		return err
+	}
+
+	return ctx.JSON(serializeKeyRotation(rotation))
+}
+
+func (c *KeyRotationController) Stage(ctx *fiber.Ctx) error {
+	var req StageEntitiesRequest
+	if err := ParseAndValidate(ctx, c.validator, &req); err != nil {
+		return err
+	}
+
+	data := util.SliceMap(req.Entities, func(entity IncomingSavedEntity) []byte { return entity.Data })
+	if status, message := checkEntityType(c.entityTypes, req.EntityType, false, data); status != fiber.StatusOK {
+		return ctx.Status(status).SendString(message)
+	}
+
+	entities, err := util.SliceMapErr(req.Entities, deserializeSavedEntity)
+	if err != nil {
+		return err
+	}
+
+	staged, err := c.keyRotationService.Stage(getUserId(ctx), getSessionId(ctx), req.EntityType, entities)
+	if err != nil {
+		if errors.As(err, &KeyRotationNotFoundError{}) {
+			return ctx.Status(fiber.StatusNotFound).SendString("No active key rotation")
+		}
+
+		return err
+	}
+
+	return ctx.JSON(StageEntitiesResponse{staged})
+}
+
+func (c *KeyRotationController) Commit(ctx *fiber.Ctx) error {
+	var req CommitKeyRotationRequest
+	if err := ParseAndValidate(ctx, c.validator, &req); err != nil {
+		return err
+	}
+
+	generation, err := c.keyRotationService.Commit(getUserId(ctx), getSessionId(ctx), req.Key, req.ProofKey)
+	if err != nil {
+		if errors.As(err, &KeyRotationNotFoundError{}) {
+			return ctx.Status(fiber.StatusNotFound).SendString("No active key rotation")
+		}
+
+		var incompleteErr KeyRotationIncompleteError
+		if errors.As(err, &incompleteErr) {
+			return ctx.Status(fiber.StatusConflict).SendString(incompleteErr.Error())
+		}
+
+		if errors.As(err, &KeyChangedError{}) {
+			return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+
+		if isQuotaError(err) {
+			return ctx.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+
+		return err
+	}
+
+	return ctx.JSON(CommitKeyRotationResponse{generation})
+}
+
+// Abort can be called from any session, so that a rotation started on a lost device doesn't lock pushes until it expires
+func (c *KeyRotationController) Abort(ctx *fiber.Ctx) error {
+	if err := c.keyRotationService.Abort(getUserId(ctx)); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(fiber.StatusOK)
+}
@@ -1,11 +1,68 @@
 package internal
 
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var keyChallengeLifetime = 5 * time.Minute
+
+var keySetReason = "set"
+var keyRotationReason = "rotation"
+var keyImportReason = "import"
+
+type KeyProofRequiredError struct{}
+
+func (e KeyProofRequiredError) Error() string {
+	return "proof of the current key is required"
+}
+
+type InvalidKeyProofError struct{}
+
+func (e InvalidKeyProofError) Error() string {
+	return "invalid proof of the current key"
+}
+
+// KeyChangedError is returned if the key was replaced by another session while setting it
+type KeyChangedError struct{}
+
+func (e KeyChangedError) Error() string {
+	return "the key has been changed by another session"
+}
+
+// ProofKeyRequiredError is returned if a key is set without a proof key, which would make it impossible to prove
+// ownership of the key later on
+type ProofKeyRequiredError struct{}
+
+func (e ProofKeyRequiredError) Error() string {
+	return "a proof key is required"
+}
+
+// KeyChange replaces the key of a user. If a key with a proof key is stored, Proof must be the HMAC-SHA256 of a
+// challenge issued by CreateChallenge, keyed with the current proof key. Keys stored without a proof key can only be
+// replaced by naming their generation in ExpectedGeneration.
+type KeyChange struct {
+	Key                []byte
+	ProofKey           []byte
+	Challenge          []byte
+	Proof              []byte
+	ExpectedGeneration *int64
+}
+
 type KeyVerificationService struct {
 	keyVerificationCollection *KeyVerificationCollection
+	keyGenerationCollection   *KeyGenerationCollection
+	keyChallengeCollection    *KeyChallengeCollection
 }
 
-func NewKeyVerificationService(keyVerificationCollection *KeyVerificationCollection) *KeyVerificationService {
-	return &KeyVerificationService{keyVerificationCollection}
+func NewKeyVerificationService(keyVerificationCollection *KeyVerificationCollection, keyGenerationCollection *KeyGenerationCollection,
+	keyChallengeCollection *KeyChallengeCollection) *KeyVerificationService {
+	return &KeyVerificationService{keyVerificationCollection, keyGenerationCollection, keyChallengeCollection}
 }
 
 func (s *KeyVerificationService) GetKeyByUser(user string) ([]byte, error) {
@@ -21,15 +78,208 @@ func (s *KeyVerificationService) GetKeyByUser(user string) ([]byte, error) {
 	return verification.Key, nil
 }
 
-func (s *KeyVerificationService) SetKey(user string, key []byte) error {
+func (s *KeyVerificationService) GetVerification(user string) (*KeyVerification, error) {
+	return s.keyVerificationCollection.FindByUser(user)
+}
+
+// GetGeneration returns the current key generation of a user, 0 if no key is set
+func (s *KeyVerificationService) GetGeneration(user string) (int64, error) {
+	verification, err := s.keyVerificationCollection.FindByUser(user)
+	if err != nil || verification == nil {
+		return 0, err
+	}
+
+	return verification.Generation, nil
+}
+
+func (s *KeyVerificationService) GetGenerations(user string) ([]KeyGeneration, error) {
+	return s.keyGenerationCollection.FindByUser(user)
+}
+
+func (s *KeyVerificationService) CreateChallenge(user string, session string) (KeyChallenge, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return KeyChallenge{}, err
+	}
+
+	keyChallenge := KeyChallenge{
+		User:      user,
+		Session:   session,
+		Challenge: challenge,
+		ExpiresAt: time.Now().Add(keyChallengeLifetime),
+	}
+
+	return keyChallenge, s.keyChallengeCollection.Insert(keyChallenge)
+}
+
+// VerifyProof checks that the caller knows the current key. Keys set before proof keys existed can't be verified,
+// for those the caller has to know the current generation instead. Returns the generation that was proven.
+func (s *KeyVerificationService) VerifyProof(user string, session string, change KeyChange) (int64, error) {
+	current, err := s.keyVerificationCollection.FindByUser(user)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.verifyProof(current, session, change); err != nil {
+		return 0, err
+	}
+
+	if current == nil {
+		return 0, nil
+	}
+
+	return current.Generation, nil
+}
+
+func (s *KeyVerificationService) verifyProof(current *KeyVerification, session string, change KeyChange) error {
+	var generation int64
+	if current != nil {
+		generation = current.Generation
+	}
+
+	if change.ExpectedGeneration != nil && *change.ExpectedGeneration != generation {
+		return KeyChangedError{}
+	}
+
+	if current == nil {
+		return nil
+	}
+
+	if len(current.ProofKey) == 0 {
+		if change.ExpectedGeneration == nil {
+			return KeyProofRequiredError{}
+		}
+
+		return nil
+	}
+
+	if len(change.Challenge) == 0 || len(change.Proof) == 0 {
+		return KeyProofRequiredError{}
+	}
+
+	challenge, err := s.keyChallengeCollection.Take(current.User, change.Challenge)
+	if err != nil {
+		return err
+	}
+
+	if challenge == nil || challenge.Session != session || time.Now().After(challenge.ExpiresAt) {
+		return InvalidKeyProofError{}
+	}
+
+	mac := hmac.New(sha256.New, current.ProofKey)
+	mac.Write(challenge.Challenge)
+	if !hmac.Equal(mac.Sum(nil), change.Proof) {
+		return InvalidKeyProofError{}
+	}
+
+	return nil
+}
+
+// SetKey replaces the key of a user and records it as a new generation. Returns the new generation.
+func (s *KeyVerificationService) SetKey(user string, session string, change KeyChange) (int64, error) {
+	if len(change.ProofKey) == 0 {
+		return 0, ProofKeyRequiredError{}
+	}
+
+	current, err := s.keyVerificationCollection.FindByUser(user)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.verifyProof(current, session, change); err != nil {
+		return 0, err
+	}
+
+	var previous int64
+	if current != nil {
+		previous = current.Generation
+	}
+
+	verification := KeyVerification{
+		User:       user,
+		Key:        change.Key,
+		Generation: previous + 1,
+		ProofKey:   change.ProofKey,
+		Session:    session,
+		CreatedAt:  time.Now(),
+	}
+
+	replaced, err := s.keyVerificationCollection.ReplaceIfGeneration(verification, previous)
+	if err != nil {
+		return 0, err
+	}
+
+	if !replaced {
+		return 0, KeyChangedError{}
+	}
+
+	if err := s.recordGeneration(context.Background(), verification, keySetReason); err != nil {
+		return 0, err
+	}
+
+	return verification.Generation, nil
+}
+
+// replaceInTransaction replaces the key as part of a rotation or backup import. The caller must have proven ownership
+// of the key with the given generation already, with VerifyProof. Fails with KeyChangedError if the key has been
+// replaced since.
+func (s *KeyVerificationService) replaceInTransaction(sessionContext mongo.SessionContext, user string, session string,
+	key []byte, proofKey []byte, provenGeneration int64, reason string) (int64, error) {
+	if len(proofKey) == 0 {
+		return 0, ProofKeyRequiredError{}
+	}
+
+	current, err := s.keyVerificationCollection.FindByUserInSession(sessionContext, user)
+	if err != nil {
+		return 0, err
+	}
+
+	var previous int64
+	if current != nil {
+		previous = current.Generation
+	}
+
+	if previous != provenGeneration {
+		return 0, KeyChangedError{}
+	}
+
+	generation := previous + 1
+
 	verification := KeyVerification{
-		User: user,
-		Key:  key,
+		User:       user,
+		Key:        key,
+		Generation: generation,
+		ProofKey:   proofKey,
+		Session:    session,
+		CreatedAt:  time.Now(),
+	}
+
+	if err := s.keyVerificationCollection.Replace(sessionContext, verification); err != nil {
+		return 0, err
 	}
 
-	return s.keyVerificationCollection.Upsert(verification)
+	return generation, s.recordGeneration(sessionContext, verification, reason)
+}
+
+func (s *KeyVerificationService) recordGeneration(context context.Context, verification KeyVerification, reason string) error {
+	return s.keyGenerationCollection.Insert(context, KeyGeneration{
+		User:       verification.User,
+		Generation: verification.Generation,
+		Key:        verification.Key,
+		Session:    verification.Session,
+		Reason:     reason,
+		CreatedAt:  verification.CreatedAt,
+	})
 }
 
 func (s *KeyVerificationService) OnUserDeleted(userId string) error {
+	if err := s.keyGenerationCollection.DeleteByUser(userId); err != nil {
+		return err
+	}
+
+	if err := s.keyChallengeCollection.DeleteByUser(userId); err != nil {
+		return err
+	}
+
 	return s.keyVerificationCollection.DeleteByUser(userId)
 }
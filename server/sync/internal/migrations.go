@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var syncMigrations = []mongoutil.Migration{
+	{
+		Version:     1,
+		Description: "assign sequence numbers to updates recorded before sequences existed",
+		Up: func(db *mongo.Database) error {
+			updates := db.Collection("sync_updates")
+			sequences := db.Collection("sync_sequences")
+
+			users, err := updates.Distinct(context.Background(), "user", bson.M{"sequence": bson.M{"$exists": false}})
+			if err != nil {
+				return err
+			}
+
+			for _, user := range users {
+				unsequenced, err := mongoutil.Find[SyncUpdate](updates,
+					bson.M{"user": user, "sequence": bson.M{"$exists": false}},
+					options.Find().SetSort(bson.M{"timestamp": 1}))
+				if err != nil {
+					return err
+				}
+
+				for _, update := range unsequenced {
+					var sequence SyncSequence
+					err := sequences.FindOneAndUpdate(context.Background(),
+						bson.M{"user": user},
+						bson.M{"$inc": bson.M{"sequence": 1}},
+						options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&sequence)
+					if err != nil {
+						return err
+					}
+
+					_, err = updates.UpdateOne(context.Background(),
+						bson.M{"id": update.ID, "sequence": bson.M{"$exists": false}},
+						bson.M{"$set": bson.M{"sequence": sequence.Sequence}})
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "calculate the storage usage of existing entities",
+		Up: func(db *mongo.Database) error {
+			definitions, err := mongoutil.Find[EntityTypeDefinition](db.Collection("entity_types"), bson.M{})
+			if err != nil {
+				return err
+			}
+
+			entityTypes := slices.Clone(defaultEntityTypes)
+			for _, definition := range definitions {
+				if !slices.Contains(entityTypes, definition.Name) {
+					entityTypes = append(entityTypes, definition.Name)
+				}
+			}
+
+			usageCollection := NewUsageCollection(db.Collection("sync_usage"))
+			for _, entityType := range entityTypes {
+				cursor, err := db.Collection(entityType).Aggregate(context.Background(), mongo.Pipeline{
+					{{Key: "$group", Value: bson.M{
+						"_id":      "$user",
+						"entities": bson.M{"$sum": 1},
+						"bytes":    bson.M{"$sum": bson.M{"$binarySize": bson.M{"$ifNull": bson.A{"$data", ""}}}},
+					}}},
+				})
+				if err != nil {
+					return err
+				}
+
+				var results []struct {
+					User     string `bson:"_id"`
+					Entities int64  `bson:"entities"`
+					Bytes    int64  `bson:"bytes"`
+				}
+				if err := cursor.All(context.Background(), &results); err != nil {
+					return err
+				}
+
+				for _, result := range results {
+					delta := usageDelta{entities: result.Entities, bytes: result.Bytes, absolute: true}
+					if _, err := usageCollection.Apply(context.Background(), result.User, entityType, delta); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "start key generations for keys set before generations were tracked",
+		Up: func(db *mongo.Database) error {
+			verifications := db.Collection("key_verifications")
+			legacy, err := mongoutil.Find[KeyVerification](verifications,
+				bson.M{"$or": bson.A{bson.M{"generation": bson.M{"$exists": false}}, bson.M{"generation": 0}}})
+			if err != nil {
+				return err
+			}
+
+			generations := db.Collection("key_generations")
+			for _, verification := range legacy {
+				createdAt := time.Now()
+
+				// Upserted so that running the migration again doesn't record the generation twice
+				_, err := generations.UpdateOne(context.Background(),
+					bson.M{"user": verification.User, "generation": 1},
+					bson.M{"$setOnInsert": KeyGeneration{
+						User:       verification.User,
+						Generation: 1,
+						Key:        verification.Key,
+						Reason:     keySetReason,
+						CreatedAt:  createdAt,
+					}},
+					options.Update().SetUpsert(true))
+				if err != nil {
+					return err
+				}
+
+				_, err = verifications.UpdateOne(context.Background(), bson.M{"user": verification.User},
+					bson.M{"$set": bson.M{"generation": 1, "createdAt": createdAt}})
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+}
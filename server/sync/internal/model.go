@@ -1,5 +1,7 @@
 package internal
 
+import "time"
+
 type UpdateEntity struct {
 	ID        string `bson:"id"`
 	Version   int    `bson:"version"`
@@ -7,21 +9,35 @@ type UpdateEntity struct {
 	Data      []byte `bson:"data"`
 }
 
+// Entity is an encrypted entity. KeyGeneration is the key generation the data was encrypted under, 0 if it was
+// stored before generations were tracked.
 type Entity struct {
-	ID      string `bson:"id"`
-	User    string `bson:"user"`
-	Version int    `bson:"version"`
-	Data    []byte `bson:"data"`
+	ID            string `bson:"id"`
+	User          string `bson:"user"`
+	Version       int    `bson:"version"`
+	KeyGeneration int64  `bson:"keyGeneration"`
+	Data          []byte `bson:"data"`
 }
 
 type SyncUpdate struct {
-	ID         string         `bson:"id"`
-	User       string         `bson:"user"`
-	Operation  string         `bson:"operation"`
-	EntityType string         `bson:"entityType"`
-	Clients    []string       `bson:"clients"`
-	Timestamp  int64          `bson:"timestamp"`
-	Entities   []UpdateEntity `bson:"entities"`
+	ID            string         `bson:"id"`
+	User          string         `bson:"user"`
+	Sequence      int64          `bson:"sequence"`
+	Origin        string         `bson:"origin"`
+	Operation     string         `bson:"operation"`
+	EntityType    string         `bson:"entityType"`
+	Clients       []string       `bson:"clients"`
+	Timestamp     int64          `bson:"timestamp"`
+	KeyGeneration int64          `bson:"keyGeneration"`
+	Entities      []UpdateEntity `bson:"entities"`
+}
+
+// SyncSequence keeps track of the last sequence number handed out to the sync updates of a user.
+// Updates up to and including Compacted may have been removed, cursors before it can no longer catch up.
+type SyncSequence struct {
+	User      string `bson:"user"`
+	Sequence  int64  `bson:"sequence"`
+	Compacted int64  `bson:"compacted"`
 }
 
 type IncomingSyncUpdate struct {
@@ -29,15 +45,90 @@ type IncomingSyncUpdate struct {
 	Operation  string
 	EntityType string
 	Timestamp  int64
-	Entities   []UpdateEntity
+	// KeyGeneration is the generation the client encrypted the entities under, 0 if the client didn't say
+	KeyGeneration int64
+	Entities      []UpdateEntity
 }
 
+// KeyVerification is the current key of a user. Key is a blob encrypted by the client, decrypting it proves that
+// the client has the right key. ProofKey is derived from the decrypted blob by the client and never leaves the server,
+// it is used to check challenge responses before the key is replaced.
 type KeyVerification struct {
 	User string `bson:"user"`
 	Key  []byte `bson:"key"`
+	// Generation is incremented every time the key is replaced or rotated
+	Generation int64     `bson:"generation"`
+	ProofKey   []byte    `bson:"proofKey"`
+	Session    string    `bson:"session"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+// KeyGeneration is a historical key of a user, one is recorded for every key that has been set
+type KeyGeneration struct {
+	User       string    `bson:"user"`
+	Generation int64     `bson:"generation"`
+	Key        []byte    `bson:"key"`
+	Session    string    `bson:"session"`
+	Reason     string    `bson:"reason"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+// KeyChallenge is a single-use challenge that has to be signed with the proof key of the current key
+type KeyChallenge struct {
+	User      string    `bson:"user"`
+	Session   string    `bson:"session"`
+	Challenge []byte    `bson:"challenge"`
+	ExpiresAt time.Time `bson:"expiresAt"`
 }
 
 type Salt struct {
 	User string `bson:"user"`
 	Salt []byte `bson:"salt"`
 }
+
+type ConflictEntity struct {
+	ID              string
+	IncomingVersion int
+	Resolution      ConflictResolution
+	Stored          Entity
+}
+
+type SyncConflict struct {
+	UpdateID   string
+	EntityType string
+	Rejected   bool
+	Entities   []ConflictEntity
+}
+
+// EntityUsage is the amount of entities and bytes of entity data a user stores for an entity type
+type EntityUsage struct {
+	User       string `bson:"user"`
+	EntityType string `bson:"entityType"`
+	Entities   int64  `bson:"entities"`
+	Bytes      int64  `bson:"bytes"`
+}
+
+// KeyRotation is an in-progress rotation of the encryption key of a user. While it is active, pushes are locked and
+// the initiating session uploads every entity re-encrypted under the new key. Nothing is visible to other sessions
+// until the rotation is committed, so abandoning it leaves the existing data untouched.
+type KeyRotation struct {
+	ID      string `bson:"id"`
+	User    string `bson:"user"`
+	Session string `bson:"session"`
+	Salt    []byte `bson:"salt"`
+	// Generation is the key generation proven when starting, the commit fails if the key has been replaced since
+	Generation int64     `bson:"generation"`
+	StartedAt  time.Time `bson:"startedAt"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+}
+
+// StagedEntity is an entity re-encrypted under the new key, it replaces the stored entity on commit
+type StagedEntity struct {
+	Rotation   string    `bson:"rotation"`
+	User       string    `bson:"user"`
+	EntityType string    `bson:"entityType"`
+	ID         string    `bson:"id"`
+	Version    int       `bson:"version"`
+	Data       []byte    `bson:"data"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+}
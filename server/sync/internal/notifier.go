@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var subscriberBufferSize = 64
+var watchRetryDelay = 5 * time.Second
+
+type SyncSubscriber struct {
+	sessionId string
+	updates   chan SyncUpdate
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *SyncSubscriber) Updates() <-chan SyncUpdate {
+	return s.updates
+}
+
+// Closed is closed when the subscriber has been dropped, e.g. because it could not keep up
+func (s *SyncSubscriber) Closed() <-chan struct{} {
+	return s.closed
+}
+
+func (s *SyncSubscriber) close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// SyncNotifier watches the sync update collection and fans out new updates to every connected session.
+// Since it is driven by a change stream, updates pushed through any sync replica reach every subscriber.
+type SyncNotifier struct {
+	syncUpdateCollection *SyncUpdateCollection
+
+	mutex       sync.RWMutex
+	subscribers map[string]map[*SyncSubscriber]struct{}
+}
+
+func NewSyncNotifier(syncUpdateCollection *SyncUpdateCollection) *SyncNotifier {
+	return &SyncNotifier{
+		syncUpdateCollection: syncUpdateCollection,
+		subscribers:          map[string]map[*SyncSubscriber]struct{}{},
+	}
+}
+
+func (n *SyncNotifier) Subscribe(sessionId string) *SyncSubscriber {
+	subscriber := &SyncSubscriber{
+		sessionId: sessionId,
+		updates:   make(chan SyncUpdate, subscriberBufferSize),
+		closed:    make(chan struct{}),
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.subscribers[sessionId]; !ok {
+		n.subscribers[sessionId] = map[*SyncSubscriber]struct{}{}
+	}
+
+	n.subscribers[sessionId][subscriber] = struct{}{}
+	return subscriber
+}
+
+func (n *SyncNotifier) Unsubscribe(subscriber *SyncSubscriber) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.removeSubscriber(subscriber)
+}
+
+// Disconnect drops every subscriber of a session, closing their streams
+func (n *SyncNotifier) Disconnect(sessionId string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for subscriber := range n.subscribers[sessionId] {
+		n.removeSubscriber(subscriber)
+	}
+}
+
+func (n *SyncNotifier) removeSubscriber(subscriber *SyncSubscriber) {
+	subscribers, ok := n.subscribers[subscriber.sessionId]
+	if !ok {
+		return
+	}
+
+	delete(subscribers, subscriber)
+	if len(subscribers) == 0 {
+		delete(n.subscribers, subscriber.sessionId)
+	}
+
+	subscriber.close()
+}
+
+func (n *SyncNotifier) dispatch(update SyncUpdate) {
+	var dropped []*SyncSubscriber
+
+	n.mutex.RLock()
+	for _, client := range update.Clients {
+		for subscriber := range n.subscribers[client] {
+			select {
+			case subscriber.updates <- update:
+			default:
+				// Subscriber can't keep up, drop it so that the client reconnects and catches up with a pull
+				dropped = append(dropped, subscriber)
+			}
+		}
+	}
+	n.mutex.RUnlock()
+
+	if len(dropped) == 0 {
+		return
+	}
+
+	n.mutex.Lock()
+	for _, subscriber := range dropped {
+		n.removeSubscriber(subscriber)
+	}
+	n.mutex.Unlock()
+}
+
+func (n *SyncNotifier) Run() {
+	go func() {
+		var resumeToken bson.Raw
+		for {
+			var err error
+			// The resume token is nil if the watch couldn't be opened, which also recovers from invalid resume tokens
+			resumeToken, err = n.watch(resumeToken)
+			if err != nil {
+				sentry.CaptureException(err)
+				log.Println("sync update watch error", err)
+			}
+
+			time.Sleep(watchRetryDelay)
+		}
+	}()
+}
+
+func (n *SyncNotifier) watch(resumeToken bson.Raw) (bson.Raw, error) {
+	stream, err := n.syncUpdateCollection.WatchInserts(context.Background(), resumeToken)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(context.Background()) {
+		var event struct {
+			FullDocument SyncUpdate `bson:"fullDocument"`
+		}
+
+		if err := stream.Decode(&event); err != nil {
+			return stream.ResumeToken(), err
+		}
+
+		n.dispatch(event.FullDocument)
+	}
+
+	return stream.ResumeToken(), stream.Err()
+}
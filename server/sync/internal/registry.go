@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"go.mongodb.org/mongo-driver/mongo"
+	"perfice.adoe.dev/mongoutil"
+)
+
+var registryReloadInterval = time.Minute
+
+// defaultEntityTypes are registered on startup if they don't exist yet
+var defaultEntityTypes = []string{
+	"trackables",
+	"variables",
+	"entries",
+	"trackableCategories",
+	"forms",
+	"formSnapshots",
+	"analyticSettings",
+	"goals",
+	"tags",
+	"tagEntries",
+	"formTemplates",
+	"tagCategories",
+	"dashboards",
+	"dashboardWidgets",
+	"reflections",
+	"savedSearches",
+	"notifications",
+}
+
+// entityTypeNamePattern restricts entity type names, which are used as collection names
+var entityTypeNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9]*$`)
+
+// reservedEntityTypeNames are the collections of the sync service itself, which an entity type must never write to
+var reservedEntityTypeNames = []string{
+	"entity_types",
+	"sync_updates",
+	"sync_sequences",
+	"sync_usage",
+	"salts",
+	"key_verifications",
+	"key_generations",
+	"key_challenges",
+	"key_rotations",
+	"rotation_entities",
+	"_migrations",
+}
+
+func validateEntityTypeName(name string) error {
+	if name == "" {
+		return errors.New("missing name")
+	}
+
+	if slices.Contains(reservedEntityTypeNames, name) {
+		return fmt.Errorf("name %s is reserved", name)
+	}
+
+	if !entityTypeNamePattern.MatchString(name) {
+		return fmt.Errorf("name %s must start with a letter and only contain letters and digits", name)
+	}
+
+	return nil
+}
+
+// EntityTypeDefinition describes a syncable entity type. Zero limits mean unlimited.
+type EntityTypeDefinition struct {
+	Name          string `bson:"name" json:"name"`
+	MaxEntitySize int    `bson:"maxEntitySize" json:"maxEntitySize"`
+	MaxEntities   int64  `bson:"maxEntities" json:"maxEntities"`
+	FullSync      bool   `bson:"fullSync" json:"fullSync"`
+}
+
+// EntityTypeRegistry keeps track of the entity types that can be synced and their collections.
+// Definitions live in the database, so types can be added at runtime without redeploying.
+type EntityTypeRegistry struct {
+	db                   *mongo.Database
+	entityTypeCollection *EntityTypeCollection
+
+	mutex       sync.RWMutex
+	definitions map[string]EntityTypeDefinition
+	collections map[string]*mongo.Collection
+}
+
+func NewEntityTypeRegistry(db *mongo.Database, entityTypeCollection *EntityTypeCollection) *EntityTypeRegistry {
+	return &EntityTypeRegistry{
+		db:                   db,
+		entityTypeCollection: entityTypeCollection,
+		definitions:          map[string]EntityTypeDefinition{},
+		collections:          map[string]*mongo.Collection{},
+	}
+}
+
+// Load registers the default entity types and the ones from the SYNC_ENTITY_TYPES_FILE config, then loads every
+// definition from the database. Definitions from the config file override the stored ones.
+func (r *EntityTypeRegistry) Load() error {
+	for _, entityType := range defaultEntityTypes {
+		err := r.entityTypeCollection.InsertIfMissing(EntityTypeDefinition{Name: entityType, FullSync: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	configured, err := r.readConfig(os.Getenv("SYNC_ENTITY_TYPES_FILE"))
+	if err != nil {
+		return err
+	}
+
+	for _, definition := range configured {
+		if err := r.entityTypeCollection.Upsert(definition); err != nil {
+			return err
+		}
+	}
+
+	return r.Reload()
+}
+
+func (r *EntityTypeRegistry) readConfig(path string) ([]EntityTypeDefinition, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var definitions []EntityTypeDefinition
+	if err := json.Unmarshal(bytes, &definitions); err != nil {
+		return nil, fmt.Errorf("invalid entity type config %s: %w", path, err)
+	}
+
+	for _, definition := range definitions {
+		if err := validateEntityTypeName(definition.Name); err != nil {
+			return nil, fmt.Errorf("invalid entity type config %s: %w", path, err)
+		}
+	}
+
+	return definitions, nil
+}
+
+// Reload reads every definition from the database and prepares the collections of newly added types
+func (r *EntityTypeRegistry) Reload() error {
+	definitions, err := r.entityTypeCollection.FindAll()
+	if err != nil {
+		return err
+	}
+
+	loaded := map[string]EntityTypeDefinition{}
+	collections := map[string]*mongo.Collection{}
+	for _, definition := range definitions {
+		// Definitions can be added to the database by hand, an invalid one must not take over another collection
+		if err := validateEntityTypeName(definition.Name); err != nil {
+			sentry.CaptureException(fmt.Errorf("skipping invalid entity type: %w", err))
+			continue
+		}
+
+		loaded[definition.Name] = definition
+
+		collection := r.getExistingCollection(definition.Name)
+		if collection == nil {
+			collection, err = r.prepareCollection(definition.Name)
+			if err != nil {
+				return err
+			}
+
+			log.Println("Registered entity type", definition.Name)
+		}
+
+		collections[definition.Name] = collection
+	}
+
+	r.mutex.Lock()
+	r.definitions = loaded
+	r.collections = collections
+	r.mutex.Unlock()
+
+	return nil
+}
+
+func (r *EntityTypeRegistry) getExistingCollection(entityType string) *mongo.Collection {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.collections[entityType]
+}
+
+// prepareCollection creates the collection up front, since collections can't always be created inside transactions
+func (r *EntityTypeRegistry) prepareCollection(entityType string) (*mongo.Collection, error) {
+	err := r.db.CreateCollection(context.Background(), entityType)
+	var commandError mongo.CommandError
+	if err != nil && !(errors.As(err, &commandError) && commandError.Name == "NamespaceExists") {
+		return nil, err
+	}
+
+	// Syncing still works without the index, failures are only reported
+	if err := mongoutil.EnsureIndexesLogged(r.db, entityIndexes(entityType)); err != nil {
+		sentry.CaptureException(err)
+	}
+
+	return r.db.Collection(entityType), nil
+}
+
+// Watch periodically reloads the definitions so that types added by other replicas or operators are picked up
+func (r *EntityTypeRegistry) Watch() {
+	go func() {
+		for range time.Tick(registryReloadInterval) {
+			if err := r.Reload(); err != nil {
+				sentry.CaptureException(fmt.Errorf("failed to reload entity types: %w", err))
+			}
+		}
+	}()
+}
+
+func (r *EntityTypeRegistry) Get(entityType string) (EntityTypeDefinition, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	definition, ok := r.definitions[entityType]
+	return definition, ok
+}
+
+func (r *EntityTypeRegistry) Has(entityType string) bool {
+	_, ok := r.Get(entityType)
+	return ok
+}
+
+// Collection returns the collection of an entity type, or nil if the type is unknown
+func (r *EntityTypeRegistry) Collection(entityType string) *mongo.Collection {
+	return r.getExistingCollection(entityType)
+}
+
+func (r *EntityTypeRegistry) Names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.definitions))
+	for name := range r.definitions {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+func (r *EntityTypeRegistry) Collections() map[string]*mongo.Collection {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	collections := make(map[string]*mongo.Collection, len(r.collections))
+	for name, collection := range r.collections {
+		collections[name] = collection
+	}
+
+	return collections
+}
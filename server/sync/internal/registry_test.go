@@ -0,0 +1,17 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateEntityTypeName(t *testing.T) {
+	for _, name := range defaultEntityTypes {
+		assert.NoError(t, validateEntityTypeName(name), "default entity type %s should be valid", name)
+	}
+
+	for _, name := range []string{"", "salts", "sync_updates", "_migrations", "system.users", "1entries", "entries$"} {
+		assert.Error(t, validateEntityTypeName(name), "entity type %q should be rejected", name)
+	}
+}
@@ -1,17 +1,28 @@
 package internal
 
 import (
-	"slices"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
 	"perfice.adoe.dev/util"
 )
 
+var streamHeartbeatInterval = 30 * time.Second
+var defaultPullLimit = 100
+
 type SyncController struct {
-	syncService *SyncService
-	validator   *validator.Validate
-	entityTypes []string
+	syncService  *SyncService
+	syncNotifier *SyncNotifier
+	validator    *validator.Validate
+	entityTypes  *EntityTypeRegistry
 }
 
 func getUserId(ctx *fiber.Ctx) string {
@@ -22,9 +33,10 @@ func getSessionId(ctx *fiber.Ctx) string {
 	return ctx.Locals(sessionIdLocal).(string)
 }
 
-func NewSyncController(syncService *SyncService, entityTypes []string) *SyncController {
+func NewSyncController(syncService *SyncService, syncNotifier *SyncNotifier, entityTypes *EntityTypeRegistry) *SyncController {
 	return &SyncController{
 		syncService,
+		syncNotifier,
 		validator.New(validator.WithRequiredStructEnabled()),
 		entityTypes,
 	}
@@ -39,11 +51,17 @@ type FullSyncRequest struct {
 }
 
 type FullPushRequest struct {
-	Entities map[string][]IncomingSavedEntity `json:"entities" validate:"required,dive"`
+	Entities      map[string][]IncomingSavedEntity `json:"entities" validate:"required,dive,dive"`
+	KeyGeneration int64                            `json:"keyGeneration"`
+}
+
+type FullPushResponse struct {
+	Ack []string `json:"ack"`
 }
 
 type FullPullResponse struct {
 	Entities map[string][]OutgoingSavedEntity `json:"entities"`
+	Cursor   int64                            `json:"cursor"`
 }
 
 type AckRequest struct {
@@ -51,20 +69,25 @@ type AckRequest struct {
 }
 
 type PushResponse struct {
-	Ack []string `json:"ack"`
+	Ack       []string               `json:"ack"`
+	Conflicts []OutgoingSyncConflict `json:"conflicts"`
+	Error     string                 `json:"error,omitempty"`
 }
 
 type PullResponse struct {
 	Key     []byte               `json:"key"`
 	Updates []OutgoingSyncUpdate `json:"updates"`
+	Cursor  int64                `json:"cursor"`
+	HasMore bool                 `json:"hasMore"`
 }
 
 type IncomingSyncUpdateDTO struct {
-	ID         string                 `json:"id" validate:"required,uuid"`
-	Operation  string                 `json:"operation" validate:"oneof=create put delete fullSync"`
-	EntityType string                 `json:"entityType" validate:"required"`
-	Timestamp  int64                  `json:"timestamp" validate:"required"`
-	Entities   []IncomingUpdateEntity `json:"entities" validate:"required,dive"`
+	ID            string                 `json:"id" validate:"required,uuid"`
+	Operation     string                 `json:"operation" validate:"oneof=create put delete fullSync"`
+	EntityType    string                 `json:"entityType" validate:"required"`
+	Timestamp     int64                  `json:"timestamp" validate:"required"`
+	KeyGeneration int64                  `json:"keyGeneration"`
+	Entities      []IncomingUpdateEntity `json:"entities" validate:"required,dive"`
 }
 
 type IncomingUpdateEntity struct {
@@ -74,11 +97,13 @@ type IncomingUpdateEntity struct {
 }
 
 type OutgoingSyncUpdate struct {
-	ID         string                 `json:"id"`
-	Operation  string                 `json:"operation"`
-	EntityType string                 `json:"entityType"`
-	Timestamp  int64                  `json:"timestamp"`
-	Entities   []OutgoingUpdateEntity `json:"entities"`
+	ID            string                 `json:"id"`
+	Sequence      int64                  `json:"sequence"`
+	Operation     string                 `json:"operation"`
+	EntityType    string                 `json:"entityType"`
+	Timestamp     int64                  `json:"timestamp"`
+	KeyGeneration int64                  `json:"keyGeneration"`
+	Entities      []OutgoingUpdateEntity `json:"entities"`
 }
 
 type OutgoingUpdateEntity struct {
@@ -87,10 +112,25 @@ type OutgoingUpdateEntity struct {
 	Data    []byte `json:"data"`
 }
 
+type OutgoingSyncConflict struct {
+	UpdateID   string                   `json:"updateId"`
+	EntityType string                   `json:"entityType"`
+	Rejected   bool                     `json:"rejected"`
+	Entities   []OutgoingConflictEntity `json:"entities"`
+}
+
+type OutgoingConflictEntity struct {
+	ID              string              `json:"id"`
+	IncomingVersion int                 `json:"incomingVersion"`
+	Resolution      string              `json:"resolution"`
+	Stored          OutgoingSavedEntity `json:"stored"`
+}
+
 type OutgoingSavedEntity struct {
-	ID      string `json:"id"`
-	Version int    `json:"version"`
-	Data    []byte `json:"data"`
+	ID            string `json:"id"`
+	Version       int    `json:"version"`
+	KeyGeneration int64  `json:"keyGeneration"`
+	Data          []byte `json:"data"`
 }
 
 type IncomingSavedEntity struct {
@@ -115,14 +155,93 @@ func serializeUpdateEntity(entity UpdateEntity) (OutgoingUpdateEntity, error) {
 	}, nil
 }
 
-func serializeSavedEntity(entity Entity) (OutgoingSavedEntity, error) {
-	return OutgoingSavedEntity{
+func serializeSyncUpdate(update SyncUpdate) (OutgoingSyncUpdate, error) {
+	entities, err := util.SliceMapErr(update.Entities, func(entity UpdateEntity) (OutgoingUpdateEntity, error) {
+		return serializeUpdateEntity(entity)
+	})
+
+	if err != nil {
+		return OutgoingSyncUpdate{}, err
+	}
+
+	return OutgoingSyncUpdate{
+		ID:            update.ID,
+		Sequence:      update.Sequence,
+		Operation:     update.Operation,
+		EntityType:    update.EntityType,
+		Timestamp:     update.Timestamp,
+		KeyGeneration: update.KeyGeneration,
+		Entities:      entities,
+	}, nil
+}
+
+func deserializeSavedEntity(entity IncomingSavedEntity) (Entity, error) {
+	return Entity{
 		ID:      entity.ID,
 		Version: entity.Version,
 		Data:    entity.Data,
 	}, nil
 }
 
+func serializeSavedEntity(entity Entity) (OutgoingSavedEntity, error) {
+	return OutgoingSavedEntity{
+		ID:            entity.ID,
+		Version:       entity.Version,
+		KeyGeneration: entity.KeyGeneration,
+		Data:          entity.Data,
+	}, nil
+}
+
+func serializeConflict(conflict SyncConflict) (OutgoingSyncConflict, error) {
+	entities, err := util.SliceMapErr(conflict.Entities, func(entity ConflictEntity) (OutgoingConflictEntity, error) {
+		stored, err := serializeSavedEntity(entity.Stored)
+		if err != nil {
+			return OutgoingConflictEntity{}, err
+		}
+
+		return OutgoingConflictEntity{
+			ID:              entity.ID,
+			IncomingVersion: entity.IncomingVersion,
+			Resolution:      string(entity.Resolution),
+			Stored:          stored,
+		}, nil
+	})
+
+	if err != nil {
+		return OutgoingSyncConflict{}, err
+	}
+
+	return OutgoingSyncConflict{
+		UpdateID:   conflict.UpdateID,
+		EntityType: conflict.EntityType,
+		Rejected:   conflict.Rejected,
+		Entities:   entities,
+	}, nil
+}
+
+// checkEntityType validates incoming entities against the definition of their type.
+// Returns fiber.StatusOK if they are valid, otherwise the status and message to respond with.
+func checkEntityType(registry *EntityTypeRegistry, entityType string, fullSync bool, data [][]byte) (int, string) {
+	definition, ok := registry.Get(entityType)
+	if !ok {
+		return fiber.StatusBadRequest, "Invalid entity type"
+	}
+
+	if fullSync && !definition.FullSync {
+		return fiber.StatusBadRequest, "Entity type does not support full sync"
+	}
+
+	if definition.MaxEntitySize > 0 {
+		for _, entityData := range data {
+			if len(entityData) > definition.MaxEntitySize {
+				return fiber.StatusRequestEntityTooLarge, "Entity exceeds maximum size"
+			}
+		}
+	}
+
+	return fiber.StatusOK, ""
+}
+
 func (c *SyncController) Push(ctx *fiber.Ctx) error {
 	var req PushRequest
 	if err := ParseAndValidate(ctx, c.validator, &req); err != nil {
@@ -134,8 +253,9 @@ func (c *SyncController) Push(ctx *fiber.Ctx) error {
 
 	var updates []IncomingSyncUpdate
 	for _, update := range req.Updates {
-		if !slices.Contains(c.entityTypes, update.EntityType) {
-			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid entity type")
+		data := util.SliceMap(update.Entities, func(entity IncomingUpdateEntity) []byte { return entity.Data })
+		if status, message := checkEntityType(c.entityTypes, update.EntityType, update.Operation == fullSyncOperation, data); status != fiber.StatusOK {
+			return ctx.Status(status).SendString(message)
 		}
 
 		entities, err := util.SliceMapErr[IncomingUpdateEntity, UpdateEntity](update.Entities, deserializeUpdateEntity)
@@ -144,54 +264,174 @@ func (c *SyncController) Push(ctx *fiber.Ctx) error {
 		}
 
 		updates = append(updates, IncomingSyncUpdate{
-			ID:         update.ID,
-			Operation:  update.Operation,
-			EntityType: update.EntityType,
-			Timestamp:  update.Timestamp,
-			Entities:   entities,
+			ID:            update.ID,
+			Operation:     update.Operation,
+			EntityType:    update.EntityType,
+			Timestamp:     update.Timestamp,
+			KeyGeneration: update.KeyGeneration,
+			Entities:      entities,
 		})
 	}
 
-	ackIds, err := c.syncService.Push(updates, userId, sessionId)
+	ackIds, conflicts, pushErr := c.syncService.Push(updates, userId, sessionId)
+	if errors.As(pushErr, &KeyRotationInProgressError{}) {
+		return ctx.Status(fiber.StatusLocked).SendString("Key rotation in progress")
+	}
+
+	if errors.As(pushErr, &KeyGenerationMismatchError{}) {
+		return ctx.Status(fiber.StatusConflict).SendString(pushErr.Error())
+	}
+
+	if errors.As(pushErr, &BatchTooLargeError{}) {
+		return ctx.Status(fiber.StatusRequestEntityTooLarge).JSON(PushResponse{[]string{}, []OutgoingSyncConflict{}, pushErr.Error()})
+	}
+
+	if pushErr != nil && !isQuotaError(pushErr) {
+		return pushErr
+	}
+
+	outgoingConflicts, err := util.SliceMapErr(conflicts, serializeConflict)
 	if err != nil {
 		return err
 	}
 
-	return ctx.JSON(PushResponse{ackIds})
+	if pushErr != nil {
+		// Updates that were processed before the quota was exceeded are still acknowledged
+		return ctx.Status(fiber.StatusTooManyRequests).JSON(PushResponse{ackIds, outgoingConflicts, pushErr.Error()})
+	}
+
+	return ctx.JSON(PushResponse{ackIds, outgoingConflicts, ""})
 }
 
 func (c *SyncController) Pull(ctx *fiber.Ctx) error {
 	userId := getUserId(ctx)
 	sessionId := getSessionId(ctx)
 
+	if ctx.Query("since") != "" {
+		return c.pullSince(ctx, userId, sessionId)
+	}
+
 	updates, key, err := c.syncService.Pull(userId, sessionId)
 	if err != nil {
 		return err
 	}
 
-	outgoingUpdates, err := util.SliceMapErr(updates, func(update SyncUpdate) (OutgoingSyncUpdate, error) {
-		entities, err := util.SliceMapErr(update.Entities, func(entity UpdateEntity) (OutgoingUpdateEntity, error) {
-			return serializeUpdateEntity(entity)
-		})
+	cursor, err := c.syncService.GetCursor(userId)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			return OutgoingSyncUpdate{}, err
+	outgoingUpdates, err := util.SliceMapErr(updates, serializeSyncUpdate)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(PullResponse{key, outgoingUpdates, cursor, false})
+}
+
+// pullSince returns a page of updates after the cursor given in the query, independent of acknowledgements
+func (c *SyncController) pullSince(ctx *fiber.Ctx, userId string, sessionId string) error {
+	since, err := strconv.ParseInt(ctx.Query("since"), 10, 64)
+	if err != nil || since < 0 {
+		return ctx.Status(fiber.StatusBadRequest).SendString("Invalid cursor")
+	}
+
+	limit := ctx.QueryInt("limit", defaultPullLimit)
+	updates, key, cursor, hasMore, err := c.syncService.PullSince(userId, sessionId, since, int64(limit))
+	if err != nil {
+		if errors.Is(err, CursorExpiredError{}) {
+			return ctx.Status(fiber.StatusGone).SendString("Cursor expired, full pull required")
 		}
 
-		return OutgoingSyncUpdate{
-			ID:         update.ID,
-			Operation:  update.Operation,
-			EntityType: update.EntityType,
-			Timestamp:  update.Timestamp,
-			Entities:   entities,
-		}, nil
-	})
+		return err
+	}
+
+	outgoingUpdates, err := util.SliceMapErr(updates, serializeSyncUpdate)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(PullResponse{key, outgoingUpdates, cursor, hasMore})
+}
+
+func writeStreamEvent(w *bufio.Writer, event string, data any) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, bytes); err != nil {
+		return err
+	}
 
+	return w.Flush()
+}
+
+func writeStreamUpdate(w *bufio.Writer, update SyncUpdate) error {
+	outgoing, err := serializeSyncUpdate(update)
 	if err != nil {
 		return err
 	}
 
-	return ctx.JSON(PullResponse{key, outgoingUpdates})
+	return writeStreamEvent(w, "update", outgoing)
+}
+
+// Stream sends updates for the session as server-sent events as soon as they are pushed by other sessions.
+// Pending updates are sent first, so an update may be delivered twice; clients ack through /ack as usual.
+func (c *SyncController) Stream(ctx *fiber.Ctx) error {
+	userId := getUserId(ctx)
+	sessionId := getSessionId(ctx)
+
+	// Subscribe before fetching pending updates so that nothing pushed in between is missed
+	subscriber := c.syncNotifier.Subscribe(sessionId)
+	pending, key, err := c.syncService.Pull(userId, sessionId)
+	if err != nil {
+		c.syncNotifier.Unsubscribe(subscriber)
+		return err
+	}
+
+	ctx.Set(fiber.HeaderContentType, "text/event-stream")
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+	ctx.Set(fiber.HeaderConnection, "keep-alive")
+
+	ctx.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer c.syncNotifier.Unsubscribe(subscriber)
+
+		if err := writeStreamEvent(w, "key", KeyResponse{Key: key}); err != nil {
+			return
+		}
+
+		for _, update := range pending {
+			if err := writeStreamUpdate(w, update); err != nil {
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case update := <-subscriber.Updates():
+				if err := writeStreamUpdate(w, update); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				// Comments keep the connection open through proxies and detect disconnected clients
+				if _, err := w.WriteString(": heartbeat\n\n"); err != nil {
+					return
+				}
+
+				if err := w.Flush(); err != nil {
+					return
+				}
+			case <-subscriber.Closed():
+				return
+			}
+		}
+	}))
+
+	return nil
 }
 
 func (c *SyncController) Ack(ctx *fiber.Ctx) error {
@@ -209,6 +449,114 @@ func (c *SyncController) Ack(ctx *fiber.Ctx) error {
 	return ctx.SendStatus(fiber.StatusOK)
 }
 
+func (c *SyncController) FullPush(ctx *fiber.Ctx) error {
+	var req FullPushRequest
+	if err := ParseAndValidate(ctx, c.validator, &req); err != nil {
+		return err
+	}
+
+	userId := getUserId(ctx)
+	sessionId := getSessionId(ctx)
+
+	entities := map[string][]Entity{}
+	for entityType, incoming := range req.Entities {
+		data := util.SliceMap(incoming, func(entity IncomingSavedEntity) []byte { return entity.Data })
+		if status, message := checkEntityType(c.entityTypes, entityType, true, data); status != fiber.StatusOK {
+			return ctx.Status(status).SendString(message)
+		}
+
+		converted, err := util.SliceMapErr(incoming, deserializeSavedEntity)
+		if err != nil {
+			return err
+		}
+
+		entities[entityType] = converted
+	}
+
+	ack, err := c.syncService.FullPush(entities, req.KeyGeneration, userId, sessionId)
+	if err != nil {
+		if isQuotaError(err) {
+			return ctx.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+
+		if errors.As(err, &KeyRotationInProgressError{}) {
+			return ctx.Status(fiber.StatusLocked).SendString("Key rotation in progress")
+		}
+
+		if errors.As(err, &KeyGenerationMismatchError{}) {
+			return ctx.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+
+		return err
+	}
+
+	return ctx.JSON(FullPushResponse{ack})
+}
+
+type FullPullChunk struct {
+	EntityType string                `json:"entityType"`
+	Entities   []OutgoingSavedEntity `json:"entities"`
+}
+
+type FullPullEnd struct {
+	Done   bool   `json:"done"`
+	Cursor int64  `json:"cursor"`
+	Error  string `json:"error,omitempty"`
+}
+
+func writeNDJSONLine(w *bufio.Writer, data any) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append(bytes, '\n')); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// StreamFullPull sends all entities as newline delimited JSON, one line per chunk of an entity type.
+// The last line marks the end of the stream and contains the cursor, or an error if the pull failed halfway.
+func (c *SyncController) StreamFullPull(ctx *fiber.Ctx) error {
+	var req FullSyncRequest
+	if err := ParseAndValidate(ctx, c.validator, &req); err != nil {
+		return err
+	}
+
+	for _, entityType := range req.EntityTypes {
+		if !c.entityTypes.Has(entityType) {
+			return ctx.Status(fiber.StatusBadRequest).SendString("Invalid entity type")
+		}
+	}
+
+	userId := getUserId(ctx)
+	sessionId := getSessionId(ctx)
+
+	ctx.Set(fiber.HeaderContentType, "application/x-ndjson")
+	ctx.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		cursor, err := c.syncService.StreamFullPull(userId, sessionId, req.EntityTypes, func(entityType string, entities []Entity) error {
+			converted, err := util.SliceMapErr(entities, serializeSavedEntity)
+			if err != nil {
+				return err
+			}
+
+			return writeNDJSONLine(w, FullPullChunk{entityType, converted})
+		})
+
+		if err != nil {
+			log.Println("Full pull stream failed:", err)
+			_ = writeNDJSONLine(w, FullPullEnd{Error: "full pull failed"})
+			return
+		}
+
+		_ = writeNDJSONLine(w, FullPullEnd{Done: true, Cursor: cursor})
+	}))
+
+	return nil
+}
+
 func (c *SyncController) FullPull(ctx *fiber.Ctx) error {
 	var req FullSyncRequest
 	if err := ParseAndValidate(ctx, c.validator, &req); err != nil {
@@ -218,7 +566,7 @@ func (c *SyncController) FullPull(ctx *fiber.Ctx) error {
 	userId := getUserId(ctx)
 	sessionId := getSessionId(ctx)
 
-	entities, err := c.syncService.FullPull(userId, sessionId, req.EntityTypes)
+	entities, cursor, err := c.syncService.FullPull(userId, sessionId, req.EntityTypes)
 	if err != nil {
 		return err
 	}
@@ -236,5 +584,5 @@ func (c *SyncController) FullPull(ctx *fiber.Ctx) error {
 		result[entityType] = converted
 	}
 
-	return ctx.JSON(FullPullResponse{result})
+	return ctx.JSON(FullPullResponse{result, cursor})
 }
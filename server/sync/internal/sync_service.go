@@ -8,9 +8,12 @@ import (
 	"maps"
 	"slices"
 	"sort"
+	"time"
 
+	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	pb "perfice.adoe.dev/proto"
 	"perfice.adoe.dev/util"
 )
@@ -20,40 +23,115 @@ var putOperation string = "put"
 var deleteOperation string = "delete"
 var fullSyncOperation string = "fullSync"
 
+var maxPullLimit int64 = 500
+
+type CursorExpiredError struct{}
+
+func (e CursorExpiredError) Error() string {
+	return "cursor expired, a full pull is required"
+}
+
+type EntityLimitExceededError struct {
+	EntityType string
+	Limit      int64
+}
+
+func (e EntityLimitExceededError) Error() string {
+	return fmt.Sprintf("entity type %s is limited to %d entities per user", e.EntityType, e.Limit)
+}
+
+// KeyGenerationMismatchError is returned if a client pushes data encrypted under an old key, it has to re-derive the
+// current key first
+type KeyGenerationMismatchError struct {
+	Current int64
+}
+
+func (e KeyGenerationMismatchError) Error() string {
+	return fmt.Sprintf("entities are not encrypted under the current key generation %d", e.Current)
+}
+
 type SyncService struct {
 	client                 *mongo.Client
-	entityCollections      map[string]*mongo.Collection
+	entityTypeRegistry     *EntityTypeRegistry
 	syncUpdateCollection   *SyncUpdateCollection
+	syncSequenceCollection *SyncSequenceCollection
 	keyVerificationService *KeyVerificationService
 	authClient             pb.UserServiceClient
+	conflictPolicy         ConflictPolicy
+	usageService           *UsageService
+	keyRotationService     *KeyRotationService
 }
 
-func NewSyncService(client *mongo.Client, collections map[string]*mongo.Collection,
-	syncUpdateCollection *SyncUpdateCollection, keyVerificationService *KeyVerificationService, authClient pb.UserServiceClient) *SyncService {
-	return &SyncService{client, collections, syncUpdateCollection, keyVerificationService, authClient}
+func NewSyncService(client *mongo.Client, entityTypeRegistry *EntityTypeRegistry,
+	syncUpdateCollection *SyncUpdateCollection, syncSequenceCollection *SyncSequenceCollection,
+	keyVerificationService *KeyVerificationService, authClient pb.UserServiceClient, conflictPolicy ConflictPolicy,
+	usageService *UsageService, keyRotationService *KeyRotationService) *SyncService {
+	return &SyncService{client, entityTypeRegistry, syncUpdateCollection, syncSequenceCollection,
+		keyVerificationService, authClient, conflictPolicy, usageService, keyRotationService}
 }
 
-func (s *SyncService) Push(updates []IncomingSyncUpdate, userId string, sessionId string) ([]string, error) {
+// getOtherSessions returns the ids of every session of the user except the given one
+func (s *SyncService) getOtherSessions(userId string, sessionId string) ([]string, error) {
 	sessions, err := s.authClient.GetSessions(context.Background(), &pb.GetSessionsRequest{UserId: userId})
 	if err != nil {
 		return nil, err
 	}
 
-	otherSessions := util.SliceMap(
+	return util.SliceMap(
 		util.SliceFilter(sessions.Sessions, func(session *pb.Session) bool { return session.Id != sessionId }),
-		func(session *pb.Session) string { return session.Id })
+		func(session *pb.Session) string { return session.Id }), nil
+}
 
-	if len(otherSessions) == 0 {
-		// There are no other sessions to sync to
-		return nil, nil
+// checkKeyGeneration returns the current key generation of a user. Generation 0 means the client didn't specify one,
+// which is accepted for older clients.
+func (s *SyncService) checkKeyGeneration(userId string, generations ...int64) (int64, error) {
+	current, err := s.keyVerificationService.GetGeneration(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, generation := range generations {
+		if generation != 0 && generation != current {
+			return 0, KeyGenerationMismatchError{Current: current}
+		}
+	}
+
+	return current, nil
+}
+
+// isQuotaError returns true if the error was caused by the user exceeding a quota
+func isQuotaError(err error) bool {
+	return errors.As(err, &EntityLimitExceededError{}) || errors.As(err, &StorageQuotaExceededError{})
+}
+
+func (s *SyncService) Push(updates []IncomingSyncUpdate, userId string, sessionId string) ([]string, []SyncConflict, error) {
+	if err := s.usageService.CheckBatchSize(len(updates)); err != nil {
+		return nil, nil, err
+	}
+
+	// Entities pushed during a rotation would be encrypted under the old key
+	if err := s.keyRotationService.CheckUnlocked(userId); err != nil {
+		return nil, nil, err
+	}
+
+	keyGeneration, err := s.checkKeyGeneration(userId,
+		util.SliceMap(updates, func(update IncomingSyncUpdate) int64 { return update.KeyGeneration })...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	otherSessions, err := s.getOtherSessions(userId, sessionId)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Sort updates by timestamp
 	sort.SliceStable(updates, func(i, j int) bool { return updates[i].Timestamp < updates[j].Timestamp })
 
 	var ackIDs = make([]string, 0)
+	var conflicts = make([]SyncConflict, 0)
 	for _, update := range updates {
-		collection := util.GetFromMapOrNil(s.entityCollections, update.EntityType)
+		collection := s.entityTypeRegistry.Collection(update.EntityType)
 		if collection == nil {
 			fmt.Println("Failed to find collection for entity type", update.EntityType)
 			continue
@@ -61,15 +139,22 @@ func (s *SyncService) Push(updates []IncomingSyncUpdate, userId string, sessionI
 
 		session, err := s.client.StartSession()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
+		var conflict *SyncConflict
 		_, err = session.WithTransaction(context.Background(), func(sessionContext mongo.SessionContext) (any, error) {
-			err := s.processUpdate(*collection, sessionContext, update, userId)
+			entities, updateConflict, err := s.processUpdate(collection, sessionContext, update, userId, keyGeneration)
 			if err != nil {
 				return nil, err
 			}
 
+			conflict = updateConflict
+			if conflict != nil && (conflict.Rejected || len(entities) == 0) {
+				// Nothing was written, other sessions don't need to know about this update
+				return nil, nil
+			}
+
 			if update.Operation == fullSyncOperation {
 				// Any previous updates are redundant since we are full syncing
 				err = s.syncUpdateCollection.DeleteUpdatesByEntityType(sessionContext, userId, update.EntityType)
@@ -78,43 +163,112 @@ func (s *SyncService) Push(updates []IncomingSyncUpdate, userId string, sessionI
 				}
 			}
 
+			// Even without other sessions the update is recorded, new sessions can catch up using the sequence number
+			sequence, err := s.syncSequenceCollection.Next(sessionContext, userId)
+			if err != nil {
+				return nil, err
+			}
+
 			err = s.syncUpdateCollection.Insert(sessionContext, SyncUpdate{
-				ID:         update.ID,
-				User:       userId,
-				Operation:  update.Operation,
-				EntityType: update.EntityType,
-				Timestamp:  update.Timestamp,
-				Clients:    otherSessions,
-				Entities:   update.Entities,
+				ID:            update.ID,
+				User:          userId,
+				Sequence:      sequence,
+				Origin:        sessionId,
+				Operation:     update.Operation,
+				EntityType:    update.EntityType,
+				Timestamp:     update.Timestamp,
+				KeyGeneration: keyGeneration,
+				Clients:       otherSessions,
+				Entities:      entities,
 			})
 
 			return nil, err
 		})
+		session.EndSession(context.Background())
+
+		if mongo.IsDuplicateKeyError(err) && s.isUpdateRecorded(update.ID, userId) {
+			// The update was processed before but the client never received the acknowledgement
+			ackIDs = append(ackIDs, update.ID)
+			continue
+		}
 
 		if err != nil {
+			if isQuotaError(err) {
+				// Later updates would most likely exceed the limit too, the client has to free up space first
+				return ackIDs, conflicts, err
+			}
+
 			log.Println("Failed to process update:", err)
 			continue
 		}
 
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+			if conflict.Rejected {
+				continue
+			}
+		}
+
 		ackIDs = append(ackIDs, update.ID)
 	}
 
-	return ackIDs, nil
+	return ackIDs, conflicts, nil
+}
+
+func (s *SyncService) isUpdateRecorded(updateId string, userId string) bool {
+	updates, err := s.syncUpdateCollection.GetUpdatesByIds([]string{updateId})
+	return err == nil && len(updates) > 0 && updates[0].User == userId
 }
 
-func (s *SyncService) processUpdate(collection *mongo.Collection, sessionContext mongo.SessionContext, update IncomingSyncUpdate, userId string) error {
+// findStoredEntities returns the currently stored entities that are referenced by an update, mapped by their id
+func (s *SyncService) findStoredEntities(collection *mongo.Collection, sessionContext mongo.SessionContext, update IncomingSyncUpdate, userId string) (map[string]Entity, error) {
+	ids := util.SliceMap(update.Entities, func(entity UpdateEntity) string { return entity.ID })
+	cursor, err := collection.Find(sessionContext, bson.M{"user": userId, "id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+
+	var entities []Entity
+	if err := cursor.All(sessionContext, &entities); err != nil {
+		return nil, err
+	}
+
+	result := map[string]Entity{}
+	for _, entity := range entities {
+		result[entity.ID] = entity
+	}
+
+	return result, nil
+}
+
+func (s *SyncService) processUpdate(collection *mongo.Collection, sessionContext mongo.SessionContext, update IncomingSyncUpdate,
+	userId string, keyGeneration int64) ([]UpdateEntity, *SyncConflict, error) {
 	var models []mongo.WriteModel
 
+	entities := update.Entities
+	var conflict *SyncConflict
+	var stored map[string]Entity
 	if update.Operation == fullSyncOperation {
 		// Clear the collection of previous data
 		models = append(models, mongo.NewDeleteManyModel().SetFilter(bson.M{
 			"user": userId,
 		}))
+	} else {
+		var err error
+		stored, err = s.findStoredEntities(collection, sessionContext, update, userId)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		entities, conflict = resolveConflicts(s.conflictPolicy, update, stored)
+		if conflict != nil && conflict.Rejected {
+			return nil, conflict, nil
+		}
 	}
 
-	for _, entity := range update.Entities {
+	for _, entity := range entities {
 		if entity.Data == nil && update.Operation != deleteOperation {
-			return errors.New("entity data is nil")
+			return nil, nil, errors.New("entity data is nil")
 		}
 
 		switch update.Operation {
@@ -123,10 +277,11 @@ func (s *SyncService) processUpdate(collection *mongo.Collection, sessionContext
 				SetFilter(bson.M{"id": entity.ID, "user": userId}).
 				SetUpdate(bson.M{
 					"$set": Entity{
-						ID:      entity.ID,
-						User:    userId,
-						Version: entity.Version,
-						Data:    entity.Data,
+						ID:            entity.ID,
+						User:          userId,
+						Version:       entity.Version,
+						KeyGeneration: keyGeneration,
+						Data:          entity.Data,
 					},
 				}).
 				SetUpsert(true)
@@ -140,11 +295,18 @@ func (s *SyncService) processUpdate(collection *mongo.Collection, sessionContext
 	}
 
 	if len(models) == 0 {
-		return nil
+		return entities, conflict, nil
 	}
 
-	_, err := collection.BulkWrite(sessionContext, models)
-	return err
+	if _, err := collection.BulkWrite(sessionContext, models); err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.usageService.Apply(sessionContext, userId, update.EntityType, computeUsageDelta(update.Operation, entities, stored)); err != nil {
+		return nil, nil, err
+	}
+
+	return entities, conflict, nil
 }
 
 func (s *SyncService) Pull(userId string, sessionId string) ([]SyncUpdate, []byte, error) {
@@ -165,57 +327,325 @@ func (s *SyncService) Pull(userId string, sessionId string) ([]SyncUpdate, []byt
 	return updates, key, nil
 }
 
+func (s *SyncService) getSequence(userId string) (SyncSequence, error) {
+	sequence, err := s.syncSequenceCollection.FindByUser(userId)
+	if err != nil {
+		return SyncSequence{}, err
+	}
+
+	if sequence == nil {
+		return SyncSequence{User: userId}, nil
+	}
+
+	return *sequence, nil
+}
+
+// GetCursor returns the cursor that a session is caught up to after it has seen every current update
+func (s *SyncService) GetCursor(userId string) (int64, error) {
+	sequence, err := s.getSequence(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return sequence.Sequence, nil
+}
+
+// PullSince returns the updates of other sessions after the given cursor, together with the cursor to continue from
+// and whether there are more updates to fetch.
+func (s *SyncService) PullSince(userId string, sessionId string, cursor int64, limit int64) ([]SyncUpdate, []byte, int64, bool, error) {
+	if limit <= 0 || limit > maxPullLimit {
+		limit = maxPullLimit
+	}
+
+	sequence, err := s.getSequence(userId)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+
+	if cursor < sequence.Compacted {
+		return nil, nil, 0, false, CursorExpiredError{}
+	}
+
+	key, err := s.keyVerificationService.GetKeyByUser(userId)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+
+	if key == nil {
+		return nil, nil, 0, false, nil
+	}
+
+	// Fetch one more than the limit to know whether there are more updates. The upper bound ensures that the cursor
+	// can safely skip to the current sequence number once everything has been returned.
+	updates, err := s.syncUpdateCollection.FindByUserAfterSequence(userId, sessionId, cursor, sequence.Sequence, limit+1)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+
+	if int64(len(updates)) > limit {
+		updates = updates[:limit]
+		return updates, key, updates[len(updates)-1].Sequence, true, nil
+	}
+
+	return updates, key, max(cursor, sequence.Sequence), false, nil
+}
+
 func (s *SyncService) Ack(sessionId string, updates []string) error {
 	_, err := s.syncUpdateCollection.PullSessionFromUpdatesWithIds(updates, sessionId)
 	return err
 }
 
-func (s *SyncService) FullPull(userId string, sessionId string, entityTypes []string) (map[string][]Entity, error) {
+var fullPullBatchSize = 500
+
+type FullPullChunkCallback func(entityType string, entities []Entity) error
+
+func (s *SyncService) FullPull(userId string, sessionId string, entityTypes []string) (map[string][]Entity, int64, error) {
+	result := map[string][]Entity{}
+	cursor, err := s.StreamFullPull(userId, sessionId, entityTypes, func(entityType string, entities []Entity) error {
+		if _, ok := result[entityType]; !ok {
+			result[entityType] = make([]Entity, 0)
+		}
+
+		result[entityType] = append(result[entityType], entities...)
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return result, cursor, nil
+}
+
+// StreamFullPull reads every entity of the given types in chunks without loading a whole type into memory.
+// The callback is invoked at least once for every entity type, with an empty chunk if the type has no entities.
+func (s *SyncService) StreamFullPull(userId string, sessionId string, entityTypes []string, callback FullPullChunkCallback) (int64, error) {
 	if entityTypes == nil {
 		// If no entity types are provided, sync all entity types
 		entityTypes = s.getSupportedEntityTypes()
 	}
 
-	result := map[string][]Entity{}
+	collections := map[string]*mongo.Collection{}
+	for _, entityType := range entityTypes {
+		collection := s.entityTypeRegistry.Collection(entityType)
+		if collection == nil {
+			return 0, fmt.Errorf("entity type %s not found", entityType)
+		}
+
+		collections[entityType] = collection
+	}
+
+	// The cursor is read before the entities, updates in between are delivered again which is harmless
+	cursor, err := s.GetCursor(userId)
+	if err != nil {
+		return 0, err
+	}
+
 	for _, entityType := range entityTypes {
-		collection := util.GetFromMapOrNil(s.entityCollections, entityType)
+		if err := s.streamEntities(collections[entityType], userId, entityType, callback); err != nil {
+			return 0, err
+		}
+	}
+
+	// Session has fully synced this entity type, they don't need to know about these updates
+	_, err = s.syncUpdateCollection.PullSessionFromUpdatesWithEntityTypes(entityTypes, sessionId)
+	if err != nil {
+		return 0, err
+	}
+
+	return cursor, nil
+}
+
+func (s *SyncService) streamEntities(collection *mongo.Collection, userId string, entityType string, callback FullPullChunkCallback) error {
+	entityCursor, err := collection.Find(context.Background(), bson.M{"user": userId},
+		options.Find().SetBatchSize(int32(fullPullBatchSize)))
+	if err != nil {
+		return err
+	}
+	defer entityCursor.Close(context.Background())
+
+	sent := false
+	var chunk = make([]Entity, 0, fullPullBatchSize)
+	for entityCursor.Next(context.Background()) {
+		var entity Entity
+		if err := entityCursor.Decode(&entity); err != nil {
+			return err
+		}
+
+		chunk = append(chunk, entity)
+		if len(chunk) >= fullPullBatchSize {
+			if err := callback(entityType, chunk); err != nil {
+				return err
+			}
+
+			sent = true
+			chunk = make([]Entity, 0, fullPullBatchSize)
+		}
+	}
+
+	if err := entityCursor.Err(); err != nil {
+		return err
+	}
+
+	if len(chunk) > 0 || !sent {
+		return callback(entityType, chunk)
+	}
+
+	return nil
+}
+
+// FullPush atomically replaces every entity of the given types. Other sessions receive a fullSync update per type.
+func (s *SyncService) FullPush(entities map[string][]Entity, keyGeneration int64, userId string, sessionId string) ([]string, error) {
+	if err := s.keyRotationService.CheckUnlocked(userId); err != nil {
+		return nil, err
+	}
+
+	keyGeneration, err := s.checkKeyGeneration(userId, keyGeneration)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.replaceAll(entities, userId, sessionId, func(sessionContext mongo.SessionContext) (int64, error) {
+		return keyGeneration, nil
+	})
+}
+
+// replaceAll replaces every entity of the given types in a single transaction. Prepare runs first inside the
+// transaction and returns the key generation that entities without one, and the sync updates, are tagged with.
+func (s *SyncService) replaceAll(entities map[string][]Entity, userId string, sessionId string,
+	prepare func(sessionContext mongo.SessionContext) (int64, error)) ([]string, error) {
+	collections := map[string]*mongo.Collection{}
+	for entityType := range entities {
+		collection := s.entityTypeRegistry.Collection(entityType)
 		if collection == nil {
 			return nil, fmt.Errorf("entity type %s not found", entityType)
 		}
 
-		cursor, err := (*collection).Find(context.Background(), bson.M{"user": userId})
+		collections[entityType] = collection
+	}
+
+	otherSessions, err := s.getOtherSessions(userId, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(context.Background())
+
+	timestamp := time.Now().UnixMilli()
+	_, err = session.WithTransaction(context.Background(), func(sessionContext mongo.SessionContext) (any, error) {
+		keyGeneration, err := prepare(sessionContext)
 		if err != nil {
 			return nil, err
 		}
 
-		var entities = make([]Entity, 0)
-		if err := cursor.All(context.Background(), &entities); err != nil {
-			return nil, err
+		for entityType, typeEntities := range entities {
+			typeEntities = util.SliceMap(typeEntities, func(entity Entity) Entity {
+				// Entities of a backup keep the generation of the key they were encrypted with
+				if entity.KeyGeneration == 0 {
+					entity.KeyGeneration = keyGeneration
+				}
+				return entity
+			})
+
+			if err := replaceEntities(sessionContext, collections[entityType], userId, typeEntities); err != nil {
+				return nil, err
+			}
+
+			delta := usageDelta{entities: int64(len(typeEntities)), absolute: true}
+			for _, entity := range typeEntities {
+				delta.bytes += int64(len(entity.Data))
+			}
+
+			if err := s.usageService.Apply(sessionContext, userId, entityType, delta); err != nil {
+				return nil, err
+			}
+
+			// Any previous updates are redundant since we are replacing everything
+			err := s.syncUpdateCollection.DeleteUpdatesByEntityType(sessionContext, userId, entityType)
+			if err != nil {
+				return nil, err
+			}
+
+			sequence, err := s.syncSequenceCollection.Next(sessionContext, userId)
+			if err != nil {
+				return nil, err
+			}
+
+			err = s.syncUpdateCollection.Insert(sessionContext, SyncUpdate{
+				ID:            uuid.NewString(),
+				User:          userId,
+				Sequence:      sequence,
+				Origin:        sessionId,
+				Operation:     fullSyncOperation,
+				EntityType:    entityType,
+				Timestamp:     timestamp,
+				KeyGeneration: keyGeneration,
+				Clients:       otherSessions,
+				Entities: util.SliceMap(typeEntities, func(entity Entity) UpdateEntity {
+					return UpdateEntity{ID: entity.ID, Version: entity.Version, Timestamp: timestamp, Data: entity.Data}
+				}),
+			})
+
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		result[entityType] = entities
-	}
+		return nil, nil
+	})
 
-	// Session has fully synced this entity type, they don't need to know about these updates
-	_, err := s.syncUpdateCollection.PullSessionFromUpdatesWithEntityTypes(entityTypes, sessionId)
 	if err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return slices.Collect(maps.Keys(entities)), nil
+}
+
+// replaceEntities deletes every entity of the user in the collection and inserts the given ones
+func replaceEntities(sessionContext mongo.SessionContext, collection *mongo.Collection, userId string, entities []Entity) error {
+	if _, err := collection.DeleteMany(sessionContext, bson.M{"user": userId}); err != nil {
+		return err
+	}
+
+	if len(entities) == 0 {
+		return nil
+	}
+
+	documents := util.SliceMap(entities, func(entity Entity) any {
+		entity.User = userId
+		return entity
+	})
+
+	_, err := collection.InsertMany(sessionContext, documents)
+	return err
 }
 
 func (s *SyncService) getSupportedEntityTypes() []string {
-	return slices.Collect(maps.Keys(s.entityCollections))
+	return s.entityTypeRegistry.Names()
+}
+
+// OnSessionRevoked stops delivering updates to a revoked session. Updates that no session references anymore are
+// deleted by the next compaction.
+func (s *SyncService) OnSessionRevoked(userId string, sessionId string) error {
+	_, err := s.syncUpdateCollection.PullSession(userId, sessionId)
+	return err
 }
 
 func (s *SyncService) OnUserDeleted(userId string) error {
-	for _, collection := range s.entityCollections {
+	for _, collection := range s.entityTypeRegistry.Collections() {
 		_, err := collection.DeleteMany(context.Background(), bson.M{"user": userId})
 		if err != nil {
 			return err
 		}
 	}
 
-	return s.syncUpdateCollection.DeleteUpdatesByUser(userId)
+	if err := s.syncSequenceCollection.DeleteByUser(userId); err != nil {
+		return err
+	}
+
+	return s.syncUpdateCollection.DeleteUpdatesByUser(context.Background(), userId)
 }
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// usageDelta is the change in usage caused by an update. If absolute is set, the update replaced every entity of
+// the type and the delta is the new usage.
+type usageDelta struct {
+	entities int64
+	bytes    int64
+	absolute bool
+}
+
+// SyncQuota limits how much data a user can store. Zero values mean unlimited.
+type SyncQuota struct {
+	MaxBytes           int64 `json:"maxBytes"`
+	MaxEntitiesPerType int64 `json:"maxEntitiesPerType"`
+	MaxBatchSize       int   `json:"maxBatchSize"`
+}
+
+type StorageQuotaExceededError struct {
+	Limit int64
+}
+
+func (e StorageQuotaExceededError) Error() string {
+	return fmt.Sprintf("storage quota of %d bytes exceeded", e.Limit)
+}
+
+type BatchTooLargeError struct {
+	Limit int
+}
+
+func (e BatchTooLargeError) Error() string {
+	return fmt.Sprintf("a push is limited to %d updates", e.Limit)
+}
+
+func intFromEnv(name string) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < 0 {
+		panic(fmt.Errorf("invalid %s: %s", name, value))
+	}
+
+	return parsed
+}
+
+func quotaFromEnv() SyncQuota {
+	return SyncQuota{
+		MaxBytes:           intFromEnv("SYNC_QUOTA_MAX_BYTES"),
+		MaxEntitiesPerType: intFromEnv("SYNC_QUOTA_MAX_ENTITIES_PER_TYPE"),
+		MaxBatchSize:       int(intFromEnv("SYNC_QUOTA_MAX_BATCH_SIZE")),
+	}
+}
+
+// entityLimit returns the effective entity limit of a type, the stricter of the quota and the type definition
+func (q SyncQuota) entityLimit(definition EntityTypeDefinition) int64 {
+	if q.MaxEntitiesPerType <= 0 {
+		return definition.MaxEntities
+	}
+
+	if definition.MaxEntities <= 0 {
+		return q.MaxEntitiesPerType
+	}
+
+	return min(q.MaxEntitiesPerType, definition.MaxEntities)
+}
+
+// computeUsageDelta calculates how the usage changes when the given entities are written by an update.
+// Stored must contain the currently stored versions of the entities, this is not needed for full syncs.
+func computeUsageDelta(operation string, entities []UpdateEntity, stored map[string]Entity) usageDelta {
+	var delta usageDelta
+	if operation == fullSyncOperation {
+		delta.absolute = true
+	}
+
+	for _, entity := range entities {
+		existing, exists := stored[entity.ID]
+		switch operation {
+		case fullSyncOperation:
+			delta.entities++
+			delta.bytes += int64(len(entity.Data))
+		case createOperation, putOperation:
+			if exists {
+				delta.bytes += int64(len(entity.Data) - len(existing.Data))
+			} else {
+				delta.entities++
+				delta.bytes += int64(len(entity.Data))
+			}
+		case deleteOperation:
+			if exists {
+				delta.entities--
+				delta.bytes -= int64(len(existing.Data))
+			}
+		}
+	}
+
+	return delta
+}
+
+// UsageService keeps track of the storage used by every user and enforces the quota
+type UsageService struct {
+	usageCollection    *UsageCollection
+	entityTypeRegistry *EntityTypeRegistry
+	quota              SyncQuota
+}
+
+func NewUsageService(usageCollection *UsageCollection, entityTypeRegistry *EntityTypeRegistry, quota SyncQuota) *UsageService {
+	return &UsageService{usageCollection, entityTypeRegistry, quota}
+}
+
+func (s *UsageService) CheckBatchSize(updates int) error {
+	if s.quota.MaxBatchSize > 0 && updates > s.quota.MaxBatchSize {
+		return BatchTooLargeError{Limit: s.quota.MaxBatchSize}
+	}
+
+	return nil
+}
+
+// Apply records the usage change of an update inside its transaction. An error is returned if the change makes the
+// user exceed a quota, which aborts the transaction. Changes that don't increase usage are always allowed, so users
+// above their quota can still free up space.
+func (s *UsageService) Apply(sessionContext mongo.SessionContext, userId string, entityType string, delta usageDelta) error {
+	usage, err := s.usageCollection.Apply(sessionContext, userId, entityType, delta)
+	if err != nil {
+		return err
+	}
+
+	definition, _ := s.entityTypeRegistry.Get(entityType)
+	limit := s.quota.entityLimit(definition)
+	grewEntities := delta.entities > 0 || delta.absolute
+	if limit > 0 && grewEntities && usage.Entities > limit {
+		return EntityLimitExceededError{EntityType: entityType, Limit: limit}
+	}
+
+	grewBytes := delta.bytes > 0 || delta.absolute
+	if s.quota.MaxBytes <= 0 || !grewBytes {
+		return nil
+	}
+
+	usages, err := s.usageCollection.FindByUser(sessionContext, userId)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, u := range usages {
+		total += u.Bytes
+	}
+
+	if total > s.quota.MaxBytes {
+		return StorageQuotaExceededError{Limit: s.quota.MaxBytes}
+	}
+
+	return nil
+}
+
+type Usage struct {
+	Types      map[string]EntityUsage
+	TotalBytes int64
+	Quota      SyncQuota
+}
+
+func (s *UsageService) GetUsage(userId string) (Usage, error) {
+	usages, err := s.usageCollection.FindByUser(context.Background(), userId)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	result := Usage{Types: map[string]EntityUsage{}, Quota: s.quota}
+	for _, usage := range usages {
+		result.Types[usage.EntityType] = usage
+		result.TotalBytes += usage.Bytes
+	}
+
+	return result, nil
+}
+
+// EntityLimit returns the effective entity limit of a type, zero if unlimited
+func (s *UsageService) EntityLimit(entityType string) int64 {
+	definition, _ := s.entityTypeRegistry.Get(entityType)
+	return s.quota.entityLimit(definition)
+}
+
+func (s *UsageService) OnUserDeleted(userId string) error {
+	return s.usageCollection.DeleteByUser(userId)
+}
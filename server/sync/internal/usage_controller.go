@@ -0,0 +1,49 @@
+package internal
+
+import "github.com/gofiber/fiber/v2"
+
+type UsageController struct {
+	usageService       *UsageService
+	entityTypeRegistry *EntityTypeRegistry
+}
+
+func NewUsageController(usageService *UsageService, entityTypeRegistry *EntityTypeRegistry) *UsageController {
+	return &UsageController{usageService, entityTypeRegistry}
+}
+
+type EntityTypeUsageResponse struct {
+	Entities    int64 `json:"entities"`
+	Bytes       int64 `json:"bytes"`
+	MaxEntities int64 `json:"maxEntities"`
+}
+
+type UsageResponse struct {
+	Types        map[string]EntityTypeUsageResponse `json:"types"`
+	TotalBytes   int64                              `json:"totalBytes"`
+	MaxBytes     int64                              `json:"maxBytes"`
+	MaxBatchSize int                                `json:"maxBatchSize"`
+}
+
+func (c *UsageController) GetUsage(ctx *fiber.Ctx) error {
+	usage, err := c.usageService.GetUsage(getUserId(ctx))
+	if err != nil {
+		return err
+	}
+
+	types := map[string]EntityTypeUsageResponse{}
+	for _, entityType := range c.entityTypeRegistry.Names() {
+		typeUsage := usage.Types[entityType]
+		types[entityType] = EntityTypeUsageResponse{
+			Entities:    typeUsage.Entities,
+			Bytes:       typeUsage.Bytes,
+			MaxEntities: c.usageService.EntityLimit(entityType),
+		}
+	}
+
+	return ctx.JSON(UsageResponse{
+		Types:        types,
+		TotalBytes:   usage.TotalBytes,
+		MaxBytes:     usage.Quota.MaxBytes,
+		MaxBatchSize: usage.Quota.MaxBatchSize,
+	})
+}
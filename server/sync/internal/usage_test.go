@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeUsageDelta_Put(t *testing.T) {
+	stored := map[string]Entity{"existing": {ID: "existing", Data: []byte("12345")}}
+	entities := []UpdateEntity{
+		{ID: "existing", Data: []byte("123")},
+		{ID: "new", Data: []byte("1234")},
+	}
+
+	delta := computeUsageDelta(putOperation, entities, stored)
+
+	assert.False(t, delta.absolute)
+	assert.Equal(t, int64(1), delta.entities, "only the new entity should be counted")
+	assert.Equal(t, int64(2), delta.bytes, "existing entity shrank by 2, new entity adds 4")
+}
+
+func TestComputeUsageDelta_Delete(t *testing.T) {
+	stored := map[string]Entity{"existing": {ID: "existing", Data: []byte("12345")}}
+	entities := []UpdateEntity{{ID: "existing"}, {ID: "missing"}}
+
+	delta := computeUsageDelta(deleteOperation, entities, stored)
+
+	assert.Equal(t, int64(-1), delta.entities, "deleting a missing entity should not change usage")
+	assert.Equal(t, int64(-5), delta.bytes)
+}
+
+func TestComputeUsageDelta_FullSync(t *testing.T) {
+	entities := []UpdateEntity{{ID: "a", Data: []byte("12")}, {ID: "b", Data: []byte("345")}}
+
+	delta := computeUsageDelta(fullSyncOperation, entities, nil)
+
+	assert.True(t, delta.absolute, "full syncs replace the usage")
+	assert.Equal(t, int64(2), delta.entities)
+	assert.Equal(t, int64(5), delta.bytes)
+}
+
+func TestSyncQuota_EntityLimit(t *testing.T) {
+	assert.Equal(t, int64(0), SyncQuota{}.entityLimit(EntityTypeDefinition{}), "no limits should be unlimited")
+	assert.Equal(t, int64(10), SyncQuota{MaxEntitiesPerType: 10}.entityLimit(EntityTypeDefinition{}))
+	assert.Equal(t, int64(5), SyncQuota{}.entityLimit(EntityTypeDefinition{MaxEntities: 5}))
+	assert.Equal(t, int64(5), SyncQuota{MaxEntitiesPerType: 10}.entityLimit(EntityTypeDefinition{MaxEntities: 5}),
+		"the stricter limit should apply")
+}